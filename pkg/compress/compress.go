@@ -0,0 +1,70 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrUnknownFormat = errors.New("unknown compression format")
+
+// Compressor produces a compressed stream. Implementations for formats outside the standard library, such as xz or
+// zstd, can be provided by callers.
+type Compressor interface {
+	Extension() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+type Decompressor interface {
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+type Gzip struct {
+	// Level is a compress/gzip level, where zero selects gzip.DefaultCompression.
+	Level int
+	// Store writes the data without compressing it, ignoring Level.
+	Store bool
+}
+
+var gzipMagic = []byte{0x1F, 0x8B}
+
+func (g Gzip) Extension() string {
+	return ".gz"
+}
+
+func (g Gzip) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	level := g.Level
+
+	switch {
+	case g.Store:
+		level = gzip.NoCompression
+	case level == 0:
+		level = gzip.DefaultCompression
+	}
+
+	gw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip writer: %w", err)
+	}
+
+	return gw, nil
+}
+
+func (g Gzip) NewReader(r io.Reader) (io.ReadCloser, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+
+	return gr, nil
+}
+
+// IsGzip reports whether the buffered reader starts with a gzip header, without consuming it.
+func IsGzip(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(gzipMagic))
+
+	return err == nil && bytes.Equal(magic, gzipMagic)
+}
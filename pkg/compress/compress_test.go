@@ -0,0 +1,62 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func compressGzip(t *testing.T, g Gzip, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	w, err := g.NewWriter(&buf)
+	require.NoError(t, err, "writer should create")
+
+	_, err = w.Write(data)
+	require.NoError(t, err, "data should write")
+	require.NoError(t, w.Close(), "writer should close")
+
+	return buf.Bytes()
+}
+
+func TestGzip(t *testing.T) {
+	data := bytes.Repeat([]byte("appliance "), 1000)
+
+	for _, g := range []Gzip{{}, {Store: true}, {Level: gzip.BestSpeed}, {Level: gzip.BestCompression}} {
+		compressed := compressGzip(t, g, data)
+
+		br := bufio.NewReader(bytes.NewReader(compressed))
+		assert.True(t, IsGzip(br), "%+v output should be detected", g)
+
+		r, err := Gzip{}.NewReader(br)
+		require.NoError(t, err, "reader should create")
+
+		out, err := io.ReadAll(r)
+		require.NoError(t, err, "data should read")
+		assert.Equal(t, data, out, "%+v should round trip", g)
+	}
+
+	stored := compressGzip(t, Gzip{Level: gzip.BestCompression, Store: true}, data)
+	assert.Greater(t, len(stored), len(data), "store should not compress the data")
+
+	defaulted := compressGzip(t, Gzip{}, data)
+	assert.Equal(t, compressGzip(t, Gzip{Level: gzip.DefaultCompression}, data), defaulted,
+		"zero level should use the default")
+	assert.Less(t, len(defaulted), len(data), "default level should compress")
+
+	_, err := Gzip{Level: 42}.NewWriter(io.Discard)
+	assert.Error(t, err, "invalid level should fail")
+
+	assert.False(t, IsGzip(bufio.NewReader(bytes.NewReader(data))), "plain data should not be detected")
+	assert.False(t, IsGzip(bufio.NewReader(bytes.NewReader([]byte{0x1F}))), "short data should not be detected")
+
+	_, err = Gzip{}.NewReader(bytes.NewReader(data))
+	assert.Error(t, err, "plain data should not decompress")
+}
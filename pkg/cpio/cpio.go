@@ -0,0 +1,75 @@
+package cpio
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	MagicNewc = "070701"
+	MagicCRC  = "070702"
+	MagicODC  = "070707"
+
+	// Trailer names the entry which ends an archive.
+	Trailer = "TRAILER!!!"
+	// BlockSize is the size archives are padded to, as done by GNU cpio.
+	BlockSize  = 512
+	MaxNameLen = 255
+	// MaxFileSize is the largest file newc and crc headers can describe.
+	MaxFileSize = 0xFFFFFFFF
+
+	newcHeaderSize = 110
+	odcHeaderSize  = 76
+)
+
+// Format identifies the header layout of an archive.
+type Format int
+
+const (
+	// FormatNewc is the SVR4 portable format used by the Linux kernel for initramfs images.
+	FormatNewc Format = iota
+	// FormatCRC is the newc format with a checksum of each file's data.
+	FormatCRC
+	// FormatODC is the POSIX octal format, which can be read but not written.
+	FormatODC
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatNewc:
+		return "newc"
+	case FormatCRC:
+		return "crc"
+	case FormatODC:
+		return "odc"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	ErrInvalidArchive    = errors.New("invalid cpio archive")
+	ErrInvalidName       = errors.New("invalid file name")
+	ErrExist             = errors.New("file already exists")
+	ErrNotDir            = errors.New("not a directory")
+	ErrUnsupportedType   = errors.New("unsupported file type")
+	ErrUnsupportedFormat = errors.New("unsupported format")
+	ErrFileTooLarge      = errors.New("file too large")
+	ErrClosed            = errors.New("writer closed")
+)
+
+type Options struct {
+	// Format selects newc or crc headers, defaulting to newc.
+	Format Format
+	// Time is the modification time of entries which have none, including implicitly created directories. The Unix
+	// epoch is used when zero.
+	Time time.Time
+	// Gzip compresses the archive.
+	Gzip bool
+	// Early is copied uncompressed ahead of the archive, padded to a multiple of four bytes. The kernel loads early
+	// microcode from such an archive, which can be built by a Writer without compression.
+	Early io.Reader
+	// TempDir is where file data is spooled until Close, defaulting to the system temporary directory.
+	TempDir string
+}
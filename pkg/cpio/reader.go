@@ -0,0 +1,729 @@
+package cpio
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/compress"
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+)
+
+const maxSymlinks = 40
+
+// compressionMagics names compression formats which may wrap an initramfs but cannot be decompressed here.
+var compressionMagics = []struct {
+	name  string
+	magic []byte
+}{
+	{"bzip2", []byte("BZh")},
+	{"lz4", []byte{0x02, 0x21, 0x4C, 0x18}},
+	{"lzma", []byte{0x5D, 0x00, 0x00}},
+	{"lzop", []byte{0x89, 'L', 'Z', 'O'}},
+	{"xz", []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}},
+	{"zstd", []byte{0x28, 0xB5, 0x2F, 0xFD}},
+}
+
+// Segment describes one archive within an image. An initramfs is commonly an uncompressed early microcode archive
+// followed by a compressed main archive, and a compressed stream may itself hold several archives.
+type Segment struct {
+	// Offset is the position within the image of the archive, or of the compressed stream holding it.
+	Offset     int64
+	Format     Format
+	Compressed bool
+	Entries    int
+}
+
+type inodeData struct {
+	attr     fsmeta.Attr
+	data     []byte
+	target   string
+	children map[string]*inodeData
+}
+
+func (n *inodeData) isDir() bool {
+	return n.attr.Mode.IsDir()
+}
+
+func (n *inodeData) isSymlink() bool {
+	return n.attr.Mode.Type() == fs.ModeSymlink
+}
+
+// FS is a read-only view of the archives within an image, merged in order as the kernel unpacks an initramfs: later
+// entries replace earlier ones of the same name, with directories keeping their contents. File data is held in memory.
+type FS struct {
+	root     *inodeData
+	segments []Segment
+	inodes   uint64
+}
+
+// countReader tracks the position within the image, from which segment offsets are derived.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(data []byte) (int, error) {
+	n, err := c.r.Read(data)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// archiveReader reads headers and data from an archive stream, tracking alignment.
+type archiveReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (a *archiveReader) read(data []byte) error {
+	n, err := io.ReadFull(a.r, data)
+	a.n += int64(n)
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: truncated archive", ErrInvalidArchive)
+	}
+
+	return err
+}
+
+func (a *archiveReader) readData(size int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(a.r, size))
+	a.n += int64(len(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("%w: truncated archive", ErrInvalidArchive)
+	}
+
+	return data, nil
+}
+
+func (a *archiveReader) skip(align int64) error {
+	if p := (align - a.n%align) % align; p > 0 {
+		n, err := a.r.Discard(int(p))
+		a.n += int64(n)
+
+		if err != nil {
+			return fmt.Errorf("%w: truncated archive", ErrInvalidArchive)
+		}
+	}
+
+	return nil
+}
+
+type rawEntry struct {
+	format Format
+	ino    uint64
+	dev    uint64
+	nlink  uint32
+	size   int64
+	check  uint32
+	attr   fsmeta.Attr
+	name   string
+}
+
+func parseHex(field []byte) (uint32, error) {
+	v, err := strconv.ParseUint(string(field), 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad header field %q", ErrInvalidArchive, field)
+	}
+
+	return uint32(v), nil
+}
+
+func parseOctal(field []byte) (uint64, error) {
+	v, err := strconv.ParseUint(string(field), 8, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad header field %q", ErrInvalidArchive, field)
+	}
+
+	return v, nil
+}
+
+// readHeader reads the header following the magic, leaving the stream at the start of the file data.
+func (a *archiveReader) readHeader(magic string) (*rawEntry, error) {
+	var (
+		e       rawEntry
+		nameLen int64
+	)
+
+	switch magic {
+	case MagicNewc, MagicCRC:
+		buf := make([]byte, newcHeaderSize-len(magic))
+		if err := a.read(buf); err != nil {
+			return nil, err
+		}
+
+		var fields [13]uint32
+
+		for i := range fields {
+			v, err := parseHex(buf[i*8 : i*8+8])
+			if err != nil {
+				return nil, err
+			}
+
+			fields[i] = v
+		}
+
+		e.format = FormatNewc
+		if magic == MagicCRC {
+			e.format = FormatCRC
+		}
+
+		e.ino = uint64(fields[0])
+		e.attr.Mode = fsmeta.FileMode(fields[1])
+		e.attr.UID = fields[2]
+		e.attr.GID = fields[3]
+		e.nlink = fields[4]
+		e.attr.ModTime = time.Unix(int64(fields[5]), 0).UTC()
+		e.size = int64(fields[6])
+		e.dev = uint64(fields[7])<<32 | uint64(fields[8])
+		e.attr.Major = fields[9]
+		e.attr.Minor = fields[10]
+		nameLen = int64(fields[11])
+		e.check = fields[12]
+	case MagicODC:
+		buf := make([]byte, odcHeaderSize-len(magic))
+		if err := a.read(buf); err != nil {
+			return nil, err
+		}
+
+		var fields [10]uint64
+
+		for i, width := range []int{6, 6, 6, 6, 6, 6, 6, 11, 6, 11} {
+			v, err := parseOctal(buf[:width])
+			if err != nil {
+				return nil, err
+			}
+
+			fields[i] = v
+			buf = buf[width:]
+		}
+
+		e.format = FormatODC
+		e.dev = fields[0]
+		e.ino = fields[1]
+		e.attr.Mode = fsmeta.FileMode(uint32(fields[2]))
+		e.attr.UID = uint32(fields[3])
+		e.attr.GID = uint32(fields[4])
+		e.nlink = uint32(fields[5])
+		// The device is encoded as by glibc makedev, which fits the field for small numbers.
+		e.attr.Major = uint32(fields[6] >> 8 & 0xFFF)
+		e.attr.Minor = uint32(fields[6]&0xFF | fields[6]>>12&0xFFF00)
+		e.attr.ModTime = time.Unix(int64(fields[7]), 0).UTC()
+		nameLen = int64(fields[8])
+		e.size = int64(fields[9])
+	default:
+		return nil, fmt.Errorf("%w: unknown magic %q", ErrInvalidArchive, magic)
+	}
+
+	if nameLen < 1 || nameLen > 4096 {
+		return nil, fmt.Errorf("%w: bad name length %v", ErrInvalidArchive, nameLen)
+	}
+
+	name := make([]byte, nameLen)
+	if err := a.read(name); err != nil {
+		return nil, err
+	}
+
+	e.name = string(bytes.TrimRight(name, "\x00"))
+
+	if e.format != FormatODC {
+		if err := a.skip(4); err != nil {
+			return nil, err
+		}
+	}
+
+	return &e, nil
+}
+
+// Open reads every archive within an image, which may be compressed with gzip, and merges them.
+func Open(r io.Reader) (*FS, error) {
+	f := &FS{
+		root: &inodeData{
+			attr:     fsmeta.Attr{Mode: fs.ModeDir | 0o755, Inode: 1},
+			children: make(map[string]*inodeData),
+		},
+		inodes: 1,
+	}
+
+	if err := f.readImage(r, 0, false); err != nil {
+		return nil, err
+	}
+
+	if len(f.segments) == 0 {
+		return nil, fmt.Errorf("%w: no archives found", ErrInvalidArchive)
+	}
+
+	return f, nil
+}
+
+// Segments lists the archives read, in order.
+func (f *FS) Segments() []Segment {
+	return slices.Clone(f.segments)
+}
+
+// readImage reads a sequence of archives and compressed streams, separated by zero padding. Positions are relative
+// to base, except within compressed streams, where the offset of the stream is used.
+func (f *FS) readImage(r io.Reader, base int64, compressed bool) error {
+	cr := &countReader{r: r}
+	br := bufio.NewReader(cr)
+
+	for {
+		pos := cr.n - int64(br.Buffered())
+
+		peek, err := br.Peek(6)
+		if len(peek) == 0 && errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		switch {
+		case len(peek) > 0 && peek[0] == 0:
+			if _, err := br.Discard(1); err != nil {
+				return err
+			}
+
+			continue
+		case err != nil && !errors.Is(err, io.EOF):
+			return fmt.Errorf("failed to read image: %w", err)
+		}
+
+		offset := base
+		if !compressed {
+			offset += pos
+		}
+
+		if compress.IsGzip(br) {
+			if compressed {
+				return fmt.Errorf("%w: nested compression at %v", ErrUnsupportedFormat, offset)
+			}
+
+			zr, err := gzip.NewReader(br)
+			if err != nil {
+				return fmt.Errorf("%w: bad gzip stream at %v: %w", ErrInvalidArchive, offset, err)
+			}
+
+			zr.Multistream(false)
+
+			if err := f.readImage(zr, offset, true); err != nil {
+				return err
+			}
+
+			// Reading to the end verifies the checksum of the stream.
+			if _, err := io.Copy(io.Discard, zr); err != nil {
+				return fmt.Errorf("%w: bad gzip stream at %v: %w", ErrInvalidArchive, offset, err)
+			}
+
+			continue
+		}
+
+		magic := string(peek)
+		if magic != MagicNewc && magic != MagicCRC && magic != MagicODC {
+			for _, c := range compressionMagics {
+				if bytes.HasPrefix(peek, c.magic) {
+					return fmt.Errorf("%w: %v compressed archive at %v", ErrUnsupportedFormat, c.name, offset)
+				}
+			}
+
+			return fmt.Errorf("%w: unrecognised data at %v", ErrInvalidArchive, offset)
+		}
+
+		seg, err := f.readArchive(br)
+		if err != nil {
+			return fmt.Errorf("archive at %v: %w", offset, err)
+		}
+
+		seg.Offset = offset
+		seg.Compressed = compressed
+		f.segments = append(f.segments, seg)
+	}
+}
+
+type linkKey struct {
+	dev uint64
+	ino uint64
+}
+
+// readArchive reads entries up to the trailer.
+func (f *FS) readArchive(br *bufio.Reader) (Segment, error) {
+	a := &archiveReader{r: br}
+	links := make(map[linkKey]*inodeData)
+
+	var seg Segment
+
+	for {
+		magic := make([]byte, 6)
+		if err := a.read(magic); err != nil {
+			return seg, err
+		}
+
+		e, err := a.readHeader(string(magic))
+		if err != nil {
+			return seg, err
+		}
+
+		seg.Format = e.format
+
+		if e.name == Trailer {
+			return seg, nil
+		}
+
+		data, err := a.readData(e.size)
+		if err != nil {
+			return seg, fmt.Errorf("reading %v: %w", e.name, err)
+		}
+
+		if e.format != FormatODC {
+			if err := a.skip(4); err != nil {
+				return seg, err
+			}
+		}
+
+		if e.format == FormatCRC && e.attr.Mode.IsRegular() {
+			var sum uint32
+			for _, b := range data {
+				sum += uint32(b)
+			}
+
+			if sum != e.check {
+				return seg, fmt.Errorf("%w: checksum mismatch for %v", ErrInvalidArchive, e.name)
+			}
+		}
+
+		if err := f.addEntry(e, data, links); err != nil {
+			return seg, err
+		}
+
+		seg.Entries++
+	}
+}
+
+func (f *FS) addEntry(e *rawEntry, data []byte, links map[linkKey]*inodeData) error {
+	name := strings.Trim(path.Clean("/"+e.name), "/")
+
+	if name == "" {
+		if !e.attr.Mode.IsDir() {
+			return fmt.Errorf("%w: root is not a directory", ErrInvalidArchive)
+		}
+
+		e.attr.Inode = f.root.attr.Inode
+		f.root.attr = e.attr
+
+		return nil
+	}
+
+	// Hard links share data, which writers store with either the first or the last link.
+	if e.attr.Mode.IsRegular() && e.nlink > 1 {
+		key := linkKey{dev: e.dev, ino: e.ino}
+
+		if n := links[key]; n != nil {
+			if len(data) > 0 {
+				n.data = data
+			}
+
+			return f.link(name, n)
+		}
+
+		n := f.newInode(e, data)
+		links[key] = n
+
+		return f.link(name, n)
+	}
+
+	n := f.newInode(e, data)
+
+	switch {
+	case n.isDir():
+		n.children = make(map[string]*inodeData)
+	case n.isSymlink():
+		n.target = string(data)
+		n.data = nil
+	case !n.attr.Mode.IsRegular():
+		n.data = nil
+	}
+
+	return f.link(name, n)
+}
+
+func (f *FS) newInode(e *rawEntry, data []byte) *inodeData {
+	f.inodes++
+
+	n := &inodeData{attr: e.attr, data: data}
+	n.attr.Inode = f.inodes
+
+	if !n.attr.Mode.IsDir() && n.attr.Mode&fs.ModeDevice == 0 {
+		n.attr.Major = 0
+		n.attr.Minor = 0
+	}
+
+	return n
+}
+
+// link places n at name, creating missing parents. An existing directory keeps its contents when replaced by
+// another.
+func (f *FS) link(name string, n *inodeData) error {
+	dir, base := path.Split(name)
+	parent := f.root
+
+	if dir != "" {
+		for _, part := range strings.Split(strings.TrimSuffix(dir, "/"), "/") {
+			next := parent.children[part]
+
+			if next == nil || !next.isDir() {
+				f.inodes++
+
+				next = &inodeData{
+					attr:     fsmeta.Attr{Mode: fs.ModeDir | 0o755, Inode: f.inodes},
+					children: make(map[string]*inodeData),
+				}
+
+				parent.children[part] = next
+			}
+
+			parent = next
+		}
+	}
+
+	if existing := parent.children[base]; existing != nil && existing.isDir() && n.isDir() {
+		n.children = existing.children
+	}
+
+	parent.children[base] = n
+
+	return nil
+}
+
+func pathError(op string, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// resolve walks a path from the root, following symlinks in intermediate components and, when follow is set, the
+// final component. Symlink targets are interpreted relative to the archive root.
+func (f *FS) resolve(op string, name string, follow bool) (*inodeData, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError(op, name, fs.ErrInvalid)
+	}
+
+	stack := []*inodeData{f.root}
+	parts := strings.Split(name, "/")
+	links := 0
+
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		cur := stack[len(stack)-1]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+
+			continue
+		}
+
+		if !cur.isDir() {
+			return nil, pathError(op, name, ErrNotDir)
+		}
+
+		next := cur.children[part]
+		if next == nil {
+			return nil, pathError(op, name, fs.ErrNotExist)
+		}
+
+		if next.isSymlink() && (len(parts) > 0 || follow) {
+			links++
+			if links > maxSymlinks {
+				return nil, pathError(op, name, errors.New("too many levels of symbolic links"))
+			}
+
+			if strings.HasPrefix(next.target, "/") {
+				stack = stack[:1]
+			}
+
+			parts = append(strings.Split(next.target, "/"), parts...)
+
+			continue
+		}
+
+		stack = append(stack, next)
+	}
+
+	return stack[len(stack)-1], nil
+}
+
+func (f *FS) info(name string, n *inodeData) *fileInfo {
+	return &fileInfo{name: name, inode: n}
+}
+
+func (f *FS) Open(name string) (fs.File, error) {
+	n, err := f.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	info := f.info(path.Base(name), n)
+
+	if n.isDir() {
+		return &dir{info: info, entries: f.dirEntries(n)}, nil
+	}
+
+	return &file{info: info, Reader: bytes.NewReader(n.data)}, nil
+}
+
+func (f *FS) dirEntries(n *inodeData) []fs.DirEntry {
+	out := make([]fs.DirEntry, 0, len(n.children))
+
+	for name, child := range n.children {
+		out = append(out, fs.FileInfoToDirEntry(f.info(name, child)))
+	}
+
+	slices.SortFunc(out, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return out
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := f.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if !n.isDir() {
+		return nil, pathError("readdir", name, ErrNotDir)
+	}
+
+	return f.dirEntries(n), nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	n, err := f.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.info(path.Base(name), n), nil
+}
+
+// Lstat describes a file without following a final symlink.
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	n, err := f.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.info(path.Base(name), n), nil
+}
+
+// ReadLink returns the target of a symlink.
+func (f *FS) ReadLink(name string) (string, error) {
+	n, err := f.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+
+	if !n.isSymlink() {
+		return "", pathError("readlink", name, fs.ErrInvalid)
+	}
+
+	return n.target, nil
+}
+
+type fileInfo struct {
+	name  string
+	inode *inodeData
+}
+
+func (i *fileInfo) Name() string {
+	return i.name
+}
+
+func (i *fileInfo) Size() int64 {
+	if i.inode.isSymlink() {
+		return int64(len(i.inode.target))
+	}
+
+	return int64(len(i.inode.data))
+}
+
+func (i *fileInfo) Mode() fs.FileMode {
+	return i.inode.attr.Mode
+}
+
+func (i *fileInfo) ModTime() time.Time {
+	return i.inode.attr.ModTime
+}
+
+func (i *fileInfo) IsDir() bool {
+	return i.inode.isDir()
+}
+
+func (i *fileInfo) Sys() any {
+	attr := i.inode.attr
+
+	return &attr
+}
+
+type file struct {
+	*bytes.Reader
+	info *fileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+type dir struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *dir) ReadDir(count int) ([]fs.DirEntry, error) {
+	entries := d.entries[d.offset:]
+
+	if count > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+
+		entries = entries[:min(count, len(entries))]
+	}
+
+	d.offset += len(entries)
+
+	return entries, nil
+}
+
+func (d *dir) Close() error {
+	return nil
+}
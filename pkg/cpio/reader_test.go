@@ -0,0 +1,307 @@
+package cpio
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func buildInitramfs(t *testing.T) []byte {
+	t.Helper()
+
+	var early, out bytes.Buffer
+
+	w, err := NewWriter(&early, Options{TempDir: t.TempDir()})
+	require.NoError(t, err, "early writer should create")
+	require.NoError(t, w.WriteFile("kernel/x86/microcode/GenuineIntel.bin", strings.NewReader("microcode"),
+		fsmeta.Attr{Mode: 0o644}), "microcode should write")
+	require.NoError(t, w.Close(), "early writer should close")
+
+	w, err = NewWriter(&out, Options{
+		Format:  FormatCRC,
+		Gzip:    true,
+		Early:   &early,
+		Time:    time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		TempDir: t.TempDir(),
+	})
+	require.NoError(t, err, "writer should create")
+
+	require.NoError(t, w.WriteFile("init", strings.NewReader("#!/bin/sh\n"), fsmeta.Attr{Mode: 0o755}),
+		"init should write")
+	require.NoError(t, w.WriteFile("bin/busybox", strings.NewReader("busybox"), fsmeta.Attr{Mode: 0o755}),
+		"busybox should write")
+	require.NoError(t, w.Symlink("bin/sh", "busybox", fsmeta.Attr{Mode: 0o777}), "symlink should create")
+	require.NoError(t, w.WriteFile("etc/passwd", strings.NewReader("root:x:0:0::/root:/bin/sh\n"), fsmeta.Attr{
+		Mode: 0o600,
+		UID:  1000,
+		GID:  100,
+	}), "passwd should write")
+	require.NoError(t, w.Link("etc/passwd-", "etc/passwd"), "hard link should create")
+	require.NoError(t, w.Mknod("dev/console", fsmeta.Attr{
+		Mode:  fs.ModeDevice | fs.ModeCharDevice | 0o600,
+		Major: 5,
+		Minor: 1,
+	}), "console should create")
+	require.NoError(t, w.Close(), "writer should close")
+
+	return out.Bytes()
+}
+
+func TestReader(t *testing.T) {
+	data := buildInitramfs(t)
+
+	fsys, err := Open(bytes.NewReader(data))
+	require.NoError(t, err, "image should open")
+
+	segments := fsys.Segments()
+	require.Len(t, segments, 2, "both archives should be read")
+	assert.Equal(t, Segment{Offset: 0, Format: FormatNewc, Entries: 5}, segments[0], "early archive should be first")
+	assert.Equal(t, FormatCRC, segments[1].Format, "main archive should use crc")
+	assert.True(t, segments[1].Compressed, "main archive should be compressed")
+	assert.Equal(t, data[segments[1].Offset:segments[1].Offset+2], []byte{0x1F, 0x8B},
+		"main archive offset should locate the gzip stream")
+
+	require.NoError(t, fstest.TestFS(fsys, "init", "bin/busybox", "bin/sh", "etc/passwd", "etc/passwd-",
+		"kernel/x86/microcode/GenuineIntel.bin"), "fs should behave")
+
+	content, err := fs.ReadFile(fsys, "bin/sh")
+	require.NoError(t, err, "symlink should be followed")
+	assert.Equal(t, "busybox", string(content), "symlink should resolve to its target")
+
+	target, err := fsys.ReadLink("bin/sh")
+	require.NoError(t, err, "link should read")
+	assert.Equal(t, "busybox", target, "link target should round trip")
+
+	info, err := fsys.Stat("etc/passwd")
+	require.NoError(t, err, "stat should succeed")
+
+	attr := info.Sys().(*fsmeta.Attr)
+	assert.Equal(t, fs.FileMode(0o600), info.Mode(), "mode should round trip")
+	assert.Equal(t, uint32(1000), attr.UID, "uid should round trip")
+	assert.Equal(t, uint32(100), attr.GID, "gid should round trip")
+	assert.Equal(t, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), info.ModTime(), "mtime should round trip")
+
+	link, err := fsys.Stat("etc/passwd-")
+	require.NoError(t, err, "hard link should stat")
+	assert.Equal(t, attr.Inode, link.Sys().(*fsmeta.Attr).Inode, "hard link should share an inode")
+
+	content, err = fs.ReadFile(fsys, "etc/passwd")
+	require.NoError(t, err, "first link should read")
+	assert.Equal(t, "root:x:0:0::/root:/bin/sh\n", string(content), "first link should have the shared data")
+
+	info, err = fsys.Lstat("dev/console")
+	require.NoError(t, err, "device should stat")
+	assert.Equal(t, fs.ModeDevice|fs.ModeCharDevice, info.Mode().Type(), "device type should round trip")
+	assert.Equal(t, uint32(5), info.Sys().(*fsmeta.Attr).Major, "major should round trip")
+	assert.Equal(t, uint32(1), info.Sys().(*fsmeta.Attr).Minor, "minor should round trip")
+
+	// Copying the merged view into a new archive keeps the metadata.
+	var out bytes.Buffer
+
+	w, err := NewWriter(&out, Options{TempDir: t.TempDir()})
+	require.NoError(t, err, "writer should create")
+	require.NoError(t, w.AddFS(fsys), "fs should copy")
+	require.NoError(t, w.Close(), "writer should close")
+
+	copied, err := Open(&out)
+	require.NoError(t, err, "copy should open")
+
+	info, err = copied.Lstat("dev/console")
+	require.NoError(t, err, "device should be copied")
+	assert.Equal(t, uint32(5), info.Sys().(*fsmeta.Attr).Major, "major should be copied")
+
+	target, err = copied.ReadLink("bin/sh")
+	require.NoError(t, err, "symlink should be copied")
+	assert.Equal(t, "busybox", target, "symlink target should be copied")
+}
+
+// rawArchive builds an archive entry by entry, allowing layouts the Writer does not produce.
+type rawArchive struct {
+	w   Writer
+	out countWriter
+	buf bytes.Buffer
+}
+
+func newRawArchive() *rawArchive {
+	a := &rawArchive{}
+	a.out.w = &a.buf
+
+	return a
+}
+
+func (a *rawArchive) add(t *testing.T, h header, data string) {
+	t.Helper()
+
+	h.size = uint32(len(data))
+	require.NoError(t, a.w.writeHeader(&a.out, h), "header should write")
+
+	_, err := a.out.Write([]byte(data))
+	require.NoError(t, err, "data should write")
+	require.NoError(t, a.out.pad(4), "data should pad")
+}
+
+func (a *rawArchive) close(t *testing.T) []byte {
+	t.Helper()
+
+	a.add(t, header{nlink: 1, name: Trailer}, "")
+	require.NoError(t, a.out.pad(BlockSize), "archive should pad")
+
+	return a.buf.Bytes()
+}
+
+func TestReaderMerge(t *testing.T) {
+	first := newRawArchive()
+	first.add(t, header{ino: 1, mode: fsmeta.ModeDir | 0o700, nlink: 2, name: "etc"}, "")
+	first.add(t, header{ino: 2, mode: fsmeta.ModeRegular | 0o644, nlink: 1, name: "etc/hostname"}, "old\n")
+	first.add(t, header{ino: 3, mode: fsmeta.ModeRegular | 0o644, nlink: 2, name: "etc/a"}, "linked\n")
+	first.add(t, header{ino: 3, mode: fsmeta.ModeRegular | 0o644, nlink: 2, name: "etc/b"}, "")
+	first.add(t, header{ino: 4, mode: fsmeta.ModeRegular | 0o644, nlink: 1, name: "./usr/lib/implicit"}, "x")
+
+	second := newRawArchive()
+	second.add(t, header{ino: 1, mode: fsmeta.ModeDir | 0o755, nlink: 2, name: "etc"}, "")
+	second.add(t, header{ino: 2, mode: fsmeta.ModeRegular | 0o644, nlink: 1, name: "etc/hostname"}, "new\n")
+	// Inode numbers are only meaningful within an archive.
+	second.add(t, header{ino: 3, mode: fsmeta.ModeRegular | 0o644, nlink: 2, name: "etc/c"}, "other\n")
+	second.add(t, header{ino: 3, mode: fsmeta.ModeRegular | 0o644, nlink: 2, name: "etc/d"}, "")
+
+	data := append(first.close(t), second.close(t)...)
+
+	fsys, err := Open(bytes.NewReader(data))
+	require.NoError(t, err, "image should open")
+
+	info, err := fsys.Stat("etc")
+	require.NoError(t, err, "directory should stat")
+	assert.Equal(t, fs.ModeDir|0o755, info.Mode(), "later directory metadata should apply")
+
+	for name, expected := range map[string]string{
+		"etc/hostname":     "new\n",
+		"etc/a":            "linked\n",
+		"etc/b":            "linked\n",
+		"etc/c":            "other\n",
+		"etc/d":            "other\n",
+		"usr/lib/implicit": "x",
+	} {
+		content, err := fs.ReadFile(fsys, name)
+		require.NoError(t, err, "%v should read", name)
+		assert.Equal(t, expected, string(content), "%v should have the expected data", name)
+	}
+
+	a, err := fsys.Stat("etc/a")
+	require.NoError(t, err, "link should stat")
+
+	c, err := fsys.Stat("etc/c")
+	require.NoError(t, err, "link should stat")
+	assert.NotEqual(t, a.Sys().(*fsmeta.Attr).Inode, c.Sys().(*fsmeta.Attr).Inode,
+		"links from separate archives should not be merged")
+
+	require.NoError(t, fstest.TestFS(fsys, "etc/hostname", "usr/lib/implicit"), "fs should behave")
+}
+
+func TestReaderODC(t *testing.T) {
+	entry := func(ino int, mode uint32, rdev int, name string, data string) string {
+		return fmt.Sprintf("%s%06o%06o%06o%06o%06o%06o%06o%011o%06o%011o%s\x00%s", MagicODC, 0, ino, mode, 0, 0, 1,
+			rdev, 1600000000, len(name)+1, len(data), name, data)
+	}
+
+	data := entry(1, fsmeta.ModeDir|0o755, 0, ".", "") +
+		entry(2, fsmeta.ModeRegular|0o644, 0, "hello", "world") +
+		entry(3, fsmeta.ModeBlock|0o600, 8<<8|17, "sdb1", "") +
+		entry(0, 0, 0, Trailer, "")
+
+	fsys, err := Open(strings.NewReader(data))
+	require.NoError(t, err, "odc archive should open")
+	assert.Equal(t, FormatODC, fsys.Segments()[0].Format, "format should be detected")
+
+	content, err := fs.ReadFile(fsys, "hello")
+	require.NoError(t, err, "file should read")
+	assert.Equal(t, "world", string(content), "file should have its data")
+
+	info, err := fsys.Stat("sdb1")
+	require.NoError(t, err, "device should stat")
+	assert.Equal(t, fs.ModeDevice, info.Mode().Type(), "block device type should be read")
+	assert.Equal(t, uint32(8), info.Sys().(*fsmeta.Attr).Major, "major should be read")
+	assert.Equal(t, uint32(17), info.Sys().(*fsmeta.Attr).Minor, "minor should be read")
+	assert.Equal(t, time.Unix(1600000000, 0).UTC(), info.ModTime(), "mtime should be read")
+}
+
+func TestReaderBsdtar(t *testing.T) {
+	bin, err := exec.LookPath("bsdtar")
+	if err != nil {
+		t.Log("bsdtar not available, skipping consistency check")
+
+		return
+	}
+
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "etc"), 0o755), "directory should create")
+	require.NoError(t, os.WriteFile(filepath.Join(src, "etc/hosts"), []byte("127.0.0.1 localhost\n"), 0o644),
+		"file should write")
+	require.NoError(t, os.Link(filepath.Join(src, "etc/hosts"), filepath.Join(src, "etc/hosts.bak")),
+		"hard link should create")
+	require.NoError(t, os.Symlink("hosts", filepath.Join(src, "etc/link")), "symlink should create")
+
+	for _, format := range []string{"newc", "odc"} {
+		path := filepath.Join(t.TempDir(), "archive.cpio")
+
+		out, err := exec.Command(bin, "-c", "-f", path, "--format", format, "-C", src, ".").CombinedOutput()
+		require.NoError(t, err, "bsdtar should create a %v archive:\n%s", format, out)
+
+		f, err := os.Open(path)
+		require.NoError(t, err, "archive should open")
+
+		fsys, err := Open(f)
+		require.NoError(t, err, "%v archive should read", format)
+		require.NoError(t, f.Close(), "archive should close")
+
+		for _, name := range []string{"etc/hosts", "etc/hosts.bak", "etc/link"} {
+			content, err := fs.ReadFile(fsys, name)
+			require.NoError(t, err, "%v should read from %v", name, format)
+			assert.Equal(t, "127.0.0.1 localhost\n", string(content), "%v should have its data in %v", name, format)
+		}
+
+		require.NoError(t, fstest.TestFS(fsys, "etc/hosts", "etc/hosts.bak", "etc/link"), "%v fs should behave",
+			format)
+	}
+}
+
+func TestReaderInvalid(t *testing.T) {
+	_, err := Open(bytes.NewReader(nil))
+	assert.ErrorIs(t, err, ErrInvalidArchive, "empty image should be rejected")
+
+	_, err = Open(strings.NewReader("not an archive"))
+	assert.ErrorIs(t, err, ErrInvalidArchive, "garbage should be rejected")
+
+	_, err = Open(bytes.NewReader([]byte{0x28, 0xB5, 0x2F, 0xFD, 0, 0, 0, 0}))
+	assert.ErrorIs(t, err, ErrUnsupportedFormat, "zstd should be reported as unsupported")
+
+	a := newRawArchive()
+	a.w.opts.Format = FormatCRC
+	a.add(t, header{ino: 1, mode: fsmeta.ModeRegular | 0o644, nlink: 1, check: 1, name: "file"}, "data")
+	data := a.close(t)
+
+	_, err = Open(bytes.NewReader(data))
+	assert.ErrorIs(t, err, ErrInvalidArchive, "checksum mismatch should be rejected")
+
+	_, err = Open(bytes.NewReader(data[:120]))
+	assert.ErrorIs(t, err, ErrInvalidArchive, "truncated archive should be rejected")
+
+	fsys, err := Open(bytes.NewReader(buildInitramfs(t)))
+	require.NoError(t, err, "image should open")
+
+	_, err = fsys.Open("missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist, "missing file should not exist")
+
+	_, err = fsys.ReadDir("init")
+	assert.ErrorIs(t, err, ErrNotDir, "file should not list")
+}
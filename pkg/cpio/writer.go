@@ -0,0 +1,590 @@
+package cpio
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+)
+
+type node struct {
+	attr     fsmeta.Attr
+	links    uint32
+	children map[string]*node
+	data     int64
+	size     int64
+	sum      uint32
+	target   string
+}
+
+func (n *node) isDir() bool {
+	return n.attr.Mode.IsDir()
+}
+
+func (n *node) sortedNames() []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+// nlink returns the link count of the entry, counting the entries of subdirectories for directories.
+func (n *node) nlink() uint32 {
+	if !n.isDir() {
+		return n.links
+	}
+
+	links := uint32(2)
+
+	for _, c := range n.children {
+		if c.isDir() {
+			links++
+		}
+	}
+
+	return links
+}
+
+func withType(mode fs.FileMode, ty fs.FileMode) fs.FileMode {
+	return mode&^fs.ModeType | ty
+}
+
+// Writer builds a cpio archive, such as an initramfs. Entries may be added in any order, with file data spooled to a
+// temporary file, and are written on Close sorted by path with each directory preceding its contents. Inode numbers
+// are assigned in that order, so they do not depend on the order entries were added.
+type Writer struct {
+	dst     io.Writer
+	opts    Options
+	spool   *os.File
+	spooled int64
+	root    *node
+	closed  bool
+}
+
+// NewWriter prepares an archive written to dst. Close must be called to write the archive and remove the spool file.
+func NewWriter(dst io.Writer, opts Options) (*Writer, error) {
+	if opts.Format != FormatNewc && opts.Format != FormatCRC {
+		return nil, fmt.Errorf("%w: cannot write %v archives", ErrUnsupportedFormat, opts.Format)
+	}
+
+	if opts.Time.IsZero() {
+		opts.Time = time.Unix(0, 0).UTC()
+	}
+
+	return &Writer{
+		dst:  dst,
+		opts: opts,
+		root: &node{
+			attr:     fsmeta.Attr{Mode: fs.ModeDir | 0o755, ModTime: opts.Time},
+			links:    1,
+			children: make(map[string]*node),
+		},
+	}, nil
+}
+
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || len(name) > MaxNameLen || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	return nil
+}
+
+func splitPath(name string) (string, string) {
+	return path.Split(cleanPath(name))
+}
+
+func cleanPath(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// sumWriter totals the bytes written, forming the checksum of crc archives.
+type sumWriter struct {
+	sum uint32
+}
+
+func (s *sumWriter) Write(data []byte) (int, error) {
+	for _, b := range data {
+		s.sum += uint32(b)
+	}
+
+	return len(data), nil
+}
+
+// writeData spools r, returning its offset within the spool, its size and its checksum.
+func (w *Writer) writeData(r io.Reader) (int64, int64, uint32, error) {
+	if w.spool == nil {
+		spool, err := os.CreateTemp(w.opts.TempDir, "cpio-*")
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("failed to create spool: %w", err)
+		}
+
+		w.spool = spool
+	}
+
+	start := w.spooled
+	sum := &sumWriter{}
+
+	size, err := io.Copy(io.MultiWriter(io.NewOffsetWriter(w.spool, start), sum), r)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to spool data: %w", err)
+	}
+
+	if size > MaxFileSize {
+		return 0, 0, 0, fmt.Errorf("%w: %v bytes", ErrFileTooLarge, size)
+	}
+
+	w.spooled += size
+
+	return start, size, sum.sum, nil
+}
+
+func (w *Writer) removeSpool() {
+	if w.spool == nil {
+		return
+	}
+
+	_ = w.spool.Close()
+	_ = os.Remove(w.spool.Name())
+	w.spool = nil
+}
+
+func (w *Writer) lookup(name string, create bool) (*node, error) {
+	name = cleanPath(name)
+
+	cur := w.root
+
+	if name == "" {
+		return cur, nil
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		next := cur.children[part]
+
+		if next == nil {
+			if !create {
+				return nil, fmt.Errorf("%w: %v", fs.ErrNotExist, name)
+			}
+
+			var err error
+
+			next, err = w.addNode(cur, part, fsmeta.Attr{Mode: fs.ModeDir | 0o755, ModTime: w.opts.Time})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !next.isDir() {
+			return nil, fmt.Errorf("%w: %v", ErrNotDir, part)
+		}
+
+		cur = next
+	}
+
+	return cur, nil
+}
+
+func (w *Writer) addNode(parent *node, name string, attr fsmeta.Attr) (*node, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	if parent.children[name] != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExist, name)
+	}
+
+	if attr.ModTime.IsZero() {
+		attr.ModTime = w.opts.Time
+	}
+
+	n := &node{
+		attr:  attr,
+		links: 1,
+	}
+
+	if attr.Mode.IsDir() {
+		n.children = make(map[string]*node)
+	}
+
+	parent.children[name] = n
+
+	return n, nil
+}
+
+func (w *Writer) create(name string, attr fsmeta.Attr) (*node, error) {
+	if w.closed {
+		return nil, ErrClosed
+	}
+
+	dir, base := splitPath(name)
+
+	parent, err := w.lookup(dir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return w.addNode(parent, base, attr)
+}
+
+// Mkdir creates a directory, along with any missing parents. The metadata of an existing directory, including the
+// root when name is ".", is replaced.
+func (w *Writer) Mkdir(name string, attr fsmeta.Attr) error {
+	if w.closed {
+		return ErrClosed
+	}
+
+	attr.Mode = withType(attr.Mode, fs.ModeDir)
+
+	if attr.ModTime.IsZero() {
+		attr.ModTime = w.opts.Time
+	}
+
+	dir, base := splitPath(name)
+
+	existing := w.root
+
+	if base != "" {
+		parent, err := w.lookup(dir, true)
+		if err != nil {
+			return err
+		}
+
+		existing = parent.children[base]
+
+		if existing == nil || !existing.isDir() {
+			_, err = w.addNode(parent, base, attr)
+
+			return err
+		}
+	}
+
+	existing.attr = attr
+
+	return nil
+}
+
+// WriteFile creates a regular file, along with any missing parent directories, containing the data read from r.
+// Extended attributes are not supported by cpio and are ignored.
+func (w *Writer) WriteFile(name string, r io.Reader, attr fsmeta.Attr) error {
+	attr.Mode = withType(attr.Mode, 0)
+
+	n, err := w.create(name, attr)
+	if err != nil {
+		return err
+	}
+
+	n.data, n.size, n.sum, err = w.writeData(r)
+	if err != nil {
+		return fmt.Errorf("writing %v: %w", name, err)
+	}
+
+	return nil
+}
+
+// Symlink creates a symbolic link, along with any missing parent directories.
+func (w *Writer) Symlink(name string, target string, attr fsmeta.Attr) error {
+	if target == "" {
+		return fmt.Errorf("%w: empty symlink target", ErrInvalidName)
+	}
+
+	attr.Mode = withType(attr.Mode, fs.ModeSymlink)
+
+	n, err := w.create(name, attr)
+	if err != nil {
+		return err
+	}
+
+	n.target = target
+
+	return nil
+}
+
+// Mknod creates a device node, FIFO or socket, selected by the type bits of attr.Mode.
+func (w *Writer) Mknod(name string, attr fsmeta.Attr) error {
+	switch attr.Mode.Type() {
+	case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice, fs.ModeNamedPipe, fs.ModeSocket:
+	default:
+		return fmt.Errorf("%w: %v is %v", ErrUnsupportedType, name, attr.Mode.Type())
+	}
+
+	_, err := w.create(name, attr)
+
+	return err
+}
+
+// Link creates a hard link to an existing non-directory entry. As with GNU cpio, the data is stored with the last
+// entry sharing the inode, with earlier entries left empty.
+func (w *Writer) Link(name string, target string) error {
+	if w.closed {
+		return ErrClosed
+	}
+
+	tdir, tbase := splitPath(target)
+
+	tparent, err := w.lookup(tdir, false)
+	if err != nil {
+		return err
+	}
+
+	n := tparent.children[tbase]
+	if n == nil {
+		return fmt.Errorf("%w: %v", fs.ErrNotExist, target)
+	}
+
+	if n.isDir() {
+		return fmt.Errorf("%w: cannot hard link directory %v", ErrUnsupportedType, target)
+	}
+
+	dir, base := splitPath(name)
+
+	parent, err := w.lookup(dir, true)
+	if err != nil {
+		return err
+	}
+
+	if err := validName(base); err != nil {
+		return err
+	}
+
+	if parent.children[base] != nil {
+		return fmt.Errorf("%w: %v", ErrExist, name)
+	}
+
+	parent.children[base] = n
+	n.links++
+
+	return nil
+}
+
+// AddFS copies the contents of fsys into the archive root, as described by fsmeta.CopyFS.
+func (w *Writer) AddFS(fsys fs.FS) error {
+	return fsmeta.CopyFS(w, fsys)
+}
+
+type entry struct {
+	name string
+	node *node
+}
+
+// entries lists the archive in output order, starting with the root as ".".
+func (w *Writer) entries() []entry {
+	out := []entry{{name: ".", node: w.root}}
+
+	var walk func(prefix string, n *node)
+
+	walk = func(prefix string, n *node) {
+		for _, name := range n.sortedNames() {
+			child := n.children[name]
+			out = append(out, entry{name: prefix + name, node: child})
+
+			if child.isDir() {
+				walk(prefix+name+"/", child)
+			}
+		}
+	}
+
+	walk("", w.root)
+
+	return out
+}
+
+type header struct {
+	ino       uint32
+	mode      uint32
+	uid       uint32
+	gid       uint32
+	nlink     uint32
+	mtime     uint32
+	size      uint32
+	rdevMajor uint32
+	rdevMinor uint32
+	check     uint32
+	name      string
+}
+
+func pad4(n int64) int64 {
+	return (4 - n%4) % 4
+}
+
+// countWriter tracks the length of the archive, which determines the padding after each header and file.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(data []byte) (int, error) {
+	n, err := c.w.Write(data)
+	c.n += int64(n)
+
+	return n, err
+}
+
+func (c *countWriter) pad(align int64) error {
+	if p := (align - c.n%align) % align; p > 0 {
+		_, err := c.Write(make([]byte, p))
+
+		return err
+	}
+
+	return nil
+}
+
+func (w *Writer) writeHeader(out *countWriter, h header) error {
+	magic := MagicNewc
+	if w.opts.Format == FormatCRC {
+		magic = MagicCRC
+	}
+
+	buf := fmt.Appendf(nil, "%s%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X", magic, h.ino, h.mode, h.uid,
+		h.gid, h.nlink, h.mtime, h.size, 0, 0, h.rdevMajor, h.rdevMinor, len(h.name)+1, h.check)
+	buf = append(buf, h.name...)
+	buf = append(buf, 0)
+
+	if _, err := out.Write(buf); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+
+	return out.pad(4)
+}
+
+func unixTime(t time.Time) uint32 {
+	return uint32(min(max(t.Unix(), 0), math.MaxUint32))
+}
+
+// Close writes the archive, preceded by any early archive, and removes the spool file.
+func (w *Writer) Close() error {
+	if w.closed {
+		return ErrClosed
+	}
+
+	w.closed = true
+
+	defer w.removeSpool()
+
+	if w.opts.Early != nil {
+		n, err := io.Copy(w.dst, w.opts.Early)
+		if err != nil {
+			return fmt.Errorf("failed to copy early archive: %w", err)
+		}
+
+		if _, err := w.dst.Write(make([]byte, pad4(n))); err != nil {
+			return fmt.Errorf("failed to pad early archive: %w", err)
+		}
+	}
+
+	var zw *gzip.Writer
+
+	dst := w.dst
+
+	if w.opts.Gzip {
+		zw = gzip.NewWriter(dst)
+		dst = zw
+	}
+
+	bw := bufio.NewWriter(dst)
+	out := &countWriter{w: bw}
+
+	if err := w.writeEntries(out); err != nil {
+		return err
+	}
+
+	if err := w.writeHeader(out, header{nlink: 1, name: Trailer}); err != nil {
+		return err
+	}
+
+	if err := out.pad(BlockSize); err != nil {
+		return fmt.Errorf("failed to pad archive: %w", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("failed to compress archive: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) writeEntries(out *countWriter) error {
+	inodes := make(map[*node]uint32)
+	seen := make(map[*node]uint32)
+
+	for _, e := range w.entries() {
+		n := e.node
+
+		ino, ok := inodes[n]
+		if !ok {
+			ino = uint32(len(inodes) + 1)
+			inodes[n] = ino
+		}
+
+		seen[n]++
+
+		h := header{
+			ino:   ino,
+			mode:  n.attr.UnixMode(),
+			uid:   n.attr.UID,
+			gid:   n.attr.GID,
+			nlink: n.nlink(),
+			mtime: unixTime(n.attr.ModTime),
+			name:  e.name,
+		}
+
+		var data io.Reader
+
+		switch {
+		case n.attr.Mode.IsRegular():
+			// Only the last link carries the data.
+			if seen[n] == n.links && n.size > 0 {
+				h.size = uint32(n.size)
+				h.check = n.sum
+				data = io.NewSectionReader(w.spool, n.data, n.size)
+			}
+		case n.attr.Mode.Type() == fs.ModeSymlink:
+			h.size = uint32(len(n.target))
+			data = strings.NewReader(n.target)
+		case n.attr.Mode&fs.ModeDevice != 0:
+			h.rdevMajor = n.attr.Major
+			h.rdevMinor = n.attr.Minor
+		}
+
+		if w.opts.Format != FormatCRC {
+			h.check = 0
+		}
+
+		if err := w.writeHeader(out, h); err != nil {
+			return err
+		}
+
+		if data == nil {
+			continue
+		}
+
+		if _, err := io.Copy(out, data); err != nil {
+			return fmt.Errorf("failed to write %v: %w", e.name, err)
+		}
+
+		if err := out.pad(4); err != nil {
+			return fmt.Errorf("failed to pad %v: %w", e.name, err)
+		}
+	}
+
+	return nil
+}
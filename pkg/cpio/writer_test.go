@@ -0,0 +1,310 @@
+package cpio
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testEntry struct {
+	magic string
+	ino   uint32
+	mode  uint32
+	uid   uint32
+	gid   uint32
+	nlink uint32
+	mtime uint32
+	major uint32
+	minor uint32
+	check uint32
+	name  string
+	data  []byte
+	off   int
+}
+
+// parseArchive decodes newc or crc entries up to the trailer, returning the offset following the trailer.
+func parseArchive(t *testing.T, buf []byte) ([]testEntry, int) {
+	t.Helper()
+
+	var out []testEntry
+
+	off := 0
+
+	for {
+		require.GreaterOrEqual(t, len(buf)-off, newcHeaderSize, "header should fit")
+		require.Zero(t, off%4, "header should be aligned")
+
+		field := func(i int) uint32 {
+			v, err := strconv.ParseUint(string(buf[off+6+i*8:off+14+i*8]), 16, 32)
+			require.NoError(t, err, "field should be hex")
+
+			return uint32(v)
+		}
+
+		e := testEntry{
+			magic: string(buf[off : off+6]),
+			ino:   field(0),
+			mode:  field(1),
+			uid:   field(2),
+			gid:   field(3),
+			nlink: field(4),
+			mtime: field(5),
+			major: field(9),
+			minor: field(10),
+			check: field(12),
+			off:   off,
+		}
+
+		size, nameSize := int(field(6)), int(field(11))
+		e.name = string(buf[off+newcHeaderSize : off+newcHeaderSize+nameSize-1])
+
+		off += newcHeaderSize + nameSize
+		off += int(pad4(int64(off)))
+		e.data = buf[off : off+size]
+		off += size
+		off += int(pad4(int64(off)))
+
+		if e.name == Trailer {
+			return out, off
+		}
+
+		out = append(out, e)
+	}
+}
+
+// listArchive checks the archive with libarchive when available, returning its verbose listing.
+func listArchive(t *testing.T, data []byte) string {
+	t.Helper()
+
+	bin, err := exec.LookPath("bsdtar")
+	if err != nil {
+		t.Log("bsdtar not available, skipping consistency check")
+
+		return ""
+	}
+
+	path := filepath.Join(t.TempDir(), "initramfs.cpio")
+	require.NoError(t, os.WriteFile(path, data, 0o644), "archive should save")
+
+	out, err := exec.Command(bin, "-tvnf", path).CombinedOutput()
+	require.NoError(t, err, "bsdtar should list the archive:\n%s", out)
+
+	return string(out)
+}
+
+func buildArchive(t *testing.T, opts Options) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	opts.TempDir = t.TempDir()
+
+	w, err := NewWriter(&buf, opts)
+	require.NoError(t, err, "writer should create")
+
+	mtime := time.Date(2022, 6, 7, 8, 9, 10, 0, time.UTC)
+
+	require.NoError(t, w.WriteFile("init", strings.NewReader("#!/bin/sh\n"), fsmeta.Attr{Mode: 0o755, ModTime: mtime}),
+		"init should write")
+	require.NoError(t, w.WriteFile("etc/passwd", strings.NewReader("root:x:0:0::/root:/bin/sh\n"), fsmeta.Attr{
+		Mode: 0o644,
+		UID:  1000,
+		GID:  100,
+	}), "file should write")
+	require.NoError(t, w.Link("etc/passwd-", "etc/passwd"), "hard link should create")
+	require.NoError(t, w.Symlink("bin/sh", "busybox", fsmeta.Attr{Mode: 0o777}), "symlink should create")
+	require.NoError(t, w.Mknod("dev/console", fsmeta.Attr{
+		Mode:  fs.ModeDevice | fs.ModeCharDevice | 0o600,
+		Major: 5,
+		Minor: 1,
+	}), "console should create")
+	require.NoError(t, w.Mknod("dev/sda", fsmeta.Attr{Mode: fs.ModeDevice | 0o660, Major: 8, Minor: 300}),
+		"block device should create")
+	require.NoError(t, w.Mkdir("root", fsmeta.Attr{Mode: 0o700}), "directory should create")
+	require.NoError(t, w.WriteFile("empty", strings.NewReader(""), fsmeta.Attr{Mode: 0o600}), "empty file should write")
+	require.NoError(t, w.Close(), "writer should close")
+
+	return buf.Bytes()
+}
+
+func findEntry(t *testing.T, entries []testEntry, name string) testEntry {
+	t.Helper()
+
+	for _, e := range entries {
+		if e.name == name {
+			return e
+		}
+	}
+
+	require.Failf(t, "entry missing", "%v should be present", name)
+
+	return testEntry{}
+}
+
+func TestWriter(t *testing.T) {
+	data := buildArchive(t, Options{})
+	assert.Zero(t, len(data)%BlockSize, "archive should be padded to a block")
+
+	entries, end := parseArchive(t, data)
+	assert.Equal(t, make([]byte, len(data)-end), data[end:], "padding should be zeroed")
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.name)
+		assert.Equal(t, MagicNewc, e.magic, "%v should use newc", e.name)
+	}
+
+	assert.Equal(t, []string{
+		".", "bin", "bin/sh", "dev", "dev/console", "dev/sda", "empty", "etc", "etc/passwd", "etc/passwd-", "init",
+		"root",
+	}, names, "entries should be sorted with parents first")
+
+	root := findEntry(t, entries, ".")
+	assert.Equal(t, uint32(fsmeta.ModeDir|0o755), root.mode, "root should be a directory")
+	assert.Equal(t, uint32(6), root.nlink, "root should count its subdirectories")
+	assert.Zero(t, root.mtime, "default time should be the epoch")
+
+	init := findEntry(t, entries, "init")
+	assert.Equal(t, uint32(fsmeta.ModeRegular|0o755), init.mode, "init should be executable")
+	assert.Equal(t, "#!/bin/sh\n", string(init.data), "init should hold its data")
+	assert.Equal(t, uint32(time.Date(2022, 6, 7, 8, 9, 10, 0, time.UTC).Unix()), init.mtime, "mtime should be kept")
+	assert.Zero(t, init.check, "newc should not carry a checksum")
+
+	passwd := findEntry(t, entries, "etc/passwd")
+	link := findEntry(t, entries, "etc/passwd-")
+	assert.Equal(t, passwd.ino, link.ino, "hard links should share an inode")
+	assert.Equal(t, uint32(2), passwd.nlink, "hard links should be counted")
+	assert.Empty(t, passwd.data, "first link should be empty")
+	assert.Equal(t, "root:x:0:0::/root:/bin/sh\n", string(link.data), "last link should hold the data")
+	assert.Equal(t, uint32(1000), passwd.uid, "uid should be kept")
+	assert.Equal(t, uint32(100), passwd.gid, "gid should be kept")
+
+	sh := findEntry(t, entries, "bin/sh")
+	assert.Equal(t, uint32(fsmeta.ModeSymlink|0o777), sh.mode, "symlink type should be kept")
+	assert.Equal(t, "busybox", string(sh.data), "symlink should hold its target")
+
+	sda := findEntry(t, entries, "dev/sda")
+	assert.Equal(t, uint32(fsmeta.ModeBlock|0o660), sda.mode, "block device type should be kept")
+	assert.Equal(t, uint32(8), sda.major, "major should be kept")
+	assert.Equal(t, uint32(300), sda.minor, "minor should be kept")
+
+	seen := make(map[uint32]string)
+	for _, e := range entries {
+		if other, ok := seen[e.ino]; ok && other != "etc/passwd" {
+			assert.Failf(t, "inode reused", "%v shares an inode with %v", e.name, other)
+		}
+
+		seen[e.ino] = e.name
+	}
+
+	if out := listArchive(t, data); out != "" {
+		assert.Contains(t, out, "init", "listing should include init")
+		assert.Contains(t, out, "bin/sh -> busybox", "listing should include the symlink")
+		assert.Contains(t, out, "8,300", "listing should include the device numbers")
+	}
+
+	assert.Equal(t, data, buildArchive(t, Options{}), "output should be deterministic")
+}
+
+func TestWriterCRC(t *testing.T) {
+	data := buildArchive(t, Options{Format: FormatCRC})
+	entries, _ := parseArchive(t, data)
+
+	for _, e := range entries {
+		assert.Equal(t, MagicCRC, e.magic, "%v should use crc", e.name)
+
+		var sum uint32
+		for _, b := range e.data {
+			sum += uint32(b)
+		}
+
+		if e.mode&fsmeta.ModeTypeMask == fsmeta.ModeRegular {
+			assert.Equal(t, sum, e.check, "%v checksum should match", e.name)
+		}
+	}
+
+	listArchive(t, data)
+}
+
+func TestWriterCompressed(t *testing.T) {
+	var early bytes.Buffer
+
+	w, err := NewWriter(&early, Options{TempDir: t.TempDir()})
+	require.NoError(t, err, "early writer should create")
+	require.NoError(t, w.WriteFile("kernel/x86/microcode/GenuineIntel.bin", bytes.NewReader(make([]byte, 1000)),
+		fsmeta.Attr{Mode: 0o644}), "microcode should write")
+	require.NoError(t, w.Close(), "early writer should close")
+
+	data := buildArchive(t, Options{Gzip: true, Early: bytes.NewReader(early.Bytes())})
+
+	require.True(t, bytes.HasPrefix(data, early.Bytes()), "early archive should come first")
+
+	entries, _ := parseArchive(t, data)
+	findEntry(t, entries, "kernel/x86/microcode/GenuineIntel.bin")
+
+	zr, err := gzip.NewReader(bytes.NewReader(data[early.Len():]))
+	require.NoError(t, err, "main archive should be gzip compressed")
+
+	main, err := io.ReadAll(zr)
+	require.NoError(t, err, "main archive should decompress")
+	assert.Equal(t, buildArchive(t, Options{}), main, "compressed archive should match")
+}
+
+func TestWriterAddFS(t *testing.T) {
+	var buf bytes.Buffer
+
+	w, err := NewWriter(&buf, Options{TempDir: t.TempDir()})
+	require.NoError(t, err, "writer should create")
+
+	require.NoError(t, w.AddFS(fstest.MapFS{
+		"init":        {Data: []byte("binary"), Mode: 0o755},
+		"lib/modules": {Mode: fs.ModeDir | 0o755},
+		"bin/a":       {Data: []byte("tool"), Mode: 0o755, Sys: &fsmeta.Attr{Mode: 0o755, Inode: 5}},
+		"bin/b":       {Data: []byte("tool"), Mode: 0o755, Sys: &fsmeta.Attr{Mode: 0o755, Inode: 5}},
+	}), "fs should add")
+	require.NoError(t, w.Close(), "writer should close")
+
+	entries, _ := parseArchive(t, buf.Bytes())
+	assert.Equal(t, "binary", string(findEntry(t, entries, "init").data), "file should be copied")
+	assert.Equal(t, uint32(fsmeta.ModeDir|0o755), findEntry(t, entries, "lib/modules").mode,
+		"directory should be copied")
+
+	a, b := findEntry(t, entries, "bin/a"), findEntry(t, entries, "bin/b")
+	assert.Equal(t, a.ino, b.ino, "hard link should share the inode")
+	assert.Equal(t, uint32(2), b.nlink, "hard link should be counted")
+}
+
+func TestWriterErrors(t *testing.T) {
+	_, err := NewWriter(io.Discard, Options{Format: FormatODC})
+	assert.ErrorIs(t, err, ErrUnsupportedFormat, "odc should not be writable")
+
+	w, err := NewWriter(io.Discard, Options{TempDir: t.TempDir()})
+	require.NoError(t, err, "writer should create")
+
+	require.NoError(t, w.WriteFile("file", strings.NewReader("x"), fsmeta.Attr{Mode: 0o644}), "file should write")
+	assert.ErrorIs(t, w.WriteFile("file", strings.NewReader(""), fsmeta.Attr{}), ErrExist, "duplicate should be rejected")
+	assert.ErrorIs(t, w.WriteFile("file/x", strings.NewReader(""), fsmeta.Attr{}), ErrNotDir,
+		"file parent should be rejected")
+	assert.ErrorIs(t, w.WriteFile(strings.Repeat("x", 300), strings.NewReader(""), fsmeta.Attr{}), ErrInvalidName,
+		"long name should be rejected")
+	require.NoError(t, w.Mkdir("dir", fsmeta.Attr{}), "dir should create")
+	assert.ErrorIs(t, w.Link("dir2", "dir"), ErrUnsupportedType, "directory hard link should be rejected")
+	assert.ErrorIs(t, w.Mknod("reg", fsmeta.Attr{Mode: 0o644}), ErrUnsupportedType, "regular mknod should be rejected")
+	assert.ErrorIs(t, w.Symlink("link", "", fsmeta.Attr{}), ErrInvalidName, "empty symlink should be rejected")
+	require.NoError(t, w.Close(), "writer should close")
+	assert.ErrorIs(t, w.Close(), ErrClosed, "second close should fail")
+	assert.ErrorIs(t, w.Mkdir("late", fsmeta.Attr{}), ErrClosed, "closed writer should reject changes")
+}
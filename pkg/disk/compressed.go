@@ -0,0 +1,86 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/csnewman/go-appliance/pkg/compress"
+)
+
+const sparseChunkSize = 64 * 1024
+
+// OpenCompressed decompresses an image into a sparse temporary file, which is removed when the disk is closed.
+func OpenCompressed(ctx context.Context, path string, dec compress.Decompressor) (*Disk, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	defer src.Close()
+
+	reader, err := dec.NewReader(src)
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	f, err := os.CreateTemp("", "disk-*.img")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+
+	d := &Disk{
+		file: f,
+		temp: true,
+	}
+
+	if err := decompressSparse(ctx, f, reader); err != nil {
+		_ = d.Close()
+
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func OpenGzip(ctx context.Context, path string) (*Disk, error) {
+	return OpenCompressed(ctx, path, compress.Gzip{})
+}
+
+func decompressSparse(ctx context.Context, f *os.File, r io.Reader) error {
+	buf := make([]byte, sparseChunkSize)
+	zeros := make([]byte, sparseChunkSize)
+
+	var off int64
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := io.ReadFull(r, buf)
+		if n > 0 && !bytes.Equal(buf[:n], zeros[:n]) {
+			if _, werr := f.WriteAt(buf[:n], off); werr != nil {
+				return fmt.Errorf("failed to write chunk: %w", werr)
+			}
+		}
+
+		off += int64(n)
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to decompress: %w", err)
+		}
+	}
+
+	if err := f.Truncate(off); err != nil {
+		return fmt.Errorf("failed to resize file: %w", err)
+	}
+
+	return nil
+}
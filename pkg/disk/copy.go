@@ -0,0 +1,95 @@
+package disk
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+const copyChunkSize = 1024 * 1024
+
+// WriteFrom copies up to limit bytes from src to the disk at off, as described by Copy.
+func (d *Disk) WriteFrom(
+	ctx context.Context,
+	off int64,
+	src io.Reader,
+	limit int64,
+	exact bool,
+	report func(done int64),
+) (int64, error) {
+	return Copy(ctx, io.NewOffsetWriter(d.file, off), src, limit, exact, report)
+}
+
+// Copy copies up to limit bytes from src to dst in chunks, checking ctx and reporting progress after each chunk. When
+// exact is set, a source which ends before limit bytes fails with io.ErrUnexpectedEOF.
+func Copy(
+	ctx context.Context,
+	dst io.Writer,
+	src io.Reader,
+	limit int64,
+	exact bool,
+	report func(done int64),
+) (int64, error) {
+	buf := make([]byte, min(limit, copyChunkSize))
+
+	var done int64
+
+	for done < limit {
+		if err := ctx.Err(); err != nil {
+			return done, err
+		}
+
+		chunk := buf[:min(limit-done, int64(len(buf)))]
+
+		n, err := io.ReadFull(src, chunk)
+		if n > 0 {
+			if _, werr := dst.Write(chunk[:n]); werr != nil {
+				return done, fmt.Errorf("failed to write chunk: %w", werr)
+			}
+
+			done += int64(n)
+
+			if report != nil {
+				report(done)
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if exact {
+				return done, fmt.Errorf("%w: content ended after %v of %v bytes", io.ErrUnexpectedEOF, done, limit)
+			}
+
+			return done, nil
+		} else if err != nil {
+			return done, fmt.Errorf("failed to read chunk: %w", err)
+		}
+	}
+
+	return done, nil
+}
+
+func (d *Disk) Zero(ctx context.Context, off int64, size int64, report func(done int64)) error {
+	buf := make([]byte, min(size, copyChunkSize))
+
+	var done int64
+
+	for done < size {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		chunk := buf[:min(size-done, int64(len(buf)))]
+
+		if _, err := d.file.WriteAt(chunk, off+done); err != nil {
+			return fmt.Errorf("failed to write zeros: %w", err)
+		}
+
+		done += int64(len(chunk))
+
+		if report != nil {
+			report(done)
+		}
+	}
+
+	return nil
+}
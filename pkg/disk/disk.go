@@ -10,6 +10,7 @@ const BlockSize = 512
 
 type Disk struct {
 	file *os.File
+	temp bool
 }
 
 func Open(dev string) (*Disk, error) {
@@ -39,13 +40,67 @@ func Create(dev string, size int64) (*Disk, error) {
 }
 
 func (d *Disk) Close() error {
-	return d.file.Close()
+	err := d.file.Close()
+
+	if d.temp {
+		if rerr := os.Remove(d.file.Name()); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+
+	return err
+}
+
+func (d *Disk) Size() (int64, error) {
+	info, err := d.file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	return info.Size(), nil
+}
+
+func (d *Disk) Truncate(size int64) error {
+	if err := d.file.Truncate(size); err != nil {
+		return fmt.Errorf("failed to resize file: %w", err)
+	}
+
+	return nil
+}
+
+func (d *Disk) ReadAt(data []byte, off int64) (int, error) {
+	return d.file.ReadAt(data, off)
+}
+
+func (d *Disk) WriteAt(data []byte, off int64) (int, error) {
+	return d.file.WriteAt(data, off)
+}
+
+func (d *Disk) Section(off int64, size int64) *io.SectionReader {
+	return io.NewSectionReader(d.file, off, size)
+}
+
+func (d *Disk) OffsetWriter(off int64) *io.OffsetWriter {
+	return io.NewOffsetWriter(d.file, off)
+}
+
+func (d *Disk) PartitionSection(part GPTPartition) *io.SectionReader {
+	return d.Section(int64(part.StartLBA)*BlockSize, int64(part.EndLBA-part.StartLBA+1)*BlockSize)
+}
+
+func (d *Disk) MBRPartitionSection(part MBRPartition) *io.SectionReader {
+	return d.Section(int64(part.LBAStart)*BlockSize, int64(part.LBASize)*BlockSize)
 }
 
 func (d *Disk) ReadMBR() (*MBR, error) {
+	return d.ReadMBRAt(0)
+}
+
+// ReadMBRAt reads an MBR formatted sector, such as an extended boot record, from the given lba.
+func (d *Disk) ReadMBRAt(lba uint64) (*MBR, error) {
 	var data [MBRSize]byte
 
-	size, err := d.file.ReadAt(data[:], 0)
+	size, err := d.file.ReadAt(data[:], int64(lba*BlockSize))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read mbr blob: %w", err)
 	}
@@ -58,11 +113,15 @@ func (d *Disk) ReadMBR() (*MBR, error) {
 }
 
 func (d *Disk) WriteMBR(mbr *MBR) error {
+	return d.WriteMBRAt(0, mbr)
+}
+
+func (d *Disk) WriteMBRAt(lba uint64, mbr *MBR) error {
 	var data [MBRSize]byte
 
 	mbr.FillBytes(data[:])
 
-	size, err := d.file.WriteAt(data[:], 0)
+	size, err := d.file.WriteAt(data[:], int64(lba*BlockSize))
 	if err != nil {
 		return fmt.Errorf("failed to write mbr blob: %w", err)
 	}
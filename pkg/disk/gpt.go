@@ -21,6 +21,27 @@ const (
 var (
 	GPTTypeMicrosoftBasicData = uuid.MustParse("EBD0A0A2-B9E5-4433-87C0-68B6B72699C7")
 	GPTTypeLinuxFileSystem    = uuid.MustParse("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	GPTTypeEFISystem          = uuid.MustParse("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	GPTTypeBIOSBoot           = uuid.MustParse("21686148-6449-6E6F-744E-656564454649")
+	GPTTypeLinuxRootX86       = uuid.MustParse("44479540-F297-41B2-9AF7-D131D5F0458A")
+	GPTTypeLinuxRootX86_64    = uuid.MustParse("4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709")
+	GPTTypeLinuxRootARM       = uuid.MustParse("69DAD710-2CE4-4E3C-B16C-21A1D49ABED3")
+	GPTTypeLinuxRootARM64     = uuid.MustParse("B921B045-1DF0-41C3-AF44-4C6F280D3FAE")
+	GPTTypeLinuxHome          = uuid.MustParse("933AC7E1-2EB4-4F13-B844-0E14E2AEF915")
+	GPTTypeLinuxServerData    = uuid.MustParse("3B8F8425-20E0-4F3B-907F-1A25A76F98E8")
+	GPTTypeLinuxVariableData  = uuid.MustParse("4D21B016-B534-45C2-A9FB-5C16E091FD2D")
+	GPTTypeLinuxLVM           = uuid.MustParse("E6D6D379-F507-44C2-A23C-238F2A3DF928")
+	GPTTypeLinuxRAID          = uuid.MustParse("A19D880F-05FC-4D3B-A006-743F0F84911E")
+	GPTTypeLinuxSwap          = uuid.MustParse("0657FD6D-A4AB-43C4-84E5-0933C84B4F4F")
+)
+
+const (
+	GPTAttrRequired           = 1 << 0
+	GPTAttrNoBlockIO          = 1 << 1
+	GPTAttrLegacyBIOSBootable = 1 << 2
+	GPTAttrGrowFS             = 1 << 59
+	GPTAttrReadOnly           = 1 << 60
+	GPTAttrNoAuto             = 1 << 63
 )
 
 type GPT struct {
@@ -43,8 +64,12 @@ type GPT struct {
 var (
 	ErrGPTNotPresent  = errors.New("GPT signature not detected")
 	ErrGPTUnsupported = errors.New("GPT version unsupported")
+	ErrGPTNameTooLong = errors.New("GPT partition name longer than 36 UTF-16 code units")
 )
 
+// GPTNameLen is the capacity of the partition name field, in UTF-16 code units.
+const GPTNameLen = 36
+
 func NewGPT(diskBlocks uint64) (*GPT, *GPT, error) {
 	partBlocks := 32
 	partCount := (BlockSize / GPTPartitionSize) * partBlocks
@@ -63,7 +88,7 @@ func NewGPT(diskBlocks uint64) (*GPT, *GPT, error) {
 		ThisLBA:        1,
 		AlternativeLBA: diskBlocks - 1,
 		DataFirst:      uint64(partBlocks + 2),
-		DataLast:       diskBlocks - 2 - uint64(partCount),
+		DataLast:       diskBlocks - 2 - uint64(partBlocks),
 		GUID:           id,
 		PartitionsLBA:  2,
 		PartitionCount: uint32(partCount),
@@ -335,6 +360,9 @@ func WriteGPTPartitions(writer io.WriterAt, start uint64, size uint32, parts []G
 
 		if len(part.Name) > 0 {
 			encoded := utf16.Encode([]rune(part.Name))
+			if len(encoded) > GPTNameLen {
+				return 0, fmt.Errorf("%w: %q", ErrGPTNameTooLong, part.Name)
+			}
 
 			for i, v := range encoded {
 				i = i*2 + 56
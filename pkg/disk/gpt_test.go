@@ -2,6 +2,7 @@ package disk
 
 import (
 	"crypto/rand"
+	"strings"
 	"testing"
 
 	"github.com/google/uuid"
@@ -85,3 +86,32 @@ func TestGPTPartitions(t *testing.T) {
 	assert.Equal(t, uint32(0xf9937558), crc, "crc should match")
 	assert.Equal(t, parts, readParts, "reread parts should match")
 }
+
+func TestGPTPartitionNameTooLong(t *testing.T) {
+	buf := &ByteBuf{buf: make([]byte, 1024)}
+
+	// The emoji takes two UTF-16 code units, so the name is one unit too long despite being 36 runes.
+	_, err := WriteGPTPartitions(buf, 0, GPTPartitionSize, []GPTPartition{
+		{Name: strings.Repeat("a", 35) + "😀"},
+	})
+	require.ErrorIs(t, err, ErrGPTNameTooLong, "long name should be rejected")
+
+	_, err = WriteGPTPartitions(buf, 0, GPTPartitionSize, []GPTPartition{
+		{Name: strings.Repeat("a", 34) + "😀"},
+	})
+	require.NoError(t, err, "name filling the field should write")
+}
+
+func TestNewGPT(t *testing.T) {
+	primary, secondary, err := NewGPT(2048)
+	require.NoError(t, err, "gpt should create")
+
+	assert.Equal(t, uint64(2047), primary.AlternativeLBA, "backup header should be the last block")
+	assert.Equal(t, uint64(34), primary.DataFirst, "data should start after the primary entries")
+
+	// The usable area ends before the 32 blocks of backup entries, not the 128 entries they hold.
+	assert.Equal(t, primary.AlternativeLBA-33, primary.DataLast, "data should end before the backup entries")
+	assert.Equal(t, primary.DataLast+1, secondary.PartitionsLBA, "backup entries should follow the data")
+	assert.Equal(t, primary.DataLast, secondary.DataLast, "headers should agree on the usable area")
+	assert.Equal(t, primary.ThisLBA, secondary.AlternativeLBA, "backup should point to the primary")
+}
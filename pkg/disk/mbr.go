@@ -2,7 +2,9 @@ package disk
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
 
 	rand "math/rand/v2"
@@ -44,19 +46,50 @@ func (a CHSAddr) String() string {
 type MBRPartType byte
 
 const (
+	MBRPartTypeEmpty         = 0x00
+	MBRPartTypeFAT12         = 0x01
+	MBRPartTypeFAT16Small    = 0x04
+	MBRPartTypeExtended      = 0x05
+	MBRPartTypeFAT16         = 0x06
+	MBRPartTypeFAT16LBA      = 0x0E
 	MBRPartTypeLinux         = 0x83
+	MBRPartTypeLinuxSwap     = 0x82
 	MBRPartTypeFAT32LBA      = 0x0C
+	MBRPartTypeExtendedLBA   = 0x0F
 	MBRPartTypeGPTProtective = 0xEE
+	MBRPartTypeEFISystem     = 0xEF
 )
 
+const MBRAttrBootable = 0x80
+
+var ErrMBRLBAOverflow = errors.New("lba exceeds mbr 32-bit limit")
+
 func (t MBRPartType) String() string {
 	switch t {
+	case MBRPartTypeEmpty:
+		return "empty"
+	case MBRPartTypeFAT12:
+		return "fat12"
+	case MBRPartTypeFAT16Small:
+		return "fat16small"
+	case MBRPartTypeExtended:
+		return "extended"
+	case MBRPartTypeFAT16:
+		return "fat16"
 	case MBRPartTypeFAT32LBA:
 		return "fat32lba"
+	case MBRPartTypeFAT16LBA:
+		return "fat16lba"
+	case MBRPartTypeExtendedLBA:
+		return "extended-lba"
 	case MBRPartTypeLinux:
 		return "linux"
+	case MBRPartTypeLinuxSwap:
+		return "linux-swap"
 	case MBRPartTypeGPTProtective:
 		return "gpt-protective"
+	case MBRPartTypeEFISystem:
+		return "efi-system"
 	default:
 		return strconv.FormatUint(uint64(t), 16)
 	}
@@ -112,6 +145,16 @@ func NewMBRPartition(ty MBRPartType, start uint32, size uint32) MBRPartition {
 	}
 }
 
+// NewMBRPartitionLBA creates a partition from 64-bit block addresses, failing if the partition cannot be represented
+// within the 32-bit fields of an MBR entry.
+func NewMBRPartitionLBA(ty MBRPartType, start uint64, size uint64) (MBRPartition, error) {
+	if start > math.MaxUint32 || size > math.MaxUint32 {
+		return MBRPartition{}, fmt.Errorf("%w: start %v size %v", ErrMBRLBAOverflow, start, size)
+	}
+
+	return NewMBRPartition(ty, uint32(start), uint32(size)), nil
+}
+
 func ParseMBRPartition(data []byte) MBRPartition {
 	return MBRPartition{
 		Attrs: data[0],
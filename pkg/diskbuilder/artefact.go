@@ -0,0 +1,111 @@
+package diskbuilder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/csnewman/go-appliance/pkg/compress"
+	"github.com/csnewman/go-appliance/pkg/disk"
+)
+
+// Artefact describes a compressed image along with the size and digest of both its raw and compressed forms.
+type Artefact struct {
+	Size             int64
+	SHA256           string
+	CompressedSize   int64
+	CompressedSHA256 string
+}
+
+type hashingWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64
+}
+
+func newHashingWriter(w io.Writer) *hashingWriter {
+	return &hashingWriter{
+		w:    w,
+		hash: sha256.New(),
+	}
+}
+
+func (h *hashingWriter) Write(data []byte) (int, error) {
+	n, err := h.w.Write(data)
+	h.hash.Write(data[:n])
+	h.size += int64(n)
+
+	return n, err
+}
+
+func (h *hashingWriter) sum() string {
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
+
+func compressTo(w io.Writer, c compress.Compressor, fn func(w io.Writer) error) (*Artefact, error) {
+	compressed := newHashingWriter(w)
+
+	cw, err := c.NewWriter(compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := newHashingWriter(cw)
+
+	if err := fn(raw); err != nil {
+		_ = cw.Close()
+
+		return nil, err
+	}
+
+	if err := cw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish compression: %w", err)
+	}
+
+	return &Artefact{
+		Size:             raw.size,
+		SHA256:           raw.sum(),
+		CompressedSize:   compressed.size,
+		CompressedSHA256: compressed.sum(),
+	}, nil
+}
+
+// EmitCompressed writes the image to w, compressed with c.
+func (s *Stream) EmitCompressed(ctx context.Context, w io.Writer, c compress.Compressor) (*Artefact, error) {
+	return compressTo(w, c, func(w io.Writer) error {
+		_, err := s.Emit(ctx, w)
+
+		return err
+	})
+}
+
+// CompressImage compresses an existing raw image, such as one produced by a Builder, into w.
+func CompressImage(
+	ctx context.Context,
+	path string,
+	w io.Writer,
+	c compress.Compressor,
+	progress Progress,
+) (*Artefact, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image: %w", err)
+	}
+
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat image: %w", err)
+	}
+
+	return compressTo(w, c, func(w io.Writer) error {
+		_, err := disk.Copy(ctx, w, f, info.Size(), true, newReporter(progress, "compressing image", info.Size()))
+
+		return err
+	})
+}
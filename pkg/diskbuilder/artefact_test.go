@@ -0,0 +1,93 @@
+package diskbuilder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/csnewman/go-appliance/pkg/compress"
+	"github.com/csnewman/go-appliance/pkg/disk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmitCompressed(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := NewStream(8 * 1024 * 1024)
+	require.NoError(t, err, "stream should create")
+
+	start, end, err := s.Allocate(0, DefaultAlignment)
+	require.NoError(t, err, "partition should allocate")
+
+	part, err := disk.NewGPTPartition(disk.GPTTypeLinuxFileSystem, start, end, "data")
+	require.NoError(t, err, "partition should create")
+
+	s.Add(part)
+
+	var out bytes.Buffer
+
+	artefact, err := s.EmitCompressed(ctx, &out, compress.Gzip{Level: gzip.BestSpeed})
+	require.NoError(t, err, "stream should emit")
+
+	assert.Equal(t, int64(8*1024*1024), artefact.Size, "size should match")
+	assert.Equal(t, int64(out.Len()), artefact.CompressedSize, "compressed size should match")
+
+	compressedSum := sha256.Sum256(out.Bytes())
+	assert.Equal(t, hex.EncodeToString(compressedSum[:]), artefact.CompressedSHA256, "compressed sum should match")
+
+	gr, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err, "gzip should open")
+
+	raw, err := io.ReadAll(gr)
+	require.NoError(t, err, "gzip should read")
+
+	rawSum := sha256.Sum256(raw)
+	assert.Equal(t, hex.EncodeToString(rawSum[:]), artefact.SHA256, "raw sum should match")
+
+	path := filepath.Join(t.TempDir(), "disk.img.gz")
+	require.NoError(t, os.WriteFile(path, out.Bytes(), 0o600), "image should write")
+
+	d, err := disk.OpenGzip(ctx, path)
+	require.NoError(t, err, "compressed image should open")
+
+	defer d.Close()
+
+	size, err := d.Size()
+	require.NoError(t, err, "size should read")
+	assert.Equal(t, artefact.Size, size, "decompressed size should match")
+
+	gpt, err := d.ReadGPT(1)
+	require.NoError(t, err, "gpt should read")
+
+	parts, _, err := d.ReadGPTPartitions(gpt.PartitionsLBA*disk.BlockSize, gpt.EntrySize, gpt.PartitionCount)
+	require.NoError(t, err, "parts should read")
+	assert.Equal(t, part, parts[0], "partition should match")
+}
+
+func TestCompressImage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+
+	b, err := New(path, 1024*1024)
+	require.NoError(t, err, "builder should create")
+	require.NoError(t, b.Close(), "builder should close")
+	require.NoError(t, b.Disk.Close(), "disk should close")
+
+	var out bytes.Buffer
+
+	artefact, err := CompressImage(context.Background(), path, &out, compress.Gzip{}, nil)
+	require.NoError(t, err, "image should compress")
+
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err, "image should read")
+
+	rawSum := sha256.Sum256(raw)
+	assert.Equal(t, hex.EncodeToString(rawSum[:]), artefact.SHA256, "raw sum should match")
+	assert.Equal(t, int64(len(raw)), artefact.Size, "size should match")
+}
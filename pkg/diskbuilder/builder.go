@@ -1,112 +1,125 @@
 package diskbuilder
 
 import (
-	"errors"
+	"context"
 	"fmt"
 
 	"github.com/csnewman/go-appliance/pkg/disk"
 )
 
-var ErrInvalidSize = errors.New("invalid disk size")
-
 type Builder struct {
-	Disk        *disk.Disk
-	MBR         *disk.MBR
-	Primary     *disk.GPT
-	Secondary   *disk.GPT
-	Parts       []disk.GPTPartition
-	LastPart    int
-	LastMBRPart int
+	Layout
+
+	Disk     *disk.Disk
+	Progress Progress
+	MinSize  int64
 }
 
 func New(path string, size int64) (*Builder, error) {
-	if size%disk.BlockSize != 0 {
-		return nil, ErrInvalidSize
+	layout, err := NewLayout(size)
+	if err != nil {
+		return nil, err
 	}
 
-	blocks := size / disk.BlockSize
-
 	d, err := disk.Create(path, size)
 	if err != nil {
 		return nil, err
 	}
 
-	mbr := disk.NewMBR()
+	return &Builder{
+		Layout: *layout,
+		Disk:   d,
+	}, nil
+}
 
-	primary, secondary, err := disk.NewGPT(uint64(blocks))
+func (b *Builder) ZeroPartition(ctx context.Context, idx int) error {
+	part, err := b.partition(idx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create gpt table: %w", err)
+		return err
 	}
 
-	parts := make([]disk.GPTPartition, primary.PartitionCount)
+	size := int64(part.EndLBA-part.StartLBA+1) * disk.BlockSize
+	report := newReporter(b.Progress, fmt.Sprintf("zeroing partition %v", idx+1), size)
 
-	return &Builder{
-		Disk:      d,
-		MBR:       mbr,
-		Parts:     parts,
-		Primary:   primary,
-		Secondary: secondary,
-	}, nil
+	if err := b.Disk.Zero(ctx, int64(part.StartLBA)*disk.BlockSize, size, report); err != nil {
+		return fmt.Errorf("failed to zero partition %v: %w", idx+1, err)
+	}
+
+	return nil
 }
 
-func (b *Builder) Add(gpt disk.GPTPartition) {
-	b.Parts[b.LastPart] = gpt
-	b.LastPart++
+func (b *Builder) Close() error {
+	return b.CloseContext(context.Background())
 }
 
-func (b *Builder) AddMBR(mbr disk.MBRPartition) {
-	switch b.LastMBRPart {
-	case 0:
-		b.MBR.Part1 = mbr
-	case 1:
-		b.MBR.Part2 = mbr
-	case 2:
-		b.MBR.Part3 = mbr
-	case 3:
-		b.MBR.Part4 = mbr
-	default:
-		panic("only 4 MBR partitions allowed")
+func (b *Builder) CloseContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	b.LastMBRPart++
-}
+	report := newReporter(b.Progress, "writing mbr", disk.MBRSize)
 
-func (b *Builder) Close() error {
 	if err := b.Disk.WriteMBR(b.MBR); err != nil {
 		return fmt.Errorf("faile to write MBR: %w", err)
 	}
 
-	partCrc, err := b.Disk.WriteGPTPartitions(
-		b.Primary.PartitionsLBA*disk.BlockSize,
-		b.Primary.EntrySize,
-		b.Parts,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to write primary parts: %w", err)
+	if report != nil {
+		report(disk.MBRSize)
 	}
 
-	b.Primary.PartitionsCRC = partCrc
-	b.Primary.Checksum = b.Primary.CalculateChecksum()
+	if err := b.writeGPT(ctx, "primary", b.Primary); err != nil {
+		return err
+	}
+
+	return b.writeGPT(ctx, "secondary", b.Secondary)
+}
 
-	if err := b.Disk.WriteGPT(b.Primary.ThisLBA, b.Primary); err != nil {
-		return fmt.Errorf("failed to write primary gpt: %w", err)
+func (b *Builder) writeGPT(ctx context.Context, name string, gpt *disk.GPT) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	partCrc, err = b.Disk.WriteGPTPartitions(
-		b.Secondary.PartitionsLBA*disk.BlockSize,
-		b.Secondary.EntrySize,
+	total := int64(gpt.PartitionCount)*int64(gpt.EntrySize) + disk.BlockSize
+	report := newReporter(b.Progress, "writing "+name+" gpt", total)
+
+	partCrc, err := b.Disk.WriteGPTPartitions(
+		gpt.PartitionsLBA*disk.BlockSize,
+		gpt.EntrySize,
 		b.Parts,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to write secondary parts: %w", err)
+		return fmt.Errorf("failed to write %v parts: %w", name, err)
 	}
 
-	b.Secondary.PartitionsCRC = partCrc
-	b.Secondary.Checksum = b.Secondary.CalculateChecksum()
+	gpt.PartitionsCRC = partCrc
+	gpt.Checksum = gpt.CalculateChecksum()
+
+	if err := b.Disk.WriteGPT(gpt.ThisLBA, gpt); err != nil {
+		return fmt.Errorf("failed to write %v gpt: %w", name, err)
+	}
 
-	if err := b.Disk.WriteGPT(b.Secondary.ThisLBA, b.Secondary); err != nil {
-		return fmt.Errorf("failed to write secondary gpt: %w", err)
+	if report != nil {
+		report(total)
 	}
 
 	return nil
 }
+
+// Shrink reduces the disk to the minimum size which holds all partitions, truncating the backing file and relocating
+// the secondary GPT. The resulting size is recorded in MinSize. It should be called once all content has been written
+// and before the builder is closed.
+func (b *Builder) Shrink(alignment int64) (int64, error) {
+	size := b.MinimumSize(alignment)
+
+	if err := b.Resize(size); err != nil {
+		return 0, err
+	}
+
+	if err := b.Disk.Truncate(size); err != nil {
+		return 0, err
+	}
+
+	b.MinSize = size
+
+	return size, nil
+}
@@ -0,0 +1,131 @@
+package diskbuilder
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/csnewman/go-appliance/pkg/disk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuilderProgress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+
+	b, err := New(path, 8*1024*1024)
+	require.NoError(t, err, "builder should create")
+
+	part, err := disk.NewGPTPartition(disk.GPTTypeLinuxFileSystem, 2048, 4095, "data")
+	require.NoError(t, err, "partition should create")
+
+	b.Add(part)
+
+	var phases []string
+
+	b.Progress = ProgressFunc(func(phase string, done int64, total int64) {
+		if done == total {
+			phases = append(phases, phase)
+		}
+	})
+
+	require.NoError(t, b.ZeroPartition(context.Background(), 0), "partition should zero")
+	require.NoError(t, b.Close(), "builder should close")
+	require.NoError(t, b.Disk.Close(), "disk should close")
+
+	assert.Equal(
+		t,
+		[]string{"zeroing partition 1", "writing mbr", "writing primary gpt", "writing secondary gpt"},
+		phases,
+		"phases should match",
+	)
+
+	d, err := disk.Open(path)
+	require.NoError(t, err, "disk should open")
+
+	defer d.Close()
+
+	gpt, err := d.ReadGPT(1)
+	require.NoError(t, err, "gpt should read")
+
+	parts, crc, err := d.ReadGPTPartitions(gpt.PartitionsLBA*disk.BlockSize, gpt.EntrySize, gpt.PartitionCount)
+	require.NoError(t, err, "parts should read")
+	assert.Equal(t, gpt.PartitionsCRC, crc, "crc should match")
+	assert.Equal(t, part, parts[0], "partition should match")
+}
+
+func TestBuilderCancel(t *testing.T) {
+	b, err := New(filepath.Join(t.TempDir(), "disk.img"), 8*1024*1024)
+	require.NoError(t, err, "builder should create")
+
+	defer b.Disk.Close()
+
+	part, err := disk.NewGPTPartition(disk.GPTTypeLinuxFileSystem, 2048, 4095, "data")
+	require.NoError(t, err, "partition should create")
+
+	b.Add(part)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	require.ErrorIs(t, b.ZeroPartition(ctx, 0), context.Canceled, "zero should cancel")
+	require.ErrorIs(t, b.CloseContext(ctx), context.Canceled, "close should cancel")
+	require.ErrorIs(t, b.ZeroPartition(context.Background(), 1), ErrInvalidPartition, "index should be checked")
+}
+
+func TestBuilderShrink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+
+	b, err := New(path, 64*1024*1024)
+	require.NoError(t, err, "builder should create")
+
+	start, end, err := b.Allocate(1024*1024, DefaultAlignment)
+	require.NoError(t, err, "partition should allocate")
+
+	part, err := disk.NewGPTPartition(disk.GPTTypeLinuxFileSystem, start, end, "data")
+	require.NoError(t, err, "partition should create")
+
+	b.Add(part)
+	b.AddMBR(disk.NewMBRPartition(disk.MBRPartTypeGPTProtective, 1, 64*1024*1024/disk.BlockSize-1))
+
+	size, err := b.Shrink(DefaultAlignment)
+	require.NoError(t, err, "builder should shrink")
+	assert.Equal(t, int64(3*1024*1024), size, "size should match")
+	assert.Equal(t, size, b.MinSize, "min size should be recorded")
+
+	require.NoError(t, b.Close(), "builder should close")
+
+	actual, err := b.Disk.Size()
+	require.NoError(t, err, "size should read")
+	assert.Equal(t, size, actual, "file should be truncated")
+	require.NoError(t, b.Disk.Close(), "disk should close")
+
+	d, err := disk.Open(path)
+	require.NoError(t, err, "disk should open")
+
+	defer d.Close()
+
+	mbr, err := d.ReadMBR()
+	require.NoError(t, err, "mbr should read")
+	assert.Equal(t, uint32(size/disk.BlockSize-1), mbr.Part1.LBASize, "protective mbr should be resized")
+
+	primary, err := d.ReadGPT(1)
+	require.NoError(t, err, "primary gpt should read")
+	assert.Equal(t, uint64(size/disk.BlockSize-1), primary.AlternativeLBA, "alternative lba should match")
+
+	secondary, err := d.ReadGPT(primary.AlternativeLBA)
+	require.NoError(t, err, "secondary gpt should read")
+	assert.Equal(t, secondary.Checksum, secondary.CalculateChecksum(), "secondary checksum should match")
+
+	parts, _, err := d.ReadGPTPartitions(secondary.PartitionsLBA*disk.BlockSize, secondary.EntrySize, 1)
+	require.NoError(t, err, "secondary parts should read")
+	assert.Equal(t, part, parts[0], "partition should match")
+
+	_, crc, err := d.ReadGPTPartitions(
+		secondary.PartitionsLBA*disk.BlockSize,
+		secondary.EntrySize,
+		secondary.PartitionCount,
+	)
+	require.NoError(t, err, "secondary parts should read")
+	assert.Equal(t, secondary.PartitionsCRC, crc, "secondary crc should match")
+}
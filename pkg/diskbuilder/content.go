@@ -0,0 +1,185 @@
+package diskbuilder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/csnewman/go-appliance/pkg/disk"
+)
+
+var ErrContentTooLarge = errors.New("content too large for partition")
+
+// Content is a source of raw partition data. Open returns the data along with its size, or -1 if the size is not
+// known in advance.
+type Content interface {
+	Open() (io.ReadCloser, int64, error)
+}
+
+type readerContent struct {
+	reader io.Reader
+	size   int64
+}
+
+func ReaderContent(r io.Reader, size int64) Content {
+	return &readerContent{
+		reader: r,
+		size:   size,
+	}
+}
+
+func (c *readerContent) Open() (io.ReadCloser, int64, error) {
+	return io.NopCloser(c.reader), c.size, nil
+}
+
+type fileContent struct {
+	path string
+}
+
+func FileContent(path string) Content {
+	return &fileContent{
+		path: path,
+	}
+}
+
+func (c *fileContent) Open() (io.ReadCloser, int64, error) {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open content: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+
+		return nil, 0, fmt.Errorf("failed to stat content: %w", err)
+	}
+
+	return f, info.Size(), nil
+}
+
+type partitionContent struct {
+	disk *disk.Disk
+	part disk.GPTPartition
+}
+
+// PartitionContent copies the full range of a partition from another disk image.
+func PartitionContent(d *disk.Disk, part disk.GPTPartition) Content {
+	return &partitionContent{
+		disk: d,
+		part: part,
+	}
+}
+
+func (c *partitionContent) Open() (io.ReadCloser, int64, error) {
+	if c.part.EndLBA < c.part.StartLBA {
+		return nil, 0, fmt.Errorf("%w: end before start", ErrInvalidPartition)
+	}
+
+	section := c.disk.PartitionSection(c.part)
+
+	return io.NopCloser(section), section.Size(), nil
+}
+
+type ContentOptions struct {
+	// ZeroRemainder overwrites any space after the content, up to the end of the partition, with zeros.
+	ZeroRemainder bool
+	// Shrink reduces the partition's EndLBA to the last block containing content.
+	Shrink bool
+}
+
+// PartitionWriter returns a writer addressing the partition at idx, along with the partition size in bytes, for use
+// with filesystem writers.
+func (b *Builder) PartitionWriter(idx int) (*io.OffsetWriter, int64, error) {
+	part, err := b.partition(idx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size := int64(part.EndLBA-part.StartLBA+1) * disk.BlockSize
+
+	return b.Disk.OffsetWriter(int64(part.StartLBA) * disk.BlockSize), size, nil
+}
+
+// WriteContent streams content into the partition at idx, returning the number of content bytes written.
+func (b *Builder) WriteContent(ctx context.Context, idx int, content Content, opts ContentOptions) (int64, error) {
+	part, err := b.partition(idx)
+	if err != nil {
+		return 0, err
+	}
+
+	blocks := part.EndLBA - part.StartLBA + 1
+
+	written, blocks, err := writeContent(ctx, b.Disk, b.Progress, idx+1, part.StartLBA, blocks, content, opts)
+	if err != nil {
+		return written, err
+	}
+
+	b.Parts[idx].EndLBA = part.StartLBA + blocks - 1
+
+	return written, nil
+}
+
+// writeContent streams content into a numbered partition, returning the number of bytes written along with the
+// partition size in blocks, which will have been reduced if shrinking was requested.
+func writeContent(
+	ctx context.Context,
+	d *disk.Disk,
+	progress Progress,
+	num int,
+	startLBA uint64,
+	blocks uint64,
+	content Content,
+	opts ContentOptions,
+) (int64, uint64, error) {
+	reader, size, err := content.Open()
+	if err != nil {
+		return 0, blocks, err
+	}
+
+	defer reader.Close()
+
+	start := int64(startLBA) * disk.BlockSize
+	capacity := int64(blocks) * disk.BlockSize
+
+	if size > capacity {
+		return 0, blocks, fmt.Errorf("%w: partition %v: %v > %v bytes", ErrContentTooLarge, num, size, capacity)
+	}
+
+	limit := capacity
+	if size >= 0 {
+		limit = size
+	}
+
+	report := newReporter(progress, fmt.Sprintf("writing partition %v", num), size)
+
+	written, err := d.WriteFrom(ctx, start, reader, limit, size >= 0, report)
+	if err != nil {
+		return written, blocks, fmt.Errorf("failed to write partition %v: %w", num, err)
+	}
+
+	if size < 0 && written == capacity {
+		var extra [1]byte
+
+		if n, _ := io.ReadFull(reader, extra[:]); n > 0 {
+			return written, blocks, fmt.Errorf("%w: partition %v: more than %v bytes", ErrContentTooLarge, num, capacity)
+		}
+	}
+
+	if opts.Shrink {
+		blocks = uint64(max((written+disk.BlockSize-1)/disk.BlockSize, 1))
+		capacity = int64(blocks) * disk.BlockSize
+	}
+
+	if opts.ZeroRemainder && written < capacity {
+		report = newReporter(progress, fmt.Sprintf("zeroing partition %v", num), capacity-written)
+
+		if err := d.Zero(ctx, start+written, capacity-written, report); err != nil {
+			return written, blocks, fmt.Errorf("failed to zero partition %v: %w", num, err)
+		}
+	}
+
+	return written, blocks, nil
+}
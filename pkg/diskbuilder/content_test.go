@@ -0,0 +1,100 @@
+package diskbuilder
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/csnewman/go-appliance/pkg/disk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type unsizedReader struct {
+	io.Reader
+}
+
+func newTestBuilder(t *testing.T) *Builder {
+	t.Helper()
+
+	b, err := New(filepath.Join(t.TempDir(), "disk.img"), 8*1024*1024)
+	require.NoError(t, err, "builder should create")
+
+	t.Cleanup(func() {
+		_ = b.Disk.Close()
+	})
+
+	for i := range 2 {
+		start, end, err := b.Allocate(1024*1024, DefaultAlignment)
+		require.NoError(t, err, "partition %v should allocate", i)
+
+		part, err := disk.NewGPTPartition(disk.GPTTypeLinuxFileSystem, start, end, "")
+		require.NoError(t, err, "partition should create")
+
+		b.Add(part)
+	}
+
+	return b
+}
+
+func TestWriteContent(t *testing.T) {
+	b := newTestBuilder(t)
+	ctx := context.Background()
+
+	require.NoError(t, b.ZeroPartition(ctx, 0), "partition should zero")
+
+	junk := bytes.Repeat([]byte{0xFF}, 4096)
+
+	_, err := b.WriteContent(ctx, 0, ReaderContent(bytes.NewReader(junk), int64(len(junk))), ContentOptions{})
+	require.NoError(t, err, "junk should write")
+
+	content := []byte("some partition content")
+
+	written, err := b.WriteContent(ctx, 0, ReaderContent(unsizedReader{bytes.NewReader(content)}, -1), ContentOptions{
+		ZeroRemainder: true,
+		Shrink:        true,
+	})
+	require.NoError(t, err, "content should write")
+	assert.Equal(t, int64(len(content)), written, "written should match")
+	assert.Equal(t, b.Parts[0].StartLBA, b.Parts[0].EndLBA, "partition should shrink to one block")
+
+	block := make([]byte, disk.BlockSize)
+
+	_, err = b.Disk.ReadAt(block, int64(b.Parts[0].StartLBA)*disk.BlockSize)
+	require.NoError(t, err, "block should read")
+	assert.Equal(t, content, block[:len(content)], "content should match")
+	assert.Equal(t, make([]byte, disk.BlockSize-len(content)), block[len(content):], "remainder should be zero")
+
+	_, err = b.WriteContent(ctx, 1, PartitionContent(b.Disk, b.Parts[0]), ContentOptions{})
+	require.NoError(t, err, "partition should copy")
+
+	_, err = b.Disk.ReadAt(block, int64(b.Parts[1].StartLBA)*disk.BlockSize)
+	require.NoError(t, err, "block should read")
+	assert.Equal(t, content, block[:len(content)], "copied content should match")
+}
+
+func TestWriteContentTooLarge(t *testing.T) {
+	b := newTestBuilder(t)
+	ctx := context.Background()
+	data := make([]byte, 1024*1024+1)
+
+	_, err := b.WriteContent(ctx, 0, ReaderContent(bytes.NewReader(data), int64(len(data))), ContentOptions{})
+	require.ErrorIs(t, err, ErrContentTooLarge, "sized content should not fit")
+
+	_, err = b.WriteContent(ctx, 0, ReaderContent(unsizedReader{bytes.NewReader(data)}, -1), ContentOptions{})
+	require.ErrorIs(t, err, ErrContentTooLarge, "unsized content should not fit")
+}
+
+func TestWriteContentTruncated(t *testing.T) {
+	b := newTestBuilder(t)
+	ctx := context.Background()
+
+	end := b.Parts[0].EndLBA
+	data := make([]byte, 4096)
+
+	_, err := b.WriteContent(ctx, 0, ReaderContent(bytes.NewReader(data), 8192), ContentOptions{Shrink: true})
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF, "short content should fail")
+	assert.Equal(t, end, b.Parts[0].EndLBA, "partition should not shrink")
+}
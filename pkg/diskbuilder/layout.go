@@ -0,0 +1,189 @@
+package diskbuilder
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/csnewman/go-appliance/pkg/disk"
+	"github.com/csnewman/go-appliance/pkg/internal/membuf"
+)
+
+const DefaultAlignment = 1024 * 1024
+
+var (
+	ErrInvalidSize      = errors.New("invalid disk size")
+	ErrInvalidPartition = errors.New("invalid partition")
+	ErrNoSpace          = errors.New("not enough space")
+)
+
+// Layout holds the partition tables of a disk image being built.
+type Layout struct {
+	MBR         *disk.MBR
+	Primary     *disk.GPT
+	Secondary   *disk.GPT
+	Parts       []disk.GPTPartition
+	LastPart    int
+	LastMBRPart int
+}
+
+func NewLayout(size int64) (*Layout, error) {
+	if size%disk.BlockSize != 0 || size < 128*disk.BlockSize {
+		return nil, ErrInvalidSize
+	}
+
+	blocks := size / disk.BlockSize
+
+	mbr := disk.NewMBR()
+
+	primary, secondary, err := disk.NewGPT(uint64(blocks))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gpt table: %w", err)
+	}
+
+	parts := make([]disk.GPTPartition, primary.PartitionCount)
+
+	return &Layout{
+		MBR:       mbr,
+		Parts:     parts,
+		Primary:   primary,
+		Secondary: secondary,
+	}, nil
+}
+
+func (l *Layout) Add(gpt disk.GPTPartition) {
+	l.Parts[l.LastPart] = gpt
+	l.LastPart++
+}
+
+func (l *Layout) AddMBR(mbr disk.MBRPartition) {
+	switch l.LastMBRPart {
+	case 0:
+		l.MBR.Part1 = mbr
+	case 1:
+		l.MBR.Part2 = mbr
+	case 2:
+		l.MBR.Part3 = mbr
+	case 3:
+		l.MBR.Part4 = mbr
+	default:
+		panic("only 4 MBR partitions allowed")
+	}
+
+	l.LastMBRPart++
+}
+
+func (l *Layout) partition(idx int) (disk.GPTPartition, error) {
+	if idx < 0 || idx >= l.LastPart {
+		return disk.GPTPartition{}, fmt.Errorf("%w: index %v", ErrInvalidPartition, idx)
+	}
+
+	part := l.Parts[idx]
+
+	if part.EndLBA < part.StartLBA {
+		return disk.GPTPartition{}, fmt.Errorf("%w: end before start", ErrInvalidPartition)
+	}
+
+	return part, nil
+}
+
+func alignBlocks(lba uint64, alignment int64) uint64 {
+	blocks := uint64(alignment / disk.BlockSize)
+	if blocks <= 1 {
+		return lba
+	}
+
+	return (lba + blocks - 1) / blocks * blocks
+}
+
+// Allocate finds space for a partition of the given size after all previously added partitions. A size of zero uses
+// all remaining space.
+func (l *Layout) Allocate(size int64, alignment int64) (uint64, uint64, error) {
+	if size < 0 || size%disk.BlockSize != 0 || alignment%disk.BlockSize != 0 {
+		return 0, 0, ErrInvalidSize
+	}
+
+	next := l.Primary.DataFirst
+
+	for _, part := range l.Parts[:l.LastPart] {
+		if part.EndLBA >= next {
+			next = part.EndLBA + 1
+		}
+	}
+
+	start := alignBlocks(next, alignment)
+	end := l.Primary.DataLast
+
+	if size > 0 {
+		end = start + uint64(size/disk.BlockSize) - 1
+	}
+
+	if start > l.Primary.DataLast || end > l.Primary.DataLast || end < start {
+		return 0, 0, fmt.Errorf("%w: %v bytes at lba %v", ErrNoSpace, size, start)
+	}
+
+	return start, end, nil
+}
+
+// encodePartitions serialises the partition entries for the given table, updating its checksums.
+func (l *Layout) encodePartitions(gpt *disk.GPT) ([]byte, error) {
+	buf := membuf.New(int(gpt.PartitionCount) * int(gpt.EntrySize))
+
+	crc, err := disk.WriteGPTPartitions(buf, 0, gpt.EntrySize, l.Parts)
+	if err != nil {
+		return nil, err
+	}
+
+	gpt.PartitionsCRC = crc
+	gpt.Checksum = gpt.CalculateChecksum()
+
+	return buf.Data, nil
+}
+
+// MinimumSize returns the smallest disk size, rounded up to alignment, which can hold all partitions along with the
+// secondary GPT.
+func (l *Layout) MinimumSize(alignment int64) int64 {
+	last := l.Primary.DataFirst - 1
+
+	for _, part := range l.Parts[:l.LastPart] {
+		last = max(last, part.EndLBA)
+	}
+
+	tableBlocks := l.Primary.DataFirst - l.Primary.PartitionsLBA + 1
+
+	return int64(alignBlocks(last+1+tableBlocks, alignment)) * disk.BlockSize
+}
+
+// Resize moves the end of the disk, relocating the secondary GPT and updating any protective MBR partition.
+func (l *Layout) Resize(size int64) error {
+	if size%disk.BlockSize != 0 {
+		return ErrInvalidSize
+	}
+
+	blocks := uint64(size / disk.BlockSize)
+	entryBlocks := l.Primary.DataFirst - l.Primary.PartitionsLBA
+	dataLast := blocks - 2 - entryBlocks
+
+	if blocks < 2*entryBlocks+4 {
+		return ErrInvalidSize
+	}
+
+	for i, part := range l.Parts[:l.LastPart] {
+		if part.EndLBA > dataLast {
+			return fmt.Errorf("%w: partition %v ends after lba %v", ErrNoSpace, i+1, dataLast)
+		}
+	}
+
+	l.Primary.AlternativeLBA = blocks - 1
+	l.Primary.DataLast = dataLast
+	l.Secondary.ThisLBA = blocks - 1
+	l.Secondary.DataLast = dataLast
+	l.Secondary.PartitionsLBA = blocks - 1 - entryBlocks
+
+	for _, part := range []*disk.MBRPartition{&l.MBR.Part1, &l.MBR.Part2, &l.MBR.Part3, &l.MBR.Part4} {
+		if part.Type == disk.MBRPartTypeGPTProtective {
+			part.LBASize = uint32(min(blocks-uint64(part.LBAStart), 0xFFFFFFFF))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,281 @@
+package diskbuilder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/csnewman/go-appliance/pkg/disk"
+)
+
+var ErrTooManyPartitions = errors.New("too many partitions")
+
+const mbrFirstLogical = 5
+
+// MBRBuilder creates disks with only an MBR partition table. Up to four primary partitions may be added, or three
+// primary partitions followed by any number of logical partitions inside an extended partition.
+type MBRBuilder struct {
+	Disk      *disk.Disk
+	MBR       *disk.MBR
+	Primary   []disk.MBRPartition
+	Logical   []disk.MBRPartition
+	Alignment int64
+	Progress  Progress
+
+	blocks   uint64
+	extended int
+	ebrs     []uint64
+}
+
+func NewMBR(path string, size int64) (*MBRBuilder, error) {
+	if size%disk.BlockSize != 0 || size < 2*disk.BlockSize {
+		return nil, ErrInvalidSize
+	}
+
+	if size/disk.BlockSize > 1<<32 {
+		return nil, fmt.Errorf("%w: disk size %v", disk.ErrMBRLBAOverflow, size)
+	}
+
+	d, err := disk.Create(path, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MBRBuilder{
+		Disk:      d,
+		MBR:       disk.NewMBR(),
+		Alignment: DefaultAlignment,
+		blocks:    uint64(size / disk.BlockSize),
+		extended:  -1,
+	}, nil
+}
+
+func (b *MBRBuilder) nextFree() uint64 {
+	next := uint64(1)
+
+	for _, part := range b.Primary {
+		if part.Type != disk.MBRPartTypeExtendedLBA {
+			next = max(next, uint64(part.LBAStart)+uint64(part.LBASize))
+		}
+	}
+
+	for _, part := range b.Logical {
+		next = max(next, uint64(part.LBAStart)+uint64(part.LBASize))
+	}
+
+	return next
+}
+
+func (b *MBRBuilder) allocate(start uint64, size int64, last uint64) (uint64, uint64, error) {
+	if size < 0 || size%disk.BlockSize != 0 {
+		return 0, 0, ErrInvalidSize
+	}
+
+	start = alignBlocks(start, b.Alignment)
+	blocks := uint64(size / disk.BlockSize)
+
+	if start > last {
+		return 0, 0, fmt.Errorf("%w: %v bytes at lba %v", ErrNoSpace, size, start)
+	}
+
+	if size == 0 {
+		blocks = last - start + 1
+	}
+
+	if start+blocks-1 > last {
+		return 0, 0, fmt.Errorf("%w: %v bytes at lba %v", ErrNoSpace, size, start)
+	}
+
+	return start, blocks, nil
+}
+
+// AddPrimary allocates a primary partition after all existing partitions, returning its partition number. A size of
+// zero uses all remaining space.
+func (b *MBRBuilder) AddPrimary(ty disk.MBRPartType, size int64, bootable bool) (int, error) {
+	if b.extended >= 0 || len(b.Primary) >= 4 {
+		return 0, fmt.Errorf("%w: no free primary partition slots", ErrTooManyPartitions)
+	}
+
+	start, blocks, err := b.allocate(b.nextFree(), size, b.blocks-1)
+	if err != nil {
+		return 0, err
+	}
+
+	part, err := disk.NewMBRPartitionLBA(ty, start, blocks)
+	if err != nil {
+		return 0, err
+	}
+
+	if bootable {
+		part.Attrs = disk.MBRAttrBootable
+	}
+
+	b.Primary = append(b.Primary, part)
+
+	return len(b.Primary), nil
+}
+
+// AddLogical allocates a logical partition, returning its partition number. The first logical partition creates an
+// extended partition covering the rest of the disk. Each logical partition is preceded by its extended boot record.
+func (b *MBRBuilder) AddLogical(ty disk.MBRPartType, size int64) (int, error) {
+	if b.extended < 0 {
+		if len(b.Primary) >= 4 {
+			return 0, fmt.Errorf("%w: no free slot for extended partition", ErrTooManyPartitions)
+		}
+
+		start, blocks, err := b.allocate(b.nextFree(), 0, b.blocks-1)
+		if err != nil {
+			return 0, err
+		}
+
+		ext, err := disk.NewMBRPartitionLBA(disk.MBRPartTypeExtendedLBA, start, blocks)
+		if err != nil {
+			return 0, err
+		}
+
+		b.Primary = append(b.Primary, ext)
+		b.extended = len(b.Primary) - 1
+	}
+
+	ext := b.Primary[b.extended]
+	ebr := alignBlocks(max(b.nextFree(), uint64(ext.LBAStart)), b.Alignment)
+	last := uint64(ext.LBAStart) + uint64(ext.LBASize) - 1
+
+	start, blocks, err := b.allocate(ebr+1, size, last)
+	if err != nil {
+		return 0, err
+	}
+
+	part, err := disk.NewMBRPartitionLBA(ty, start, blocks)
+	if err != nil {
+		return 0, err
+	}
+
+	b.Logical = append(b.Logical, part)
+	b.ebrs = append(b.ebrs, ebr)
+
+	return mbrFirstLogical + len(b.Logical) - 1, nil
+}
+
+func (b *MBRBuilder) partition(num int) (*disk.MBRPartition, error) {
+	switch {
+	case num >= 1 && num <= len(b.Primary) && num-1 != b.extended:
+		return &b.Primary[num-1], nil
+	case num >= mbrFirstLogical && num < mbrFirstLogical+len(b.Logical):
+		return &b.Logical[num-mbrFirstLogical], nil
+	default:
+		return nil, fmt.Errorf("%w: number %v", ErrInvalidPartition, num)
+	}
+}
+
+// PartitionWriter returns a writer addressing the numbered partition, along with the partition size in bytes.
+func (b *MBRBuilder) PartitionWriter(num int) (*io.OffsetWriter, int64, error) {
+	part, err := b.partition(num)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return b.Disk.OffsetWriter(int64(part.LBAStart) * disk.BlockSize), int64(part.LBASize) * disk.BlockSize, nil
+}
+
+// WriteContent streams content into the numbered partition, returning the number of content bytes written.
+func (b *MBRBuilder) WriteContent(ctx context.Context, num int, content Content, opts ContentOptions) (int64, error) {
+	part, err := b.partition(num)
+	if err != nil {
+		return 0, err
+	}
+
+	written, blocks, err := writeContent(
+		ctx,
+		b.Disk,
+		b.Progress,
+		num,
+		uint64(part.LBAStart),
+		uint64(part.LBASize),
+		content,
+		opts,
+	)
+	if err != nil {
+		return written, err
+	}
+
+	part.LBASize = uint32(blocks)
+
+	return written, nil
+}
+
+func (b *MBRBuilder) Close() error {
+	return b.CloseContext(context.Background())
+}
+
+func (b *MBRBuilder) CloseContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	report := newReporter(b.Progress, "writing mbr", int64(1+len(b.Logical))*disk.MBRSize)
+
+	for i, part := range b.Primary {
+		switch i {
+		case 0:
+			b.MBR.Part1 = part
+		case 1:
+			b.MBR.Part2 = part
+		case 2:
+			b.MBR.Part3 = part
+		case 3:
+			b.MBR.Part4 = part
+		}
+	}
+
+	if err := b.Disk.WriteMBR(b.MBR); err != nil {
+		return fmt.Errorf("failed to write MBR: %w", err)
+	}
+
+	for i, part := range b.Logical {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := b.writeEBR(i, part); err != nil {
+			return err
+		}
+
+		if report != nil {
+			report(int64(i+2) * disk.MBRSize)
+		}
+	}
+
+	return nil
+}
+
+func (b *MBRBuilder) writeEBR(i int, part disk.MBRPartition) error {
+	ext := b.Primary[b.extended]
+	lba := b.ebrs[i]
+
+	ebr := &disk.MBR{
+		Signature: disk.MBRSignature,
+	}
+
+	// Logical partitions are addressed relative to their own EBR.
+	ebr.Part1 = disk.NewMBRPartition(part.Type, part.LBAStart-uint32(lba), part.LBASize)
+
+	// Links to the next EBR are addressed relative to the start of the extended partition.
+	if i+1 < len(b.Logical) {
+		next := b.ebrs[i+1]
+		nextPart := b.Logical[i+1]
+
+		ebr.Part2 = disk.NewMBRPartition(
+			disk.MBRPartTypeExtended,
+			uint32(next)-ext.LBAStart,
+			nextPart.LBAStart+nextPart.LBASize-uint32(next),
+		)
+	}
+
+	if err := b.Disk.WriteMBRAt(lba, ebr); err != nil {
+		return fmt.Errorf("failed to write EBR %v: %w", i+mbrFirstLogical, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package diskbuilder
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/csnewman/go-appliance/pkg/disk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMBRBuilder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+
+	b, err := NewMBR(path, 64*1024*1024)
+	require.NoError(t, err, "builder should create")
+
+	num, err := b.AddPrimary(disk.MBRPartTypeFAT32LBA, 4*1024*1024, true)
+	require.NoError(t, err, "primary should add")
+	assert.Equal(t, 1, num, "primary number should match")
+
+	for range 2 {
+		_, err = b.AddPrimary(disk.MBRPartTypeLinux, 4*1024*1024, false)
+		require.NoError(t, err, "primary should add")
+	}
+
+	num, err = b.AddLogical(disk.MBRPartTypeLinux, 4*1024*1024)
+	require.NoError(t, err, "logical should add")
+	assert.Equal(t, 5, num, "logical number should match")
+
+	num, err = b.AddLogical(disk.MBRPartTypeLinuxSwap, 0)
+	require.NoError(t, err, "logical should add")
+	assert.Equal(t, 6, num, "logical number should match")
+
+	_, err = b.AddPrimary(disk.MBRPartTypeLinux, 4*1024*1024, false)
+	require.ErrorIs(t, err, ErrTooManyPartitions, "primary should not add after extended")
+
+	content := bytes.Repeat([]byte{0xAB}, 1000)
+
+	_, err = b.WriteContent(context.Background(), 5, ReaderContent(bytes.NewReader(content), -1), ContentOptions{})
+	require.NoError(t, err, "content should write")
+
+	_, err = b.WriteContent(context.Background(), 4, ReaderContent(bytes.NewReader(content), -1), ContentOptions{})
+	require.ErrorIs(t, err, ErrInvalidPartition, "extended partition should not take content")
+
+	require.NoError(t, b.Close(), "builder should close")
+	require.NoError(t, b.Disk.Close(), "disk should close")
+
+	d, err := disk.Open(path)
+	require.NoError(t, err, "disk should open")
+
+	defer d.Close()
+
+	mbr, err := d.ReadMBR()
+	require.NoError(t, err, "mbr should read")
+
+	assert.Equal(t, byte(disk.MBRAttrBootable), mbr.Part1.Attrs, "first partition should be bootable")
+	assert.Equal(t, uint32(2048), mbr.Part1.LBAStart, "first partition should be aligned")
+	assert.Equal(t, uint32(8192), mbr.Part1.LBASize, "first partition size should match")
+	assert.Equal(t, uint32(2048+3*8192), mbr.Part4.LBAStart, "extended partition should follow primaries")
+	assert.Equal(t, disk.MBRPartType(disk.MBRPartTypeExtendedLBA), mbr.Part4.Type, "extended type should match")
+
+	ext := mbr.Part4.LBAStart
+
+	ebr, err := d.ReadMBRAt(uint64(ext))
+	require.NoError(t, err, "first ebr should read")
+	assert.Equal(t, uint16(disk.MBRSignature), ebr.Signature, "ebr signature should match")
+	assert.Equal(t, disk.MBRPartType(disk.MBRPartTypeLinux), ebr.Part1.Type, "logical type should match")
+	assert.Equal(t, uint32(2048), ebr.Part1.LBAStart, "logical should be relative to ebr")
+	assert.Equal(t, uint32(8192), ebr.Part1.LBASize, "logical size should match")
+
+	data := make([]byte, len(content))
+
+	_, err = d.ReadAt(data, int64(ext+ebr.Part1.LBAStart)*disk.BlockSize)
+	require.NoError(t, err, "content should read")
+	assert.Equal(t, content, data, "content should match")
+
+	next := ext + ebr.Part2.LBAStart
+	assert.Equal(t, disk.MBRPartType(disk.MBRPartTypeExtended), ebr.Part2.Type, "link type should match")
+	assert.Equal(t, ext+2048+8192, next, "next ebr should follow logical")
+
+	ebr, err = d.ReadMBRAt(uint64(next))
+	require.NoError(t, err, "second ebr should read")
+	assert.Equal(t, disk.MBRPartType(disk.MBRPartTypeLinuxSwap), ebr.Part1.Type, "logical type should match")
+	assert.Equal(t, uint32(64*1024*1024/disk.BlockSize)-next-2048, ebr.Part1.LBASize, "logical should fill disk")
+	assert.Equal(t, disk.MBRPartition{}, ebr.Part2, "chain should end")
+}
+
+func TestMBRBuilderLimits(t *testing.T) {
+	_, err := NewMBR(filepath.Join(t.TempDir(), "disk.img"), 3*1024*1024*1024*1024)
+	require.ErrorIs(t, err, disk.ErrMBRLBAOverflow, "disk larger than 2TiB should fail")
+
+	_, err = disk.NewMBRPartitionLBA(disk.MBRPartTypeLinux, 1<<32, 1)
+	require.ErrorIs(t, err, disk.ErrMBRLBAOverflow, "start should be checked")
+}
@@ -0,0 +1,25 @@
+package diskbuilder
+
+// Progress receives updates during long-running operations. The total is -1 when the size of the operation is not
+// known in advance.
+type Progress interface {
+	Update(phase string, done int64, total int64)
+}
+
+type ProgressFunc func(phase string, done int64, total int64)
+
+func (f ProgressFunc) Update(phase string, done int64, total int64) {
+	f(phase, done, total)
+}
+
+func newReporter(progress Progress, phase string, total int64) func(done int64) {
+	if progress == nil {
+		return nil
+	}
+
+	progress.Update(phase, 0, total)
+
+	return func(done int64) {
+		progress.Update(phase, done, total)
+	}
+}
@@ -0,0 +1,257 @@
+package diskbuilder
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/csnewman/go-appliance/pkg/disk"
+)
+
+const streamChunkSize = 1024 * 1024
+
+var ErrContentOverlap = errors.New("partition contents overlap")
+
+// Stream builds a disk image which is written strictly sequentially to an io.Writer, so it can be piped into a
+// compressor or upload without requiring a seekable file.
+type Stream struct {
+	Layout
+
+	Size     int64
+	Progress Progress
+	contents map[int]Content
+}
+
+func NewStream(size int64) (*Stream, error) {
+	layout, err := NewLayout(size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stream{
+		Layout:   *layout,
+		Size:     size,
+		contents: make(map[int]Content),
+	}, nil
+}
+
+// SetContent sets the content to write into the partition at idx when the image is emitted.
+func (s *Stream) SetContent(idx int, content Content) error {
+	if _, err := s.partition(idx); err != nil {
+		return err
+	}
+
+	s.contents[idx] = content
+
+	return nil
+}
+
+// Emit writes the full image to w.
+func (s *Stream) Emit(ctx context.Context, w io.Writer) (int64, error) {
+	primaryParts, err := s.encodePartitions(s.Primary)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode primary parts: %w", err)
+	}
+
+	secondaryParts, err := s.encodePartitions(s.Secondary)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode secondary parts: %w", err)
+	}
+
+	order := make([]int, 0, len(s.contents))
+
+	for idx := range s.contents {
+		order = append(order, idx)
+	}
+
+	slices.SortFunc(order, func(a, b int) int {
+		return cmp.Compare(s.Parts[a].StartLBA, s.Parts[b].StartLBA)
+	})
+
+	out := &streamWriter{
+		ctx: ctx,
+		w:   w,
+	}
+
+	var mbr [disk.MBRSize]byte
+
+	s.MBR.FillBytes(mbr[:])
+
+	if err := out.write(mbr[:]); err != nil {
+		return out.pos, fmt.Errorf("failed to write mbr: %w", err)
+	}
+
+	if err := s.emitGPT(out, "primary", s.Primary, primaryParts); err != nil {
+		return out.pos, err
+	}
+
+	for _, idx := range order {
+		if err := s.emitContent(out, idx); err != nil {
+			return out.pos, err
+		}
+	}
+
+	if err := s.emitGPT(out, "secondary", s.Secondary, secondaryParts); err != nil {
+		return out.pos, err
+	}
+
+	if out.pos != s.Size {
+		return out.pos, fmt.Errorf("%w: emitted %v of %v bytes", io.ErrShortWrite, out.pos, s.Size)
+	}
+
+	return out.pos, nil
+}
+
+func (s *Stream) emitGPT(out *streamWriter, name string, gpt *disk.GPT, parts []byte) error {
+	report := newReporter(s.Progress, "writing "+name+" gpt", int64(len(parts))+disk.BlockSize)
+
+	header := make([]byte, disk.BlockSize)
+
+	gpt.FillBytes(header)
+
+	// The primary header precedes its partition entries, whilst the secondary header follows them.
+	chunks := [][]byte{header, parts}
+	headerPos := int64(gpt.ThisLBA) * disk.BlockSize
+
+	if gpt.PartitionsLBA < gpt.ThisLBA {
+		chunks = [][]byte{parts, header}
+		headerPos = int64(gpt.PartitionsLBA) * disk.BlockSize
+	}
+
+	if err := out.zeroTo(headerPos, nil); err != nil {
+		return fmt.Errorf("failed to write gap: %w", err)
+	}
+
+	var done int64
+
+	for _, chunk := range chunks {
+		if err := out.write(chunk); err != nil {
+			return fmt.Errorf("failed to write %v gpt: %w", name, err)
+		}
+
+		done += int64(len(chunk))
+
+		if report != nil {
+			report(done)
+		}
+	}
+
+	return nil
+}
+
+func (s *Stream) emitContent(out *streamWriter, idx int) error {
+	part := s.Parts[idx]
+	start := int64(part.StartLBA) * disk.BlockSize
+	capacity := int64(part.EndLBA-part.StartLBA+1) * disk.BlockSize
+
+	if start < out.pos {
+		return fmt.Errorf("%w: partition %v", ErrContentOverlap, idx+1)
+	}
+
+	if err := out.zeroTo(start, nil); err != nil {
+		return fmt.Errorf("failed to write gap: %w", err)
+	}
+
+	reader, size, err := s.contents[idx].Open()
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	if size > capacity {
+		return fmt.Errorf("%w: partition %v: %v > %v bytes", ErrContentTooLarge, idx+1, size, capacity)
+	}
+
+	limit := capacity
+	if size >= 0 {
+		limit = size
+	}
+
+	report := newReporter(s.Progress, fmt.Sprintf("writing partition %v", idx+1), size)
+
+	written, err := disk.Copy(out.ctx, out, reader, limit, size >= 0, report)
+	if err != nil {
+		return fmt.Errorf("failed to write partition %v: %w", idx+1, err)
+	}
+
+	if size < 0 && written == capacity {
+		var extra [1]byte
+
+		if n, _ := io.ReadFull(reader, extra[:]); n > 0 {
+			return fmt.Errorf("%w: partition %v: more than %v bytes", ErrContentTooLarge, idx+1, capacity)
+		}
+	}
+
+	return nil
+}
+
+type streamWriter struct {
+	ctx context.Context //nolint:containedctx
+	w   io.Writer
+	pos int64
+}
+
+func (s *streamWriter) write(data []byte) error {
+	n, err := s.w.Write(data)
+	s.pos += int64(n)
+
+	if err != nil {
+		return err
+	}
+
+	if n != len(data) {
+		return io.ErrShortWrite
+	}
+
+	return nil
+}
+
+func (s *streamWriter) Write(data []byte) (int, error) {
+	if err := s.write(data); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (s *streamWriter) zeroTo(target int64, report func(done int64)) error {
+	if target <= s.pos {
+		return nil
+	}
+
+	zeros := make([]byte, min(target-s.pos, streamChunkSize))
+	start := s.pos
+
+	for s.pos < target {
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := s.write(zeros[:min(target-s.pos, int64(len(zeros)))]); err != nil {
+			return err
+		}
+
+		if report != nil {
+			report(s.pos - start)
+		}
+	}
+
+	return nil
+}
+
+// Shrink reduces the disk to the minimum size which holds all partitions.
+func (s *Stream) Shrink(alignment int64) (int64, error) {
+	size := s.MinimumSize(alignment)
+
+	if err := s.Resize(size); err != nil {
+		return 0, err
+	}
+
+	s.Size = size
+
+	return size, nil
+}
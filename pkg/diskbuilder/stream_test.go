@@ -0,0 +1,106 @@
+package diskbuilder
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/csnewman/go-appliance/pkg/disk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamMatchesBuilder(t *testing.T) {
+	const size = 8 * 1024 * 1024
+
+	s, err := NewStream(size)
+	require.NoError(t, err, "stream should create")
+
+	first := bytes.Repeat([]byte("first"), 1000)
+	second := bytes.Repeat([]byte("second"), 1000)
+
+	for i, data := range [][]byte{first, second} {
+		start, end, err := s.Allocate(2*1024*1024, DefaultAlignment)
+		require.NoError(t, err, "partition should allocate")
+
+		part, err := disk.NewGPTPartition(disk.GPTTypeLinuxFileSystem, start, end, "")
+		require.NoError(t, err, "partition should create")
+
+		s.Add(part)
+
+		require.NoError(t, s.SetContent(i, ReaderContent(bytes.NewReader(data), int64(len(data)))))
+	}
+
+	s.AddMBR(disk.NewMBRPartition(disk.MBRPartTypeGPTProtective, 1, size/disk.BlockSize-1))
+
+	var out bytes.Buffer
+
+	written, err := s.Emit(context.Background(), &out)
+	require.NoError(t, err, "stream should emit")
+	assert.Equal(t, int64(size), written, "written should match")
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+
+	b, err := New(path, size)
+	require.NoError(t, err, "builder should create")
+
+	b.Layout = s.Layout
+
+	for i, data := range [][]byte{first, second} {
+		_, err := b.WriteContent(context.Background(), i, ReaderContent(bytes.NewReader(data), -1), ContentOptions{})
+		require.NoError(t, err, "content should write")
+	}
+
+	require.NoError(t, b.Close(), "builder should close")
+	require.NoError(t, b.Disk.Close(), "disk should close")
+
+	expected, err := os.ReadFile(path)
+	require.NoError(t, err, "image should read")
+
+	assert.True(t, bytes.Equal(expected, out.Bytes()), "streamed image should match built image")
+}
+
+func TestStreamContentTooLarge(t *testing.T) {
+	s, err := NewStream(8 * 1024 * 1024)
+	require.NoError(t, err, "stream should create")
+
+	start, end, err := s.Allocate(1024*1024, DefaultAlignment)
+	require.NoError(t, err, "partition should allocate")
+
+	part, err := disk.NewGPTPartition(disk.GPTTypeLinuxFileSystem, start, end, "")
+	require.NoError(t, err, "partition should create")
+
+	s.Add(part)
+
+	data := make([]byte, 1024*1024+1)
+
+	require.NoError(t, s.SetContent(0, ReaderContent(unsizedReader{bytes.NewReader(data)}, -1)))
+
+	var out bytes.Buffer
+
+	_, err = s.Emit(context.Background(), &out)
+	require.ErrorIs(t, err, ErrContentTooLarge, "content should not fit")
+}
+
+func TestStreamContentTruncated(t *testing.T) {
+	s, err := NewStream(8 * 1024 * 1024)
+	require.NoError(t, err, "stream should create")
+
+	start, end, err := s.Allocate(1024*1024, DefaultAlignment)
+	require.NoError(t, err, "partition should allocate")
+
+	part, err := disk.NewGPTPartition(disk.GPTTypeLinuxFileSystem, start, end, "")
+	require.NoError(t, err, "partition should create")
+
+	s.Add(part)
+
+	require.NoError(t, s.SetContent(0, ReaderContent(bytes.NewReader(make([]byte, 4096)), 8192)))
+
+	var out bytes.Buffer
+
+	_, err = s.Emit(context.Background(), &out)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF, "short content should fail")
+}
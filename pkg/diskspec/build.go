@@ -0,0 +1,361 @@
+package diskspec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/disk"
+	"github.com/csnewman/go-appliance/pkg/diskbuilder"
+	"github.com/csnewman/go-appliance/pkg/erofs"
+	"github.com/csnewman/go-appliance/pkg/ext4"
+	"github.com/csnewman/go-appliance/pkg/fstree"
+	"github.com/csnewman/go-appliance/pkg/oci"
+	"github.com/csnewman/go-appliance/pkg/squashfs"
+	"github.com/google/uuid"
+)
+
+// Build creates the image described by the spec at path.
+func (s *Spec) Build(ctx context.Context, path string, progress diskbuilder.Progress) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+
+	if s.Table == TableMBR {
+		return s.buildMBR(ctx, path, progress)
+	}
+
+	b, err := diskbuilder.New(path, int64(s.Size))
+	if err != nil {
+		return fmt.Errorf("failed to create disk: %w", err)
+	}
+
+	b.Progress = progress
+
+	if err := s.populate(ctx, b); err != nil {
+		_ = b.Disk.Close()
+
+		return err
+	}
+
+	if err := b.CloseContext(ctx); err != nil {
+		_ = b.Disk.Close()
+
+		return err
+	}
+
+	return b.Disk.Close()
+}
+
+func (s *Spec) populate(ctx context.Context, b *diskbuilder.Builder) error {
+	if s.GUID != "" {
+		b.Primary.GUID = uuid.MustParse(s.GUID)
+		b.Secondary.GUID = b.Primary.GUID
+	}
+
+	blocks := uint64(s.Size / disk.BlockSize)
+
+	b.AddMBR(disk.NewMBRPartition(disk.MBRPartTypeGPTProtective, 1, uint32(min(blocks-1, 0xFFFFFFFF))))
+
+	alignment := int64(s.Alignment)
+	if alignment == 0 {
+		alignment = diskbuilder.DefaultAlignment
+	}
+
+	for i, part := range s.Partitions {
+		field := fmt.Sprintf("partitions[%v]", i)
+
+		start, end, err := b.Allocate(int64(part.Size), alignment)
+		if err != nil {
+			return &FieldError{Field: field + ".size", Err: err}
+		}
+
+		ty, _ := PartitionType(part.Type)
+		attrs, _ := PartitionAttributes(part.Attributes)
+
+		gpt, err := disk.NewGPTPartition(ty, start, end, part.Name)
+		if err != nil {
+			return fmt.Errorf("failed to create partition: %w", err)
+		}
+
+		gpt.Attributes = attrs
+
+		if part.GUID != "" {
+			gpt.ID = uuid.MustParse(part.GUID)
+		}
+
+		b.Add(gpt)
+	}
+
+	for i, part := range s.Partitions {
+		if part.Content == nil {
+			continue
+		}
+
+		if err := s.writeContent(ctx, b, i, part.Content); err != nil {
+			return &FieldError{Field: fmt.Sprintf("partitions[%v].content.%v", i, part.Content.source()), Err: err}
+		}
+	}
+
+	if s.Shrink {
+		if _, err := b.Shrink(alignment); err != nil {
+			return fmt.Errorf("failed to shrink disk: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Spec) writeContent(ctx context.Context, b *diskbuilder.Builder, idx int, content *Content) error {
+	if content.formats() {
+		dst, size, err := b.PartitionWriter(idx)
+		if err != nil {
+			return err
+		}
+
+		return s.writeFilesystem(ctx, dst, size, content)
+	}
+
+	_, err := b.WriteContent(ctx, idx, s.content(content), content.options())
+
+	return err
+}
+
+func (s *Spec) path(name string) string {
+	if !filepath.IsAbs(name) && s.BaseDir != "" {
+		return filepath.Join(s.BaseDir, name)
+	}
+
+	return name
+}
+
+func (s *Spec) content(content *Content) diskbuilder.Content {
+	return diskbuilder.FileContent(s.path(content.File))
+}
+
+// source returns the name of the field holding the content source.
+func (c *Content) source() string {
+	switch {
+	case c.Image != "":
+		return "image"
+	case c.Tar != "":
+		return "tar"
+	default:
+		return "file"
+	}
+}
+
+// formats reports whether the content populates a new filesystem, rather than being copied as is.
+func (c *Content) formats() bool {
+	return c.Tar != "" || c.Image != ""
+}
+
+type filesystemWriter interface {
+	fstree.Builder
+	Close() error
+}
+
+// writeFilesystem creates a filesystem spanning the partition, populated from tar or image content.
+func (s *Spec) writeFilesystem(ctx context.Context, dst io.WriterAt, size int64, content *Content) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	tree, err := s.tree(content)
+	if err != nil {
+		return err
+	}
+
+	defer tree.Close()
+
+	var (
+		w  filesystemWriter
+		id uuid.UUID
+		t  time.Time
+	)
+
+	if content.UUID != "" {
+		id = uuid.MustParse(content.UUID)
+	}
+
+	if content.Time != "" {
+		t, _ = time.Parse(time.RFC3339, content.Time)
+	}
+
+	switch content.Filesystem {
+	case FilesystemExt4:
+		w, err = ext4.NewWriter(dst, size, ext4.Options{Label: content.Label, UUID: id, Time: t})
+	case FilesystemEROFS:
+		w, err = erofs.NewWriter(dst, size, erofs.Options{Label: content.Label, UUID: id, Time: t})
+	case FilesystemSquashFS:
+		w, err = squashfs.NewWriter(dst, size, squashfs.Options{Time: t})
+	default:
+		err = fmt.Errorf("%w: unknown filesystem %q", ErrInvalidValue, content.Filesystem)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := tree.CopyTo(w); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+// tree reads the files of tar or image content.
+func (s *Spec) tree(content *Content) (*fstree.Tree, error) {
+	if content.Image != "" {
+		return s.imageTree(content)
+	}
+
+	f, err := os.Open(s.path(content.Tar))
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return fstree.OpenTar(f, fstree.Options{})
+}
+
+// imageTree flattens the selected image of an OCI image layout directory or docker save archive.
+func (s *Spec) imageTree(content *Content) (*fstree.Tree, error) {
+	opts := oci.ImageOptions{Ref: content.Ref}
+
+	if content.Platform != "" {
+		platform, err := oci.ParsePlatform(content.Platform)
+		if err != nil {
+			return nil, err
+		}
+
+		opts.Platform = platform
+	}
+
+	path := s.path(content.Image)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		layout, err := oci.OpenLayoutDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		img, err := layout.Image(opts)
+		if err != nil {
+			return nil, err
+		}
+
+		return img.Flatten(fstree.Options{})
+	}
+
+	archive, err := oci.OpenArchiveFile(path, fstree.Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	defer archive.Close()
+
+	img, err := archive.Image(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return img.Flatten(fstree.Options{})
+}
+
+func (c *Content) options() diskbuilder.ContentOptions {
+	return diskbuilder.ContentOptions{
+		ZeroRemainder: c.Zero,
+		Shrink:        c.Shrink,
+	}
+}
+
+func (s *Spec) buildMBR(ctx context.Context, path string, progress diskbuilder.Progress) error {
+	b, err := diskbuilder.NewMBR(path, int64(s.Size))
+	if err != nil {
+		return fmt.Errorf("failed to create disk: %w", err)
+	}
+
+	b.Progress = progress
+
+	if err := s.populateMBR(ctx, b); err != nil {
+		_ = b.Disk.Close()
+
+		return err
+	}
+
+	if err := b.CloseContext(ctx); err != nil {
+		_ = b.Disk.Close()
+
+		return err
+	}
+
+	return b.Disk.Close()
+}
+
+func (s *Spec) populateMBR(ctx context.Context, b *diskbuilder.MBRBuilder) error {
+	if s.Alignment != 0 {
+		b.Alignment = int64(s.Alignment)
+	}
+
+	// Logical partitions are only used when the layout does not fit into the four primary slots.
+	primaries := len(s.Partitions)
+	if primaries > 4 {
+		primaries = 3
+	}
+
+	nums := make([]int, len(s.Partitions))
+
+	for i, part := range s.Partitions {
+		ty, _ := MBRPartitionType(part.Type)
+
+		var err error
+
+		if i < primaries {
+			nums[i], err = b.AddPrimary(ty, int64(part.Size), slices.Contains(part.Attributes, AttrBootable))
+		} else {
+			nums[i], err = b.AddLogical(ty, int64(part.Size))
+		}
+
+		if err != nil {
+			return &FieldError{Field: fmt.Sprintf("partitions[%v].size", i), Err: err}
+		}
+	}
+
+	for i, part := range s.Partitions {
+		if part.Content == nil {
+			continue
+		}
+
+		if err := s.writeContentMBR(ctx, b, nums[i], part.Content); err != nil {
+			return &FieldError{Field: fmt.Sprintf("partitions[%v].content.%v", i, part.Content.source()), Err: err}
+		}
+	}
+
+	return nil
+}
+
+func (s *Spec) writeContentMBR(ctx context.Context, b *diskbuilder.MBRBuilder, num int, content *Content) error {
+	if content.formats() {
+		dst, size, err := b.PartitionWriter(num)
+		if err != nil {
+			return err
+		}
+
+		return s.writeFilesystem(ctx, dst, size, content)
+	}
+
+	_, err := b.WriteContent(ctx, num, s.content(content), content.options())
+
+	return err
+}
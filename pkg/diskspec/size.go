@@ -0,0 +1,102 @@
+package diskspec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidSize = errors.New("invalid size")
+
+// Size is a byte count which may be written as a plain integer or with a binary (KiB, MiB, GiB, TiB) or decimal (KB,
+// MB, GB, TB) unit suffix.
+type Size int64
+
+var sizeUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"TB", 1000 * 1000 * 1000 * 1000},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"T", 1 << 40},
+	{"B", 1},
+}
+
+func ParseSize(s string) (Size, error) {
+	s = strings.TrimSpace(s)
+	scale := int64(1)
+
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			scale = unit.scale
+
+			break
+		}
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidSize, s)
+	}
+
+	if v > 0 && scale > (1<<63-1)/v {
+		return 0, fmt.Errorf("%w: %q overflows", ErrInvalidSize, s)
+	}
+
+	return Size(v * scale), nil
+}
+
+func (s Size) String() string {
+	for i := 3; i >= 0 && s != 0; i-- {
+		unit := sizeUnits[i]
+
+		if int64(s)%unit.scale == 0 {
+			return strconv.FormatInt(int64(s)/unit.scale, 10) + unit.suffix
+		}
+	}
+
+	return strconv.FormatInt(int64(s), 10)
+}
+
+func (s Size) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Size) UnmarshalText(data []byte) error {
+	v, err := ParseSize(string(data))
+	if err != nil {
+		return err
+	}
+
+	*s = v
+
+	return nil
+}
+
+func (s *Size) UnmarshalJSON(data []byte) error {
+	var num json.Number
+
+	if err := json.Unmarshal(data, &num); err == nil {
+		return s.UnmarshalText([]byte(num))
+	}
+
+	var str string
+
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSize, data)
+	}
+
+	return s.UnmarshalText([]byte(str))
+}
@@ -0,0 +1,134 @@
+package diskspec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	TableGPT = "gpt"
+	TableMBR = "mbr"
+)
+
+// AttrBootable marks an MBR partition as active.
+const AttrBootable = "bootable"
+
+type Spec struct {
+	Size       Size        `json:"size"                yaml:"size"`
+	Table      string      `json:"table,omitempty"     yaml:"table,omitempty"`
+	GUID       string      `json:"guid,omitempty"      yaml:"guid,omitempty"`
+	Alignment  Size        `json:"alignment,omitempty" yaml:"alignment,omitempty"`
+	Shrink     bool        `json:"shrink,omitempty"    yaml:"shrink,omitempty"`
+	Partitions []Partition `json:"partitions"          yaml:"partitions"`
+
+	// BaseDir is used to resolve relative content paths. It is set by LoadFile.
+	BaseDir string `json:"-" yaml:"-"`
+}
+
+type Partition struct {
+	Name       string   `json:"name,omitempty"       yaml:"name,omitempty"`
+	Type       string   `json:"type"                 yaml:"type"`
+	Size       Size     `json:"size,omitempty"       yaml:"size,omitempty"`
+	GUID       string   `json:"guid,omitempty"       yaml:"guid,omitempty"`
+	Attributes []string `json:"attributes,omitempty" yaml:"attributes,omitempty"`
+	Content    *Content `json:"content,omitempty"    yaml:"content,omitempty"`
+}
+
+// Filesystems which can be created from tar and image content.
+const (
+	FilesystemExt4     = "ext4"
+	FilesystemEROFS    = "erofs"
+	FilesystemSquashFS = "squashfs"
+)
+
+type Content struct {
+	// File is an image copied into the partition as is.
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+	// Tar is an archive, optionally gzip compressed, used to populate a new filesystem of the given type. Ownership,
+	// permissions, extended attributes, hard links and device nodes are taken from the archive.
+	Tar string `json:"tar,omitempty" yaml:"tar,omitempty"`
+	// Image is a container image, either an OCI image layout directory or a docker save archive, whose flattened
+	// layers populate a new filesystem of the given type. Ref and Platform select the image, such as "app:latest"
+	// and "linux/arm64".
+	Image      string `json:"image,omitempty"      yaml:"image,omitempty"`
+	Ref        string `json:"ref,omitempty"        yaml:"ref,omitempty"`
+	Platform   string `json:"platform,omitempty"   yaml:"platform,omitempty"`
+	Filesystem string `json:"filesystem,omitempty" yaml:"filesystem,omitempty"`
+	Label      string `json:"label,omitempty"      yaml:"label,omitempty"`
+	// UUID identifies an ext4 or erofs filesystem. Time is an RFC 3339 timestamp used for the filesystem and for
+	// files without a modification time, defaulting to the Unix epoch.
+	UUID   string `json:"uuid,omitempty"   yaml:"uuid,omitempty"`
+	Time   string `json:"time,omitempty"   yaml:"time,omitempty"`
+	Zero   bool   `json:"zero,omitempty"   yaml:"zero,omitempty"`
+	Shrink bool   `json:"shrink,omitempty" yaml:"shrink,omitempty"`
+}
+
+var ErrUnknownFormat = errors.New("unknown spec format")
+
+func ParseJSON(r io.Reader) (*Spec, error) {
+	var spec Spec
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("failed to decode json spec: %w", err)
+	}
+
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &spec, nil
+}
+
+func ParseYAML(r io.Reader) (*Spec, error) {
+	var spec Spec
+
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+
+	if err := dec.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("failed to decode yaml spec: %w", err)
+	}
+
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &spec, nil
+}
+
+func LoadFile(path string) (*Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spec: %w", err)
+	}
+
+	var spec *Spec
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		spec, err = ParseJSON(bytes.NewReader(data))
+	case ".yaml", ".yml":
+		spec, err = ParseYAML(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnknownFormat, path)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	spec.BaseDir = filepath.Dir(path)
+
+	return spec, nil
+}
@@ -0,0 +1,553 @@
+package diskspec
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/csnewman/go-appliance/pkg/disk"
+	"github.com/csnewman/go-appliance/pkg/ext4"
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/csnewman/go-appliance/pkg/oci"
+	"github.com/csnewman/go-appliance/pkg/squashfs"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testYAML = `
+size: 16MiB
+guid: 5f0c5b8e-8c9a-4d4e-9d59-6b8f8a0d3c11
+partitions:
+  - name: ESP
+    type: esp
+    size: 4MiB
+    attributes: [required]
+    content:
+      file: esp.img
+  - name: root
+    type: linux-root-x86-64
+    guid: 0e2b4f2c-2f0e-4a59-9d6e-3b0b8b3d6f1a
+    attributes: [growfs, "48"]
+`
+
+func TestParseSize(t *testing.T) {
+	for in, expected := range map[string]Size{
+		"512":    512,
+		"4KiB":   4096,
+		"1 MiB":  1024 * 1024,
+		"2G":     2 << 30,
+		"1MB":    1000 * 1000,
+		"100 B":  100,
+		"10TiB":  10 << 40,
+		"  64K ": 64 * 1024,
+	} {
+		size, err := ParseSize(in)
+		require.NoError(t, err, "size %q should parse", in)
+		assert.Equal(t, expected, size, "size %q should match", in)
+	}
+
+	_, err := ParseSize("12XB")
+	require.ErrorIs(t, err, ErrInvalidSize, "unknown unit should fail")
+
+	assert.Equal(t, "16MiB", Size(16<<20).String(), "size should format")
+	assert.Equal(t, "1536KiB", Size(1536<<10).String(), "size should format")
+}
+
+func TestParseYAML(t *testing.T) {
+	spec, err := ParseYAML(strings.NewReader(testYAML))
+	require.NoError(t, err, "spec should parse")
+
+	assert.Equal(t, Size(16<<20), spec.Size, "size should match")
+	assert.Len(t, spec.Partitions, 2, "partitions should match")
+	assert.Equal(t, Size(4<<20), spec.Partitions[0].Size, "partition size should match")
+	assert.Equal(t, "esp.img", spec.Partitions[0].Content.File, "content should match")
+}
+
+func TestParseJSON(t *testing.T) {
+	spec, err := ParseJSON(strings.NewReader(`{
+		"size": 16777216,
+		"partitions": [{"type": "linux", "size": "8MiB"}]
+	}`))
+	require.NoError(t, err, "spec should parse")
+
+	assert.Equal(t, Size(16<<20), spec.Size, "size should match")
+	assert.Equal(t, Size(8<<20), spec.Partitions[0].Size, "partition size should match")
+
+	_, err = ParseJSON(strings.NewReader(`{"size": 1024, "bogus": true}`))
+	require.Error(t, err, "unknown fields should fail")
+}
+
+func TestValidate(t *testing.T) {
+	spec := &Spec{
+		Size: 1000,
+		Partitions: []Partition{
+			{Type: "linux"},
+			{Type: "nope", Size: 4096, Attributes: []string{"64"}},
+		},
+	}
+
+	err := spec.Validate()
+	require.Error(t, err, "spec should be invalid")
+
+	for _, field := range []string{
+		"size:",
+		"partitions[0].size:",
+		"partitions[1].type:",
+		"partitions[1].attributes:",
+	} {
+		assert.Contains(t, err.Error(), field, "error should mention field")
+	}
+
+	var fieldErr *FieldError
+
+	require.ErrorAs(t, err, &fieldErr, "error should be a field error")
+
+	// Names are limited in UTF-16 code units, so characters outside the BMP count twice.
+	spec = &Spec{
+		Size:       1 << 20,
+		Partitions: []Partition{{Type: "linux", Name: strings.Repeat("a", 35) + "😀"}},
+	}
+
+	err = spec.Validate()
+	require.Error(t, err, "long name should be invalid")
+	assert.Contains(t, err.Error(), "partitions[0].name:", "error should mention field")
+}
+
+func TestBuild(t *testing.T) {
+	dir := t.TempDir()
+
+	content := []byte("hello partition")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "esp.img"), content, 0o600), "content should write")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "disk.yaml"), []byte(testYAML), 0o600), "spec should write")
+
+	spec, err := LoadFile(filepath.Join(dir, "disk.yaml"))
+	require.NoError(t, err, "spec should load")
+
+	path := filepath.Join(dir, "disk.img")
+
+	require.NoError(t, spec.Build(context.Background(), path, nil), "spec should build")
+
+	d, err := disk.Open(path)
+	require.NoError(t, err, "disk should open")
+
+	defer d.Close()
+
+	mbr, err := d.ReadMBR()
+	require.NoError(t, err, "mbr should read")
+	assert.Equal(t, disk.MBRPartType(disk.MBRPartTypeGPTProtective), mbr.Part1.Type, "mbr should be protective")
+
+	gpt, err := d.ReadGPT(1)
+	require.NoError(t, err, "gpt should read")
+	assert.Equal(t, uuid.MustParse("5f0c5b8e-8c9a-4d4e-9d59-6b8f8a0d3c11"), gpt.GUID, "disk guid should match")
+
+	parts, _, err := d.ReadGPTPartitions(gpt.PartitionsLBA*disk.BlockSize, gpt.EntrySize, gpt.PartitionCount)
+	require.NoError(t, err, "parts should read")
+
+	assert.Equal(t, disk.GPTTypeEFISystem, parts[0].Type, "esp type should match")
+	assert.Equal(t, uint64(2048), parts[0].StartLBA, "esp should be aligned")
+	assert.Equal(t, uint64(2048+8192-1), parts[0].EndLBA, "esp size should match")
+	assert.Equal(t, uint64(disk.GPTAttrRequired), parts[0].Attributes, "esp attributes should match")
+
+	assert.Equal(t, disk.GPTTypeLinuxRootX86_64, parts[1].Type, "root type should match")
+	assert.Equal(t, uint64(2048+8192), parts[1].StartLBA, "root should follow esp")
+	assert.Equal(t, gpt.DataLast, parts[1].EndLBA, "root should fill disk")
+	assert.Equal(t, uint64(disk.GPTAttrGrowFS|1<<48), parts[1].Attributes, "root attributes should match")
+	assert.Equal(t, uuid.MustParse("0e2b4f2c-2f0e-4a59-9d6e-3b0b8b3d6f1a"), parts[1].ID, "root guid should match")
+
+	data := make([]byte, len(content))
+
+	f, err := os.Open(path)
+	require.NoError(t, err, "image should open")
+
+	defer f.Close()
+
+	_, err = f.ReadAt(data, 2048*disk.BlockSize)
+	require.NoError(t, err, "content should read")
+	assert.Equal(t, content, data, "content should match")
+}
+
+func TestBuildTooLarge(t *testing.T) {
+	spec := &Spec{
+		Size: 4 << 20,
+		Partitions: []Partition{
+			{Type: "linux", Size: 8 << 20},
+		},
+	}
+
+	err := spec.Build(context.Background(), filepath.Join(t.TempDir(), "disk.img"), nil)
+	require.Error(t, err, "build should fail")
+	assert.Contains(t, err.Error(), "partitions[0].size", "error should mention field")
+}
+
+func TestBuildMBR(t *testing.T) {
+	spec, err := ParseYAML(strings.NewReader(`
+size: 32MiB
+table: mbr
+partitions:
+  - type: fat32
+    size: 4MiB
+    attributes: [bootable]
+  - type: linux
+    size: 4MiB
+  - type: "0x83"
+    size: 4MiB
+  - type: linux
+    size: 4MiB
+  - type: linux-swap
+`))
+	require.NoError(t, err, "spec should parse")
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+
+	require.NoError(t, spec.Build(context.Background(), path, nil), "spec should build")
+
+	d, err := disk.Open(path)
+	require.NoError(t, err, "disk should open")
+
+	defer d.Close()
+
+	mbr, err := d.ReadMBR()
+	require.NoError(t, err, "mbr should read")
+
+	assert.Equal(t, disk.MBRPartType(disk.MBRPartTypeFAT32LBA), mbr.Part1.Type, "first type should match")
+	assert.Equal(t, byte(disk.MBRAttrBootable), mbr.Part1.Attrs, "first partition should be bootable")
+	assert.Equal(t, disk.MBRPartType(disk.MBRPartTypeExtendedLBA), mbr.Part4.Type, "extended should be used")
+
+	ebr, err := d.ReadMBRAt(uint64(mbr.Part4.LBAStart))
+	require.NoError(t, err, "ebr should read")
+	assert.Equal(t, disk.MBRPartType(disk.MBRPartTypeLinux), ebr.Part1.Type, "logical type should match")
+
+	_, err = ParseYAML(strings.NewReader(`
+size: 32MiB
+table: mbr
+partitions:
+  - type: linux
+    name: root
+`))
+	require.Error(t, err, "names should be rejected")
+	assert.Contains(t, err.Error(), "partitions[0].name", "error should mention field")
+}
+
+// writeRootTar creates a gzip compressed tar as produced by container tooling, with metadata that cannot be
+// created on the host without root.
+func writeRootTar(t *testing.T, path string) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	require.NoError(t, err, "tar should create")
+
+	defer f.Close()
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755},
+		{Typeflag: tar.TypeReg, Name: "etc/shadow", Mode: 0o640, Gid: 42, Size: 5, PAXRecords: map[string]string{
+			"SCHILY.xattr.security.selinux": "system_u:object_r:shadow_t:s0",
+		}},
+		{Typeflag: tar.TypeLink, Name: "etc/gshadow", Linkname: "etc/shadow"},
+		{Typeflag: tar.TypeDir, Name: "dev/", Mode: 0o755},
+		{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3},
+		{Typeflag: tar.TypeDir, Name: "home/user/", Mode: 0o700, Uid: 1000, Gid: 1000},
+		{Typeflag: tar.TypeSymlink, Name: "home/user/link", Linkname: "/etc/shadow"},
+	} {
+		require.NoError(t, tw.WriteHeader(hdr), "header should write")
+
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte("root\n"))
+			require.NoError(t, err, "data should write")
+		}
+	}
+
+	require.NoError(t, tw.Close(), "tar should close")
+	require.NoError(t, gw.Close(), "gzip should close")
+}
+
+func TestBuildTar(t *testing.T) {
+	dir := t.TempDir()
+
+	writeRootTar(t, filepath.Join(dir, "rootfs.tar.gz"))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "disk.yaml"), []byte(`
+size: 32MiB
+partitions:
+  - type: linux-root-x86-64
+    size: 16MiB
+    content:
+      tar: rootfs.tar.gz
+      filesystem: ext4
+      label: root
+  - type: linux
+    content:
+      tar: rootfs.tar.gz
+      filesystem: squashfs
+`), 0o600), "spec should write")
+
+	spec, err := LoadFile(filepath.Join(dir, "disk.yaml"))
+	require.NoError(t, err, "spec should load")
+
+	path := filepath.Join(dir, "disk.img")
+
+	require.NoError(t, spec.Build(context.Background(), path, nil), "spec should build")
+
+	d, err := disk.Open(path)
+	require.NoError(t, err, "disk should open")
+
+	defer d.Close()
+
+	gpt, err := d.ReadGPT(1)
+	require.NoError(t, err, "gpt should read")
+
+	parts, _, err := d.ReadGPTPartitions(gpt.PartitionsLBA*disk.BlockSize, gpt.EntrySize, gpt.PartitionCount)
+	require.NoError(t, err, "parts should read")
+
+	root, err := ext4.Open(d.PartitionSection(parts[0]))
+	require.NoError(t, err, "ext4 should open")
+
+	sqfs, err := squashfs.Open(d.PartitionSection(parts[1]))
+	require.NoError(t, err, "squashfs should open")
+
+	for name, fsys := range map[string]interface {
+		fs.StatFS
+		Lstat(name string) (fs.FileInfo, error)
+	}{"ext4": root, "squashfs": sqfs} {
+		data, err := fs.ReadFile(fsys, "home/user/link")
+		require.NoError(t, err, "%v file should read through the symlink", name)
+		assert.Equal(t, "root\n", string(data), "%v data should match", name)
+
+		shadow, err := fsys.Stat("etc/shadow")
+		require.NoError(t, err, "%v file should stat", name)
+
+		attr := shadow.Sys().(*fsmeta.Attr)
+		assert.Equal(t, fs.FileMode(0o640), shadow.Mode(), "%v mode should be kept", name)
+		assert.Equal(t, uint32(42), attr.GID, "%v gid should be kept", name)
+		assert.Equal(t, "system_u:object_r:shadow_t:s0", string(attr.Xattrs["security.selinux"]),
+			"%v xattr should be kept", name)
+
+		gshadow, err := fsys.Stat("etc/gshadow")
+		require.NoError(t, err, "%v hard link should stat", name)
+		assert.Equal(t, attr.Inode, gshadow.Sys().(*fsmeta.Attr).Inode, "%v hard link should be kept", name)
+
+		null, err := fsys.Lstat("dev/null")
+		require.NoError(t, err, "%v device should stat", name)
+		assert.Equal(t, fs.ModeDevice|fs.ModeCharDevice|0o666, null.Mode(), "%v device should be kept", name)
+		assert.Equal(t, uint32(3), null.Sys().(*fsmeta.Attr).Minor, "%v device numbers should be kept", name)
+
+		home, err := fsys.Stat("home/user")
+		require.NoError(t, err, "%v directory should stat", name)
+		assert.Equal(t, uint32(1000), home.Sys().(*fsmeta.Attr).UID, "%v ownership should be kept", name)
+	}
+}
+
+func TestBuildTarReproducible(t *testing.T) {
+	dir := t.TempDir()
+
+	writeRootTar(t, filepath.Join(dir, "rootfs.tar.gz"))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "disk.yaml"), []byte(`
+size: 32MiB
+partitions:
+  - type: linux
+    size: 16MiB
+    content:
+      tar: rootfs.tar.gz
+      filesystem: ext4
+      uuid: 0b9c5b0e-6c1d-4e6b-9d0f-3f0e8c1a2b3c
+      time: 2024-05-01T12:00:00Z
+  - type: linux
+    content:
+      tar: rootfs.tar.gz
+      filesystem: erofs
+`), 0o600), "spec should write")
+
+	spec, err := LoadFile(filepath.Join(dir, "disk.yaml"))
+	require.NoError(t, err, "spec should load")
+
+	var images [][][]byte
+
+	for i := range 2 {
+		path := filepath.Join(dir, fmt.Sprintf("disk%v.img", i))
+
+		require.NoError(t, spec.Build(context.Background(), path, nil), "spec should build")
+
+		d, err := disk.Open(path)
+		require.NoError(t, err, "disk should open")
+
+		gpt, err := d.ReadGPT(1)
+		require.NoError(t, err, "gpt should read")
+
+		parts, _, err := d.ReadGPTPartitions(gpt.PartitionsLBA*disk.BlockSize, gpt.EntrySize, gpt.PartitionCount)
+		require.NoError(t, err, "parts should read")
+
+		var contents [][]byte
+
+		for _, part := range parts[:2] {
+			data, err := io.ReadAll(d.PartitionSection(part))
+			require.NoError(t, err, "partition should read")
+
+			contents = append(contents, data)
+		}
+
+		require.NoError(t, d.Close(), "disk should close")
+
+		images = append(images, contents)
+	}
+
+	assert.Equal(t, images[0], images[1], "filesystems should be reproducible")
+
+	id := uuid.MustParse("0b9c5b0e-6c1d-4e6b-9d0f-3f0e8c1a2b3c")
+	assert.Equal(t, id[:], images[0][0][ext4.SuperblockOffset+104:ext4.SuperblockOffset+120], "uuid should be set")
+}
+
+func TestValidateTar(t *testing.T) {
+	spec := &Spec{
+		Size: 4 << 20,
+		Partitions: []Partition{
+			{Type: "linux", Size: 1 << 20, Content: &Content{Tar: "a.tar"}},
+			{Type: "linux", Size: 1 << 20, Content: &Content{Tar: "a.tar", File: "a.img", Filesystem: "ext4"}},
+			{Type: "linux", Size: 1 << 20, Content: &Content{Tar: "a.tar", Filesystem: "btrfs", Shrink: true}},
+			{Type: "linux", Size: 1 << 20, Content: &Content{File: "a.img", Filesystem: "ext4", Ref: "latest"}},
+			{Type: "linux", Content: &Content{Image: "app.tar", Filesystem: "erofs", Platform: "linux"}},
+			{Type: "linux", Content: &Content{Tar: "a.tar", Filesystem: "squashfs", UUID: uuid.NewString()}},
+			{Type: "linux", Content: &Content{Tar: "a.tar", Filesystem: "ext4", UUID: "x", Time: "yesterday"}},
+			{Type: "linux", Size: 1 << 20, Content: &Content{File: "a.img", Time: "2024-05-01T12:00:00Z"}},
+		},
+	}
+
+	err := spec.Validate()
+	require.Error(t, err, "spec should be invalid")
+
+	for _, field := range []string{
+		"partitions[0].content.filesystem: required",
+		"partitions[1].content.tar:",
+		"partitions[2].content.filesystem:",
+		"partitions[2].content.shrink:",
+		"partitions[3].content.filesystem:",
+		"partitions[3].content.ref:",
+		"partitions[4].content.platform:",
+		"partitions[5].content.uuid:",
+		"partitions[6].content.uuid:",
+		"partitions[6].content.time:",
+		"partitions[7].content.time:",
+	} {
+		assert.Contains(t, err.Error(), field, "error should mention field")
+	}
+
+	spec.Partitions = []Partition{{Type: "linux", Content: &Content{Tar: "missing.tar", Filesystem: "erofs"}}}
+
+	err = spec.Build(context.Background(), filepath.Join(t.TempDir(), "disk.img"), nil)
+	require.Error(t, err, "build should fail")
+	assert.Contains(t, err.Error(), "partitions[0].content.tar", "error should mention field")
+}
+
+// writeSaveArchive creates an archive in the format written by docker save, holding a single layer image.
+func writeSaveArchive(t *testing.T, path string) {
+	t.Helper()
+
+	var layer bytes.Buffer
+
+	lw := tar.NewWriter(&layer)
+	require.NoError(t, lw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "etc/motd",
+		Mode:     0o644,
+		Uid:      7,
+		Size:     6,
+	}), "header should write")
+
+	_, err := lw.Write([]byte("hello\n"))
+	require.NoError(t, err, "data should write")
+	require.NoError(t, lw.Close(), "layer should close")
+
+	layerSum := sha256.Sum256(layer.Bytes())
+	config := []byte(`{"architecture":"arm64","os":"linux","rootfs":{"type":"layers","diff_ids":["sha256:` +
+		hex.EncodeToString(layerSum[:]) + `"]}}`)
+	manifest := []byte(`[{"Config":"config.json","RepoTags":["app:latest"],"Layers":["layer/layer.tar"]}]`)
+
+	f, err := os.Create(path)
+	require.NoError(t, err, "archive should create")
+
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{"config.json", config},
+		{"layer/layer.tar", layer.Bytes()},
+		{"manifest.json", manifest},
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file.name,
+			Mode:     0o644,
+			Size:     int64(len(file.data)),
+		}), "header should write")
+
+		_, err := tw.Write(file.data)
+		require.NoError(t, err, "data should write")
+	}
+
+	require.NoError(t, tw.Close(), "archive should close")
+}
+
+func TestBuildImage(t *testing.T) {
+	dir := t.TempDir()
+
+	writeSaveArchive(t, filepath.Join(dir, "app.tar"))
+
+	spec, err := ParseYAML(strings.NewReader(`
+size: 16MiB
+table: mbr
+partitions:
+  - type: linux
+    content:
+      image: app.tar
+      ref: app:latest
+      platform: linux/arm64
+      filesystem: ext4
+`))
+	require.NoError(t, err, "spec should parse")
+
+	spec.BaseDir = dir
+	path := filepath.Join(dir, "disk.img")
+
+	require.NoError(t, spec.Build(context.Background(), path, nil), "spec should build")
+
+	d, err := disk.Open(path)
+	require.NoError(t, err, "disk should open")
+
+	defer d.Close()
+
+	mbr, err := d.ReadMBR()
+	require.NoError(t, err, "mbr should read")
+
+	root, err := ext4.Open(d.MBRPartitionSection(mbr.Part1))
+	require.NoError(t, err, "ext4 should open")
+
+	data, err := fs.ReadFile(root, "etc/motd")
+	require.NoError(t, err, "file should read")
+	assert.Equal(t, "hello\n", string(data), "file should be taken from the image")
+
+	info, err := root.Stat("etc/motd")
+	require.NoError(t, err, "file should stat")
+	assert.Equal(t, uint32(7), info.Sys().(*fsmeta.Attr).UID, "ownership should be kept")
+
+	spec.Partitions[0].Content.Platform = "linux/amd64"
+
+	err = spec.Build(context.Background(), path, nil)
+	require.ErrorIs(t, err, oci.ErrNotFound, "other platform should fail")
+	assert.Contains(t, err.Error(), "partitions[0].content.image", "error should mention field")
+}
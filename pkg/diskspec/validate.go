@@ -0,0 +1,334 @@
+package diskspec
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/csnewman/go-appliance/pkg/disk"
+	"github.com/csnewman/go-appliance/pkg/oci"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrRequired     = errors.New("required")
+	ErrInvalidValue = errors.New("invalid value")
+)
+
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+var partitionTypes = map[string]uuid.UUID{
+	"esp":                  disk.GPTTypeEFISystem,
+	"efi-system":           disk.GPTTypeEFISystem,
+	"bios-boot":            disk.GPTTypeBIOSBoot,
+	"microsoft-basic-data": disk.GPTTypeMicrosoftBasicData,
+	"linux":                disk.GPTTypeLinuxFileSystem,
+	"linux-root-x86":       disk.GPTTypeLinuxRootX86,
+	"linux-root-x86-64":    disk.GPTTypeLinuxRootX86_64,
+	"linux-root-arm":       disk.GPTTypeLinuxRootARM,
+	"linux-root-arm64":     disk.GPTTypeLinuxRootARM64,
+	"linux-home":           disk.GPTTypeLinuxHome,
+	"linux-srv":            disk.GPTTypeLinuxServerData,
+	"linux-var":            disk.GPTTypeLinuxVariableData,
+	"linux-lvm":            disk.GPTTypeLinuxLVM,
+	"linux-raid":           disk.GPTTypeLinuxRAID,
+	"linux-swap":           disk.GPTTypeLinuxSwap,
+}
+
+var mbrPartitionTypes = map[string]disk.MBRPartType{
+	"esp":         disk.MBRPartTypeEFISystem,
+	"efi-system":  disk.MBRPartTypeEFISystem,
+	"fat12":       disk.MBRPartTypeFAT12,
+	"fat16-small": disk.MBRPartTypeFAT16Small,
+	"fat16":       disk.MBRPartTypeFAT16,
+	"fat16-lba":   disk.MBRPartTypeFAT16LBA,
+	"fat32":       disk.MBRPartTypeFAT32LBA,
+	"linux":       disk.MBRPartTypeLinux,
+	"linux-swap":  disk.MBRPartTypeLinuxSwap,
+}
+
+var partitionAttributes = map[string]uint64{
+	"required":             disk.GPTAttrRequired,
+	"no-block-io":          disk.GPTAttrNoBlockIO,
+	"legacy-bios-bootable": disk.GPTAttrLegacyBIOSBootable,
+	"growfs":               disk.GPTAttrGrowFS,
+	"read-only":            disk.GPTAttrReadOnly,
+	"no-auto":              disk.GPTAttrNoAuto,
+}
+
+// PartitionType resolves a partition type name, such as "esp" or "linux", or a literal GUID.
+func PartitionType(name string) (uuid.UUID, error) {
+	if ty, ok := partitionTypes[strings.ToLower(name)]; ok {
+		return ty, nil
+	}
+
+	ty, err := uuid.Parse(name)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("%w: unknown partition type %q", ErrInvalidValue, name)
+	}
+
+	return ty, nil
+}
+
+// MBRPartitionType resolves an MBR partition type name, such as "fat32" or "linux", or a literal type code such as
+// "0x83".
+func MBRPartitionType(name string) (disk.MBRPartType, error) {
+	if ty, ok := mbrPartitionTypes[strings.ToLower(name)]; ok {
+		return ty, nil
+	}
+
+	ty, err := strconv.ParseUint(name, 0, 8)
+	if err != nil || ty == 0 {
+		return 0, fmt.Errorf("%w: unknown mbr partition type %q", ErrInvalidValue, name)
+	}
+
+	return disk.MBRPartType(ty), nil
+}
+
+// PartitionAttributes resolves attribute names, or bit indices, into a GPT attribute mask.
+func PartitionAttributes(names []string) (uint64, error) {
+	var attrs uint64
+
+	for _, name := range names {
+		if attr, ok := partitionAttributes[strings.ToLower(name)]; ok {
+			attrs |= attr
+
+			continue
+		}
+
+		bit, err := strconv.ParseUint(name, 10, 8)
+		if err != nil || bit > 63 {
+			return 0, fmt.Errorf("%w: unknown attribute %q", ErrInvalidValue, name)
+		}
+
+		attrs |= 1 << bit
+	}
+
+	return attrs, nil
+}
+
+func (s *Spec) Validate() error {
+	var errs []error
+
+	fail := func(field string, err error) {
+		errs = append(errs, &FieldError{Field: field, Err: err})
+	}
+
+	if s.Size <= 0 {
+		fail("size", ErrRequired)
+	} else if s.Size%disk.BlockSize != 0 {
+		fail("size", fmt.Errorf("%w: must be a multiple of %v", ErrInvalidValue, disk.BlockSize))
+	}
+
+	switch s.Table {
+	case "", TableGPT, TableMBR:
+	default:
+		fail("table", fmt.Errorf("%w: unknown table type %q", ErrInvalidValue, s.Table))
+	}
+
+	if s.GUID != "" && s.Table == TableMBR {
+		fail("guid", fmt.Errorf("%w: not supported by mbr tables", ErrInvalidValue))
+	} else if s.GUID != "" {
+		if _, err := uuid.Parse(s.GUID); err != nil {
+			fail("guid", fmt.Errorf("%w: %w", ErrInvalidValue, err))
+		}
+	}
+
+	if s.Alignment < 0 || s.Alignment%disk.BlockSize != 0 {
+		fail("alignment", fmt.Errorf("%w: must be a multiple of %v", ErrInvalidValue, disk.BlockSize))
+	}
+
+	if s.Table == TableMBR {
+		if s.Shrink {
+			fail("shrink", fmt.Errorf("%w: not supported by mbr tables", ErrInvalidValue))
+		}
+
+		s.validateMBR(fail)
+
+		return errors.Join(errs...)
+	}
+
+	if len(s.Partitions) > disk.BlockSize/disk.GPTPartitionSize*32 {
+		fail("partitions", fmt.Errorf("%w: too many partitions", ErrInvalidValue))
+	}
+
+	for i, part := range s.Partitions {
+		prefix := fmt.Sprintf("partitions[%v].", i)
+
+		if part.Type == "" {
+			fail(prefix+"type", ErrRequired)
+		} else if _, err := PartitionType(part.Type); err != nil {
+			fail(prefix+"type", err)
+		}
+
+		if part.Size == 0 && i != len(s.Partitions)-1 {
+			fail(prefix+"size", fmt.Errorf("%w: only the last partition may omit its size", ErrRequired))
+		} else if part.Size < 0 || part.Size%disk.BlockSize != 0 {
+			fail(prefix+"size", fmt.Errorf("%w: must be a multiple of %v", ErrInvalidValue, disk.BlockSize))
+		}
+
+		if len(utf16.Encode([]rune(part.Name))) > disk.GPTNameLen {
+			fail(prefix+"name", fmt.Errorf("%w: longer than %v UTF-16 code units", ErrInvalidValue, disk.GPTNameLen))
+		}
+
+		if part.GUID != "" {
+			if _, err := uuid.Parse(part.GUID); err != nil {
+				fail(prefix+"guid", fmt.Errorf("%w: %w", ErrInvalidValue, err))
+			}
+		}
+
+		if _, err := PartitionAttributes(part.Attributes); err != nil {
+			fail(prefix+"attributes", err)
+		}
+
+		if part.Content != nil {
+			part.Content.validate(prefix+"content.", fail)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *Spec) validateMBR(fail func(field string, err error)) {
+	for i, part := range s.Partitions {
+		prefix := fmt.Sprintf("partitions[%v].", i)
+
+		if part.Type == "" {
+			fail(prefix+"type", ErrRequired)
+		} else if _, err := MBRPartitionType(part.Type); err != nil {
+			fail(prefix+"type", err)
+		}
+
+		if part.Size == 0 && i != len(s.Partitions)-1 {
+			fail(prefix+"size", fmt.Errorf("%w: only the last partition may omit its size", ErrRequired))
+		} else if part.Size < 0 || part.Size%disk.BlockSize != 0 {
+			fail(prefix+"size", fmt.Errorf("%w: must be a multiple of %v", ErrInvalidValue, disk.BlockSize))
+		}
+
+		if part.Name != "" {
+			fail(prefix+"name", fmt.Errorf("%w: not supported by mbr tables", ErrInvalidValue))
+		}
+
+		if part.GUID != "" {
+			fail(prefix+"guid", fmt.Errorf("%w: not supported by mbr tables", ErrInvalidValue))
+		}
+
+		for _, attr := range part.Attributes {
+			if attr != AttrBootable {
+				fail(prefix+"attributes", fmt.Errorf("%w: unknown mbr attribute %q", ErrInvalidValue, attr))
+			}
+		}
+
+		if part.Content != nil {
+			part.Content.validate(prefix+"content.", fail)
+		}
+	}
+}
+
+func (c *Content) validate(prefix string, fail func(field string, err error)) {
+	sources := 0
+
+	for _, source := range []string{c.File, c.Tar, c.Image} {
+		if source != "" {
+			sources++
+		}
+	}
+
+	switch {
+	case sources == 0:
+		fail(prefix+"file", ErrRequired)
+	case sources > 1:
+		fail(prefix+c.source(), fmt.Errorf("%w: only one of file, tar and image may be set", ErrInvalidValue))
+	}
+
+	if c.Image == "" {
+		if c.Ref != "" {
+			fail(prefix+"ref", fmt.Errorf("%w: only supported for image content", ErrInvalidValue))
+		}
+
+		if c.Platform != "" {
+			fail(prefix+"platform", fmt.Errorf("%w: only supported for image content", ErrInvalidValue))
+		}
+	} else if c.Platform != "" {
+		if _, err := oci.ParsePlatform(c.Platform); err != nil {
+			fail(prefix+"platform", fmt.Errorf("%w: %w", ErrInvalidValue, err))
+		}
+	}
+
+	if c.Tar != "" || c.Image != "" {
+		c.validateFilesystem(prefix, fail)
+
+		return
+	}
+
+	if c.Filesystem != "" {
+		fail(prefix+"filesystem", fmt.Errorf("%w: only supported for tar and image content", ErrInvalidValue))
+	}
+
+	if c.Label != "" {
+		fail(prefix+"label", fmt.Errorf("%w: only supported for tar and image content", ErrInvalidValue))
+	}
+
+	if c.UUID != "" {
+		fail(prefix+"uuid", fmt.Errorf("%w: only supported for tar and image content", ErrInvalidValue))
+	}
+
+	if c.Time != "" {
+		fail(prefix+"time", fmt.Errorf("%w: only supported for tar and image content", ErrInvalidValue))
+	}
+}
+
+func (c *Content) validateFilesystem(prefix string, fail func(field string, err error)) {
+	switch c.Filesystem {
+	case "":
+		fail(prefix+"filesystem", ErrRequired)
+	case FilesystemExt4, FilesystemEROFS:
+		if len(c.Label) > 16 {
+			fail(prefix+"label", fmt.Errorf("%w: longer than 16 bytes", ErrInvalidValue))
+		}
+	case FilesystemSquashFS:
+		if c.Label != "" {
+			fail(prefix+"label", fmt.Errorf("%w: not supported by squashfs", ErrInvalidValue))
+		}
+
+		if c.UUID != "" {
+			fail(prefix+"uuid", fmt.Errorf("%w: not supported by squashfs", ErrInvalidValue))
+		}
+	default:
+		fail(prefix+"filesystem", fmt.Errorf("%w: unknown filesystem %q", ErrInvalidValue, c.Filesystem))
+	}
+
+	if c.UUID != "" {
+		if _, err := uuid.Parse(c.UUID); err != nil {
+			fail(prefix+"uuid", fmt.Errorf("%w: %w", ErrInvalidValue, err))
+		}
+	}
+
+	if c.Time != "" {
+		if _, err := time.Parse(time.RFC3339, c.Time); err != nil {
+			fail(prefix+"time", fmt.Errorf("%w: %w", ErrInvalidValue, err))
+		}
+	}
+
+	if c.Zero {
+		fail(prefix+"zero", fmt.Errorf("%w: not supported for filesystem content", ErrInvalidValue))
+	}
+
+	if c.Shrink {
+		fail(prefix+"shrink", fmt.Errorf("%w: not supported for filesystem content", ErrInvalidValue))
+	}
+}
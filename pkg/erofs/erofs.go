@@ -0,0 +1,131 @@
+package erofs
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	SuperblockOffset  = 1024
+	SuperblockSize    = 128
+	Magic             = 0xE0F5E1E2
+	DefaultBlockSize  = 4096
+	MinBlockSize      = 4096
+	MaxBlockSize      = 65536
+	SlotSize          = 32
+	CompactInodeSize  = 32
+	ExtendedInodeSize = 64
+	DirentSize        = 12
+	MaxNameLen        = 255
+
+	// RootOffset is where the root inode is placed, directly after the superblock, keeping its nid small enough for
+	// the 16-bit superblock field.
+	RootOffset = SuperblockOffset + SuperblockSize
+
+	xattrHeaderSize  = 12
+	mapHeaderSize    = 16
+	lclusterSize     = 8
+	maxPcluster      = 16
+	extendedVersion  = 1
+	compressionLZ4   = 0
+	maxCompactID     = 0xFFFF
+	maxCompactLinks  = 0xFFFF
+	maxCompactSize   = 0xFFFFFFFF
+	maxXattrValue    = 0xFFFF
+	maxXattrIcount   = 0xFFFF
+	maxSharedXattrs  = 0xFF
+	maxSymlinkTarget = 4095
+)
+
+// Feature flags.
+const (
+	CompatSBChecksum = 0x1
+	CompatMTime      = 0x2
+
+	IncompatZeroPadding = 0x1
+)
+
+// Data layouts, stored in bits 1-3 of the inode format.
+const (
+	LayoutFlatPlain = iota
+	LayoutCompressedFull
+	LayoutFlatInline
+	LayoutCompressedCompact
+	LayoutChunkBased
+)
+
+// Logical cluster types of the compression index.
+const (
+	LclusterPlain = iota
+	LclusterHead1
+	LclusterNonHead
+	LclusterHead2
+)
+
+// Directory entry file types.
+const (
+	FileTypeUnknown = iota
+	FileTypeRegular
+	FileTypeDir
+	FileTypeChar
+	FileTypeBlock
+	FileTypeFIFO
+	FileTypeSocket
+	FileTypeSymlink
+)
+
+// Xattr name indexes, which replace the well-known prefixes.
+const (
+	XattrUser            = 1
+	XattrPosixACLAccess  = 2
+	XattrPosixACLDefault = 3
+	XattrTrusted         = 4
+	XattrSecurity        = 6
+)
+
+// xattrNames maps name indexes to the prefix they replace, or the full name for POSIX ACLs, which are stored in the
+// same format as the VFS uses.
+var xattrNames = []struct {
+	index  uint8
+	prefix string
+	exact  bool
+}{
+	{XattrPosixACLAccess, "system.posix_acl_access", true},
+	{XattrPosixACLDefault, "system.posix_acl_default", true},
+	{XattrUser, "user.", false},
+	{XattrTrusted, "trusted.", false},
+	{XattrSecurity, "security.", false},
+}
+
+var (
+	ErrInvalidBlock    = errors.New("invalid block size")
+	ErrNoSpace         = errors.New("no space left for image")
+	ErrInvalidName     = errors.New("invalid file name")
+	ErrExist           = errors.New("file already exists")
+	ErrNotDir          = errors.New("not a directory")
+	ErrUnsupportedType = errors.New("unsupported file type")
+	ErrInvalidXattr    = errors.New("invalid extended attribute")
+	ErrClosed          = errors.New("writer closed")
+)
+
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionLZ4
+)
+
+type Options struct {
+	// BlockSize must not exceed the page size of the kernel mounting the image, defaulting to 4KiB.
+	BlockSize int
+	// Compression selects per-file compression. Files that do not shrink are stored uncompressed.
+	Compression Compression
+	Label       string
+	// UUID is written to the superblock, where tools such as blkid report it. No UUID is set when zero.
+	UUID uuid.UUID
+	// Time is the build time, used by compact inodes and for files without a modification time. The Unix epoch is
+	// used when zero.
+	Time time.Time
+}
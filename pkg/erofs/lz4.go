@@ -0,0 +1,90 @@
+package erofs
+
+import (
+	"encoding/binary"
+)
+
+const (
+	lz4MinMatch     = 4
+	lz4MFLimit      = 12
+	lz4LastLiterals = 5
+	lz4MaxOffset    = 65535
+	lz4HashLog      = 16
+)
+
+// lz4Compress encodes src as a single LZ4 block. Matches are found greedily through a table of the last position of
+// each hashed four byte sequence, trading ratio for simplicity.
+func lz4Compress(src []byte) []byte {
+	dst := make([]byte, 0, len(src)+len(src)/255+16)
+	anchor := 0
+
+	if len(src) > lz4MFLimit {
+		var table [1 << lz4HashLog]int32
+
+		limit := len(src) - lz4MFLimit
+		maxEnd := len(src) - lz4LastLiterals
+
+		for i := 0; i < limit; {
+			seq := binary.LittleEndian.Uint32(src[i:])
+			h := seq * 2654435761 >> (32 - lz4HashLog)
+			ref := int(table[h]) - 1
+			table[h] = int32(i + 1)
+
+			if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+				i++
+
+				continue
+			}
+
+			for i > anchor && ref > 0 && src[i-1] == src[ref-1] {
+				i--
+				ref--
+			}
+
+			end := i + lz4MinMatch
+			for end < maxEnd && src[end] == src[ref+end-i] {
+				end++
+			}
+
+			dst = lz4Sequence(dst, src[anchor:i], i-ref, end-i)
+			i = end
+			anchor = end
+		}
+	}
+
+	return lz4Sequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4Sequence appends literals followed by a match. A zero offset ends the block with literals only.
+func lz4Sequence(dst []byte, literals []byte, offset int, match int) []byte {
+	token := byte(min(len(literals), 15)) << 4
+
+	if offset > 0 {
+		token |= byte(min(match-lz4MinMatch, 15))
+	}
+
+	dst = append(dst, token)
+	dst = lz4Length(dst, len(literals))
+	dst = append(dst, literals...)
+
+	if offset == 0 {
+		return dst
+	}
+
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(offset))
+
+	return lz4Length(dst, match-lz4MinMatch)
+}
+
+// lz4Length appends the continuation bytes of a length whose first 15 were stored in the token.
+func lz4Length(dst []byte, n int) []byte {
+	if n < 15 {
+		return dst
+	}
+
+	for n -= 15; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+
+	return append(dst, byte(n))
+}
@@ -0,0 +1,108 @@
+package erofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lz4Decompress decodes a single LZ4 block, checking the constraints the kernel decoder relies on.
+func lz4Decompress(src []byte) ([]byte, error) {
+	var dst []byte
+
+	length := func(n int) (int, error) {
+		if n < 15 {
+			return n, nil
+		}
+
+		for {
+			if len(src) == 0 {
+				return 0, errors.New("truncated length")
+			}
+
+			b := src[0]
+			src = src[1:]
+			n += int(b)
+
+			if b != 255 {
+				return n, nil
+			}
+		}
+	}
+
+	for {
+		if len(src) == 0 {
+			return nil, errors.New("missing token")
+		}
+
+		token := src[0]
+		src = src[1:]
+
+		literals, err := length(int(token >> 4))
+		if err != nil {
+			return nil, err
+		}
+
+		if literals > len(src) {
+			return nil, errors.New("truncated literals")
+		}
+
+		dst = append(dst, src[:literals]...)
+		src = src[literals:]
+
+		if len(src) == 0 {
+			return dst, nil
+		}
+
+		if len(src) < 2 {
+			return nil, errors.New("truncated offset")
+		}
+
+		offset := int(binary.LittleEndian.Uint16(src))
+		src = src[2:]
+
+		match, err := length(int(token & 15))
+		if err != nil {
+			return nil, err
+		}
+
+		if offset == 0 || offset > len(dst) {
+			return nil, errors.New("invalid offset")
+		}
+
+		for range match + lz4MinMatch {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+}
+
+func TestLZ4RoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	noise := make([]byte, 70000)
+	rnd.Read(noise)
+
+	inputs := [][]byte{
+		nil,
+		[]byte("short"),
+		[]byte("exactly13byte"),
+		bytes.Repeat([]byte{0}, 1<<20),
+		bytes.Repeat([]byte("abcdefgh"), 10000),
+		noise,
+		append(bytes.Repeat([]byte("pattern "), 9000), noise[:5000]...),
+	}
+
+	for i, in := range inputs {
+		out := lz4Compress(in)
+
+		back, err := lz4Decompress(out)
+		require.NoError(t, err, "input %v should decode", i)
+		assert.True(t, bytes.Equal(in, back), "input %v should round trip", i)
+	}
+
+	assert.Less(t, len(lz4Compress(inputs[3])), 5000, "zeros should compress well")
+}
@@ -0,0 +1,1057 @@
+package erofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+)
+
+type node struct {
+	attr     fsmeta.Attr
+	entries  [][]byte
+	xattrs   []byte
+	links    uint32
+	children map[string]*node
+	parent   *node
+
+	size      uint64
+	layout    int
+	blkaddr   uint64
+	tail      []byte
+	blocks    uint64
+	lclusters []lcluster
+	listing   [][]string
+
+	ino    uint32
+	pos    uint64
+	placed bool
+}
+
+type lcluster struct {
+	ty      uint16
+	blkaddr uint32
+	delta   [2]uint16
+}
+
+func (n *node) isDir() bool {
+	return n.attr.Mode.IsDir()
+}
+
+func (n *node) nid() uint64 {
+	return n.pos / SlotSize
+}
+
+func (n *node) sortedNames() []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+func (n *node) fileType() uint8 {
+	switch n.attr.Mode.Type() {
+	case fs.ModeDir:
+		return FileTypeDir
+	case fs.ModeSymlink:
+		return FileTypeSymlink
+	case fs.ModeDevice:
+		return FileTypeBlock
+	case fs.ModeDevice | fs.ModeCharDevice:
+		return FileTypeChar
+	case fs.ModeNamedPipe:
+		return FileTypeFIFO
+	case fs.ModeSocket:
+		return FileTypeSocket
+	default:
+		return FileTypeRegular
+	}
+}
+
+func withType(mode fs.FileMode, ty fs.FileMode) fs.FileMode {
+	return mode&^fs.ModeType | ty
+}
+
+// Writer builds an EROFS image. File data is written from the second block onwards as it is added. Shared xattrs,
+// directories, symlinks and the inodes follow on Close, except for the root inode which is kept in the first block
+// alongside the superblock.
+type Writer struct {
+	dst       io.WriterAt
+	limit     int64
+	opts      Options
+	blockSize uint64
+	pos       uint64
+	root      *node
+	xattrBlk  uint64
+	closed    bool
+	size      int64
+}
+
+// NewWriter prepares an image within dst. A positive size limits the space the image may use, such as the size of the
+// target partition.
+func NewWriter(dst io.WriterAt, size int64, opts Options) (*Writer, error) {
+	if opts.BlockSize == 0 {
+		opts.BlockSize = DefaultBlockSize
+	}
+
+	bs := opts.BlockSize
+	if bs < MinBlockSize || bs > MaxBlockSize || bs&(bs-1) != 0 {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBlock, bs)
+	}
+
+	if len(opts.Label) > 16 {
+		return nil, fmt.Errorf("%w: label %q exceeds 16 bytes", ErrInvalidName, opts.Label)
+	}
+
+	if opts.Time.IsZero() {
+		opts.Time = time.Unix(0, 0).UTC()
+	}
+
+	return &Writer{
+		dst:       dst,
+		limit:     size,
+		opts:      opts,
+		blockSize: uint64(bs),
+		pos:       uint64(bs),
+		root: &node{
+			attr:     fsmeta.Attr{Mode: fs.ModeDir | 0o755, ModTime: opts.Time},
+			children: make(map[string]*node),
+		},
+	}, nil
+}
+
+func (w *Writer) writeAt(data []byte, off uint64) error {
+	if w.limit > 0 && off+uint64(len(data)) > uint64(w.limit) {
+		return fmt.Errorf("%w: image exceeds %v bytes", ErrNoSpace, w.limit)
+	}
+
+	if _, err := w.dst.WriteAt(data, int64(off)); err != nil {
+		return fmt.Errorf("failed to write image: %w", err)
+	}
+
+	return nil
+}
+
+// writeBlock writes data, which must not exceed a block, into the next block of the data area.
+func (w *Writer) writeBlock(data []byte) error {
+	block := data
+
+	if uint64(len(data)) < w.blockSize {
+		block = make([]byte, w.blockSize)
+		copy(block, data)
+	}
+
+	if err := w.writeAt(block, w.pos); err != nil {
+		return err
+	}
+
+	w.pos += w.blockSize
+
+	return nil
+}
+
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || len(name) > MaxNameLen || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	return nil
+}
+
+func splitPath(name string) (string, string) {
+	return path.Split(strings.Trim(path.Clean("/"+name), "/"))
+}
+
+func (w *Writer) lookup(name string, create bool) (*node, error) {
+	name = strings.Trim(path.Clean("/"+name), "/")
+
+	cur := w.root
+
+	if name == "" {
+		return cur, nil
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		next := cur.children[part]
+
+		if next == nil {
+			if !create {
+				return nil, fmt.Errorf("%w: %v", fs.ErrNotExist, name)
+			}
+
+			var err error
+
+			next, err = w.addNode(cur, part, fsmeta.Attr{Mode: fs.ModeDir | 0o755, ModTime: w.opts.Time})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !next.isDir() {
+			return nil, fmt.Errorf("%w: %v", ErrNotDir, part)
+		}
+
+		cur = next
+	}
+
+	return cur, nil
+}
+
+func (w *Writer) addNode(parent *node, name string, attr fsmeta.Attr) (*node, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	if parent.children[name] != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExist, name)
+	}
+
+	entries, err := encodeXattrs(&attr)
+	if err != nil {
+		return nil, err
+	}
+
+	if attr.ModTime.IsZero() {
+		attr.ModTime = w.opts.Time
+	}
+
+	n := &node{
+		attr:    attr,
+		entries: entries,
+		xattrs:  xattrBody(nil, entries),
+		links:   1,
+	}
+
+	if attr.Mode.IsDir() {
+		n.children = make(map[string]*node)
+	}
+
+	parent.children[name] = n
+
+	return n, nil
+}
+
+func (w *Writer) create(name string, attr fsmeta.Attr) (*node, error) {
+	if w.closed {
+		return nil, ErrClosed
+	}
+
+	dir, base := splitPath(name)
+
+	parent, err := w.lookup(dir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return w.addNode(parent, base, attr)
+}
+
+// Mkdir creates a directory, along with any missing parents. The metadata of an existing directory, including the
+// root when name is ".", is replaced.
+func (w *Writer) Mkdir(name string, attr fsmeta.Attr) error {
+	if w.closed {
+		return ErrClosed
+	}
+
+	attr.Mode = withType(attr.Mode, fs.ModeDir)
+
+	dir, base := splitPath(name)
+
+	existing := w.root
+
+	if base != "" {
+		parent, err := w.lookup(dir, true)
+		if err != nil {
+			return err
+		}
+
+		existing = parent.children[base]
+
+		if existing == nil || !existing.isDir() {
+			_, err = w.addNode(parent, base, attr)
+
+			return err
+		}
+	}
+
+	entries, err := encodeXattrs(&attr)
+	if err != nil {
+		return err
+	}
+
+	if attr.ModTime.IsZero() {
+		attr.ModTime = w.opts.Time
+	}
+
+	existing.attr = attr
+	existing.entries = entries
+	existing.xattrs = xattrBody(nil, entries)
+
+	return nil
+}
+
+// WriteFile creates a regular file, along with any missing parent directories, containing the data read from r.
+func (w *Writer) WriteFile(name string, r io.Reader, attr fsmeta.Attr) error {
+	attr.Mode = withType(attr.Mode, 0)
+
+	n, err := w.create(name, attr)
+	if err != nil {
+		return err
+	}
+
+	if w.opts.Compression == CompressionLZ4 {
+		err = w.writeCompressed(n, r)
+	} else {
+		err = w.writePlain(n, r)
+	}
+
+	if err != nil {
+		return fmt.Errorf("writing %v: %w", name, err)
+	}
+
+	return nil
+}
+
+func (w *Writer) writePlain(n *node, r io.Reader) error {
+	buf := make([]byte, w.blockSize)
+	n.blkaddr = w.pos / w.blockSize
+
+	for {
+		read, err := io.ReadFull(r, buf)
+		n.size += uint64(read)
+
+		if uint64(read) == w.blockSize {
+			if err := w.writeBlock(buf); err != nil {
+				return err
+			}
+		} else if read > 0 {
+			n.tail = bytes.Clone(buf[:read])
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read: %w", err)
+		}
+	}
+
+	// The tail must directly follow the full blocks when it is not inlined, so the decision is made now assuming the
+	// largest inode format.
+	if len(n.tail) == 0 {
+		return nil
+	}
+
+	if w.inlineFits(n, ExtendedInodeSize, uint64(len(n.tail))) {
+		n.layout = LayoutFlatInline
+
+		return nil
+	}
+
+	tail := n.tail
+	n.tail = nil
+
+	return w.writeBlock(tail)
+}
+
+func (w *Writer) writeCompressed(n *node, r io.Reader) error {
+	buf := make([]byte, 0, maxPcluster*w.blockSize)
+	start := w.pos
+	compressed := false
+	eof := false
+
+	for {
+		if !eof {
+			read, err := io.ReadFull(r, buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+read]
+			n.size += uint64(read)
+
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return fmt.Errorf("failed to read: %w", err)
+			}
+		}
+
+		if len(buf) == 0 {
+			break
+		}
+
+		consumed, block, packed := w.packCluster(buf)
+		clusters := (uint64(consumed) + w.blockSize - 1) / w.blockSize
+
+		head := lcluster{ty: LclusterPlain, blkaddr: uint32(w.pos / w.blockSize)}
+		if packed {
+			head.ty = LclusterHead1
+			compressed = true
+		}
+
+		n.lclusters = append(n.lclusters, head)
+
+		for i := uint64(1); i < clusters; i++ {
+			n.lclusters = append(n.lclusters, lcluster{
+				ty:    LclusterNonHead,
+				delta: [2]uint16{uint16(i), uint16(clusters - i)},
+			})
+		}
+
+		if err := w.writeBlock(block); err != nil {
+			return err
+		}
+
+		n.blocks++
+		buf = buf[:copy(buf, buf[consumed:])]
+	}
+
+	if compressed {
+		n.layout = LayoutCompressedFull
+
+		return nil
+	}
+
+	// Nothing shrank, so the clusters were written as consecutive blocks that can be addressed directly.
+	n.lclusters = nil
+	n.blocks = 0
+	n.blkaddr = start / w.blockSize
+
+	return nil
+}
+
+// packCluster compresses the longest run of logical clusters that fits within a single block, returning the number of
+// bytes consumed and the block to write. Data that would not save at least one block is stored as is, a single
+// cluster at a time. Compressed data is aligned to the end of the block, as required by the zero padding feature.
+func (w *Writer) packCluster(data []byte) (int, []byte, bool) {
+	bs := int(w.blockSize)
+	clusters := (len(data) + bs - 1) / bs
+
+	attempt := func(count int) []byte {
+		out := lz4Compress(data[:min(count*bs, len(data))])
+		if len(out) > bs {
+			return nil
+		}
+
+		return out
+	}
+
+	var (
+		best  []byte
+		count int
+	)
+
+	if clusters >= 2 {
+		best = attempt(2)
+		count = 2
+	}
+
+	if best == nil {
+		block := make([]byte, bs)
+		consumed := copy(block, data)
+
+		return consumed, block, false
+	}
+
+	if out := attempt(clusters); out != nil {
+		best, count = out, clusters
+	} else {
+		for lo, hi := 2, clusters; hi-lo > 1; {
+			mid := (lo + hi) / 2
+
+			if out := attempt(mid); out != nil {
+				best, count, lo = out, mid, mid
+			} else {
+				hi = mid
+			}
+		}
+	}
+
+	block := make([]byte, bs)
+	copy(block[bs-len(best):], best)
+
+	return min(count*bs, len(data)), block, true
+}
+
+// Symlink creates a symbolic link pointing at target.
+func (w *Writer) Symlink(name string, target string, attr fsmeta.Attr) error {
+	if target == "" || len(target) > maxSymlinkTarget {
+		return fmt.Errorf("%w: symlink target of %v bytes", ErrInvalidName, len(target))
+	}
+
+	attr.Mode = withType(attr.Mode, fs.ModeSymlink)
+
+	n, err := w.create(name, attr)
+	if err != nil {
+		return err
+	}
+
+	n.tail = []byte(target)
+	n.size = uint64(len(target))
+
+	return nil
+}
+
+// Mknod creates a device node, FIFO or socket, selected by the type bits of attr.Mode.
+func (w *Writer) Mknod(name string, attr fsmeta.Attr) error {
+	switch attr.Mode.Type() {
+	case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice, fs.ModeNamedPipe, fs.ModeSocket:
+	default:
+		return fmt.Errorf("%w: %v is %v", ErrUnsupportedType, name, attr.Mode.Type())
+	}
+
+	_, err := w.create(name, attr)
+
+	return err
+}
+
+// Link creates a hard link to an existing non-directory entry.
+func (w *Writer) Link(name string, target string) error {
+	if w.closed {
+		return ErrClosed
+	}
+
+	tdir, tbase := splitPath(target)
+
+	tparent, err := w.lookup(tdir, false)
+	if err != nil {
+		return err
+	}
+
+	n := tparent.children[tbase]
+	if n == nil {
+		return fmt.Errorf("%w: %v", fs.ErrNotExist, target)
+	}
+
+	if n.isDir() {
+		return fmt.Errorf("%w: cannot hard link directory %v", ErrUnsupportedType, target)
+	}
+
+	dir, base := splitPath(name)
+
+	parent, err := w.lookup(dir, true)
+	if err != nil {
+		return err
+	}
+
+	if err := validName(base); err != nil {
+		return err
+	}
+
+	if parent.children[base] != nil {
+		return fmt.Errorf("%w: %v", ErrExist, name)
+	}
+
+	parent.children[base] = n
+	n.links++
+
+	return nil
+}
+
+// AddFS copies the contents of fsys into the image root, as described by fsmeta.CopyFS.
+func (w *Writer) AddFS(fsys fs.FS) error {
+	return fsmeta.CopyFS(w, fsys)
+}
+
+func splitXattr(name string) (uint8, string, error) {
+	for _, x := range xattrNames {
+		if x.exact && name == x.prefix {
+			return x.index, "", nil
+		}
+
+		if suffix, ok := strings.CutPrefix(name, x.prefix); ok && !x.exact && suffix != "" {
+			return x.index, suffix, nil
+		}
+	}
+
+	return 0, "", fmt.Errorf("%w: %v has an unsupported namespace", ErrInvalidXattr, name)
+}
+
+// encodeXattrs encodes the extended attributes of an inode as xattr entries, sorted by name.
+func encodeXattrs(attr *fsmeta.Attr) ([][]byte, error) {
+	var (
+		entries [][]byte
+		size    int
+	)
+
+	for _, name := range attr.XattrNames() {
+		index, suffix, err := splitXattr(name)
+		if err != nil {
+			return nil, err
+		}
+
+		value := attr.Xattrs[name]
+
+		if len(suffix) > MaxNameLen || len(value) > maxXattrValue {
+			return nil, fmt.Errorf("%w: %v is too large", ErrInvalidXattr, name)
+		}
+
+		entry := []byte{uint8(len(suffix)), index}
+		entry = binary.LittleEndian.AppendUint16(entry, uint16(len(value)))
+		entry = append(entry, suffix...)
+		entry = append(entry, value...)
+		entry = append(entry, make([]byte, -len(entry)&3)...)
+
+		entries = append(entries, entry)
+		size += len(entry)
+	}
+
+	if size/4+1 > maxXattrIcount {
+		return nil, fmt.Errorf("%w: attributes exceed %v bytes", ErrInvalidXattr, maxXattrIcount*4)
+	}
+
+	return entries, nil
+}
+
+// xattrBody builds the xattr area stored after an inode, referencing the shared entries by id ahead of the entries
+// stored inline. It returns nil when there are no attributes.
+func xattrBody(shared []uint32, entries [][]byte) []byte {
+	if len(shared) == 0 && len(entries) == 0 {
+		return nil
+	}
+
+	buf := make([]byte, xattrHeaderSize)
+	buf[4] = uint8(len(shared))
+
+	for _, id := range shared {
+		buf = binary.LittleEndian.AppendUint32(buf, id)
+	}
+
+	for _, entry := range entries {
+		buf = append(buf, entry...)
+	}
+
+	return buf
+}
+
+// shareXattrs moves entries used by more than one inode into the shared xattr area, which is written to the next
+// blocks of the data area, leaving a 4 byte reference in each inode. Entries are kept within a single block.
+func (w *Writer) shareXattrs(nodes []*node) error {
+	counts := make(map[string]int)
+
+	for _, n := range nodes {
+		for _, entry := range n.entries {
+			counts[string(entry)]++
+		}
+	}
+
+	var area []byte
+
+	ids := make(map[string]uint32)
+
+	for _, n := range nodes {
+		for _, entry := range n.entries {
+			if _, ok := ids[string(entry)]; ok || counts[string(entry)] < 2 || uint64(len(entry)) > w.blockSize {
+				continue
+			}
+
+			if used := uint64(len(area)) % w.blockSize; used+uint64(len(entry)) > w.blockSize {
+				area = append(area, make([]byte, w.blockSize-used)...)
+			}
+
+			ids[string(entry)] = uint32(len(area) / 4)
+			area = append(area, entry...)
+		}
+	}
+
+	if len(area) == 0 {
+		return nil
+	}
+
+	w.xattrBlk = w.pos / w.blockSize
+
+	for ; len(area) > 0; area = area[min(uint64(len(area)), w.blockSize):] {
+		if err := w.writeBlock(area[:min(uint64(len(area)), w.blockSize)]); err != nil {
+			return err
+		}
+	}
+
+	for _, n := range nodes {
+		var (
+			shared []uint32
+			inline [][]byte
+		)
+
+		for _, entry := range n.entries {
+			if id, ok := ids[string(entry)]; ok && len(shared) < maxSharedXattrs {
+				shared = append(shared, id)
+			} else {
+				inline = append(inline, entry)
+			}
+		}
+
+		n.xattrs = xattrBody(shared, inline)
+	}
+
+	return nil
+}
+
+func (w *Writer) compact(n *node) bool {
+	return n.attr.UID <= maxCompactID && n.attr.GID <= maxCompactID && n.links <= maxCompactLinks &&
+		n.size <= maxCompactSize && n.attr.ModTime.Equal(w.opts.Time)
+}
+
+func (w *Writer) inodeSize(n *node) uint64 {
+	if w.compact(n) {
+		return CompactInodeSize
+	}
+
+	return ExtendedInodeSize
+}
+
+// inlineFits reports whether a tail of the given length can be stored after the inode and its xattrs without crossing
+// a block boundary, given the inode size.
+func (w *Writer) inlineFits(n *node, isize uint64, tail uint64) bool {
+	start := isize + uint64(len(n.xattrs))
+	if n == w.root {
+		start += RootOffset
+	}
+
+	return start+tail <= w.blockSize
+}
+
+// recordSize returns the space taken in the metadata area by an inode, its xattrs and any index or inline data.
+func (w *Writer) recordSize(n *node) uint64 {
+	size := w.inodeSize(n) + uint64(len(n.xattrs))
+
+	switch n.layout {
+	case LayoutFlatInline:
+		size += n.size % w.blockSize
+	case LayoutCompressedFull:
+		size = (size+7)&^7 + mapHeaderSize + lclusterSize*uint64(len(n.lclusters))
+	}
+
+	return size
+}
+
+// collect lists the inodes in depth first order, starting with the root and visiting each hard linked file once.
+func (w *Writer) collect(dir *node, out []*node) []*node {
+	if dir == w.root {
+		out = append(out, dir)
+	}
+
+	for _, name := range dir.sortedNames() {
+		child := dir.children[name]
+
+		if child.placed {
+			continue
+		}
+
+		child.placed = true
+		out = append(out, child)
+
+		if child.isDir() {
+			child.parent = dir
+			out = w.collect(child, out)
+		}
+	}
+
+	return out
+}
+
+// buildListing splits the sorted entries of a directory into blocks. Entries may not span blocks, and the final
+// block is only as long as its contents.
+func (w *Writer) buildListing(n *node) {
+	names := append([]string{".", ".."}, n.sortedNames()...)
+	slices.Sort(names)
+
+	var used uint64
+
+	n.listing = nil
+
+	for _, name := range names {
+		size := DirentSize + uint64(len(name))
+
+		if len(n.listing) == 0 || used+size > w.blockSize {
+			n.listing = append(n.listing, nil)
+			used = 0
+		}
+
+		n.listing[len(n.listing)-1] = append(n.listing[len(n.listing)-1], name)
+		used += size
+	}
+
+	n.size = uint64(len(n.listing)-1)*w.blockSize + used
+}
+
+func (w *Writer) encodeDirBlock(n *node, names []string) []byte {
+	le := binary.LittleEndian
+	block := make([]byte, 0, w.blockSize)
+	nameoff := DirentSize * len(names)
+
+	for _, name := range names {
+		child := n.children[name]
+
+		switch name {
+		case ".":
+			child = n
+		case "..":
+			child = n.parent
+		}
+
+		block = le.AppendUint64(block, child.nid())
+		block = le.AppendUint16(block, uint16(nameoff))
+		block = append(block, child.fileType(), 0)
+		nameoff += len(name)
+	}
+
+	for _, name := range names {
+		block = append(block, name...)
+	}
+
+	return block
+}
+
+func (w *Writer) Close() error {
+	if w.closed {
+		return ErrClosed
+	}
+
+	w.closed = true
+	w.root.parent = w.root
+
+	nodes := w.collect(w.root, nil)
+	bs := w.blockSize
+
+	for i, n := range nodes {
+		n.ino = uint32(i + 1)
+
+		if !n.isDir() {
+			continue
+		}
+
+		n.links = 2
+
+		for _, child := range n.children {
+			if child.isDir() {
+				n.links++
+			}
+		}
+
+		w.buildListing(n)
+	}
+
+	if err := w.shareXattrs(nodes); err != nil {
+		return err
+	}
+
+	// Directory and symlink data is placed now that inode sizes are final. Directory blocks are reserved and only
+	// written once the inodes they reference have been placed.
+	for _, n := range nodes {
+		if !n.isDir() && n.attr.Mode.Type() != fs.ModeSymlink {
+			continue
+		}
+
+		tail := n.size % bs
+		n.blkaddr = w.pos / bs
+
+		if tail > 0 && w.inlineFits(n, w.inodeSize(n), tail) {
+			n.layout = LayoutFlatInline
+		} else {
+			n.layout = LayoutFlatPlain
+		}
+
+		if n.isDir() {
+			blocks := n.size / bs
+			if n.layout == LayoutFlatPlain && tail > 0 {
+				blocks++
+			}
+
+			w.pos += blocks * bs
+		} else if n.layout == LayoutFlatPlain {
+			if err := w.writeBlock(n.tail); err != nil {
+				return err
+			}
+		}
+	}
+
+	w.root.pos = RootOffset
+	if RootOffset+w.recordSize(w.root) > bs {
+		return fmt.Errorf("%w: root xattrs do not fit in the first block", ErrInvalidXattr)
+	}
+
+	metaStart := w.pos
+	end := metaStart
+
+	for _, n := range nodes[1:] {
+		pos := (end + SlotSize - 1) &^ (SlotSize - 1)
+
+		if n.layout == LayoutFlatInline {
+			head := w.inodeSize(n) + uint64(len(n.xattrs))
+
+			if (pos+head)%bs+n.size%bs > bs {
+				pos = (pos + bs - 1) / bs * bs
+			}
+		}
+
+		n.pos = pos
+		end = pos + w.recordSize(n)
+	}
+
+	for _, n := range nodes {
+		if !n.isDir() {
+			continue
+		}
+
+		for i, names := range n.listing {
+			block := w.encodeDirBlock(n, names)
+
+			if n.layout == LayoutFlatInline && i == len(n.listing)-1 {
+				n.tail = block
+
+				continue
+			}
+
+			if err := w.writeAt(append(block, make([]byte, bs-uint64(len(block)))...), (n.blkaddr+uint64(i))*bs); err != nil {
+				return err
+			}
+		}
+	}
+
+	total := (end + bs - 1) / bs * bs
+	meta := make([]byte, total-metaStart)
+	first := make([]byte, bs)
+
+	for _, n := range nodes {
+		record := w.encodeInode(n)
+
+		if n == w.root {
+			copy(first[n.pos:], record)
+		} else {
+			copy(meta[n.pos-metaStart:], record)
+		}
+	}
+
+	if err := w.writeAt(meta, metaStart); err != nil {
+		return err
+	}
+
+	copy(first[SuperblockOffset:], w.superblock(len(nodes), total/bs))
+
+	if err := w.writeAt(first, 0); err != nil {
+		return err
+	}
+
+	w.size = int64(total)
+
+	return nil
+}
+
+func (w *Writer) encodeInode(n *node) []byte {
+	le := binary.LittleEndian
+	format := uint16(n.layout) << 1
+
+	var icount uint16
+	if len(n.xattrs) > 0 {
+		icount = uint16((len(n.xattrs)-xattrHeaderSize)/4 + 1)
+	}
+
+	var iu uint32
+
+	switch {
+	case n.attr.Mode&fs.ModeDevice != 0:
+		major, minor := n.attr.Major, n.attr.Minor
+		iu = minor&0xFF | major<<8 | (minor&^0xFF)<<12
+	case n.layout == LayoutCompressedFull:
+		iu = uint32(n.blocks)
+	case n.attr.Mode.IsRegular() || n.isDir() || n.attr.Mode.Type() == fs.ModeSymlink:
+		iu = uint32(n.blkaddr)
+	}
+
+	mode := uint16(fsmeta.UnixMode(n.attr.Mode))
+
+	var buf []byte
+
+	if w.compact(n) {
+		buf = make([]byte, CompactInodeSize)
+		le.PutUint16(buf[0:], format)
+		le.PutUint16(buf[2:], icount)
+		le.PutUint16(buf[4:], mode)
+		le.PutUint16(buf[6:], uint16(n.links))
+		le.PutUint32(buf[8:], uint32(n.size))
+		le.PutUint32(buf[16:], iu)
+		le.PutUint32(buf[20:], n.ino)
+		le.PutUint16(buf[24:], uint16(n.attr.UID))
+		le.PutUint16(buf[26:], uint16(n.attr.GID))
+	} else {
+		buf = make([]byte, ExtendedInodeSize)
+		le.PutUint16(buf[0:], format|extendedVersion)
+		le.PutUint16(buf[2:], icount)
+		le.PutUint16(buf[4:], mode)
+		le.PutUint64(buf[8:], n.size)
+		le.PutUint32(buf[16:], iu)
+		le.PutUint32(buf[20:], n.ino)
+		le.PutUint32(buf[24:], n.attr.UID)
+		le.PutUint32(buf[28:], n.attr.GID)
+		le.PutUint64(buf[32:], uint64(n.attr.ModTime.Unix()))
+		le.PutUint32(buf[40:], uint32(n.attr.ModTime.Nanosecond()))
+		le.PutUint32(buf[44:], n.links)
+	}
+
+	buf = append(buf, n.xattrs...)
+
+	switch n.layout {
+	case LayoutFlatInline:
+		buf = append(buf, n.tail...)
+	case LayoutCompressedFull:
+		// The map header selects LZ4 with logical clusters of one block, followed by a reserved word.
+		buf = append(buf, make([]byte, -len(buf)&7+mapHeaderSize)...)
+		buf[len(buf)-mapHeaderSize+6] = compressionLZ4
+
+		for _, lc := range n.lclusters {
+			buf = le.AppendUint16(buf, lc.ty)
+			buf = le.AppendUint16(buf, 0)
+
+			if lc.ty == LclusterNonHead {
+				buf = le.AppendUint16(buf, lc.delta[0])
+				buf = le.AppendUint16(buf, lc.delta[1])
+			} else {
+				buf = le.AppendUint32(buf, lc.blkaddr)
+			}
+		}
+	}
+
+	return buf
+}
+
+func (w *Writer) superblock(inodes int, blocks uint64) []byte {
+	le := binary.LittleEndian
+	sb := make([]byte, SuperblockSize)
+
+	blkszbits := byte(0)
+	for 1<<blkszbits < w.blockSize {
+		blkszbits++
+	}
+
+	incompat := uint32(0)
+	if w.opts.Compression == CompressionLZ4 {
+		incompat |= IncompatZeroPadding
+	}
+
+	le.PutUint32(sb[0:], Magic)
+	le.PutUint32(sb[8:], CompatMTime)
+	sb[12] = blkszbits
+	le.PutUint16(sb[14:], uint16(w.root.nid()))
+	le.PutUint64(sb[16:], uint64(inodes))
+	le.PutUint64(sb[24:], uint64(w.opts.Time.Unix()))
+	le.PutUint32(sb[32:], uint32(w.opts.Time.Nanosecond()))
+	le.PutUint32(sb[36:], uint32(blocks))
+	le.PutUint32(sb[44:], uint32(w.xattrBlk))
+	copy(sb[48:64], w.opts.UUID[:])
+	copy(sb[64:80], w.opts.Label)
+	le.PutUint32(sb[80:], incompat)
+
+	return sb
+}
+
+// Size returns the size of the image once the writer is closed.
+func (w *Writer) Size() int64 {
+	return w.size
+}
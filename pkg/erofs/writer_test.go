@@ -0,0 +1,339 @@
+package erofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/csnewman/go-appliance/pkg/internal/membuf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fsck runs fsck.erofs over the image when it is available on the host.
+func fsck(t *testing.T, img []byte) {
+	t.Helper()
+
+	bin, err := exec.LookPath("fsck.erofs")
+	if err != nil {
+		t.Log("fsck.erofs not available, skipping consistency check")
+
+		return
+	}
+
+	path := filepath.Join(t.TempDir(), "erofs.img")
+	require.NoError(t, os.WriteFile(path, img, 0o644), "image should save")
+
+	out, err := exec.Command(bin, "--extract", path).CombinedOutput()
+	assert.NoError(t, err, "fsck.erofs should pass:\n%s", out)
+}
+
+var (
+	buildTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	text      = bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 10000)
+	noise     = make([]byte, 100000)
+	mixed     []byte
+)
+
+func init() {
+	rand.New(rand.NewSource(1)).Read(noise)
+
+	mixed = slices.Concat(text[:3*DefaultBlockSize], noise[:2*DefaultBlockSize], text[:2*DefaultBlockSize])
+}
+
+// selinux is a label shared by several files, which should be stored once in the shared xattr area.
+var selinux = map[string][]byte{"security.selinux": []byte("system_u:object_r:bin_t:s0")}
+
+func buildImage(t *testing.T, opts Options) (*Writer, []byte) {
+	t.Helper()
+
+	img := &membuf.Buffer{}
+	bs := DefaultBlockSize
+
+	w, err := NewWriter(img, 0, opts)
+	require.NoError(t, err, "writer should create")
+
+	require.NoError(t, w.Mkdir(".", fsmeta.Attr{Mode: 0o755, Xattrs: map[string][]byte{"user.root": []byte("yes")}}),
+		"root should update")
+	require.NoError(t, w.Mkdir("var/lib/app", fsmeta.Attr{Mode: 0o700, UID: 1000, GID: 70000,
+		ModTime: time.Unix(1600000000, 5)}), "dir should create")
+
+	require.NoError(t, w.WriteFile("bin/init", strings.NewReader("#!/bin/sh\nexec /sbin/runit\n"),
+		fsmeta.Attr{Mode: 0o755, Xattrs: selinux}), "labelled file should write")
+	require.NoError(t, w.WriteFile("bin/sh", bytes.NewReader(noise[:300]), fsmeta.Attr{Mode: 0o755, Xattrs: selinux}),
+		"labelled file should write")
+	require.NoError(t, w.WriteFile("bin/busybox", bytes.NewReader(noise[:9000]), fsmeta.Attr{
+		Mode:   0o755,
+		Xattrs: map[string][]byte{"security.selinux": selinux["security.selinux"], "user.applet": []byte("multi-call")},
+	}), "labelled file should write")
+	require.NoError(t, w.Link("sbin/init", "bin/init"), "hard link should create")
+
+	// The tails are sized around what fits in a block after an extended inode.
+	require.NoError(t, w.WriteFile("tail/short", bytes.NewReader(noise[:100]), fsmeta.Attr{Mode: 0o644}),
+		"short file should write")
+	require.NoError(t, w.WriteFile("tail/fits", bytes.NewReader(noise[:2*bs-ExtendedInodeSize]),
+		fsmeta.Attr{Mode: 0o644, UID: 70000}), "file filling the inode block should write")
+	require.NoError(t, w.WriteFile("tail/spills", bytes.NewReader(noise[:2*bs-ExtendedInodeSize+1]),
+		fsmeta.Attr{Mode: 0o644, UID: 70000}), "file overflowing the inode block should write")
+	require.NoError(t, w.WriteFile("tail/aligned", bytes.NewReader(noise[:bs]), fsmeta.Attr{Mode: 0o644}),
+		"block sized file should write")
+
+	require.NoError(t, w.WriteFile("usr/share/text", bytes.NewReader(text), fsmeta.Attr{Mode: 0o644}),
+		"text should write")
+	require.NoError(t, w.WriteFile("usr/share/noise", bytes.NewReader(noise), fsmeta.Attr{Mode: 0o644}),
+		"noise should write")
+	require.NoError(t, w.WriteFile("usr/share/mixed", bytes.NewReader(mixed), fsmeta.Attr{Mode: 0o644}),
+		"mixed file should write")
+	require.NoError(t, w.WriteFile("usr/share/empty", strings.NewReader(""), fsmeta.Attr{Mode: 0o600}),
+		"empty file should write")
+
+	require.NoError(t, w.Symlink("lib", "usr/lib", fsmeta.Attr{Mode: 0o777}), "symlink should create")
+	require.NoError(t, w.Symlink("usr/lib/long", strings.Repeat("../", 1000)+"lib", fsmeta.Attr{Mode: 0o777}),
+		"long symlink should create")
+	require.NoError(t, w.Mknod("dev/console", fsmeta.Attr{Mode: fs.ModeDevice | fs.ModeCharDevice | 0o600, Major: 5,
+		Minor: 1}), "char device should create")
+	require.NoError(t, w.Mknod("run/initctl", fsmeta.Attr{Mode: fs.ModeNamedPipe | 0o600}), "fifo should create")
+
+	for i := range 200 {
+		require.NoError(t, w.WriteFile(fmt.Sprintf("usr/lib/modules/module-%03d.ko", i), bytes.NewReader(text[:i]),
+			fsmeta.Attr{Mode: 0o644}), "module should write")
+	}
+
+	require.NoError(t, w.Close(), "writer should close")
+
+	return w, img.Data
+}
+
+// readXattrs decodes the xattrs stored after an inode, resolving shared entries through the superblock.
+func readXattrs(w *Writer, img []byte, n *node) map[string][]byte {
+	le := binary.LittleEndian
+	body := img[n.pos+w.inodeSize(n):][:len(n.xattrs)]
+	area := img[uint64(le.Uint32(img[SuperblockOffset+44:]))*DefaultBlockSize:]
+	xattrs := make(map[string][]byte)
+
+	decode := func(entry []byte) int {
+		nameLen, valueLen := int(entry[0]), int(le.Uint16(entry[2:]))
+
+		for _, x := range xattrNames {
+			if x.index == entry[1] {
+				xattrs[x.prefix+string(entry[4:4+nameLen])] = entry[4+nameLen:][:valueLen]
+			}
+		}
+
+		return (4 + nameLen + valueLen + 3) &^ 3
+	}
+
+	shared := int(body[4])
+
+	for i := range shared {
+		decode(area[le.Uint32(body[xattrHeaderSize+4*i:])*4:])
+	}
+
+	for pos := xattrHeaderSize + 4*shared; pos < len(body); {
+		pos += decode(body[pos:])
+	}
+
+	return xattrs
+}
+
+// readCompressed reassembles a compressed file from its logical clusters.
+func readCompressed(t *testing.T, img []byte, n *node) []byte {
+	t.Helper()
+
+	var data []byte
+
+	for i, lc := range n.lclusters {
+		block := img[uint64(lc.blkaddr)*DefaultBlockSize:][:DefaultBlockSize]
+
+		switch lc.ty {
+		case LclusterHead1:
+			out, err := lz4Decompress(bytes.TrimLeft(block, "\x00"))
+			require.NoError(t, err, "cluster %v should decompress", i)
+
+			data = append(data, out...)
+		case LclusterPlain:
+			data = append(data, block...)
+		case LclusterNonHead:
+			assert.NotZero(t, lc.delta[0], "non-head cluster should point back to its head")
+			assert.NotZero(t, lc.delta[1], "non-head cluster should point to the next head")
+		}
+	}
+
+	return data[:n.size]
+}
+
+func TestWriter(t *testing.T) {
+	w, img := buildImage(t, Options{Label: "rootfs", Time: buildTime})
+
+	le := binary.LittleEndian
+	sb := img[SuperblockOffset:]
+	bs := uint64(DefaultBlockSize)
+
+	assert.Equal(t, uint32(Magic), le.Uint32(sb), "magic should be set")
+	assert.Equal(t, byte(12), sb[12], "block size should be 4KiB")
+	assert.Equal(t, uint16(RootOffset/SlotSize), le.Uint16(sb[14:]), "root should follow the superblock")
+	assert.Equal(t, uint64(buildTime.Unix()), le.Uint64(sb[24:]), "build time should be set")
+	assert.Equal(t, uint32(len(img)/DefaultBlockSize), le.Uint32(sb[36:]), "blocks should cover the image")
+	assert.NotZero(t, le.Uint32(sb[44:]), "shared xattr area should be set")
+	assert.Equal(t, "rootfs", strings.TrimRight(string(sb[64:80]), "\x00"), "label should be set")
+	assert.Zero(t, le.Uint32(sb[80:]), "no incompatible features should be needed")
+	assert.Equal(t, int64(len(img)), w.Size(), "size should match the image")
+
+	bin := w.root.children["bin"]
+	tail := w.root.children["tail"]
+	app := w.root.children["var"].children["lib"].children["app"]
+	modules := w.root.children["usr"].children["lib"].children["modules"]
+
+	assert.Equal(t, uint64(CompactInodeSize), w.inodeSize(bin.children["init"]), "default metadata should be compact")
+	assert.Equal(t, uint64(ExtendedInodeSize), w.inodeSize(app), "large ids and times should use an extended inode")
+	assert.Same(t, bin.children["init"], w.root.children["sbin"].children["init"], "hard link should share the inode")
+	assert.Equal(t, uint32(2), bin.children["init"].links, "hard link should be counted")
+	assert.Equal(t, uint32(2+7), w.root.links, "root should count subdirectories")
+
+	// Every inode is slot aligned, and inline data never crosses a block boundary.
+	for _, n := range w.collect(w.root, nil) {
+		assert.Zero(t, n.pos%SlotSize, "inodes should be slot aligned")
+
+		if n.layout == LayoutFlatInline {
+			start := n.pos + w.inodeSize(n) + uint64(len(n.xattrs))
+			assert.LessOrEqual(t, start%bs+n.size%bs, bs, "inline data should not cross a block")
+			assert.Equal(t, n.tail, img[start:][:n.size%bs], "inline data should follow the xattrs")
+		}
+	}
+
+	assert.Equal(t, LayoutFlatInline, tail.children["short"].layout, "short file should be inlined")
+	assert.Equal(t, LayoutFlatPlain, tail.children["aligned"].layout, "file without a tail should be plain")
+	assert.Equal(t, LayoutFlatPlain, w.root.children["usr"].children["share"].children["empty"].layout,
+		"empty file should be plain")
+
+	fits := tail.children["fits"]
+	require.Equal(t, LayoutFlatInline, fits.layout, "tail filling the inode block should be inlined")
+	assert.Zero(t, fits.pos%bs, "inode should move to a new block to hold its tail")
+	assert.Zero(t, (fits.pos+w.recordSize(fits))%bs, "tail should end at the block boundary")
+
+	spills := tail.children["spills"]
+	require.Equal(t, LayoutFlatPlain, spills.layout, "tail too large for the inode block should not be inlined")
+	assert.Equal(t, noise[:spills.size], img[spills.blkaddr*bs:][:spills.size], "tail should follow the full blocks")
+
+	assert.Equal(t, LayoutFlatInline, w.root.children["lib"].layout, "short symlink should be inlined")
+	assert.Greater(t, len(modules.listing), 1, "large directory should span blocks")
+
+	// The shared label is stored once, and referenced alongside the attributes unique to each inode.
+	busybox := bin.children["busybox"]
+
+	for _, n := range []*node{bin.children["init"], bin.children["sh"], busybox} {
+		assert.Equal(t, byte(1), n.xattrs[4], "label should be shared")
+		assert.Equal(t, n.xattrs[xattrHeaderSize:][:4], busybox.xattrs[xattrHeaderSize:][:4],
+			"label should be referenced by the same id")
+		assert.Equal(t, n.attr.Xattrs, readXattrs(w, img, n), "xattrs should decode")
+	}
+
+	assert.Zero(t, w.root.xattrs[4], "unique xattrs should be stored inline")
+	assert.Equal(t, w.root.attr.Xattrs, readXattrs(w, img, w.root), "root xattrs should decode")
+
+	fsck(t, img)
+}
+
+func TestWriterCompressed(t *testing.T) {
+	w, img := buildImage(t, Options{Compression: CompressionLZ4, Time: buildTime})
+
+	assert.Equal(t, uint32(IncompatZeroPadding), binary.LittleEndian.Uint32(img[SuperblockOffset+80:]),
+		"zero padding should be enabled")
+
+	share := w.root.children["usr"].children["share"]
+	compressed := share.children["text"]
+
+	require.Equal(t, LayoutCompressedFull, compressed.layout, "compressible file should be compressed")
+	assert.Equal(t, LayoutFlatPlain, share.children["noise"].layout, "incompressible file should be stored as is")
+	assert.Less(t, compressed.blocks, uint64(len(text)/DefaultBlockSize), "compression should save blocks")
+	assert.Len(t, compressed.lclusters, (len(text)+DefaultBlockSize-1)/DefaultBlockSize,
+		"every logical cluster should be indexed")
+	assert.Equal(t, text, readCompressed(t, img, compressed), "clusters should reproduce the file")
+
+	// The compressible runs of the mixed file are packed into single block pclusters, with the noise between them
+	// stored one plain cluster at a time.
+	mixedNode := share.children["mixed"]
+
+	var types []uint16
+
+	for _, lc := range mixedNode.lclusters {
+		types = append(types, lc.ty)
+	}
+
+	require.Equal(t, LayoutCompressedFull, mixedNode.layout, "mixed file should be compressed")
+	assert.Equal(t, []uint16{
+		LclusterHead1, LclusterNonHead, LclusterNonHead, LclusterPlain, LclusterPlain, LclusterHead1, LclusterNonHead,
+	}, types, "clusters should follow the content")
+	assert.Equal(t, uint64(4), mixedNode.blocks, "each pcluster should take one block")
+	assert.Equal(t, mixed, readCompressed(t, img, mixedNode), "clusters should reproduce the file")
+
+	fsck(t, img)
+}
+
+func TestWriterDeterministic(t *testing.T) {
+	for _, comp := range []Compression{CompressionNone, CompressionLZ4} {
+		_, first := buildImage(t, Options{Compression: comp})
+		_, second := buildImage(t, Options{Compression: comp})
+
+		assert.Equal(t, first, second, "images should be identical")
+	}
+}
+
+func TestWriterAddFS(t *testing.T) {
+	w, err := NewWriter(&membuf.Buffer{}, 0, Options{})
+	require.NoError(t, err, "writer should create")
+
+	require.NoError(t, w.AddFS(fstest.MapFS{
+		"bin/busybox": {Data: []byte("tool"), Mode: 0o755, Sys: &fsmeta.Attr{Mode: 0o755, Inode: 5}},
+		"bin/sh":      {Data: []byte("tool"), Mode: 0o755, Sys: &fsmeta.Attr{Mode: 0o755, Inode: 5}},
+		"etc/motd":    {Data: []byte("hello\n"), Mode: 0o644},
+	}), "fs should add")
+
+	bin := w.root.children["bin"]
+	assert.Same(t, bin.children["busybox"], bin.children["sh"], "files sharing an inode should be linked")
+	require.NoError(t, w.Close(), "writer should close")
+}
+
+func TestWriterErrors(t *testing.T) {
+	_, err := NewWriter(&membuf.Buffer{}, 0, Options{BlockSize: 1024})
+	assert.ErrorIs(t, err, ErrInvalidBlock, "small block size should be rejected")
+
+	_, err = NewWriter(&membuf.Buffer{}, 0, Options{Label: strings.Repeat("x", 17)})
+	assert.ErrorIs(t, err, ErrInvalidName, "long label should be rejected")
+
+	w, err := NewWriter(&membuf.Buffer{}, 0, Options{})
+	require.NoError(t, err, "writer should create")
+
+	require.NoError(t, w.WriteFile("file", strings.NewReader("x"), fsmeta.Attr{Mode: 0o644}), "file should write")
+	assert.ErrorIs(t, w.WriteFile("file", strings.NewReader(""), fsmeta.Attr{}), ErrExist, "duplicate should be rejected")
+	assert.ErrorIs(t, w.WriteFile("file/x", strings.NewReader(""), fsmeta.Attr{}), ErrNotDir,
+		"file parent should be rejected")
+	require.NoError(t, w.Mkdir("dir", fsmeta.Attr{}), "dir should create")
+	assert.ErrorIs(t, w.Link("dir2", "dir"), ErrUnsupportedType, "directory hard link should be rejected")
+	assert.ErrorIs(t, w.Mknod("reg", fsmeta.Attr{Mode: 0o644}), ErrUnsupportedType, "regular mknod should be rejected")
+	assert.ErrorIs(t, w.Symlink("link", strings.Repeat("x", 5000), fsmeta.Attr{}), ErrInvalidName,
+		"long symlink should be rejected")
+	assert.ErrorIs(t, w.WriteFile("bad", strings.NewReader(""), fsmeta.Attr{Xattrs: map[string][]byte{"system.x": nil}}),
+		ErrInvalidXattr, "unsupported xattr namespace should be rejected")
+	require.NoError(t, w.Mkdir(".", fsmeta.Attr{Xattrs: map[string][]byte{"user.big": make([]byte, 4000)}}),
+		"root xattrs should be accepted until close")
+	assert.ErrorIs(t, w.Close(), ErrInvalidXattr, "root xattrs beyond the first block should be rejected")
+	assert.ErrorIs(t, w.Close(), ErrClosed, "second close should fail")
+
+	small, err := NewWriter(&membuf.Buffer{}, 8192, Options{})
+	require.NoError(t, err, "writer should create")
+
+	err = small.WriteFile("big", bytes.NewReader(noise), fsmeta.Attr{Mode: 0o644})
+	assert.ErrorIs(t, err, ErrNoSpace, "oversized image should be rejected")
+}
@@ -0,0 +1,300 @@
+package ext4
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	SuperblockOffset = 1024
+	SuperblockSize   = 1024
+	SuperblockMagic  = 0xEF53
+	InodeSize        = 256
+	GroupDescSize    = 32
+	ExtraInodeSize   = 32
+
+	RootInode        = 2
+	JournalInode     = 8
+	FirstInode       = 11
+	LostAndFound     = FirstInode
+	lostAndFoundSize = 16 * 1024
+
+	CompatHasJournal = 0x4
+	CompatExtAttr    = 0x8
+	CompatDirIndex   = 0x20
+
+	IncompatFiletype   = 0x2
+	IncompatRecover    = 0x4
+	IncompatJournalDev = 0x8
+	IncompatMetaBG     = 0x10
+	IncompatExtents    = 0x40
+	Incompat64Bit      = 0x80
+	IncompatFlexBG     = 0x200
+	IncompatInlineData = 0x8000
+
+	ROCompatSparseSuper  = 0x1
+	ROCompatLargeFile    = 0x2
+	ROCompatHugeFile     = 0x8
+	ROCompatGDTCsum      = 0x10
+	ROCompatDirNlink     = 0x20
+	ROCompatExtraIsize   = 0x40
+	ROCompatMetadataCsum = 0x400
+
+	InodeFlagIndex      = 0x1000
+	InodeFlagHugeFile   = 0x40000
+	InodeFlagExtents    = 0x80000
+	InodeFlagInlineData = 0x10000000
+
+	ExtentMagic     = 0xF30A
+	extentHeaderLen = 12
+	extentEntryLen  = 12
+	maxExtentLen    = 32768
+
+	JournalMagic        = 0xC03B3998
+	journalSuperblockV2 = 4
+
+	defaultBlockSize  = 4096
+	defaultInodeRatio = 16384
+	maxLinks          = 65000
+)
+
+// Directory entry file types.
+const (
+	FileTypeUnknown = iota
+	FileTypeRegular
+	FileTypeDir
+	FileTypeChar
+	FileTypeBlock
+	FileTypeFIFO
+	FileTypeSocket
+	FileTypeSymlink
+)
+
+var (
+	ErrTooSmall        = errors.New("filesystem too small")
+	ErrTooLarge        = errors.New("filesystem too large")
+	ErrInvalidBlock    = errors.New("invalid block size")
+	ErrNoSpace         = errors.New("no space left on filesystem")
+	ErrNoInodes        = errors.New("no free inodes")
+	ErrInvalidName     = errors.New("invalid file name")
+	ErrExist           = errors.New("file already exists")
+	ErrNotDir          = errors.New("not a directory")
+	ErrUnsupportedType = errors.New("unsupported file type")
+	ErrTooManyLinks    = errors.New("too many links")
+	ErrInvalidXattr    = errors.New("invalid extended attribute")
+	ErrClosed          = errors.New("writer closed")
+)
+
+type Options struct {
+	// Label is the volume label, up to 16 bytes.
+	Label string
+	// UUID identifies the filesystem. When zero, it is derived from the label and time.
+	UUID uuid.UUID
+	// HashSeed seeds the directory index hash. When zero, it is derived from the UUID.
+	HashSeed uuid.UUID
+	// BlockSize is 1024, 2048 or 4096, defaulting to 4096.
+	BlockSize int
+	// Inodes is the total number of inodes. When zero, one inode is created per InodeRatio bytes.
+	Inodes uint32
+	// InodeRatio defaults to 16384 bytes per inode.
+	InodeRatio int64
+	// JournalSize is the journal size in bytes. It is chosen based on the filesystem size when zero.
+	JournalSize int64
+	// NoJournal disables the journal, producing an ext2-style layout that still uses extents.
+	NoJournal bool
+	// ReservedPercent is the percentage of blocks reserved for root.
+	ReservedPercent int
+	// Time is used for the superblock timestamps and implicitly created directories, defaulting to the Unix epoch.
+	Time time.Time
+}
+
+type layout struct {
+	blockSize      uint64
+	blocks         uint64
+	firstData      uint64
+	blocksPerGroup uint64
+	groups         uint64
+	inodesPerGroup uint64
+	gdtBlocks      uint64
+	tableBlocks    uint64
+}
+
+func (l *layout) groupStart(group uint64) uint64 {
+	return l.firstData + group*l.blocksPerGroup
+}
+
+func (l *layout) groupBlocks(group uint64) uint64 {
+	if group == l.groups-1 {
+		return l.blocks - l.groupStart(group)
+	}
+
+	return l.blocksPerGroup
+}
+
+func (l *layout) hasSuper(group uint64) bool {
+	return sparseSuper(group)
+}
+
+// sparseSuper reports whether a group holds a superblock backup under sparse_super: groups 0, 1 and powers of 3, 5
+// and 7.
+func sparseSuper(group uint64) bool {
+	if group <= 1 {
+		return true
+	}
+
+	for _, base := range []uint64{3, 5, 7} {
+		n := base
+		for n < group {
+			n *= base
+		}
+
+		if n == group {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *layout) overhead(group uint64) uint64 {
+	n := 2 + l.tableBlocks
+	if l.hasSuper(group) {
+		n += 1 + l.gdtBlocks
+	}
+
+	return n
+}
+
+// blockBitmap returns the block bitmap location, which is followed by the inode bitmap and inode table.
+func (l *layout) blockBitmap(group uint64) uint64 {
+	block := l.groupStart(group)
+	if l.hasSuper(group) {
+		block += 1 + l.gdtBlocks
+	}
+
+	return block
+}
+
+func (l *layout) inodeBitmap(group uint64) uint64 {
+	return l.blockBitmap(group) + 1
+}
+
+func (l *layout) inodeTable(group uint64) uint64 {
+	return l.blockBitmap(group) + 2
+}
+
+func (l *layout) inodes() uint64 {
+	return l.groups * l.inodesPerGroup
+}
+
+func newLayout(size int64, opts Options) (*layout, error) {
+	bs := uint64(opts.BlockSize)
+	if bs == 0 {
+		bs = defaultBlockSize
+	}
+
+	if bs != 1024 && bs != 2048 && bs != 4096 {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBlock, bs)
+	}
+
+	l := &layout{
+		blockSize:      bs,
+		blocks:         uint64(size) / bs,
+		blocksPerGroup: bs * 8,
+	}
+
+	if bs == 1024 {
+		l.firstData = 1
+	}
+
+	if l.blocks >= 1<<32 {
+		return nil, fmt.Errorf("%w: %v blocks", ErrTooLarge, l.blocks)
+	}
+
+	if l.blocks < 64 {
+		return nil, fmt.Errorf("%w: %v bytes", ErrTooSmall, size)
+	}
+
+	inodes := uint64(opts.Inodes)
+	if inodes == 0 {
+		ratio := opts.InodeRatio
+		if ratio <= 0 {
+			ratio = defaultInodeRatio
+		}
+
+		inodes = uint64(size / ratio)
+	}
+
+	perBlock := bs / InodeSize
+
+	for {
+		l.groups = (l.blocks - l.firstData + l.blocksPerGroup - 1) / l.blocksPerGroup
+		l.gdtBlocks = (l.groups*GroupDescSize + bs - 1) / bs
+
+		ipg := (max(inodes, FirstInode+5) + l.groups - 1) / l.groups
+		ipg = (ipg + perBlock - 1) / perBlock * perBlock
+		ipg = (ipg + 7) / 8 * 8
+		l.inodesPerGroup = min(ipg, l.blocksPerGroup)
+		l.tableBlocks = l.inodesPerGroup * InodeSize / bs
+
+		// A trailing group too small to hold its own metadata and some data is dropped, as mke2fs does.
+		last := l.groups - 1
+		if last > 0 && l.groupBlocks(last) < l.overhead(last)+50 {
+			l.blocks = l.groupStart(last)
+
+			continue
+		}
+
+		break
+	}
+
+	if l.groupBlocks(0) < l.overhead(0)+l.firstData+16 {
+		return nil, fmt.Errorf("%w: %v bytes", ErrTooSmall, size)
+	}
+
+	return l, nil
+}
+
+// defaultJournalBlocks mirrors the journal sizes picked by mke2fs.
+func defaultJournalBlocks(blocks uint64) uint64 {
+	switch {
+	case blocks < 2048:
+		return 0
+	case blocks < 32768:
+		return 1024
+	case blocks < 256*1024:
+		return 4096
+	case blocks < 512*1024:
+		return 8192
+	case blocks < 4096*1024:
+		return 16384
+	case blocks < 8192*1024:
+		return 32768
+	case blocks < 16384*1024:
+		return 65536
+	case blocks < 32768*1024:
+		return 131072
+	default:
+		return 262144
+	}
+}
+
+func encodeTime(t time.Time) (uint32, uint32) {
+	if t.IsZero() {
+		return 0, 0
+	}
+
+	sec := t.Unix()
+	extra := uint32(uint64(sec-int64(int32(sec)))>>32)&3 | uint32(t.Nanosecond())<<2
+
+	return uint32(sec), extra
+}
+
+func decodeTime(sec uint32, extra uint32) time.Time {
+	s := int64(int32(sec)) + int64(extra&3)<<32
+
+	return time.Unix(s, int64(extra>>2)).UTC()
+}
@@ -0,0 +1,1018 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/google/uuid"
+)
+
+var ErrInvalidFilesystem = errors.New("invalid ext filesystem")
+
+const (
+	maxSymlinks    = 40
+	xattrDataIndex = 7
+	xattrDataName  = "data"
+)
+
+// FS provides read-only access to an ext2, ext3 or ext4 filesystem.
+type FS struct {
+	r              io.ReaderAt
+	blockSize      uint64
+	blocks         uint64
+	firstData      uint64
+	blocksPerGroup uint64
+	inodesPerGroup uint64
+	inodeSize      uint64
+	descSize       uint64
+	firstMetaBG    uint64
+	compat         uint32
+	incompat       uint32
+	roCompat       uint32
+	label          string
+	uuid           uuid.UUID
+}
+
+var (
+	_ fs.FS             = (*FS)(nil)
+	_ fs.ReadDirFS      = (*FS)(nil)
+	_ fs.StatFS         = (*FS)(nil)
+	_ fsmeta.ReadLinkFS = (*FS)(nil)
+)
+
+// Open reads the filesystem at the start of r, such as the section returned by disk.Disk.PartitionSection.
+func Open(r io.ReaderAt) (*FS, error) {
+	sb := make([]byte, SuperblockSize)
+
+	if _, err := r.ReadAt(sb, SuperblockOffset); err != nil {
+		return nil, fmt.Errorf("failed to read superblock: %w", err)
+	}
+
+	le := binary.LittleEndian
+
+	if le.Uint16(sb[56:]) != SuperblockMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidFilesystem)
+	}
+
+	f := &FS{
+		r:              r,
+		blockSize:      1024 << le.Uint32(sb[24:]),
+		blocks:         uint64(le.Uint32(sb[4:])),
+		firstData:      uint64(le.Uint32(sb[20:])),
+		blocksPerGroup: uint64(le.Uint32(sb[32:])),
+		inodesPerGroup: uint64(le.Uint32(sb[40:])),
+		inodeSize:      128,
+		descSize:       GroupDescSize,
+	}
+
+	if le.Uint32(sb[76:]) >= 1 {
+		f.inodeSize = uint64(le.Uint16(sb[88:]))
+		f.compat = le.Uint32(sb[92:])
+		f.incompat = le.Uint32(sb[96:])
+		f.roCompat = le.Uint32(sb[100:])
+		f.label = strings.TrimRight(string(sb[120:136]), "\x00")
+		f.firstMetaBG = uint64(le.Uint32(sb[260:]))
+		copy(f.uuid[:], sb[104:120])
+	}
+
+	if f.incompat&Incompat64Bit != 0 {
+		f.blocks |= uint64(le.Uint32(sb[336:])) << 32
+
+		if size := uint64(le.Uint16(sb[254:])); size > GroupDescSize {
+			f.descSize = size
+		}
+	}
+
+	switch {
+	case f.blockSize > 64*1024:
+		return nil, fmt.Errorf("%w: block size %v", ErrInvalidFilesystem, f.blockSize)
+	case f.blocksPerGroup == 0 || f.inodesPerGroup == 0:
+		return nil, fmt.Errorf("%w: empty groups", ErrInvalidFilesystem)
+	case f.inodeSize < 128 || f.inodeSize > f.blockSize || f.inodeSize&(f.inodeSize-1) != 0:
+		return nil, fmt.Errorf("%w: inode size %v", ErrInvalidFilesystem, f.inodeSize)
+	case f.incompat&IncompatJournalDev != 0:
+		return nil, fmt.Errorf("%w: external journal device", ErrInvalidFilesystem)
+	}
+
+	return f, nil
+}
+
+func (f *FS) Label() string {
+	return f.label
+}
+
+func (f *FS) UUID() uuid.UUID {
+	return f.uuid
+}
+
+func (f *FS) readBlock(block uint64) ([]byte, error) {
+	if block >= f.blocks {
+		return nil, fmt.Errorf("%w: block %v out of range", ErrInvalidFilesystem, block)
+	}
+
+	buf := make([]byte, f.blockSize)
+
+	if _, err := f.r.ReadAt(buf, int64(block*f.blockSize)); err != nil {
+		return nil, fmt.Errorf("failed to read block %v: %w", block, err)
+	}
+
+	return buf, nil
+}
+
+func (f *FS) hasSuper(group uint64) bool {
+	if f.roCompat&ROCompatSparseSuper == 0 {
+		return true
+	}
+
+	return sparseSuper(group)
+}
+
+// descriptorBlock locates the block holding a group descriptor, which moves into each meta group with meta_bg.
+func (f *FS) descriptorBlock(group uint64) uint64 {
+	perBlock := f.blockSize / f.descSize
+	idx := group / perBlock
+
+	if f.incompat&IncompatMetaBG == 0 || idx < f.firstMetaBG {
+		return f.firstData + 1 + idx
+	}
+
+	first := idx * perBlock
+	block := f.firstData + first*f.blocksPerGroup
+
+	if f.hasSuper(first) {
+		block++
+	}
+
+	return block
+}
+
+func (f *FS) inodeTable(group uint64) (uint64, error) {
+	desc := make([]byte, f.descSize)
+	off := f.descriptorBlock(group)*f.blockSize + group%(f.blockSize/f.descSize)*f.descSize
+
+	if _, err := f.r.ReadAt(desc, int64(off)); err != nil {
+		return 0, fmt.Errorf("failed to read group descriptor: %w", err)
+	}
+
+	table := uint64(binary.LittleEndian.Uint32(desc[8:]))
+	if f.descSize >= 64 {
+		table |= uint64(binary.LittleEndian.Uint32(desc[40:])) << 32
+	}
+
+	return table, nil
+}
+
+type inodeData struct {
+	num     uint32
+	raw     []byte
+	mode    uint32
+	size    uint64
+	flags   uint32
+	iblock  []byte
+	fileACL uint64
+	extra   uint64
+}
+
+func (n *inodeData) isDir() bool {
+	return n.mode&fsmeta.ModeTypeMask == fsmeta.ModeDir
+}
+
+func (n *inodeData) isSymlink() bool {
+	return n.mode&fsmeta.ModeTypeMask == fsmeta.ModeSymlink
+}
+
+// time decodes a timestamp, using the nanosecond field in the extended area when present.
+func (n *inodeData) time(sec int, extra int) time.Time {
+	raw := binary.LittleEndian.Uint32(n.raw[sec:])
+
+	if extra >= 128 && uint64(extra)+4 <= 128+n.extra {
+		return decodeTime(raw, binary.LittleEndian.Uint32(n.raw[extra:]))
+	}
+
+	return time.Unix(int64(int32(raw)), 0).UTC()
+}
+
+func (f *FS) readInode(num uint32) (*inodeData, error) {
+	if num == 0 || uint64(num) > f.inodesPerGroup*((f.blocks-f.firstData+f.blocksPerGroup-1)/f.blocksPerGroup) {
+		return nil, fmt.Errorf("%w: inode %v out of range", ErrInvalidFilesystem, num)
+	}
+
+	group := uint64(num-1) / f.inodesPerGroup
+	idx := uint64(num-1) % f.inodesPerGroup
+
+	table, err := f.inodeTable(group)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, f.inodeSize)
+
+	if _, err := f.r.ReadAt(raw, int64(table*f.blockSize+idx*f.inodeSize)); err != nil {
+		return nil, fmt.Errorf("failed to read inode %v: %w", num, err)
+	}
+
+	le := binary.LittleEndian
+
+	n := &inodeData{
+		num:     num,
+		raw:     raw,
+		mode:    uint32(le.Uint16(raw[0:])),
+		size:    uint64(le.Uint32(raw[4:])) | uint64(le.Uint32(raw[108:]))<<32,
+		flags:   le.Uint32(raw[32:]),
+		iblock:  raw[40:100],
+		fileACL: uint64(le.Uint32(raw[104:])) | uint64(le.Uint16(raw[118:]))<<32,
+	}
+
+	if f.inodeSize > 128 {
+		n.extra = uint64(le.Uint16(raw[128:]))
+
+		if 128+n.extra > f.inodeSize {
+			return nil, fmt.Errorf("%w: inode %v extra size %v", ErrInvalidFilesystem, num, n.extra)
+		}
+	}
+
+	return n, nil
+}
+
+// mapBlock returns the physical block backing a logical block and the number of following blocks that are also
+// contiguous. A physical block of zero denotes a hole.
+func (f *FS) mapBlock(n *inodeData, logical uint64) (uint64, uint64, error) {
+	if n.flags&InodeFlagExtents != 0 {
+		return f.mapExtent(n.iblock, logical, 0)
+	}
+
+	return f.mapIndirect(n, logical)
+}
+
+func (f *FS) mapExtent(node []byte, logical uint64, level int) (uint64, uint64, error) {
+	le := binary.LittleEndian
+
+	if level > 5 || len(node) < extentHeaderLen || le.Uint16(node[0:]) != ExtentMagic {
+		return 0, 0, fmt.Errorf("%w: bad extent header", ErrInvalidFilesystem)
+	}
+
+	entries := int(le.Uint16(node[2:]))
+	depth := le.Uint16(node[6:])
+
+	if extentHeaderLen+entries*extentEntryLen > len(node) {
+		return 0, 0, fmt.Errorf("%w: extent node overflows", ErrInvalidFilesystem)
+	}
+
+	entry := func(i int) []byte {
+		return node[extentHeaderLen+i*extentEntryLen:]
+	}
+
+	// Find the last entry starting at or before the logical block.
+	idx := -1
+	for i := range entries {
+		if uint64(le.Uint32(entry(i))) > logical {
+			break
+		}
+
+		idx = i
+	}
+
+	if depth > 0 {
+		if idx < 0 {
+			return 0, 1, nil
+		}
+
+		e := entry(idx)
+		child := uint64(le.Uint32(e[4:])) | uint64(le.Uint16(e[8:]))<<32
+
+		buf, err := f.readBlock(child)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		return f.mapExtent(buf, logical, level+1)
+	}
+
+	hole := uint64(1)
+
+	if idx+1 < entries {
+		hole = uint64(le.Uint32(entry(idx+1))) - logical
+	}
+
+	if idx < 0 {
+		return 0, hole, nil
+	}
+
+	e := entry(idx)
+	start := uint64(le.Uint32(e[0:]))
+	length := uint64(le.Uint16(e[4:]))
+	phys := uint64(le.Uint32(e[8:])) | uint64(le.Uint16(e[6:]))<<32
+
+	// Lengths above the maximum mark preallocated extents, which read as zeros.
+	unwritten := length > maxExtentLen
+	if unwritten {
+		length -= maxExtentLen
+	}
+
+	if logical >= start+length {
+		return 0, hole, nil
+	}
+
+	if unwritten {
+		return 0, start + length - logical, nil
+	}
+
+	return phys + logical - start, start + length - logical, nil
+}
+
+func (f *FS) mapIndirect(n *inodeData, logical uint64) (uint64, uint64, error) {
+	le := binary.LittleEndian
+	perBlock := f.blockSize / 4
+
+	if logical < 12 {
+		return uint64(le.Uint32(n.iblock[logical*4:])), 1, nil
+	}
+
+	logical -= 12
+
+	var (
+		ptr    uint64
+		levels int
+	)
+
+	switch {
+	case logical < perBlock:
+		ptr, levels = uint64(le.Uint32(n.iblock[48:])), 1
+	case logical-perBlock < perBlock*perBlock:
+		logical -= perBlock
+		ptr, levels = uint64(le.Uint32(n.iblock[52:])), 2
+	default:
+		logical -= perBlock + perBlock*perBlock
+		ptr, levels = uint64(le.Uint32(n.iblock[56:])), 3
+	}
+
+	for level := levels - 1; level >= 0; level-- {
+		if ptr == 0 {
+			return 0, 1, nil
+		}
+
+		buf, err := f.readBlock(ptr)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		span := uint64(1)
+		for range level {
+			span *= perBlock
+		}
+
+		ptr = uint64(le.Uint32(buf[logical/span%perBlock*4:]))
+	}
+
+	return ptr, 1, nil
+}
+
+// inlineData returns the contents of an inode using inline data, stored in i_block and the system.data attribute.
+func (f *FS) inlineData(n *inodeData) ([]byte, error) {
+	data := slices.Clone(n.iblock)
+
+	attrs, err := f.rawXattrs(n)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range attrs {
+		if a.index == xattrDataIndex && a.name == xattrDataName {
+			data = append(data, a.value...)
+		}
+	}
+
+	return data, nil
+}
+
+func (f *FS) readAt(n *inodeData, data []byte, off int64) (int, error) {
+	size := int64(n.size)
+
+	if off < 0 {
+		return 0, fs.ErrInvalid
+	}
+
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	if n.flags&InodeFlagInlineData != 0 {
+		inline, err := f.inlineData(n)
+		if err != nil {
+			return 0, err
+		}
+
+		buf := data[:min(int64(len(data)), size-off)]
+
+		// Bytes past the inline data but within the file size read as zeros, like a hole.
+		copied := 0
+		if off < int64(len(inline)) {
+			copied = copy(buf, inline[off:min(int64(len(inline)), size)])
+		}
+
+		clear(buf[copied:])
+
+		if len(buf) < len(data) {
+			return len(buf), io.EOF
+		}
+
+		return len(buf), nil
+	}
+
+	bs := int64(f.blockSize)
+	total := 0
+
+	for total < len(data) && off < size {
+		phys, count, err := f.mapBlock(n, uint64(off/bs))
+		if err != nil {
+			return total, err
+		}
+
+		within := off % bs
+		chunk := min(int64(len(data)-total), int64(count)*bs-within, size-off)
+		buf := data[total : total+int(chunk)]
+
+		if phys == 0 {
+			clear(buf)
+		} else if _, err := f.r.ReadAt(buf, int64(phys)*bs+within); err != nil {
+			return total, fmt.Errorf("failed to read inode %v: %w", n.num, err)
+		}
+
+		total += int(chunk)
+		off += chunk
+	}
+
+	if total < len(data) {
+		return total, io.EOF
+	}
+
+	return total, nil
+}
+
+func (f *FS) readAll(n *inodeData) ([]byte, error) {
+	buf := make([]byte, n.size)
+
+	if _, err := f.readAt(n, buf, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func (f *FS) readLink(n *inodeData) (string, error) {
+	// Fast symlinks keep the target in i_block rather than in a data block.
+	if n.flags&(InodeFlagExtents|InodeFlagInlineData) == 0 && n.size < uint64(len(n.iblock)) {
+		return string(n.iblock[:n.size]), nil
+	}
+
+	data, err := f.readAll(n)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+type rawXattr struct {
+	index byte
+	name  string
+	value []byte
+}
+
+func (f *FS) parseXattrs(buf []byte, start int, base int, out []rawXattr) ([]rawXattr, error) {
+	le := binary.LittleEndian
+
+	for pos := start; pos+4 <= len(buf) && le.Uint32(buf[pos:]) != 0; {
+		if pos+xattrEntryLen > len(buf) {
+			return nil, fmt.Errorf("%w: xattr entry overflows", ErrInvalidFilesystem)
+		}
+
+		e := buf[pos:]
+		nameLen := int(e[0])
+		offs := int(le.Uint16(e[2:]))
+		inum := le.Uint32(e[4:])
+		size := int(le.Uint32(e[8:]))
+
+		if pos+xattrEntryLen+nameLen > len(buf) {
+			return nil, fmt.Errorf("%w: xattr name overflows", ErrInvalidFilesystem)
+		}
+
+		x := rawXattr{index: e[1], name: string(e[xattrEntryLen : xattrEntryLen+nameLen])}
+
+		if inum != 0 {
+			// Large values live in a dedicated inode when ea_inode is enabled.
+			vn, err := f.readInode(inum)
+			if err != nil {
+				return nil, err
+			}
+
+			if x.value, err = f.readAll(vn); err != nil {
+				return nil, err
+			}
+		} else {
+			if base+offs+size > len(buf) {
+				return nil, fmt.Errorf("%w: xattr value overflows", ErrInvalidFilesystem)
+			}
+
+			x.value = slices.Clone(buf[base+offs : base+offs+size])
+		}
+
+		out = append(out, x)
+		pos += xattrEntryLen + (nameLen+3)&^3
+	}
+
+	return out, nil
+}
+
+func (f *FS) rawXattrs(n *inodeData) ([]rawXattr, error) {
+	var (
+		out []rawXattr
+		err error
+	)
+
+	if start := 128 + n.extra; n.extra > 0 && start+4 <= f.inodeSize &&
+		binary.LittleEndian.Uint32(n.raw[start:]) == XattrMagic {
+		out, err = f.parseXattrs(n.raw[start+4:], 0, 0, out)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if n.fileACL != 0 {
+		buf, err := f.readBlock(n.fileACL)
+		if err != nil {
+			return nil, err
+		}
+
+		if binary.LittleEndian.Uint32(buf) != XattrMagic {
+			return nil, fmt.Errorf("%w: bad xattr block magic", ErrInvalidFilesystem)
+		}
+
+		if out, err = f.parseXattrs(buf, xattrHeaderLen, 0, out); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+func (f *FS) attr(n *inodeData) (*fsmeta.Attr, error) {
+	le := binary.LittleEndian
+	raw := n.raw
+
+	attr := &fsmeta.Attr{
+		Mode:       fsmeta.FileMode(n.mode),
+		UID:        uint32(le.Uint16(raw[2:])) | uint32(le.Uint16(raw[120:]))<<16,
+		GID:        uint32(le.Uint16(raw[24:])) | uint32(le.Uint16(raw[122:]))<<16,
+		AccessTime: n.time(8, 140),
+		ChangeTime: n.time(12, 132),
+		ModTime:    n.time(16, 136),
+		Inode:      uint64(n.num),
+	}
+
+	if attr.Mode&fs.ModeDevice != 0 {
+		if old := le.Uint32(n.iblock[0:]); old != 0 {
+			attr.Major = old >> 8 & 0xFF
+			attr.Minor = old & 0xFF
+		} else {
+			dev := le.Uint32(n.iblock[4:])
+			attr.Major = dev & 0xFFF00 >> 8
+			attr.Minor = dev&0xFF | dev>>12&0xFFF00
+		}
+	}
+
+	attrs, err := f.rawXattrs(n)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range attrs {
+		if a.index == xattrDataIndex && a.name == xattrDataName {
+			continue
+		}
+
+		name := joinXattr(a.index, a.name)
+		if name == "" {
+			continue
+		}
+
+		value := a.value
+
+		if a.index == 2 || a.index == 3 {
+			if value, err = aclFromDisk(value); err != nil {
+				return nil, fmt.Errorf("%w: inode %v %v: %w", ErrInvalidFilesystem, n.num, name, err)
+			}
+		}
+
+		if attr.Xattrs == nil {
+			attr.Xattrs = make(map[string][]byte)
+		}
+
+		attr.Xattrs[name] = value
+	}
+
+	return attr, nil
+}
+
+type rawDirEntry struct {
+	name  string
+	inode uint32
+}
+
+func (f *FS) parseDirEntries(data []byte, out []rawDirEntry) ([]rawDirEntry, error) {
+	le := binary.LittleEndian
+
+	for pos := 0; pos+8 <= len(data); {
+		ino := le.Uint32(data[pos:])
+		recLen := int(le.Uint16(data[pos+4:]))
+		nameLen := int(data[pos+6])
+
+		if f.incompat&IncompatFiletype == 0 {
+			nameLen = int(le.Uint16(data[pos+6:]))
+		}
+
+		if f.blockSize >= 65536 && (recLen == 65535 || recLen == 0) {
+			recLen = 65536
+		}
+
+		if recLen < 8 || pos+recLen > len(data) || 8+nameLen > recLen {
+			return nil, fmt.Errorf("%w: corrupt directory entry", ErrInvalidFilesystem)
+		}
+
+		name := string(data[pos+8 : pos+8+nameLen])
+
+		if ino != 0 && name != "." && name != ".." {
+			out = append(out, rawDirEntry{name: name, inode: ino})
+		}
+
+		pos += recLen
+	}
+
+	return out, nil
+}
+
+// readDir lists a directory. Hashed directory index blocks are skipped, as they appear as empty entries.
+func (f *FS) readDir(n *inodeData) ([]rawDirEntry, error) {
+	if n.flags&InodeFlagInlineData != 0 {
+		inline, err := f.inlineData(n)
+		if err != nil {
+			return nil, err
+		}
+
+		// The first four bytes hold the parent inode, replacing the usual dot entries.
+		entries, err := f.parseDirEntries(inline[4:len(n.iblock)], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return f.parseDirEntries(inline[len(n.iblock):], entries)
+	}
+
+	data, err := f.readAll(n)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []rawDirEntry
+
+	for off := uint64(0); off < uint64(len(data)); off += f.blockSize {
+		if entries, err = f.parseDirEntries(data[off:min(off+f.blockSize, uint64(len(data)))], entries); err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+func pathError(op string, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// resolve walks a path from the root, following symlinks in intermediate components and, when follow is set, the
+// final component. Symlink targets are interpreted relative to the filesystem root.
+func (f *FS) resolve(op string, name string, follow bool) (*inodeData, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError(op, name, fs.ErrInvalid)
+	}
+
+	root, err := f.readInode(RootInode)
+	if err != nil {
+		return nil, pathError(op, name, err)
+	}
+
+	stack := []*inodeData{root}
+	parts := strings.Split(name, "/")
+	links := 0
+
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		cur := stack[len(stack)-1]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+
+			continue
+		}
+
+		if !cur.isDir() {
+			return nil, pathError(op, name, ErrNotDir)
+		}
+
+		entries, err := f.readDir(cur)
+		if err != nil {
+			return nil, pathError(op, name, err)
+		}
+
+		idx := slices.IndexFunc(entries, func(e rawDirEntry) bool {
+			return e.name == part
+		})
+
+		if idx < 0 {
+			return nil, pathError(op, name, fs.ErrNotExist)
+		}
+
+		next, err := f.readInode(entries[idx].inode)
+		if err != nil {
+			return nil, pathError(op, name, err)
+		}
+
+		if next.isSymlink() && (len(parts) > 0 || follow) {
+			links++
+			if links > maxSymlinks {
+				return nil, pathError(op, name, errors.New("too many levels of symbolic links"))
+			}
+
+			target, err := f.readLink(next)
+			if err != nil {
+				return nil, pathError(op, name, err)
+			}
+
+			if strings.HasPrefix(target, "/") {
+				stack = stack[:1]
+			}
+
+			parts = append(strings.Split(target, "/"), parts...)
+
+			continue
+		}
+
+		stack = append(stack, next)
+	}
+
+	return stack[len(stack)-1], nil
+}
+
+func (f *FS) info(name string, n *inodeData) (*fileInfo, error) {
+	attr, err := f.attr(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{name: name, size: int64(n.size), attr: attr}, nil
+}
+
+func (f *FS) Open(name string) (fs.File, error) {
+	n, err := f.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.info(path.Base(name), n)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+
+	if n.isDir() {
+		entries, err := f.dirEntries(n)
+		if err != nil {
+			return nil, pathError("open", name, err)
+		}
+
+		return &dir{info: info, entries: entries}, nil
+	}
+
+	return &file{fs: f, info: info, inode: n}, nil
+}
+
+func (f *FS) dirEntries(n *inodeData) ([]fs.DirEntry, error) {
+	raw, err := f.readDir(n)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]fs.DirEntry, len(raw))
+
+	for i, e := range raw {
+		child, err := f.readInode(e.inode)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := f.info(e.name, child)
+		if err != nil {
+			return nil, err
+		}
+
+		out[i] = fs.FileInfoToDirEntry(info)
+	}
+
+	slices.SortFunc(out, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return out, nil
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := f.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if !n.isDir() {
+		return nil, pathError("readdir", name, ErrNotDir)
+	}
+
+	entries, err := f.dirEntries(n)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+
+	return entries, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	n, err := f.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.info(path.Base(name), n)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+
+	return info, nil
+}
+
+// Lstat describes a file without following a final symlink.
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	n, err := f.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.info(path.Base(name), n)
+	if err != nil {
+		return nil, pathError("lstat", name, err)
+	}
+
+	return info, nil
+}
+
+// ReadLink returns the target of a symlink.
+func (f *FS) ReadLink(name string) (string, error) {
+	n, err := f.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+
+	if !n.isSymlink() {
+		return "", pathError("readlink", name, fs.ErrInvalid)
+	}
+
+	target, err := f.readLink(n)
+	if err != nil {
+		return "", pathError("readlink", name, err)
+	}
+
+	return target, nil
+}
+
+type fileInfo struct {
+	name string
+	size int64
+	attr *fsmeta.Attr
+}
+
+func (i *fileInfo) Name() string {
+	return i.name
+}
+
+func (i *fileInfo) Size() int64 {
+	return i.size
+}
+
+func (i *fileInfo) Mode() fs.FileMode {
+	return i.attr.Mode
+}
+
+func (i *fileInfo) ModTime() time.Time {
+	return i.attr.ModTime
+}
+
+func (i *fileInfo) IsDir() bool {
+	return i.attr.Mode.IsDir()
+}
+
+func (i *fileInfo) Sys() any {
+	return i.attr
+}
+
+type file struct {
+	fs     *FS
+	info   *fileInfo
+	inode  *inodeData
+	offset int64
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Read(data []byte) (int, error) {
+	n, err := f.ReadAt(data, f.offset)
+	f.offset += int64(n)
+
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (f *file) ReadAt(data []byte, off int64) (int, error) {
+	return f.fs.readAt(f.inode, data, off)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	default:
+		return 0, fs.ErrInvalid
+	}
+
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+type dir struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *dir) ReadDir(count int) ([]fs.DirEntry, error) {
+	entries := d.entries[d.offset:]
+
+	if count > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+
+		entries = entries[:min(count, len(entries))]
+	}
+
+	d.offset += len(entries)
+
+	return entries, nil
+}
+
+func (d *dir) Close() error {
+	return nil
+}
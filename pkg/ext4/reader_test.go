@@ -0,0 +1,188 @@
+package ext4
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/csnewman/go-appliance/pkg/internal/membuf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func loadImage(t *testing.T, name string) *bytes.Reader {
+	t.Helper()
+
+	f, err := os.Open("testdata/" + name)
+	require.NoError(t, err, "fixture should open")
+
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err, "fixture should decompress")
+
+	data, err := io.ReadAll(gz)
+	require.NoError(t, err, "fixture should read")
+
+	return bytes.NewReader(data)
+}
+
+func TestReaderRoundTrip(t *testing.T) {
+	for _, bs := range []int{1024, 4096} {
+		d := membuf.New(32 << 20)
+		mtime := time.Date(2023, 7, 1, 8, 30, 0, 123456789, time.UTC)
+
+		w, err := NewWriter(d, int64(len(d.Data)), Options{BlockSize: bs, Time: mtime})
+		require.NoError(t, err, "writer should create")
+
+		large := bytes.Repeat([]byte("ext4 reader "), 700000)
+		clear(large[100000:600000])
+
+		require.NoError(t, w.WriteFile("etc/motd", strings.NewReader("welcome\n"), fsmeta.Attr{
+			Mode:    0o640,
+			UID:     1000,
+			GID:     100000,
+			ModTime: mtime,
+			Xattrs:  map[string][]byte{"user.note": []byte("hi"), "trusted.big": bytes.Repeat([]byte{1}, 200)},
+		}), "file should write")
+		require.NoError(t, w.WriteFile("var/large.bin", bytes.NewReader(large), fsmeta.Attr{Mode: 0o600}),
+			"large file should write")
+		require.NoError(t, w.Symlink("etc/issue", "motd", fsmeta.Attr{Mode: 0o777}), "symlink should create")
+		require.NoError(t, w.Symlink("abs", "/etc/motd", fsmeta.Attr{Mode: 0o777}), "symlink should create")
+		require.NoError(t, w.Link("motd.link", "etc/motd"), "hard link should create")
+		require.NoError(t, w.Mknod("dev/sda", fsmeta.Attr{Mode: fs.ModeDevice | 0o660, Major: 8, Minor: 300}),
+			"device should create")
+		require.NoError(t, w.Close(), "writer should close")
+
+		fsys, err := Open(bytes.NewReader(d.Data))
+		require.NoError(t, err, "filesystem should open")
+
+		require.NoError(t, fstest.TestFS(fsys, "etc/motd", "var/large.bin", "motd.link", "dev/sda", "lost+found"),
+			"filesystem should behave")
+
+		data, err := fs.ReadFile(fsys, "var/large.bin")
+		require.NoError(t, err, "large file should read")
+		assert.True(t, bytes.Equal(large, data), "large file should round trip")
+
+		data, err = fs.ReadFile(fsys, "etc/issue")
+		require.NoError(t, err, "symlink should be followed")
+		assert.Equal(t, "welcome\n", string(data), "symlink should resolve")
+
+		data, err = fs.ReadFile(fsys, "abs")
+		require.NoError(t, err, "absolute symlink should be followed")
+		assert.Equal(t, "welcome\n", string(data), "absolute symlink should resolve from the root")
+
+		target, err := fsys.ReadLink("etc/issue")
+		require.NoError(t, err, "link should read")
+		assert.Equal(t, "motd", target, "link target should match")
+
+		info, err := fsys.Lstat("etc/issue")
+		require.NoError(t, err, "lstat should succeed")
+		assert.Equal(t, fs.ModeSymlink, info.Mode().Type(), "lstat should not follow links")
+
+		info, err = fsys.Stat("etc/motd")
+		require.NoError(t, err, "stat should succeed")
+
+		attr := info.Sys().(*fsmeta.Attr)
+		assert.Equal(t, fs.FileMode(0o640), info.Mode(), "mode should round trip")
+		assert.Equal(t, uint32(1000), attr.UID, "uid should round trip")
+		assert.Equal(t, uint32(100000), attr.GID, "gid should round trip")
+		assert.Equal(t, mtime, info.ModTime(), "mtime should round trip")
+		assert.Equal(t, []byte("hi"), attr.Xattrs["user.note"], "xattr should round trip")
+		assert.Len(t, attr.Xattrs["trusted.big"], 200, "block xattr should round trip")
+
+		link, err := fsys.Stat("motd.link")
+		require.NoError(t, err, "hard link should stat")
+		assert.Equal(t, attr.Inode, link.Sys().(*fsmeta.Attr).Inode, "hard link should share an inode")
+
+		info, err = fsys.Stat("dev/sda")
+		require.NoError(t, err, "device should stat")
+		assert.Equal(t, fs.ModeDevice, info.Mode().Type(), "device type should round trip")
+		assert.Equal(t, uint32(8), info.Sys().(*fsmeta.Attr).Major, "major should round trip")
+		assert.Equal(t, uint32(300), info.Sys().(*fsmeta.Attr).Minor, "minor should round trip")
+	}
+}
+
+func TestReaderFixtures(t *testing.T) {
+	for name, label := range map[string]string{"ext2.img.gz": "legacy", "ext4.img.gz": "modern"} {
+		fsys, err := Open(loadImage(t, name))
+		require.NoError(t, err, "%v should open", name)
+		assert.Equal(t, label, fsys.Label(), "%v label should match", name)
+
+		require.NoError(t, fstest.TestFS(fsys, "hello.txt", "tiny.txt", "big.bin", "dir/sub/nested.txt"),
+			"%v should behave", name)
+
+		data, err := fs.ReadFile(fsys, "hello.txt")
+		require.NoError(t, err, "%v file should read", name)
+		assert.Equal(t, "hello world\n", string(data), "%v content should match", name)
+
+		info, err := fsys.Stat("hello.txt")
+		require.NoError(t, err, "%v file should stat", name)
+
+		attr := info.Sys().(*fsmeta.Attr)
+		assert.Equal(t, uint32(1000), attr.UID, "%v uid should match", name)
+		assert.Equal(t, fs.FileMode(0o640), info.Mode(), "%v mode should match", name)
+		assert.Equal(t, time.Unix(1600000000, 0).UTC(), info.ModTime(), "%v mtime should match", name)
+		assert.Equal(t, []byte("test"), attr.Xattrs["user.comment"], "%v xattr should match", name)
+
+		data, err = fs.ReadFile(fsys, "tiny.txt")
+		require.NoError(t, err, "%v small file should read", name)
+		assert.Equal(t, "tiny", string(data), "%v small file should match", name)
+
+		data, err = fs.ReadFile(fsys, "big.bin")
+		require.NoError(t, err, "%v big file should read", name)
+		require.Len(t, data, 300*1024, "%v big file size should match", name)
+
+		for i, b := range data {
+			if b != byte(i*7%251) {
+				t.Fatalf("%v big file differs at %v", name, i)
+			}
+		}
+
+		data, err = fs.ReadFile(fsys, "sparse.bin")
+		require.NoError(t, err, "%v sparse file should read", name)
+		assert.Equal(t, "data in the middle", string(data[512*1024:512*1024+18]), "%v sparse data should match", name)
+		assert.Zero(t, data[0], "%v hole should read as zeros", name)
+
+		target, err := fsys.ReadLink("longlink")
+		require.NoError(t, err, "%v long link should read", name)
+		assert.Equal(t, strings.Repeat("./", 50)+"hello.txt", target, "%v long link should match", name)
+
+		info, err = fsys.Stat("dev/nvme")
+		require.NoError(t, err, "%v device should stat", name)
+		assert.Equal(t, uint32(259), info.Sys().(*fsmeta.Attr).Major, "%v major should match", name)
+		assert.Equal(t, uint32(300), info.Sys().(*fsmeta.Attr).Minor, "%v minor should match", name)
+
+		entries, err := fsys.ReadDir("many")
+		require.NoError(t, err, "%v indexed directory should list", name)
+		assert.Len(t, entries, 400, "%v indexed directory should list every entry", name)
+	}
+}
+
+func TestReaderInlineData(t *testing.T) {
+	fsys, err := Open(loadImage(t, "inline.img.gz"))
+	require.NoError(t, err, "image should open")
+
+	data, err := fs.ReadFile(fsys, "small.txt")
+	require.NoError(t, err, "inline file should read")
+	assert.Equal(t, "hello inline\n", string(data), "inline content should match")
+
+	// sparse.bin holds 60 inline bytes with its size extended to 10 MiB.
+	data, err = fs.ReadFile(fsys, "sparse.bin")
+	require.NoError(t, err, "sparse inline file should read")
+	require.Len(t, data, 10<<20, "sparse inline file size should match")
+	assert.Equal(t, strings.Repeat("x", 59)+"\n", string(data[:60]), "inline content should match")
+	assert.Equal(t, make([]byte, len(data)-60), data[60:], "data past the inline bytes should read as zeros")
+}
+
+func TestReaderInvalid(t *testing.T) {
+	_, err := Open(bytes.NewReader(make([]byte, 4096)))
+	assert.ErrorIs(t, err, ErrInvalidFilesystem, "blank data should be rejected")
+}
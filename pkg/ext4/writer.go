@@ -0,0 +1,1111 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/google/uuid"
+)
+
+type extent struct {
+	logical uint32
+	start   uint64
+	length  uint32
+}
+
+type dirEntry struct {
+	name  string
+	inode *inode
+}
+
+type inode struct {
+	num     uint32
+	attr    fsmeta.Attr
+	links   uint32
+	size    uint64
+	flags   uint32
+	iblock  [60]byte
+	extents []extent
+	blocks  uint64
+	xattrs  []xattr
+	xblock  uint64
+
+	parent  *inode
+	entries []dirEntry
+	index   map[string]*inode
+	minSize uint64
+}
+
+func (n *inode) isDir() bool {
+	return n.attr.Mode.IsDir()
+}
+
+func (n *inode) addExtent(logical uint32, start uint64, length uint32) {
+	if len(n.extents) > 0 {
+		last := &n.extents[len(n.extents)-1]
+
+		if last.logical+last.length == logical && last.start+uint64(last.length) == start {
+			grow := min(length, maxExtentLen-last.length)
+			last.length += grow
+			logical += grow
+			start += uint64(grow)
+			length -= grow
+		}
+	}
+
+	for length > 0 {
+		chunk := min(length, maxExtentLen)
+		n.extents = append(n.extents, extent{logical: logical, start: start, length: chunk})
+
+		logical += chunk
+		start += uint64(chunk)
+		length -= chunk
+	}
+}
+
+func withType(mode fs.FileMode, ty fs.FileMode) fs.FileMode {
+	return mode&^fs.ModeType | ty
+}
+
+func fileType(mode fs.FileMode) byte {
+	switch mode.Type() {
+	case fs.ModeDir:
+		return FileTypeDir
+	case fs.ModeSymlink:
+		return FileTypeSymlink
+	case fs.ModeNamedPipe:
+		return FileTypeFIFO
+	case fs.ModeSocket:
+		return FileTypeSocket
+	case fs.ModeDevice:
+		return FileTypeBlock
+	case fs.ModeDevice | fs.ModeCharDevice:
+		return FileTypeChar
+	default:
+		return FileTypeRegular
+	}
+}
+
+// Writer formats an ext4 filesystem and populates it. File data is written as it is added, whilst directories,
+// inodes and allocation metadata are written on Close.
+type Writer struct {
+	dst       io.WriterAt
+	opts      Options
+	layout    *layout
+	used      []byte
+	next      uint64
+	inodes    []*inode
+	nextInode uint32
+	root      *inode
+	journal   *inode
+	closed    bool
+}
+
+// NewWriter prepares a filesystem of the given size within dst.
+func NewWriter(dst io.WriterAt, size int64, opts Options) (*Writer, error) {
+	l, err := newLayout(size, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts.Label) > 16 {
+		return nil, fmt.Errorf("%w: label %q longer than 16 bytes", ErrInvalidName, opts.Label)
+	}
+
+	if opts.Time.IsZero() {
+		opts.Time = time.Unix(0, 0).UTC()
+	}
+
+	if opts.UUID == uuid.Nil {
+		opts.UUID = uuid.NewSHA1(uuid.Nil, []byte(opts.Label+"\x00"+opts.Time.UTC().Format(time.RFC3339Nano)))
+	}
+
+	if opts.HashSeed == uuid.Nil {
+		opts.HashSeed = uuid.NewSHA1(opts.UUID, []byte("hash seed"))
+	}
+
+	w := &Writer{
+		dst:       dst,
+		opts:      opts,
+		layout:    l,
+		used:      make([]byte, (l.blocks+7)/8),
+		inodes:    make([]*inode, l.inodes()),
+		nextInode: FirstInode + 1,
+	}
+
+	for b := range l.firstData {
+		w.markUsed(b, 1)
+	}
+
+	for g := range l.groups {
+		w.markUsed(l.groupStart(g), l.overhead(g))
+	}
+
+	dirAttr := fsmeta.Attr{
+		Mode:    fs.ModeDir | 0o755,
+		ModTime: opts.Time,
+	}
+
+	w.root = &inode{
+		num:   RootInode,
+		attr:  dirAttr,
+		index: make(map[string]*inode),
+	}
+	w.root.parent = w.root
+	w.inodes[RootInode-1] = w.root
+
+	lost := &inode{
+		num:     LostAndFound,
+		attr:    dirAttr,
+		index:   make(map[string]*inode),
+		minSize: lostAndFoundSize,
+	}
+	lost.attr.Mode = fs.ModeDir | 0o700
+	w.inodes[LostAndFound-1] = lost
+	w.link(w.root, "lost+found", lost)
+
+	if !opts.NoJournal {
+		if err := w.createJournal(); err != nil {
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// Format creates an empty filesystem.
+func Format(dst io.WriterAt, size int64, opts Options) error {
+	w, err := NewWriter(dst, size, opts)
+	if err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+func (w *Writer) markUsed(start uint64, count uint64) {
+	for b := start; b < start+count; b++ {
+		w.used[b/8] |= 1 << (b % 8)
+	}
+}
+
+func (w *Writer) isUsed(block uint64) bool {
+	return w.used[block/8]&(1<<(block%8)) != 0
+}
+
+// alloc reserves up to count contiguous blocks, returning the first block and the number reserved.
+func (w *Writer) alloc(count uint64) (uint64, uint64, error) {
+	for w.next < w.layout.blocks && w.isUsed(w.next) {
+		w.next++
+	}
+
+	if w.next >= w.layout.blocks {
+		return 0, 0, ErrNoSpace
+	}
+
+	start := w.next
+
+	for w.next < w.layout.blocks && w.next-start < count && !w.isUsed(w.next) {
+		w.next++
+	}
+
+	w.markUsed(start, w.next-start)
+
+	return start, w.next - start, nil
+}
+
+// writeBlocks allocates storage for data, which must be a whole number of blocks, and maps it into the inode from
+// the given logical block.
+func (w *Writer) writeBlocks(n *inode, logical uint32, data []byte) error {
+	bs := w.layout.blockSize
+
+	for len(data) > 0 {
+		start, count, err := w.alloc(uint64(len(data)) / bs)
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.dst.WriteAt(data[:count*bs], int64(start*bs)); err != nil {
+			return fmt.Errorf("failed to write blocks: %w", err)
+		}
+
+		n.addExtent(logical, start, uint32(count))
+		n.blocks += count
+		logical += uint32(count)
+		data = data[count*bs:]
+	}
+
+	return nil
+}
+
+func (w *Writer) createJournal() error {
+	bs := w.layout.blockSize
+
+	blocks := defaultJournalBlocks(w.layout.blocks)
+	if w.opts.JournalSize > 0 {
+		blocks = uint64(w.opts.JournalSize) / bs
+	}
+
+	if blocks == 0 {
+		return nil
+	}
+
+	if blocks < 1024 || blocks > w.layout.blocks/2 {
+		return fmt.Errorf("%w: journal of %v blocks does not fit", ErrTooSmall, blocks)
+	}
+
+	w.journal = &inode{
+		num:   JournalInode,
+		attr:  fsmeta.Attr{Mode: 0o600, ModTime: w.opts.Time},
+		links: 1,
+		size:  blocks * bs,
+		flags: InodeFlagExtents,
+	}
+	w.inodes[JournalInode-1] = w.journal
+
+	for logical := uint64(0); logical < blocks; {
+		start, count, err := w.alloc(blocks - logical)
+		if err != nil {
+			return fmt.Errorf("%w: allocating journal", err)
+		}
+
+		w.journal.addExtent(uint32(logical), start, uint32(count))
+		w.journal.blocks += count
+		logical += count
+	}
+
+	return nil
+}
+
+func (w *Writer) newInode(attr fsmeta.Attr) (*inode, error) {
+	if w.closed {
+		return nil, ErrClosed
+	}
+
+	if uint64(w.nextInode) > uint64(len(w.inodes)) {
+		return nil, ErrNoInodes
+	}
+
+	if attr.ModTime.IsZero() {
+		attr.ModTime = w.opts.Time
+	}
+
+	xattrs, err := parseXattrs(&attr)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &inode{
+		num:    w.nextInode,
+		attr:   attr,
+		xattrs: xattrs,
+	}
+
+	if attr.Mode.IsDir() {
+		n.index = make(map[string]*inode)
+	}
+
+	w.inodes[n.num-1] = n
+	w.nextInode++
+
+	return n, nil
+}
+
+func (w *Writer) link(parent *inode, name string, n *inode) {
+	parent.entries = append(parent.entries, dirEntry{name: name, inode: n})
+	parent.index[name] = n
+
+	if n.isDir() {
+		n.parent = parent
+	} else {
+		n.links++
+	}
+}
+
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || len(name) > 255 || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	return nil
+}
+
+func splitPath(name string) (string, string) {
+	return path.Split(strings.Trim(path.Clean("/"+name), "/"))
+}
+
+func (w *Writer) lookup(name string, create bool) (*inode, error) {
+	name = strings.Trim(path.Clean("/"+name), "/")
+
+	cur := w.root
+
+	if name == "" {
+		return cur, nil
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		next := cur.index[part]
+
+		if next == nil {
+			if !create {
+				return nil, fmt.Errorf("%w: %v", fs.ErrNotExist, name)
+			}
+
+			var err error
+
+			next, err = w.addNode(cur, part, fsmeta.Attr{Mode: fs.ModeDir | 0o755})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !next.isDir() {
+			return nil, fmt.Errorf("%w: %v", ErrNotDir, part)
+		}
+
+		cur = next
+	}
+
+	return cur, nil
+}
+
+func (w *Writer) addNode(parent *inode, name string, attr fsmeta.Attr) (*inode, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	if parent.index[name] != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExist, name)
+	}
+
+	n, err := w.newInode(attr)
+	if err != nil {
+		return nil, err
+	}
+
+	w.link(parent, name, n)
+
+	return n, nil
+}
+
+func (w *Writer) create(name string, attr fsmeta.Attr) (*inode, error) {
+	if w.closed {
+		return nil, ErrClosed
+	}
+
+	dir, base := splitPath(name)
+
+	parent, err := w.lookup(dir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return w.addNode(parent, base, attr)
+}
+
+// Mkdir creates a directory, along with any missing parents. The metadata of an existing directory, including the
+// root when name is ".", is replaced.
+func (w *Writer) Mkdir(name string, attr fsmeta.Attr) error {
+	if w.closed {
+		return ErrClosed
+	}
+
+	attr.Mode = withType(attr.Mode, fs.ModeDir)
+
+	if attr.ModTime.IsZero() {
+		attr.ModTime = w.opts.Time
+	}
+
+	dir, base := splitPath(name)
+
+	existing := w.root
+
+	if base != "" {
+		parent, err := w.lookup(dir, true)
+		if err != nil {
+			return err
+		}
+
+		existing = parent.index[base]
+
+		if existing == nil || !existing.isDir() {
+			_, err = w.addNode(parent, base, attr)
+
+			return err
+		}
+	}
+
+	xattrs, err := parseXattrs(&attr)
+	if err != nil {
+		return err
+	}
+
+	existing.attr = attr
+	existing.xattrs = xattrs
+
+	return nil
+}
+
+// WriteFile creates a regular file, along with any missing parent directories, containing the data read from r.
+// Blocks consisting entirely of zeros are left as holes.
+func (w *Writer) WriteFile(name string, r io.Reader, attr fsmeta.Attr) error {
+	attr.Mode = withType(attr.Mode, 0)
+
+	n, err := w.create(name, attr)
+	if err != nil {
+		return err
+	}
+
+	n.flags = InodeFlagExtents
+
+	bs := w.layout.blockSize
+	buf := make([]byte, 256*bs)
+
+	for {
+		read, err := io.ReadFull(r, buf)
+		if read > 0 {
+			clear(buf[read:])
+
+			if (n.size+uint64(read)+bs-1)/bs > 1<<32 {
+				return fmt.Errorf("%w: %v exceeds maximum file size", ErrNoSpace, name)
+			}
+
+			if err := w.writeSparse(n, buf[:(uint64(read)+bs-1)/bs*bs]); err != nil {
+				return fmt.Errorf("writing %v: %w", name, err)
+			}
+
+			n.size += uint64(read)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read %v: %w", name, err)
+		}
+	}
+}
+
+// writeSparse writes the non-zero blocks of data at the end of the file.
+func (w *Writer) writeSparse(n *inode, data []byte) error {
+	bs := w.layout.blockSize
+	logical := uint32(n.size / bs)
+
+	for i := uint64(0); i < uint64(len(data)); {
+		if isZero(data[i : i+bs]) {
+			i += bs
+
+			continue
+		}
+
+		end := i + bs
+		for end < uint64(len(data)) && !isZero(data[end:end+bs]) {
+			end += bs
+		}
+
+		if err := w.writeBlocks(n, logical+uint32(i/bs), data[i:end]); err != nil {
+			return err
+		}
+
+		i = end
+	}
+
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Symlink creates a symbolic link pointing at target.
+func (w *Writer) Symlink(name string, target string, attr fsmeta.Attr) error {
+	if target == "" || len(target) >= int(w.layout.blockSize) {
+		return fmt.Errorf("%w: symlink target of %v bytes", ErrInvalidName, len(target))
+	}
+
+	attr.Mode = withType(attr.Mode, fs.ModeSymlink)
+
+	n, err := w.create(name, attr)
+	if err != nil {
+		return err
+	}
+
+	n.size = uint64(len(target))
+
+	// Short targets are stored directly in the inode as a fast symlink.
+	if len(target) < len(n.iblock) {
+		copy(n.iblock[:], target)
+
+		return nil
+	}
+
+	n.flags = InodeFlagExtents
+
+	buf := make([]byte, w.layout.blockSize)
+	copy(buf, target)
+
+	return w.writeBlocks(n, 0, buf)
+}
+
+// Mknod creates a device node, FIFO or socket, selected by the type bits of attr.Mode.
+func (w *Writer) Mknod(name string, attr fsmeta.Attr) error {
+	switch attr.Mode.Type() {
+	case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice, fs.ModeNamedPipe, fs.ModeSocket:
+	default:
+		return fmt.Errorf("%w: %v is %v", ErrUnsupportedType, name, attr.Mode.Type())
+	}
+
+	n, err := w.create(name, attr)
+	if err != nil {
+		return err
+	}
+
+	if attr.Mode&fs.ModeDevice != 0 {
+		if attr.Major < 256 && attr.Minor < 256 {
+			binary.LittleEndian.PutUint32(n.iblock[0:], attr.Major<<8|attr.Minor)
+		} else {
+			binary.LittleEndian.PutUint32(n.iblock[4:], attr.Minor&0xFF|attr.Major<<8|(attr.Minor&^0xFF)<<12)
+		}
+	}
+
+	return nil
+}
+
+// Link creates a hard link to an existing non-directory entry.
+func (w *Writer) Link(name string, target string) error {
+	if w.closed {
+		return ErrClosed
+	}
+
+	tdir, tbase := splitPath(target)
+
+	tparent, err := w.lookup(tdir, false)
+	if err != nil {
+		return err
+	}
+
+	n := tparent.index[tbase]
+	if n == nil {
+		return fmt.Errorf("%w: %v", fs.ErrNotExist, target)
+	}
+
+	if n.isDir() {
+		return fmt.Errorf("%w: cannot hard link directory %v", ErrUnsupportedType, target)
+	}
+
+	if n.links >= maxLinks {
+		return fmt.Errorf("%w: %v", ErrTooManyLinks, target)
+	}
+
+	dir, base := splitPath(name)
+
+	parent, err := w.lookup(dir, true)
+	if err != nil {
+		return err
+	}
+
+	if err := validName(base); err != nil {
+		return err
+	}
+
+	if parent.index[base] != nil {
+		return fmt.Errorf("%w: %v", ErrExist, name)
+	}
+
+	w.link(parent, base, n)
+
+	return nil
+}
+
+// AddFS copies the contents of fsys into the filesystem root, as described by fsmeta.CopyFS.
+func (w *Writer) AddFS(fsys fs.FS) error {
+	return fsmeta.CopyFS(w, fsys)
+}
+
+func (w *Writer) Close() error {
+	if w.closed {
+		return ErrClosed
+	}
+
+	w.closed = true
+
+	if err := w.writeDir(w.root); err != nil {
+		return err
+	}
+
+	for _, n := range w.inodes {
+		if n == nil {
+			continue
+		}
+
+		if err := w.writeXattrs(n); err != nil {
+			return err
+		}
+
+		if n.flags&InodeFlagExtents != 0 {
+			if err := w.writeExtentTree(n); err != nil {
+				return err
+			}
+		}
+	}
+
+	if w.journal != nil {
+		if err := w.writeJournal(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.writeInodeTables(); err != nil {
+		return err
+	}
+
+	return w.writeMetadata()
+}
+
+func (w *Writer) dirData(dir *inode) []byte {
+	bs := int(w.layout.blockSize)
+
+	var (
+		data  []byte
+		block []byte
+		last  int
+	)
+
+	finish := func() {
+		binary.LittleEndian.PutUint16(block[last+4:], uint16(bs-last))
+		data = append(data, block...)
+		data = append(data, make([]byte, bs-len(block))...)
+		block = nil
+	}
+
+	add := func(num uint32, name string, ty byte) {
+		size := (8 + len(name) + 3) &^ 3
+
+		if len(block)+size > bs {
+			finish()
+		}
+
+		last = len(block)
+		entry := make([]byte, size)
+		binary.LittleEndian.PutUint32(entry[0:], num)
+		binary.LittleEndian.PutUint16(entry[4:], uint16(size))
+		entry[6] = byte(len(name))
+		entry[7] = ty
+		copy(entry[8:], name)
+
+		block = append(block, entry...)
+	}
+
+	add(dir.num, ".", FileTypeDir)
+	add(dir.parent.num, "..", FileTypeDir)
+
+	for _, e := range dir.entries {
+		add(e.inode.num, e.name, fileType(e.inode.attr.Mode))
+	}
+
+	finish()
+
+	for uint64(len(data)) < dir.minSize {
+		empty := make([]byte, bs)
+		binary.LittleEndian.PutUint16(empty[4:], uint16(bs))
+		data = append(data, empty...)
+	}
+
+	return data
+}
+
+func (w *Writer) writeDir(dir *inode) error {
+	data := w.dirData(dir)
+
+	dir.flags = InodeFlagExtents
+	dir.size = uint64(len(data))
+	dir.links = 2
+
+	if err := w.writeBlocks(dir, 0, data); err != nil {
+		return fmt.Errorf("writing directory %v: %w", dir.num, err)
+	}
+
+	for _, e := range dir.entries {
+		if !e.inode.isDir() {
+			continue
+		}
+
+		dir.links++
+
+		if err := w.writeDir(e.inode); err != nil {
+			return err
+		}
+	}
+
+	// With dir_nlink, a count of one means the directory has too many subdirectories to count.
+	if dir.links >= maxLinks {
+		dir.links = 1
+	}
+
+	return nil
+}
+
+func (w *Writer) writeXattrs(n *inode) error {
+	if len(n.xattrs) == 0 {
+		return nil
+	}
+
+	var inodeSpace [InodeSize - xattrInodeStart - 4]byte
+	if encodeXattrs(inodeSpace[:], 0, 0, n.xattrs) {
+		return nil
+	}
+
+	buf, ok := encodeXattrBlock(int(w.layout.blockSize), n.xattrs)
+	if !ok {
+		return fmt.Errorf("%w: attributes of inode %v exceed one block", ErrInvalidXattr, n.num)
+	}
+
+	block, _, err := w.alloc(1)
+	if err != nil {
+		return fmt.Errorf("%w: allocating xattr block", err)
+	}
+
+	if _, err := w.dst.WriteAt(buf, int64(block*w.layout.blockSize)); err != nil {
+		return fmt.Errorf("failed to write xattr block: %w", err)
+	}
+
+	n.xattrs = nil
+	n.xblock = block
+	n.blocks++
+
+	return nil
+}
+
+// writeExtentTree fills the inode's extent root, writing leaf and index blocks when the extents do not fit in the
+// inode itself.
+func (w *Writer) writeExtentTree(n *inode) error {
+	type node struct {
+		logical uint32
+		raw     [12]byte
+	}
+
+	nodes := make([]node, len(n.extents))
+
+	for i, e := range n.extents {
+		nodes[i].logical = e.logical
+		binary.LittleEndian.PutUint32(nodes[i].raw[0:], e.logical)
+		binary.LittleEndian.PutUint16(nodes[i].raw[4:], uint16(e.length))
+		binary.LittleEndian.PutUint16(nodes[i].raw[6:], uint16(e.start>>32))
+		binary.LittleEndian.PutUint32(nodes[i].raw[8:], uint32(e.start))
+	}
+
+	bs := w.layout.blockSize
+	perBlock := int(bs-extentHeaderLen) / extentEntryLen
+	depth := 0
+
+	putHeader := func(buf []byte, entries int, max int) {
+		binary.LittleEndian.PutUint16(buf[0:], ExtentMagic)
+		binary.LittleEndian.PutUint16(buf[2:], uint16(entries))
+		binary.LittleEndian.PutUint16(buf[4:], uint16(max))
+		binary.LittleEndian.PutUint16(buf[6:], uint16(depth))
+	}
+
+	for len(nodes) > 4 {
+		var parents []node
+
+		for i := 0; i < len(nodes); i += perBlock {
+			chunk := nodes[i:min(i+perBlock, len(nodes))]
+
+			block, _, err := w.alloc(1)
+			if err != nil {
+				return fmt.Errorf("%w: allocating extent tree", err)
+			}
+
+			buf := make([]byte, bs)
+			putHeader(buf, len(chunk), perBlock)
+
+			for j, c := range chunk {
+				copy(buf[extentHeaderLen+j*extentEntryLen:], c.raw[:])
+			}
+
+			if _, err := w.dst.WriteAt(buf, int64(block*bs)); err != nil {
+				return fmt.Errorf("failed to write extent tree: %w", err)
+			}
+
+			n.blocks++
+
+			parent := node{logical: chunk[0].logical}
+			binary.LittleEndian.PutUint32(parent.raw[0:], chunk[0].logical)
+			binary.LittleEndian.PutUint32(parent.raw[4:], uint32(block))
+			binary.LittleEndian.PutUint16(parent.raw[8:], uint16(block>>32))
+			parents = append(parents, parent)
+		}
+
+		nodes = parents
+		depth++
+	}
+
+	putHeader(n.iblock[:], len(nodes), 4)
+
+	for i, c := range nodes {
+		copy(n.iblock[extentHeaderLen+i*extentEntryLen:], c.raw[:])
+	}
+
+	return nil
+}
+
+func (w *Writer) writeJournal() error {
+	bs := w.layout.blockSize
+	buf := make([]byte, bs)
+
+	binary.BigEndian.PutUint32(buf[0:], JournalMagic)
+	binary.BigEndian.PutUint32(buf[4:], journalSuperblockV2)
+	binary.BigEndian.PutUint32(buf[12:], uint32(bs))
+	binary.BigEndian.PutUint32(buf[16:], uint32(w.journal.size/bs))
+	binary.BigEndian.PutUint32(buf[20:], 1)
+	binary.BigEndian.PutUint32(buf[24:], 1)
+	copy(buf[48:64], w.opts.UUID[:])
+	binary.BigEndian.PutUint32(buf[64:], 1)
+
+	if _, err := w.dst.WriteAt(buf, int64(w.journal.extents[0].start*bs)); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+
+	return nil
+}
+
+func (w *Writer) encodeInode(n *inode, buf []byte) {
+	le := binary.LittleEndian
+
+	atime := n.attr.AccessTime
+	if atime.IsZero() {
+		atime = n.attr.ModTime
+	}
+
+	ctime := n.attr.ChangeTime
+	if ctime.IsZero() {
+		ctime = n.attr.ModTime
+	}
+
+	le.PutUint16(buf[0:], uint16(n.attr.UnixMode()))
+	le.PutUint16(buf[2:], uint16(n.attr.UID))
+	le.PutUint32(buf[4:], uint32(n.size))
+
+	for _, t := range []struct {
+		value time.Time
+		sec   int
+		extra int
+	}{
+		{atime, 8, 140},
+		{ctime, 12, 132},
+		{n.attr.ModTime, 16, 136},
+		{ctime, 144, 148},
+	} {
+		sec, extra := encodeTime(t.value)
+		le.PutUint32(buf[t.sec:], sec)
+		le.PutUint32(buf[t.extra:], extra)
+	}
+
+	sectors := n.blocks * (w.layout.blockSize / 512)
+
+	le.PutUint16(buf[24:], uint16(n.attr.GID))
+	le.PutUint16(buf[26:], uint16(n.links))
+	le.PutUint32(buf[28:], uint32(sectors))
+	le.PutUint32(buf[32:], n.flags)
+	copy(buf[40:100], n.iblock[:])
+	le.PutUint32(buf[104:], uint32(n.xblock))
+	le.PutUint32(buf[108:], uint32(n.size>>32))
+	le.PutUint16(buf[116:], uint16(sectors>>32))
+	le.PutUint16(buf[118:], uint16(n.xblock>>32))
+	le.PutUint16(buf[120:], uint16(n.attr.UID>>16))
+	le.PutUint16(buf[122:], uint16(n.attr.GID>>16))
+	le.PutUint16(buf[128:], ExtraInodeSize)
+
+	if len(n.xattrs) > 0 {
+		le.PutUint32(buf[xattrInodeStart:], XattrMagic)
+		encodeXattrs(buf[xattrInodeStart+4:InodeSize], 0, 0, n.xattrs)
+	}
+}
+
+func (w *Writer) writeInodeTables() error {
+	l := w.layout
+
+	for g := range l.groups {
+		table := make([]byte, l.tableBlocks*l.blockSize)
+
+		for i := range l.inodesPerGroup {
+			if n := w.inodes[g*l.inodesPerGroup+i]; n != nil {
+				w.encodeInode(n, table[i*InodeSize:(i+1)*InodeSize])
+			}
+		}
+
+		if _, err := w.dst.WriteAt(table, int64(l.inodeTable(g)*l.blockSize)); err != nil {
+			return fmt.Errorf("failed to write inode table: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) writeMetadata() error {
+	l := w.layout
+	bs := l.blockSize
+	gdt := make([]byte, l.gdtBlocks*bs)
+
+	var freeBlocks, freeInodes uint64
+
+	for g := range l.groups {
+		blockBitmap := make([]byte, bs)
+		inodeBitmap := make([]byte, bs)
+
+		var free, freeIno, dirs uint64
+
+		start := l.groupStart(g)
+
+		for i := range l.blocksPerGroup {
+			if i >= l.groupBlocks(g) || w.isUsed(start+i) {
+				blockBitmap[i/8] |= 1 << (i % 8)
+			} else {
+				free++
+			}
+		}
+
+		for i := range bs * 8 {
+			if i >= l.inodesPerGroup {
+				inodeBitmap[i/8] |= 1 << (i % 8)
+
+				continue
+			}
+
+			num := g*l.inodesPerGroup + i + 1
+			n := w.inodes[num-1]
+
+			if n != nil && n.isDir() {
+				dirs++
+			}
+
+			if n != nil || num < FirstInode {
+				inodeBitmap[i/8] |= 1 << (i % 8)
+			} else {
+				freeIno++
+			}
+		}
+
+		if _, err := w.dst.WriteAt(blockBitmap, int64(l.blockBitmap(g)*bs)); err != nil {
+			return fmt.Errorf("failed to write block bitmap: %w", err)
+		}
+
+		if _, err := w.dst.WriteAt(inodeBitmap, int64(l.inodeBitmap(g)*bs)); err != nil {
+			return fmt.Errorf("failed to write inode bitmap: %w", err)
+		}
+
+		desc := gdt[g*GroupDescSize:]
+		binary.LittleEndian.PutUint32(desc[0:], uint32(l.blockBitmap(g)))
+		binary.LittleEndian.PutUint32(desc[4:], uint32(l.inodeBitmap(g)))
+		binary.LittleEndian.PutUint32(desc[8:], uint32(l.inodeTable(g)))
+		binary.LittleEndian.PutUint16(desc[12:], uint16(free))
+		binary.LittleEndian.PutUint16(desc[14:], uint16(freeIno))
+		binary.LittleEndian.PutUint16(desc[16:], uint16(dirs))
+
+		freeBlocks += free
+		freeInodes += freeIno
+	}
+
+	for g := range l.groups {
+		if !l.hasSuper(g) {
+			continue
+		}
+
+		sb := w.superblock(g, freeBlocks, freeInodes)
+
+		block := l.groupStart(g)
+		off := int64(block * bs)
+
+		if g == 0 {
+			off = SuperblockOffset
+		}
+
+		if _, err := w.dst.WriteAt(sb, off); err != nil {
+			return fmt.Errorf("failed to write superblock: %w", err)
+		}
+
+		if _, err := w.dst.WriteAt(gdt, int64((block+1)*bs)); err != nil {
+			return fmt.Errorf("failed to write group descriptors: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) superblock(group uint64, freeBlocks uint64, freeInodes uint64) []byte {
+	le := binary.LittleEndian
+	l := w.layout
+	sb := make([]byte, SuperblockSize)
+	now, _ := encodeTime(w.opts.Time)
+
+	logBlock := uint32(0)
+	for 1024<<logBlock < l.blockSize {
+		logBlock++
+	}
+
+	compat := uint32(CompatExtAttr | CompatDirIndex)
+	if w.journal != nil {
+		compat |= CompatHasJournal
+	}
+
+	le.PutUint32(sb[0:], uint32(l.inodes()))
+	le.PutUint32(sb[4:], uint32(l.blocks))
+	le.PutUint32(sb[8:], uint32(l.blocks*uint64(w.opts.ReservedPercent)/100))
+	le.PutUint32(sb[12:], uint32(freeBlocks))
+	le.PutUint32(sb[16:], uint32(freeInodes))
+	le.PutUint32(sb[20:], uint32(l.firstData))
+	le.PutUint32(sb[24:], logBlock)
+	le.PutUint32(sb[28:], logBlock)
+	le.PutUint32(sb[32:], uint32(l.blocksPerGroup))
+	le.PutUint32(sb[36:], uint32(l.blocksPerGroup))
+	le.PutUint32(sb[40:], uint32(l.inodesPerGroup))
+	le.PutUint32(sb[48:], now)
+	le.PutUint16(sb[54:], 0xFFFF)
+	le.PutUint16(sb[56:], SuperblockMagic)
+	le.PutUint16(sb[58:], 1)
+	le.PutUint16(sb[60:], 1)
+	le.PutUint32(sb[64:], now)
+	le.PutUint32(sb[76:], 1)
+	le.PutUint32(sb[84:], FirstInode)
+	le.PutUint16(sb[88:], InodeSize)
+	le.PutUint16(sb[90:], uint16(group))
+	le.PutUint32(sb[92:], compat)
+	le.PutUint32(sb[96:], IncompatFiletype|IncompatExtents)
+	le.PutUint32(sb[100:], ROCompatSparseSuper|ROCompatLargeFile|ROCompatHugeFile|ROCompatDirNlink|ROCompatExtraIsize)
+	copy(sb[104:120], w.opts.UUID[:])
+	copy(sb[120:136], w.opts.Label)
+	copy(sb[236:252], w.opts.HashSeed[:])
+	sb[252] = 1
+	le.PutUint32(sb[256:], 0x000C)
+	le.PutUint32(sb[264:], now)
+	le.PutUint16(sb[348:], ExtraInodeSize)
+	le.PutUint16(sb[350:], ExtraInodeSize)
+	le.PutUint32(sb[352:], 1)
+
+	if w.journal != nil {
+		le.PutUint32(sb[224:], JournalInode)
+
+		// A copy of the journal inode's extent root lets e2fsck recover a damaged journal inode.
+		sb[253] = 1
+
+		for i := 0; i < 15; i++ {
+			copy(sb[268+i*4:], w.journal.iblock[i*4:i*4+4])
+		}
+
+		le.PutUint32(sb[268+15*4:], uint32(w.journal.size>>32))
+		le.PutUint32(sb[268+16*4:], uint32(w.journal.size))
+	}
+
+	return sb
+}
@@ -0,0 +1,216 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/csnewman/go-appliance/pkg/internal/membuf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fsck runs e2fsck over the image when it is available on the host.
+func fsck(t *testing.T, img []byte) {
+	t.Helper()
+
+	bin, err := exec.LookPath("e2fsck")
+	if err != nil {
+		t.Log("e2fsck not available, skipping consistency check")
+
+		return
+	}
+
+	path := filepath.Join(t.TempDir(), "ext4.img")
+	require.NoError(t, os.WriteFile(path, img, 0o644), "image should save")
+
+	out, err := exec.Command(bin, "-fn", path).CombinedOutput()
+	assert.NoError(t, err, "e2fsck should pass:\n%s", out)
+}
+
+func TestFormat(t *testing.T) {
+	for _, bs := range []int{1024, 2048, 4096} {
+		d := membuf.New(32 << 20)
+
+		err := Format(d, int64(len(d.Data)), Options{Label: "rootfs", BlockSize: bs})
+		require.NoError(t, err, "format should succeed with %v byte blocks", bs)
+
+		sb := d.Data[SuperblockOffset:]
+		assert.Equal(t, uint16(SuperblockMagic), binary.LittleEndian.Uint16(sb[56:]), "magic should be set")
+		assert.Equal(t, uint32(32<<20/bs), binary.LittleEndian.Uint32(sb[4:]), "blocks should fill the volume")
+		assert.Equal(t, "rootfs", strings.TrimRight(string(sb[120:136]), "\x00"), "label should be set")
+		assert.NotZero(t, binary.LittleEndian.Uint32(sb[92:])&CompatHasJournal, "journal should be present")
+		assert.NotZero(t, binary.LittleEndian.Uint32(sb[96:])&IncompatExtents, "extents should be enabled")
+
+		fsck(t, d.Data)
+	}
+}
+
+func TestFormatNoJournal(t *testing.T) {
+	d := membuf.New(8 << 20)
+
+	require.NoError(t, Format(d, int64(len(d.Data)), Options{NoJournal: true}), "format should succeed")
+	assert.Zero(t, binary.LittleEndian.Uint32(d.Data[SuperblockOffset+92:])&CompatHasJournal, "journal should be absent")
+
+	fsck(t, d.Data)
+}
+
+func TestFormatDeterministic(t *testing.T) {
+	a, b := membuf.New(8<<20), membuf.New(8<<20)
+
+	require.NoError(t, Format(a, int64(len(a.Data)), Options{Label: "rootfs"}), "format should succeed")
+	require.NoError(t, Format(b, int64(len(b.Data)), Options{Label: "rootfs"}), "format should succeed")
+	assert.Equal(t, a.Data, b.Data, "output should be reproducible")
+	assert.NotEqual(t, make([]byte, 16), a.Data[SuperblockOffset+104:SuperblockOffset+120], "uuid should be derived")
+	assert.Zero(t, binary.LittleEndian.Uint32(a.Data[SuperblockOffset+48:]), "time should default to the epoch")
+
+	c := membuf.New(8 << 20)
+
+	require.NoError(t, Format(c, int64(len(c.Data)), Options{Label: "data"}), "format should succeed")
+	uuid := SuperblockOffset + 104
+	assert.NotEqual(t, a.Data[uuid:uuid+16], c.Data[uuid:uuid+16], "uuid should depend on the label")
+}
+
+func TestFormatTooSmall(t *testing.T) {
+	d := membuf.New(64 << 10)
+
+	err := Format(d, int64(len(d.Data)), Options{})
+	assert.ErrorIs(t, err, ErrTooSmall, "tiny volume should be rejected")
+
+	_, err = NewWriter(d, 64<<20, Options{BlockSize: 512})
+	assert.ErrorIs(t, err, ErrInvalidBlock, "unsupported block size should be rejected")
+}
+
+func TestWriter(t *testing.T) {
+	d := membuf.New(64 << 20)
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+
+	w, err := NewWriter(d, int64(len(d.Data)), Options{BlockSize: 1024, Time: mtime})
+	require.NoError(t, err, "writer should create")
+
+	acl := binary.LittleEndian.AppendUint32(nil, aclVersionVFS)
+	for _, e := range []struct{ tag, perm, id uint32 }{{1, 7, 0xFFFFFFFF}, {2, 5, 1000}, {4, 5, 0xFFFFFFFF}, {0x10, 5, 0xFFFFFFFF}, {0x20, 0, 0xFFFFFFFF}} {
+		acl = binary.LittleEndian.AppendUint16(acl, uint16(e.tag))
+		acl = binary.LittleEndian.AppendUint16(acl, uint16(e.perm))
+		acl = binary.LittleEndian.AppendUint32(acl, e.id)
+	}
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), 12<<20/16)
+	for i := 0; i < len(large); i += 1 << 20 {
+		clear(large[i : i+64<<10])
+	}
+
+	manyXattrs := make(map[string][]byte)
+	for i := range 12 {
+		manyXattrs["user.attribute-"+strings.Repeat("x", i)] = bytes.Repeat([]byte{byte(i)}, 24)
+	}
+
+	require.NoError(t, w.Mkdir(".", fsmeta.Attr{Mode: 0o755, ModTime: mtime}), "root should update")
+	require.NoError(t, w.Mkdir("home/user", fsmeta.Attr{Mode: 0o700, UID: 1000, GID: 70000}), "dir should create")
+	require.NoError(t, w.WriteFile("etc/hostname", strings.NewReader("appliance\n"), fsmeta.Attr{
+		Mode:   0o644,
+		Xattrs: map[string][]byte{"user.origin": []byte("build"), "system.posix_acl_access": acl},
+	}), "file should write")
+	require.NoError(t, w.WriteFile("usr/bin/tool", bytes.NewReader(large), fsmeta.Attr{Mode: 0o755 | fs.ModeSetuid}),
+		"large file should write")
+	require.NoError(t, w.WriteFile("attrs", strings.NewReader("x"), fsmeta.Attr{Mode: 0o600, Xattrs: manyXattrs}),
+		"file with xattr block should write")
+	require.NoError(t, w.WriteFile("empty", strings.NewReader(""), fsmeta.Attr{Mode: 0o600}), "empty file should write")
+	require.NoError(t, w.Symlink("etc/short", "hostname", fsmeta.Attr{Mode: 0o777}), "fast symlink should create")
+	require.NoError(t, w.Symlink("etc/long", strings.Repeat("../", 40)+"x", fsmeta.Attr{Mode: 0o777}),
+		"slow symlink should create")
+	require.NoError(t, w.Link("etc/hostname.bak", "etc/hostname"), "hard link should create")
+	require.NoError(t, w.Mknod("dev/null", fsmeta.Attr{Mode: fs.ModeDevice | fs.ModeCharDevice | 0o666, Major: 1, Minor: 3}),
+		"char device should create")
+	require.NoError(t, w.Mknod("dev/nvme", fsmeta.Attr{Mode: fs.ModeDevice | 0o660, Major: 259, Minor: 300}),
+		"block device should create")
+	require.NoError(t, w.Mknod("run/fifo", fsmeta.Attr{Mode: fs.ModeNamedPipe | 0o600}), "fifo should create")
+
+	for i := range 200 {
+		require.NoError(t, w.WriteFile("var/lib/many/entry-"+strings.Repeat("n", i%40)+string(rune('a'+i%26))+
+			strings.Repeat("0", i/26), strings.NewReader("x"), fsmeta.Attr{Mode: 0o644}), "file should write")
+	}
+
+	assert.ErrorIs(t, w.WriteFile("etc/hostname", strings.NewReader(""), fsmeta.Attr{}), ErrExist,
+		"duplicate should be rejected")
+	assert.ErrorIs(t, w.WriteFile("etc/hostname/x", strings.NewReader(""), fsmeta.Attr{}), ErrNotDir,
+		"file parent should be rejected")
+	assert.ErrorIs(t, w.Link("home2", "home"), ErrUnsupportedType, "directory hard link should be rejected")
+	assert.ErrorIs(t, w.Mknod("reg", fsmeta.Attr{Mode: 0o644}), ErrUnsupportedType, "regular mknod should be rejected")
+	assert.ErrorIs(t, w.WriteFile("bad", strings.NewReader(""), fsmeta.Attr{Xattrs: map[string][]byte{"foo": nil}}),
+		ErrInvalidXattr, "unknown xattr namespace should be rejected")
+
+	tool := w.root.index["usr"].index["bin"].index["tool"]
+	hostname := w.root.index["etc"].index["hostname"]
+
+	require.NoError(t, w.Close(), "writer should close")
+	assert.ErrorIs(t, w.Close(), ErrClosed, "second close should fail")
+
+	assert.Equal(t, uint32(2), hostname.links, "hard link should be counted")
+	assert.Greater(t, len(tool.extents), 4, "large file should span many extents")
+	assert.Equal(t, uint16(1), binary.LittleEndian.Uint16(tool.iblock[6:]), "extent tree should have an index level")
+	assert.Less(t, tool.blocks, uint64(len(large))/1024, "zero blocks should be left as holes")
+
+	fsck(t, d.Data)
+}
+
+func TestWriterAddFS(t *testing.T) {
+	d := membuf.New(8 << 20)
+
+	w, err := NewWriter(d, int64(len(d.Data)), Options{})
+	require.NoError(t, err, "writer should create")
+
+	require.NoError(t, w.AddFS(fstest.MapFS{
+		"bin/busybox": {Data: []byte("tool"), Mode: 0o755, Sys: &fsmeta.Attr{Mode: 0o755, Inode: 5}},
+		"bin/sh":      {Data: []byte("tool"), Mode: 0o755, Sys: &fsmeta.Attr{Mode: 0o755, Inode: 5}},
+		"etc/motd":    {Data: []byte("hello\n"), Mode: 0o644},
+	}), "fs should add")
+
+	bin := w.root.index["bin"]
+	assert.Same(t, bin.index["busybox"], bin.index["sh"], "files sharing an inode should be linked")
+	assert.Equal(t, uint32(2), bin.index["sh"].links, "hard link should be counted")
+
+	require.NoError(t, w.Close(), "writer should close")
+
+	fsck(t, d.Data)
+}
+
+func TestACLConversion(t *testing.T) {
+	vfs := binary.LittleEndian.AppendUint32(nil, aclVersionVFS)
+	for _, e := range []struct{ tag, perm, id uint32 }{{1, 6, 0xFFFFFFFF}, {8, 4, 42}, {0x20, 4, 0xFFFFFFFF}} {
+		vfs = binary.LittleEndian.AppendUint16(vfs, uint16(e.tag))
+		vfs = binary.LittleEndian.AppendUint16(vfs, uint16(e.perm))
+		vfs = binary.LittleEndian.AppendUint32(vfs, e.id)
+	}
+
+	disk, err := aclToDisk(vfs)
+	require.NoError(t, err, "acl should convert")
+	assert.Len(t, disk, 4+4+8+4, "short entries should omit ids")
+
+	back, err := aclFromDisk(disk)
+	require.NoError(t, err, "acl should convert back")
+	assert.Equal(t, vfs, back, "acl should round trip")
+
+	_, err = aclToDisk([]byte{1, 2, 3})
+	assert.Error(t, err, "malformed acl should be rejected")
+}
+
+func TestEncodeTime(t *testing.T) {
+	for _, ts := range []time.Time{
+		time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 2, 29, 23, 59, 59, 999999999, time.UTC),
+		time.Date(2100, 1, 1, 0, 0, 0, 1, time.UTC),
+		time.Date(1960, 6, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		sec, extra := encodeTime(ts)
+		assert.Equal(t, ts, decodeTime(sec, extra), "%v should round trip", ts)
+	}
+}
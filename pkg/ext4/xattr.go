@@ -0,0 +1,243 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+)
+
+const (
+	XattrMagic      = 0xEA020000
+	xattrHeaderLen  = 32
+	xattrEntryLen   = 16
+	xattrInodeStart = 128 + ExtraInodeSize
+
+	aclVersionDisk = 1
+	aclVersionVFS  = 2
+	aclUser        = 0x02
+	aclGroup       = 0x08
+)
+
+var xattrPrefixes = []struct {
+	index  byte
+	prefix string
+}{
+	{2, "system.posix_acl_access"},
+	{3, "system.posix_acl_default"},
+	{1, "user."},
+	{4, "trusted."},
+	{6, "security."},
+	{7, "system."},
+}
+
+type xattr struct {
+	index byte
+	name  string
+	value []byte
+}
+
+func (x *xattr) entrySize() int {
+	return xattrEntryLen + (len(x.name)+3)&^3
+}
+
+func (x *xattr) valueSize() int {
+	return (len(x.value) + 3) &^ 3
+}
+
+// hash matches ext2fs_ext_attr_hash_entry, covering the name and the padded value.
+func (x *xattr) hash() uint32 {
+	var hash uint32
+
+	for i := 0; i < len(x.name); i++ {
+		hash = hash<<5 ^ hash>>27 ^ uint32(int32(int8(x.name[i])))
+	}
+
+	padded := make([]byte, x.valueSize())
+	copy(padded, x.value)
+
+	for i := 0; i < len(padded); i += 4 {
+		hash = hash<<16 ^ hash>>16 ^ binary.LittleEndian.Uint32(padded[i:])
+	}
+
+	return hash
+}
+
+func splitXattr(name string, value []byte) (xattr, error) {
+	for _, p := range xattrPrefixes {
+		if p.index == 2 || p.index == 3 {
+			if name != p.prefix {
+				continue
+			}
+
+			acl, err := aclToDisk(value)
+			if err != nil {
+				return xattr{}, fmt.Errorf("%w: %v: %w", ErrInvalidXattr, name, err)
+			}
+
+			return xattr{index: p.index, value: acl}, nil
+		}
+
+		if suffix, ok := strings.CutPrefix(name, p.prefix); ok && suffix != "" {
+			if len(suffix) > 255 {
+				return xattr{}, fmt.Errorf("%w: %v name too long", ErrInvalidXattr, name)
+			}
+
+			return xattr{index: p.index, name: suffix, value: value}, nil
+		}
+	}
+
+	return xattr{}, fmt.Errorf("%w: %v has an unsupported namespace", ErrInvalidXattr, name)
+}
+
+func parseXattrs(attr *fsmeta.Attr) ([]xattr, error) {
+	var out []xattr
+
+	for _, name := range attr.XattrNames() {
+		x, err := splitXattr(name, attr.Xattrs[name])
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, x)
+	}
+
+	sortXattrs(out)
+
+	return out, nil
+}
+
+func joinXattr(index byte, name string) string {
+	for _, p := range xattrPrefixes {
+		if p.index == index {
+			return p.prefix + name
+		}
+	}
+
+	return ""
+}
+
+// aclToDisk converts a POSIX ACL from the xattr interface format into the more compact ext4 representation.
+func aclToDisk(value []byte) ([]byte, error) {
+	if len(value) < 4 || (len(value)-4)%8 != 0 || binary.LittleEndian.Uint32(value) != aclVersionVFS {
+		return nil, fmt.Errorf("malformed acl")
+	}
+
+	out := binary.LittleEndian.AppendUint32(nil, aclVersionDisk)
+
+	for i := 4; i < len(value); i += 8 {
+		tag := binary.LittleEndian.Uint16(value[i:])
+
+		out = append(out, value[i:i+4]...)
+		if tag == aclUser || tag == aclGroup {
+			out = append(out, value[i+4:i+8]...)
+		}
+	}
+
+	return out, nil
+}
+
+// aclFromDisk reverses aclToDisk.
+func aclFromDisk(value []byte) ([]byte, error) {
+	if len(value) < 4 || binary.LittleEndian.Uint32(value) != aclVersionDisk {
+		return nil, fmt.Errorf("malformed acl")
+	}
+
+	out := binary.LittleEndian.AppendUint32(nil, aclVersionVFS)
+
+	for i := 4; i < len(value); {
+		if i+4 > len(value) {
+			return nil, fmt.Errorf("malformed acl")
+		}
+
+		tag := binary.LittleEndian.Uint16(value[i:])
+		out = append(out, value[i:i+4]...)
+		i += 4
+
+		if tag == aclUser || tag == aclGroup {
+			if i+4 > len(value) {
+				return nil, fmt.Errorf("malformed acl")
+			}
+
+			out = append(out, value[i:i+4]...)
+			i += 4
+		} else {
+			out = binary.LittleEndian.AppendUint32(out, 0xFFFFFFFF)
+		}
+	}
+
+	return out, nil
+}
+
+func sortXattrs(attrs []xattr) {
+	sort.Slice(attrs, func(i, j int) bool {
+		a, b := attrs[i], attrs[j]
+		if a.index != b.index {
+			return a.index < b.index
+		}
+
+		if len(a.name) != len(b.name) {
+			return len(a.name) < len(b.name)
+		}
+
+		return a.name < b.name
+	})
+}
+
+// encodeXattrs lays out entries from the start of buf and values from its end. Value offsets are relative to base.
+// It reports false if the attributes do not fit.
+func encodeXattrs(buf []byte, start int, base int, attrs []xattr) bool {
+	used := start + 4
+	for i := range attrs {
+		used += attrs[i].entrySize() + attrs[i].valueSize()
+	}
+
+	if used > len(buf) {
+		return false
+	}
+
+	pos := start
+	end := len(buf)
+
+	for i := range attrs {
+		a := &attrs[i]
+		end -= a.valueSize()
+		copy(buf[end:], a.value)
+
+		e := buf[pos:]
+		e[0] = byte(len(a.name))
+		e[1] = a.index
+		binary.LittleEndian.PutUint16(e[2:], uint16(end-base))
+		binary.LittleEndian.PutUint32(e[4:], 0)
+		binary.LittleEndian.PutUint32(e[8:], uint32(len(a.value)))
+		binary.LittleEndian.PutUint32(e[12:], a.hash())
+		copy(e[xattrEntryLen:], a.name)
+
+		pos += a.entrySize()
+	}
+
+	return true
+}
+
+func encodeXattrBlock(blockSize int, attrs []xattr) ([]byte, bool) {
+	buf := make([]byte, blockSize)
+
+	if !encodeXattrs(buf, xattrHeaderLen, 0, attrs) {
+		return nil, false
+	}
+
+	var hash uint32
+
+	for i := range attrs {
+		hash = hash<<16 ^ hash>>16 ^ attrs[i].hash()
+	}
+
+	binary.LittleEndian.PutUint32(buf[0:], XattrMagic)
+	binary.LittleEndian.PutUint32(buf[4:], 1)
+	binary.LittleEndian.PutUint32(buf[8:], 1)
+	binary.LittleEndian.PutUint32(buf[12:], hash)
+
+	return buf, true
+}
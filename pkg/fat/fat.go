@@ -0,0 +1,290 @@
+package fat
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	SectorSize   = 512
+	DirEntrySize = 32
+
+	fat32ReservedSectors  = 32
+	fat32FSInfoSector     = 1
+	fat32BackupBootSector = 6
+	fat32RootCluster      = 2
+
+	fat16ReservedSectors = 1
+	fat16RootEntries     = 512
+
+	fat12MaxClusters = 4084
+	fat16MaxClusters = 65524
+	fat32MaxClusters = 0x0FFFFFF5
+
+	numFATs   = 2
+	mediaType = 0xF8
+
+	firstCluster = 2
+)
+
+const (
+	AttrReadOnly  = 0x01
+	AttrHidden    = 0x02
+	AttrSystem    = 0x04
+	AttrVolumeID  = 0x08
+	AttrDirectory = 0x10
+	AttrArchive   = 0x20
+	AttrLongName  = AttrReadOnly | AttrHidden | AttrSystem | AttrVolumeID
+)
+
+type Type int
+
+const (
+	TypeAuto  Type = 0
+	TypeFAT12 Type = 12
+	TypeFAT16 Type = 16
+	TypeFAT32 Type = 32
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeAuto:
+		return "auto"
+	case TypeFAT12, TypeFAT16, TypeFAT32:
+		return fmt.Sprintf("FAT%d", int(t))
+	default:
+		return fmt.Sprintf("unknown(%d)", int(t))
+	}
+}
+
+// eoc returns the end of chain marker for the FAT type.
+func (t Type) eoc() uint32 {
+	switch t {
+	case TypeFAT12:
+		return 0xFFF
+	case TypeFAT16:
+		return 0xFFFF
+	default:
+		return 0x0FFFFFFF
+	}
+}
+
+// isEOC reports whether a FAT entry marks the end of a chain, or is otherwise not a valid next cluster.
+func (t Type) isEOC(v uint32) bool {
+	return v >= t.eoc()&^7 || v < firstCluster
+}
+
+var (
+	ErrTooSmall        = errors.New("volume too small")
+	ErrTooLarge        = errors.New("volume too large")
+	ErrInvalidCluster  = errors.New("invalid cluster size")
+	ErrInvalidType     = errors.New("invalid fat type")
+	ErrNoSpace         = errors.New("no space left on volume")
+	ErrInvalidName     = errors.New("invalid file name")
+	ErrExist           = errors.New("file already exists")
+	ErrNotDir          = errors.New("not a directory")
+	ErrUnsupportedType = errors.New("unsupported file type")
+	ErrClosed          = errors.New("writer closed")
+)
+
+// DefaultTime is used for timestamps when none is provided. It is the earliest date a FAT directory entry can hold.
+var DefaultTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type Options struct {
+	// Type selects FAT12, FAT16 or FAT32. When unset the type is chosen based on the volume size: FAT12 for volumes of
+	// 4MiB or less, FAT16 up to 512MiB and FAT32 above.
+	Type Type
+	// Label is the volume label, up to 11 characters.
+	Label string
+	// Serial is the volume serial number. A random value is used when zero.
+	Serial uint32
+	// ClusterSize is the cluster size in bytes. It is chosen based on the volume size when zero.
+	ClusterSize int
+	// OEMName is written into the boot sector, defaulting to MSWIN4.1 for maximum compatibility.
+	OEMName string
+	// HiddenSectors is the number of sectors preceding the volume, usually the partition start LBA.
+	HiddenSectors uint32
+}
+
+type geometry struct {
+	fatType           Type
+	sectorSize        uint32
+	fats              uint32
+	totalSectors      uint32
+	sectorsPerCluster uint32
+	reservedSectors   uint32
+	fatSectors        uint32
+	rootEntries       uint32
+	clusters          uint32
+}
+
+func (g *geometry) rootDirSectors() uint32 {
+	return (g.rootEntries*DirEntrySize + g.sectorSize - 1) / g.sectorSize
+}
+
+func (g *geometry) rootDirStart() int64 {
+	return int64(g.reservedSectors+g.fats*g.fatSectors) * int64(g.sectorSize)
+}
+
+func (g *geometry) dataStart() int64 {
+	return int64(g.reservedSectors+g.fats*g.fatSectors+g.rootDirSectors()) * int64(g.sectorSize)
+}
+
+func (g *geometry) clusterSize() int64 {
+	return int64(g.sectorsPerCluster) * int64(g.sectorSize)
+}
+
+func (g *geometry) clusterOffset(cluster uint32) int64 {
+	return g.dataStart() + int64(cluster-firstCluster)*g.clusterSize()
+}
+
+// autoType picks the FAT type for a volume size. Firmware determines the type solely from the cluster count, so the
+// thresholds and cluster sizes are chosen to keep the count well within the range for each type.
+func autoType(size int64) Type {
+	switch {
+	case size <= 4*1024*1024:
+		return TypeFAT12
+	case size <= 512*1024*1024:
+		return TypeFAT16
+	default:
+		return TypeFAT32
+	}
+}
+
+// defaultClusterSize follows the Microsoft recommendations for cluster sizes.
+func defaultClusterSize(ty Type, sectors int64) int {
+	switch ty {
+	case TypeFAT12:
+		// Use the smallest cluster size which keeps the cluster count within FAT12 limits, leaving room for the
+		// root directory and FATs.
+		size := SectorSize
+
+		for sectors/int64(size/SectorSize) > fat12MaxClusters-64 && size < 64*1024 {
+			size *= 2
+		}
+
+		return size
+	case TypeFAT16:
+		switch {
+		case sectors <= 32680:
+			return 512
+		case sectors <= 262144:
+			return 2048
+		case sectors <= 524288:
+			return 4096
+		case sectors <= 1048576:
+			return 8192
+		case sectors <= 2097152:
+			return 16384
+		case sectors <= 4194304:
+			return 32768
+		default:
+			return 65536
+		}
+	default:
+		switch {
+		case sectors <= 532480:
+			return 512
+		case sectors <= 16777216:
+			return 4096
+		case sectors <= 33554432:
+			return 8192
+		case sectors <= 67108864:
+			return 16384
+		default:
+			return 32768
+		}
+	}
+}
+
+func clusterLimits(ty Type) (uint32, uint32) {
+	switch ty {
+	case TypeFAT12:
+		return 1, fat12MaxClusters
+	case TypeFAT16:
+		return fat12MaxClusters + 1, fat16MaxClusters
+	default:
+		return fat16MaxClusters + 1, fat32MaxClusters
+	}
+}
+
+func fatSectorsFor(ty Type, clusters uint32) uint32 {
+	entries := clusters + firstCluster
+
+	switch ty {
+	case TypeFAT12:
+		return ((entries*3+1)/2 + SectorSize - 1) / SectorSize
+	case TypeFAT16:
+		return (entries*2 + SectorSize - 1) / SectorSize
+	default:
+		return (entries*4 + SectorSize - 1) / SectorSize
+	}
+}
+
+func newGeometry(size int64, ty Type, clusterSize int) (*geometry, error) {
+	sectors := size / SectorSize
+
+	if sectors > 0xFFFFFFFF {
+		return nil, fmt.Errorf("%w: %v bytes", ErrTooLarge, size)
+	}
+
+	if ty == TypeAuto {
+		ty = autoType(size)
+	}
+
+	if ty != TypeFAT12 && ty != TypeFAT16 && ty != TypeFAT32 {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidType, ty)
+	}
+
+	if clusterSize == 0 {
+		clusterSize = defaultClusterSize(ty, sectors)
+	}
+
+	if clusterSize < SectorSize || clusterSize > 64*1024 || clusterSize&(clusterSize-1) != 0 {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCluster, clusterSize)
+	}
+
+	geo := &geometry{
+		fatType:           ty,
+		sectorSize:        SectorSize,
+		fats:              numFATs,
+		totalSectors:      uint32(sectors),
+		sectorsPerCluster: uint32(clusterSize / SectorSize),
+		reservedSectors:   fat32ReservedSectors,
+	}
+
+	if ty != TypeFAT32 {
+		geo.reservedSectors = fat16ReservedSectors
+		geo.rootEntries = fat16RootEntries
+	}
+
+	overhead := geo.reservedSectors + geo.rootDirSectors()
+
+	if geo.totalSectors < overhead+numFATs+geo.sectorsPerCluster {
+		return nil, fmt.Errorf("%w: %v bytes", ErrTooSmall, size)
+	}
+
+	// Size the FATs for an upper bound on the cluster count, then derive the actual count from the remaining space
+	// in the same way readers do, which can only be smaller.
+	geo.fatSectors = fatSectorsFor(ty, (geo.totalSectors-overhead)/geo.sectorsPerCluster)
+
+	if geo.totalSectors < overhead+numFATs*geo.fatSectors+geo.sectorsPerCluster {
+		return nil, fmt.Errorf("%w: %v bytes", ErrTooSmall, size)
+	}
+
+	clusters := (geo.totalSectors - overhead - numFATs*geo.fatSectors) / geo.sectorsPerCluster
+	geo.clusters = clusters
+
+	low, high := clusterLimits(ty)
+
+	if clusters < low {
+		return nil, fmt.Errorf("%w: %v clusters, %v requires at least %v", ErrTooSmall, clusters, ty, low)
+	}
+
+	if clusters > high {
+		return nil, fmt.Errorf("%w: %v clusters, %v allows at most %v", ErrTooLarge, clusters, ty, high)
+	}
+
+	return geo, nil
+}
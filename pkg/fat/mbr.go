@@ -0,0 +1,25 @@
+package fat
+
+import (
+	"github.com/csnewman/go-appliance/pkg/disk"
+)
+
+// MBRPartType returns the MBR partition type code conventionally used for a FAT volume of the given type and size.
+func MBRPartType(ty Type, size int64) disk.MBRPartType {
+	if ty == TypeAuto {
+		ty = autoType(size)
+	}
+
+	switch ty {
+	case TypeFAT12:
+		return disk.MBRPartTypeFAT12
+	case TypeFAT16:
+		if size < 32*1024*1024 {
+			return disk.MBRPartTypeFAT16Small
+		}
+
+		return disk.MBRPartTypeFAT16LBA
+	default:
+		return disk.MBRPartTypeFAT32LBA
+	}
+}
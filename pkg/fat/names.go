@@ -0,0 +1,179 @@
+package fat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	maxNameLength    = 255
+	lfnCharsPerEntry = 13
+	lfnLastFlag      = 0x40
+)
+
+var lfnCharOffsets = [lfnCharsPerEntry]int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || len(utf16.Encode([]rune(name))) > maxNameLength {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune(`"*/:<>?\|`, r) {
+			return fmt.Errorf("%w: %q", ErrInvalidName, name)
+		}
+	}
+
+	if strings.TrimRight(name, ". ") == "" {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	return nil
+}
+
+func validShortChar(r rune) bool {
+	return (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune("$%'-_@~`!(){}^#&", r)
+}
+
+// shortBasis converts a long name into the base and extension of its short name, reporting whether the conversion
+// was lossless, so that the long name can be represented entirely by the short name.
+func shortBasis(name string) (string, string, bool) {
+	exact := true
+
+	base := name
+	ext := ""
+
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		base = name[:i]
+		ext = name[i+1:]
+	}
+
+	convert := func(s string, limit int) string {
+		var out strings.Builder
+
+		for _, r := range s {
+			switch {
+			case r == ' ' || r == '.':
+				exact = false
+
+				continue
+			case r >= 'a' && r <= 'z':
+				exact = false
+				r -= 'a' - 'A'
+			case !validShortChar(r):
+				exact = false
+				r = '_'
+			}
+
+			if out.Len() >= limit {
+				exact = false
+
+				break
+			}
+
+			out.WriteRune(r)
+		}
+
+		return out.String()
+	}
+
+	base = convert(strings.TrimLeft(base, ". "), 8)
+	ext = convert(ext, 3)
+
+	if base == "" {
+		base = "_"
+		exact = false
+	}
+
+	return base, ext, exact
+}
+
+func formatShortName(base string, ext string) [11]byte {
+	var out [11]byte
+
+	copy(out[:], "           ")
+	copy(out[0:8], base)
+	copy(out[8:11], ext)
+
+	// A leading 0xE5 marks a deleted entry, so it is stored as 0x05.
+	if out[0] == 0xE5 {
+		out[0] = 0x05
+	}
+
+	return out
+}
+
+// generateShortName returns the short name for a long name and whether a long name entry is required, using the
+// numeric tail scheme to avoid collisions with names already present in the directory.
+func generateShortName(name string, exists func([11]byte) bool) ([11]byte, bool, error) {
+	base, ext, exact := shortBasis(name)
+
+	if exact {
+		short := formatShortName(base, ext)
+
+		if !exists(short) {
+			return short, false, nil
+		}
+	}
+
+	for n := 1; n < 1000000; n++ {
+		tail := "~" + strconv.Itoa(n)
+		prefix := base[:min(len(base), 8-len(tail))]
+		short := formatShortName(prefix+tail, ext)
+
+		if !exists(short) {
+			return short, true, nil
+		}
+	}
+
+	return [11]byte{}, false, fmt.Errorf("%w: no free short name for %q", ErrExist, name)
+}
+
+func shortNameChecksum(short [11]byte) byte {
+	var sum byte
+
+	for _, c := range short {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+
+	return sum
+}
+
+// encodeLongName returns the long name directory entries for a name, in on-disk order.
+func encodeLongName(name string, short [11]byte) []byte {
+	chars := utf16.Encode([]rune(name))
+	count := (len(chars) + lfnCharsPerEntry - 1) / lfnCharsPerEntry
+
+	// Names which do not fill the last entry are null terminated and padded with 0xFFFF.
+	if len(chars)%lfnCharsPerEntry != 0 {
+		chars = append(chars, 0)
+
+		for len(chars)%lfnCharsPerEntry != 0 {
+			chars = append(chars, 0xFFFF)
+		}
+	}
+
+	sum := shortNameChecksum(short)
+	data := make([]byte, count*DirEntrySize)
+
+	for i := range count {
+		entry := data[(count-1-i)*DirEntrySize:][:DirEntrySize]
+
+		entry[0] = byte(i + 1)
+		if i == count-1 {
+			entry[0] |= lfnLastFlag
+		}
+
+		entry[11] = AttrLongName
+		entry[13] = sum
+
+		for j, off := range lfnCharOffsets {
+			binary.LittleEndian.PutUint16(entry[off:], chars[i*lfnCharsPerEntry+j])
+		}
+	}
+
+	return data
+}
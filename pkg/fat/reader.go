@@ -0,0 +1,668 @@
+package fat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+var ErrInvalidVolume = errors.New("invalid fat volume")
+
+const (
+	caseLowerBase = 0x08
+	caseLowerExt  = 0x10
+)
+
+// FS provides read-only access to a FAT12, FAT16 or FAT32 volume.
+type FS struct {
+	r      io.ReaderAt
+	geo    *geometry
+	fat    []uint32
+	root   uint32
+	label  string
+	serial uint32
+}
+
+var (
+	_ fs.FS        = (*FS)(nil)
+	_ fs.ReadDirFS = (*FS)(nil)
+	_ fs.StatFS    = (*FS)(nil)
+)
+
+// Open reads the volume at the start of r, such as the section returned by disk.Disk.PartitionSection.
+func Open(r io.ReaderAt) (*FS, error) {
+	boot := make([]byte, SectorSize)
+
+	if _, err := r.ReadAt(boot, 0); err != nil {
+		return nil, fmt.Errorf("failed to read boot sector: %w", err)
+	}
+
+	if binary.LittleEndian.Uint16(boot[510:512]) != 0xAA55 {
+		return nil, fmt.Errorf("%w: missing boot signature", ErrInvalidVolume)
+	}
+
+	geo := &geometry{
+		sectorSize:        uint32(binary.LittleEndian.Uint16(boot[11:13])),
+		sectorsPerCluster: uint32(boot[13]),
+		reservedSectors:   uint32(binary.LittleEndian.Uint16(boot[14:16])),
+		fats:              uint32(boot[16]),
+		rootEntries:       uint32(binary.LittleEndian.Uint16(boot[17:19])),
+		totalSectors:      uint32(binary.LittleEndian.Uint16(boot[19:21])),
+		fatSectors:        uint32(binary.LittleEndian.Uint16(boot[22:24])),
+	}
+
+	if geo.totalSectors == 0 {
+		geo.totalSectors = binary.LittleEndian.Uint32(boot[32:36])
+	}
+
+	if geo.fatSectors == 0 {
+		geo.fatSectors = binary.LittleEndian.Uint32(boot[36:40])
+	}
+
+	switch geo.sectorSize {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, fmt.Errorf("%w: sector size %v", ErrInvalidVolume, geo.sectorSize)
+	}
+
+	if geo.sectorsPerCluster == 0 || geo.sectorsPerCluster&(geo.sectorsPerCluster-1) != 0 || geo.fats == 0 {
+		return nil, fmt.Errorf("%w: invalid bpb", ErrInvalidVolume)
+	}
+
+	meta := geo.reservedSectors + geo.fats*geo.fatSectors + geo.rootDirSectors()
+	if meta >= geo.totalSectors {
+		return nil, fmt.Errorf("%w: invalid bpb", ErrInvalidVolume)
+	}
+
+	geo.clusters = (geo.totalSectors - meta) / geo.sectorsPerCluster
+
+	// The FAT type is determined solely by the number of clusters.
+	ext := boot[36:]
+
+	switch {
+	case geo.clusters <= fat12MaxClusters:
+		geo.fatType = TypeFAT12
+	case geo.clusters <= fat16MaxClusters:
+		geo.fatType = TypeFAT16
+	default:
+		geo.fatType = TypeFAT32
+		ext = boot[64:]
+	}
+
+	f := &FS{
+		r:   r,
+		geo: geo,
+	}
+
+	if ext[2] == 0x29 {
+		f.serial = binary.LittleEndian.Uint32(ext[3:7])
+		f.label = strings.TrimRight(string(ext[7:18]), " ")
+	}
+
+	if geo.fatType == TypeFAT32 {
+		f.root = binary.LittleEndian.Uint32(boot[44:48])
+	}
+
+	if err := f.readFAT(); err != nil {
+		return nil, err
+	}
+
+	if label, ok := f.rootLabel(); ok {
+		f.label = label
+	}
+
+	return f, nil
+}
+
+func (f *FS) readFAT() error {
+	data := make([]byte, int64(f.geo.fatSectors)*int64(f.geo.sectorSize))
+
+	if _, err := f.r.ReadAt(data, int64(f.geo.reservedSectors)*int64(f.geo.sectorSize)); err != nil {
+		return fmt.Errorf("failed to read fat: %w", err)
+	}
+
+	count := f.geo.clusters + firstCluster
+
+	switch f.geo.fatType {
+	case TypeFAT12:
+		count = min(count, uint32(len(data)-1)*2/3)
+	case TypeFAT16:
+		count = min(count, uint32(len(data)/2))
+	default:
+		count = min(count, uint32(len(data)/4))
+	}
+
+	f.fat = make([]uint32, count)
+
+	for i := range count {
+		switch f.geo.fatType {
+		case TypeFAT12:
+			off := i * 3 / 2
+			v := uint32(binary.LittleEndian.Uint16(data[off:]))
+
+			if i%2 == 0 {
+				f.fat[i] = v & 0xFFF
+			} else {
+				f.fat[i] = v >> 4
+			}
+		case TypeFAT16:
+			f.fat[i] = uint32(binary.LittleEndian.Uint16(data[i*2:]))
+		default:
+			f.fat[i] = binary.LittleEndian.Uint32(data[i*4:]) & 0x0FFFFFFF
+		}
+	}
+
+	return nil
+}
+
+func (f *FS) Type() Type {
+	return f.geo.fatType
+}
+
+func (f *FS) Label() string {
+	return f.label
+}
+
+func (f *FS) Serial() uint32 {
+	return f.serial
+}
+
+// chain returns the clusters making up a file or directory.
+func (f *FS) chain(start uint32) ([]uint32, error) {
+	var clusters []uint32
+
+	for cluster := start; !f.geo.fatType.isEOC(cluster); cluster = f.fat[cluster] {
+		if cluster >= uint32(len(f.fat)) || len(clusters) > len(f.fat) {
+			return nil, fmt.Errorf("%w: corrupt cluster chain at %v", ErrInvalidVolume, cluster)
+		}
+
+		clusters = append(clusters, cluster)
+	}
+
+	return clusters, nil
+}
+
+func (f *FS) readDirData(cluster uint32) ([]byte, error) {
+	if cluster == 0 && f.geo.fatType != TypeFAT32 {
+		data := make([]byte, int64(f.geo.rootEntries)*DirEntrySize)
+
+		if _, err := f.r.ReadAt(data, f.geo.rootDirStart()); err != nil {
+			return nil, fmt.Errorf("failed to read root directory: %w", err)
+		}
+
+		return data, nil
+	}
+
+	if cluster == 0 {
+		cluster = f.root
+	}
+
+	clusters, err := f.chain(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	size := f.geo.clusterSize()
+	data := make([]byte, int64(len(clusters))*size)
+
+	for i, c := range clusters {
+		if _, err := f.r.ReadAt(data[int64(i)*size:][:size], f.geo.clusterOffset(c)); err != nil {
+			return nil, fmt.Errorf("failed to read directory: %w", err)
+		}
+	}
+
+	return data, nil
+}
+
+func (f *FS) rootLabel() (string, bool) {
+	data, err := f.readDirData(0)
+	if err != nil {
+		return "", false
+	}
+
+	for off := 0; off+DirEntrySize <= len(data); off += DirEntrySize {
+		entry := data[off : off+DirEntrySize]
+
+		if entry[0] == 0 {
+			break
+		}
+
+		if entry[0] != 0xE5 && entry[11]&(AttrLongName|AttrDirectory) == AttrVolumeID {
+			return strings.TrimRight(string(entry[0:11]), " "), true
+		}
+	}
+
+	return "", false
+}
+
+// Entry holds the directory entry for a file, and is returned by fs.FileInfo.Sys.
+type Entry struct {
+	Name       string
+	ShortName  string
+	Attr       byte
+	Cluster    uint32
+	Size       uint32
+	ModTime    time.Time
+	CreateTime time.Time
+	AccessDate time.Time
+}
+
+func decodeTimestamp(tm uint16, date uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+
+	return time.Date(
+		int(date>>9)+1980,
+		time.Month(date>>5&0x0F),
+		int(date&0x1F),
+		int(tm>>11),
+		int(tm>>5&0x3F),
+		int(tm&0x1F)*2,
+		0,
+		time.UTC,
+	)
+}
+
+func decodeShortName(data []byte, caseFlags byte) string {
+	name := make([]byte, 11)
+	copy(name, data[0:11])
+
+	if name[0] == 0x05 {
+		name[0] = 0xE5
+	}
+
+	base := strings.TrimRight(string(name[0:8]), " ")
+	ext := strings.TrimRight(string(name[8:11]), " ")
+
+	if caseFlags&caseLowerBase != 0 {
+		base = strings.ToLower(base)
+	}
+
+	if caseFlags&caseLowerExt != 0 {
+		ext = strings.ToLower(ext)
+	}
+
+	if ext == "" {
+		return base
+	}
+
+	return base + "." + ext
+}
+
+func (f *FS) readDir(cluster uint32) ([]*Entry, error) {
+	data, err := f.readDirData(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		entries []*Entry
+		long    []uint16
+		sum     byte
+		next    int
+	)
+
+	for off := 0; off+DirEntrySize <= len(data); off += DirEntrySize {
+		entry := data[off : off+DirEntrySize]
+
+		if entry[0] == 0 {
+			break
+		}
+
+		if entry[0] == 0xE5 {
+			long = nil
+
+			continue
+		}
+
+		if entry[11]&AttrLongName == AttrLongName {
+			ord := int(entry[0] &^ lfnLastFlag)
+
+			if entry[0]&lfnLastFlag != 0 {
+				long = make([]uint16, ord*lfnCharsPerEntry)
+				sum = entry[13]
+				next = ord
+			} else if ord != next || entry[13] != sum {
+				long = nil
+			}
+
+			if long != nil && ord >= 1 && ord == next {
+				for j, pos := range lfnCharOffsets {
+					long[(ord-1)*lfnCharsPerEntry+j] = binary.LittleEndian.Uint16(entry[pos:])
+				}
+
+				next--
+			} else {
+				long = nil
+			}
+
+			continue
+		}
+
+		if entry[11]&AttrVolumeID != 0 {
+			long = nil
+
+			continue
+		}
+
+		short := [11]byte(entry[0:11])
+		name := decodeShortName(entry, entry[12])
+
+		if long != nil && next == 0 && shortNameChecksum(short) == sum {
+			if end := slices.Index(long, 0); end >= 0 {
+				long = long[:end]
+			}
+
+			name = string(utf16.Decode(long))
+		}
+
+		long = nil
+
+		if name == "." || name == ".." {
+			continue
+		}
+
+		u16 := func(off int) uint16 {
+			return binary.LittleEndian.Uint16(entry[off:])
+		}
+
+		entries = append(entries, &Entry{
+			Name:       name,
+			ShortName:  decodeShortName(entry, 0),
+			Attr:       entry[11],
+			Cluster:    uint32(u16(20))<<16 | uint32(u16(26)),
+			Size:       binary.LittleEndian.Uint32(entry[28:32]),
+			ModTime:    decodeTimestamp(u16(22), u16(24)),
+			CreateTime: decodeTimestamp(u16(14), u16(16)),
+			AccessDate: decodeTimestamp(0, u16(18)),
+		})
+	}
+
+	return entries, nil
+}
+
+func (f *FS) rootEntry() *Entry {
+	return &Entry{
+		Name: ".",
+		Attr: AttrDirectory,
+	}
+}
+
+func (f *FS) lookup(op string, name string) (*Entry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	cur := f.rootEntry()
+
+	if name == "." {
+		return cur, nil
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if cur.Attr&AttrDirectory == 0 {
+			return nil, &fs.PathError{Op: op, Path: name, Err: ErrNotDir}
+		}
+
+		entries, err := f.readDir(cur.Cluster)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+
+		var found *Entry
+
+		for _, e := range entries {
+			if strings.EqualFold(e.Name, part) || strings.EqualFold(e.ShortName, part) {
+				found = e
+
+				break
+			}
+		}
+
+		if found == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+
+		cur = found
+	}
+
+	return cur, nil
+}
+
+func (f *FS) Open(name string) (fs.File, error) {
+	entry, err := f.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &fileInfo{name: path.Base(name), entry: entry}
+
+	if entry.Attr&AttrDirectory != 0 {
+		entries, err := f.readDir(entry.Cluster)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		return &dir{info: info, entries: sortedDirEntries(entries)}, nil
+	}
+
+	var clusters []uint32
+
+	if entry.Size > 0 {
+		clusters, err = f.chain(entry.Cluster)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		if int64(len(clusters))*f.geo.clusterSize() < int64(entry.Size) {
+			err = fmt.Errorf("%w: truncated chain", ErrInvalidVolume)
+
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+
+	return &file{fs: f, info: info, clusters: clusters}, nil
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entry, err := f.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.Attr&AttrDirectory == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: ErrNotDir}
+	}
+
+	entries, err := f.readDir(entry.Cluster)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	return sortedDirEntries(entries), nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	entry, err := f.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{name: path.Base(name), entry: entry}, nil
+}
+
+func sortedDirEntries(entries []*Entry) []fs.DirEntry {
+	out := make([]fs.DirEntry, len(entries))
+
+	for i, e := range entries {
+		out[i] = fs.FileInfoToDirEntry(&fileInfo{name: e.Name, entry: e})
+	}
+
+	slices.SortFunc(out, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return out
+}
+
+type fileInfo struct {
+	name  string
+	entry *Entry
+}
+
+func (i *fileInfo) Name() string {
+	return i.name
+}
+
+func (i *fileInfo) Size() int64 {
+	return int64(i.entry.Size)
+}
+
+func (i *fileInfo) Mode() fs.FileMode {
+	mode := fs.FileMode(0o666)
+
+	if i.entry.Attr&AttrDirectory != 0 {
+		mode = fs.ModeDir | 0o777
+	}
+
+	if i.entry.Attr&AttrReadOnly != 0 {
+		mode &^= 0o222
+	}
+
+	return mode
+}
+
+func (i *fileInfo) ModTime() time.Time {
+	return i.entry.ModTime
+}
+
+func (i *fileInfo) IsDir() bool {
+	return i.entry.Attr&AttrDirectory != 0
+}
+
+func (i *fileInfo) Sys() any {
+	return i.entry
+}
+
+type file struct {
+	fs       *FS
+	info     *fileInfo
+	clusters []uint32
+	offset   int64
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Read(data []byte) (int, error) {
+	n, err := f.ReadAt(data, f.offset)
+	f.offset += int64(n)
+
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (f *file) ReadAt(data []byte, off int64) (int, error) {
+	size := f.info.Size()
+
+	if off < 0 {
+		return 0, fs.ErrInvalid
+	}
+
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	clusterSize := f.fs.geo.clusterSize()
+	total := 0
+
+	for total < len(data) && off < size {
+		idx := off / clusterSize
+		within := off % clusterSize
+		chunk := min(int64(len(data)-total), clusterSize-within, size-off)
+
+		n, err := f.fs.r.ReadAt(data[total:total+int(chunk)], f.fs.geo.clusterOffset(f.clusters[idx])+within)
+		total += n
+		off += int64(n)
+
+		if err != nil && !(err == io.EOF && int64(n) == chunk) {
+			return total, err
+		}
+	}
+
+	if total < len(data) {
+		return total, io.EOF
+	}
+
+	return total, nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	default:
+		return 0, fs.ErrInvalid
+	}
+
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+type dir struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *dir) ReadDir(count int) ([]fs.DirEntry, error) {
+	entries := d.entries[d.offset:]
+
+	if count > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+
+		entries = entries[:min(count, len(entries))]
+	}
+
+	d.offset += len(entries)
+
+	return entries, nil
+}
+
+func (d *dir) Close() error {
+	return nil
+}
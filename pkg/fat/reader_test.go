@@ -0,0 +1,132 @@
+package fat
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/disk"
+	"github.com/csnewman/go-appliance/pkg/diskbuilder"
+	"github.com/csnewman/go-appliance/pkg/internal/membuf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testTree = fstest.MapFS{
+	"EFI/BOOT/BOOTX64.EFI":             {Data: []byte(strings.Repeat("boot", 3000))},
+	"loader/loader.conf":               {Data: []byte("timeout 3\n")},
+	"loader/entries/Appliance A.conf":  {Data: []byte("title Appliance A\nlinux /vmlinuz\n")},
+	"loader/entries/Appliance B.conf":  {Data: []byte("title Appliance B\nlinux /vmlinuz\n")},
+	"config.txt":                       {Data: []byte("arm_64bit=1\n")},
+	"empty":                            {Data: nil},
+	"a-very-long-file-name-indeed.txt": {Data: []byte("long")},
+}
+
+func TestReadRoundTrip(t *testing.T) {
+	modTime := time.Date(2024, 5, 6, 7, 8, 10, 0, time.UTC)
+
+	for _, file := range testTree {
+		file.ModTime = modTime
+	}
+
+	for _, size := range []int64{2 * 1024 * 1024, 32 * 1024 * 1024, 64 * 1024 * 1024} {
+		ty := TypeAuto
+		if size == 64*1024*1024 {
+			ty = TypeFAT32
+		}
+
+		dev := membuf.New(int(size))
+
+		w, err := NewWriter(dev, size, Options{Type: ty, Label: "VOLUME", Serial: 42})
+		require.NoError(t, err, "writer should create")
+		require.NoError(t, w.AddFS(testTree), "fs should add")
+		require.NoError(t, w.Close(), "writer should close")
+
+		fsys, err := Open(dev)
+		require.NoError(t, err, "volume should open")
+
+		assert.Equal(t, w.geo.fatType, fsys.Type(), "type should match")
+		assert.Equal(t, "VOLUME", fsys.Label(), "label should match")
+		assert.Equal(t, uint32(42), fsys.Serial(), "serial should match")
+
+		require.NoError(t, fstest.TestFS(fsys, "EFI/BOOT/BOOTX64.EFI", "loader/entries/Appliance A.conf"))
+
+		for name, file := range testTree {
+			data, err := fs.ReadFile(fsys, name)
+			require.NoError(t, err, "%v should read", name)
+			assert.Equal(t, string(file.Data), string(data), "%v should match", name)
+
+			info, err := fs.Stat(fsys, name)
+			require.NoError(t, err, "%v should stat", name)
+			assert.Equal(t, modTime, info.ModTime(), "%v time should match", name)
+		}
+
+		data, err := fs.ReadFile(fsys, "efi/boot/bootx64.efi")
+		require.NoError(t, err, "lookups should be case insensitive")
+		assert.Len(t, data, 12000, "data should match")
+
+		info, err := fs.Stat(fsys, "loader/entries/Appliance A.conf")
+		require.NoError(t, err, "file should stat")
+		assert.Equal(t, "APPLIA~1.CON", info.Sys().(*Entry).ShortName, "short name should be exposed")
+	}
+}
+
+func TestReadPartition(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "disk.img")
+
+	b, err := diskbuilder.New(path, 64*1024*1024)
+	require.NoError(t, err, "builder should create")
+
+	start, end, err := b.Allocate(16*1024*1024, diskbuilder.DefaultAlignment)
+	require.NoError(t, err, "partition should allocate")
+
+	part, err := disk.NewGPTPartition(disk.GPTTypeEFISystem, start, end, "ESP")
+	require.NoError(t, err, "partition should create")
+
+	b.Add(part)
+
+	dst, size, err := b.PartitionWriter(0)
+	require.NoError(t, err, "partition writer should open")
+
+	w, err := NewWriter(dst, size, Options{HiddenSectors: uint32(start)})
+	require.NoError(t, err, "writer should create")
+	require.NoError(t, w.WriteFile("EFI/BOOT/BOOTAA64.EFI", strings.NewReader("efi"), DefaultTime))
+	require.NoError(t, w.Close(), "fat should close")
+	require.NoError(t, b.CloseContext(ctx), "builder should close")
+	require.NoError(t, b.Disk.Close(), "disk should close")
+
+	d, err := disk.Open(path)
+	require.NoError(t, err, "disk should open")
+
+	defer d.Close()
+
+	fsys, err := Open(d.PartitionSection(part))
+	require.NoError(t, err, "volume should open")
+
+	var names []string
+
+	require.NoError(t, fs.WalkDir(fsys, ".", func(name string, _ fs.DirEntry, err error) error {
+		names = append(names, name)
+
+		return err
+	}), "walk should succeed")
+	assert.Equal(t, []string{".", "EFI", "EFI/BOOT", "EFI/BOOT/BOOTAA64.EFI"}, names, "walk should match")
+
+	f, err := fsys.Open("EFI/BOOT/BOOTAA64.EFI")
+	require.NoError(t, err, "file should open")
+
+	data, err := io.ReadAll(f)
+	require.NoError(t, err, "file should read")
+	assert.Equal(t, "efi", string(data), "data should match")
+}
+
+func TestOpenInvalid(t *testing.T) {
+	_, err := Open(membuf.New(4096))
+	require.ErrorIs(t, err, ErrInvalidVolume, "blank volume should be rejected")
+}
@@ -0,0 +1,591 @@
+package fat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"path"
+	"strings"
+	"time"
+)
+
+type node struct {
+	name     string
+	short    [11]byte
+	long     bool
+	dir      bool
+	modTime  time.Time
+	cluster  uint32
+	size     uint32
+	children []*node
+	parent   *node
+}
+
+func (n *node) child(name string) *node {
+	for _, c := range n.children {
+		if strings.EqualFold(c.name, name) {
+			return c
+		}
+	}
+
+	return nil
+}
+
+func (n *node) shortExists(short [11]byte) bool {
+	for _, c := range n.children {
+		if c.short == short {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Writer formats a FAT volume and populates it with files and directories. File data is written as it is added,
+// whilst directories and allocation tables are written on Close.
+type Writer struct {
+	dst    io.WriterAt
+	opts   Options
+	geo    *geometry
+	fat    []uint32
+	next   uint32
+	root   *node
+	closed bool
+}
+
+// NewWriter prepares a volume of the given size within dst. Nothing is written until content is added.
+func NewWriter(dst io.WriterAt, size int64, opts Options) (*Writer, error) {
+	geo, err := newGeometry(size, opts.Type, opts.ClusterSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts.Label) > 11 {
+		return nil, fmt.Errorf("%w: label %q longer than 11 characters", ErrInvalidName, opts.Label)
+	}
+
+	if opts.Serial == 0 {
+		opts.Serial = rand.Uint32()
+	}
+
+	if opts.OEMName == "" {
+		opts.OEMName = "MSWIN4.1"
+	}
+
+	w := &Writer{
+		dst:  dst,
+		opts: opts,
+		geo:  geo,
+		fat:  make([]uint32, geo.clusters+firstCluster),
+		next: firstCluster,
+		root: &node{
+			dir:     true,
+			modTime: DefaultTime,
+		},
+	}
+
+	w.fat[0] = geo.fatType.eoc()&^0xFF | mediaType
+	w.fat[1] = geo.fatType.eoc()
+
+	// The FAT32 root directory always starts at the first cluster, whilst FAT12 and FAT16 use a fixed region.
+	if geo.fatType == TypeFAT32 {
+		w.root.cluster = w.alloc()
+		w.fat[w.root.cluster] = geo.fatType.eoc()
+	}
+
+	return w, nil
+}
+
+// Format creates an empty volume.
+func Format(dst io.WriterAt, size int64, opts Options) error {
+	w, err := NewWriter(dst, size, opts)
+	if err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+func (w *Writer) alloc() uint32 {
+	if w.next >= uint32(len(w.fat)) {
+		return 0
+	}
+
+	cluster := w.next
+	w.next++
+
+	return cluster
+}
+
+func (w *Writer) lookup(name string, create bool) (*node, error) {
+	name = strings.Trim(path.Clean("/"+name), "/")
+
+	cur := w.root
+
+	if name == "" {
+		return cur, nil
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		next := cur.child(part)
+
+		if next == nil {
+			if !create {
+				return nil, fmt.Errorf("%w: %v", fs.ErrNotExist, name)
+			}
+
+			var err error
+
+			next, err = w.addNode(cur, part, true, DefaultTime)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !next.dir {
+			return nil, fmt.Errorf("%w: %v", ErrNotDir, part)
+		}
+
+		cur = next
+	}
+
+	return cur, nil
+}
+
+func (w *Writer) addNode(parent *node, name string, dir bool, modTime time.Time) (*node, error) {
+	if w.closed {
+		return nil, ErrClosed
+	}
+
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	if parent.child(name) != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExist, name)
+	}
+
+	short, long, err := generateShortName(name, parent.shortExists)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &node{
+		name:    name,
+		short:   short,
+		long:    long,
+		dir:     dir,
+		modTime: modTime,
+		parent:  parent,
+	}
+
+	parent.children = append(parent.children, n)
+
+	return n, nil
+}
+
+// Mkdir creates a directory, along with any missing parents.
+func (w *Writer) Mkdir(name string, modTime time.Time) error {
+	dir, base := path.Split(strings.Trim(path.Clean("/"+name), "/"))
+
+	parent, err := w.lookup(dir, true)
+	if err != nil {
+		return err
+	}
+
+	if existing := parent.child(base); existing != nil && existing.dir {
+		existing.modTime = modTime
+
+		return nil
+	}
+
+	_, err = w.addNode(parent, base, true, modTime)
+
+	return err
+}
+
+// WriteFile creates a file, along with any missing parent directories, containing the data read from r.
+func (w *Writer) WriteFile(name string, r io.Reader, modTime time.Time) error {
+	dir, base := path.Split(strings.Trim(path.Clean("/"+name), "/"))
+
+	parent, err := w.lookup(dir, true)
+	if err != nil {
+		return err
+	}
+
+	n, err := w.addNode(parent, base, false, modTime)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, w.geo.clusterSize())
+
+	var prev uint32
+
+	for {
+		read, err := io.ReadFull(r, buf)
+		if read > 0 {
+			if uint64(n.size)+uint64(read) > 0xFFFFFFFF {
+				return fmt.Errorf("%w: %v exceeds 4GiB", ErrNoSpace, name)
+			}
+
+			cluster := w.alloc()
+			if cluster == 0 {
+				return fmt.Errorf("%w: writing %v", ErrNoSpace, name)
+			}
+
+			if _, err := w.dst.WriteAt(buf[:read], w.geo.clusterOffset(cluster)); err != nil {
+				return fmt.Errorf("failed to write %v: %w", name, err)
+			}
+
+			if prev == 0 {
+				n.cluster = cluster
+			} else {
+				w.fat[prev] = cluster
+			}
+
+			w.fat[cluster] = w.geo.fatType.eoc()
+			prev = cluster
+			n.size += uint32(read)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read %v: %w", name, err)
+		}
+	}
+}
+
+// AddFS copies all directories and regular files from fsys into the volume root.
+func (w *Writer) AddFS(fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			if name == "." {
+				return nil
+			}
+
+			return w.Mkdir(name, info.ModTime())
+		case d.Type().IsRegular():
+			f, err := fsys.Open(name)
+			if err != nil {
+				return err
+			}
+
+			defer f.Close()
+
+			return w.WriteFile(name, f, info.ModTime())
+		default:
+			return fmt.Errorf("%w: %v is %v", ErrUnsupportedType, name, d.Type())
+		}
+	})
+}
+
+func (w *Writer) Close() error {
+	if w.closed {
+		return ErrClosed
+	}
+
+	w.closed = true
+
+	if err := w.writeDir(w.root); err != nil {
+		return err
+	}
+
+	if err := w.writeFATs(); err != nil {
+		return err
+	}
+
+	return w.writeBootSectors()
+}
+
+func (w *Writer) dirEntries(dir *node) []byte {
+	var data []byte
+
+	if dir == w.root {
+		if w.opts.Label != "" {
+			entry := make([]byte, DirEntrySize)
+
+			copy(entry[0:11], formatLabel(w.opts.Label))
+			entry[11] = AttrVolumeID
+			putTimestamp(entry[22:26], DefaultTime)
+
+			data = append(data, entry...)
+		}
+	} else {
+		parentCluster := dir.parent.cluster
+		if dir.parent == w.root {
+			parentCluster = 0
+		}
+
+		data = append(data, makeEntry(formatShortName(".", ""), AttrDirectory, dir.cluster, 0, dir.modTime)...)
+		data = append(data, makeEntry(formatShortName("..", ""), AttrDirectory, parentCluster, 0, dir.modTime)...)
+	}
+
+	for _, c := range dir.children {
+		if c.long {
+			data = append(data, encodeLongName(c.name, c.short)...)
+		}
+
+		attr := byte(AttrArchive)
+		if c.dir {
+			attr = AttrDirectory
+		}
+
+		data = append(data, makeEntry(c.short, attr, c.cluster, c.size, c.modTime)...)
+	}
+
+	return data
+}
+
+// writeDir allocates clusters for a directory tree and writes the directory entries.
+func (w *Writer) writeDir(dir *node) error {
+	if err := w.allocDirs(dir); err != nil {
+		return err
+	}
+
+	return w.encodeDirs(dir)
+}
+
+func (w *Writer) allocDirs(dir *node) error {
+	// Entries are only sized here, clusters are assigned before any are encoded.
+	size := int64(len(w.dirEntries(dir)))
+	clusters := max((size+w.geo.clusterSize()-1)/w.geo.clusterSize(), 1)
+
+	if dir == w.root && w.geo.fatType != TypeFAT32 {
+		if size > int64(w.geo.rootEntries)*DirEntrySize {
+			return fmt.Errorf("%w: root directory exceeds %v entries", ErrNoSpace, w.geo.rootEntries)
+		}
+
+		clusters = 0
+	}
+
+	eoc := w.geo.fatType.eoc()
+	prev := dir.cluster
+
+	if prev == 0 && clusters > 0 {
+		prev = w.alloc()
+		if prev == 0 {
+			return fmt.Errorf("%w: allocating directory %v", ErrNoSpace, dir.name)
+		}
+
+		dir.cluster = prev
+		w.fat[prev] = eoc
+	}
+
+	for range clusters - 1 {
+		cluster := w.alloc()
+		if cluster == 0 {
+			return fmt.Errorf("%w: allocating directory %v", ErrNoSpace, dir.name)
+		}
+
+		w.fat[prev] = cluster
+		w.fat[cluster] = eoc
+		prev = cluster
+	}
+
+	for _, c := range dir.children {
+		if c.dir {
+			if err := w.allocDirs(c); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) encodeDirs(dir *node) error {
+	data := w.dirEntries(dir)
+
+	if dir.cluster == 0 {
+		buf := make([]byte, int64(w.geo.rootDirSectors())*SectorSize)
+		copy(buf, data)
+
+		if _, err := w.dst.WriteAt(buf, w.geo.rootDirStart()); err != nil {
+			return fmt.Errorf("failed to write root directory: %w", err)
+		}
+	}
+
+	buf := make([]byte, w.geo.clusterSize())
+
+	for cluster := dir.cluster; !w.geo.fatType.isEOC(cluster); cluster = w.fat[cluster] {
+		clear(buf)
+		data = data[copy(buf, data):]
+
+		if _, err := w.dst.WriteAt(buf, w.geo.clusterOffset(cluster)); err != nil {
+			return fmt.Errorf("failed to write directory: %w", err)
+		}
+	}
+
+	for _, c := range dir.children {
+		if c.dir {
+			if err := w.encodeDirs(c); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) writeFATs() error {
+	data := make([]byte, int64(w.geo.fatSectors)*SectorSize)
+
+	for i, v := range w.fat {
+		switch w.geo.fatType {
+		case TypeFAT12:
+			// Entries are packed as 12-bit values, two per three bytes.
+			off := i * 3 / 2
+
+			if i%2 == 0 {
+				data[off] = byte(v)
+				data[off+1] = data[off+1]&0xF0 | byte(v>>8)&0x0F
+			} else {
+				data[off] = data[off]&0x0F | byte(v<<4)
+				data[off+1] = byte(v >> 4)
+			}
+		case TypeFAT16:
+			binary.LittleEndian.PutUint16(data[i*2:], uint16(v))
+		default:
+			binary.LittleEndian.PutUint32(data[i*4:], v)
+		}
+	}
+
+	for i := range uint32(numFATs) {
+		off := int64(w.geo.reservedSectors+i*w.geo.fatSectors) * SectorSize
+
+		if _, err := w.dst.WriteAt(data, off); err != nil {
+			return fmt.Errorf("failed to write fat: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) writeBootSectors() error {
+	boot := make([]byte, SectorSize)
+
+	copy(boot[3:11], fmt.Sprintf("%-8.8s", w.opts.OEMName))
+	binary.LittleEndian.PutUint16(boot[11:13], SectorSize)
+	boot[13] = byte(w.geo.sectorsPerCluster)
+	binary.LittleEndian.PutUint16(boot[14:16], uint16(w.geo.reservedSectors))
+	boot[16] = numFATs
+	binary.LittleEndian.PutUint16(boot[17:19], uint16(w.geo.rootEntries))
+	boot[21] = mediaType
+	binary.LittleEndian.PutUint16(boot[24:26], 63)
+	binary.LittleEndian.PutUint16(boot[26:28], 255)
+	binary.LittleEndian.PutUint32(boot[28:32], w.opts.HiddenSectors)
+
+	if w.geo.totalSectors < 0x10000 && w.geo.fatType != TypeFAT32 {
+		binary.LittleEndian.PutUint16(boot[19:21], uint16(w.geo.totalSectors))
+	} else {
+		binary.LittleEndian.PutUint32(boot[32:36], w.geo.totalSectors)
+	}
+
+	// The extended boot record follows the BPB, which is larger for FAT32.
+	ext := boot[36:]
+
+	if w.geo.fatType == TypeFAT32 {
+		binary.LittleEndian.PutUint32(boot[36:40], w.geo.fatSectors)
+		binary.LittleEndian.PutUint32(boot[44:48], fat32RootCluster)
+		binary.LittleEndian.PutUint16(boot[48:50], fat32FSInfoSector)
+		binary.LittleEndian.PutUint16(boot[50:52], fat32BackupBootSector)
+
+		ext = boot[64:]
+	} else {
+		binary.LittleEndian.PutUint16(boot[22:24], uint16(w.geo.fatSectors))
+	}
+
+	ext[0] = 0x80
+	ext[2] = 0x29
+	binary.LittleEndian.PutUint32(ext[3:7], w.opts.Serial)
+	copy(ext[7:18], formatLabel(w.opts.Label))
+	copy(ext[18:26], fmt.Sprintf("%-8v", w.geo.fatType))
+
+	// Jump over the BPB to a stub which halts if booted: hlt; jmp $-1.
+	code := len(boot) - len(ext) + 26
+
+	copy(boot[0:3], []byte{0xEB, byte(code - 2), 0x90})
+	copy(boot[code:], []byte{0xF4, 0xEB, 0xFD})
+	binary.LittleEndian.PutUint16(boot[510:512], 0xAA55)
+
+	if w.geo.fatType != TypeFAT32 {
+		if _, err := w.dst.WriteAt(boot, 0); err != nil {
+			return fmt.Errorf("failed to write boot sector: %w", err)
+		}
+
+		return nil
+	}
+
+	info := make([]byte, SectorSize)
+
+	binary.LittleEndian.PutUint32(info[0:4], 0x41615252)
+	binary.LittleEndian.PutUint32(info[484:488], 0x61417272)
+	binary.LittleEndian.PutUint32(info[488:492], w.geo.clusters+firstCluster-w.next)
+	binary.LittleEndian.PutUint32(info[492:496], w.next)
+	binary.LittleEndian.PutUint32(info[508:512], 0xAA550000)
+
+	reserved := make([]byte, int64(w.geo.reservedSectors)*SectorSize)
+
+	for _, base := range []int{0, fat32BackupBootSector} {
+		copy(reserved[base*SectorSize:], boot)
+		copy(reserved[(base+fat32FSInfoSector)*SectorSize:], info)
+		binary.LittleEndian.PutUint16(reserved[(base+2)*SectorSize+510:], 0xAA55)
+	}
+
+	if _, err := w.dst.WriteAt(reserved, 0); err != nil {
+		return fmt.Errorf("failed to write boot sectors: %w", err)
+	}
+
+	return nil
+}
+
+func formatLabel(label string) []byte {
+	if label == "" {
+		label = "NO NAME"
+	}
+
+	return []byte(fmt.Sprintf("%-11.11s", strings.ToUpper(label)))
+}
+
+func putTimestamp(data []byte, t time.Time) {
+	t = t.UTC()
+
+	if t.Year() < 1980 {
+		t = DefaultTime
+	} else if t.Year() > 2107 {
+		t = time.Date(2107, 12, 31, 23, 59, 58, 0, time.UTC)
+	}
+
+	binary.LittleEndian.PutUint16(data[0:2], uint16(t.Hour()<<11|t.Minute()<<5|t.Second()/2))
+	binary.LittleEndian.PutUint16(data[2:4], uint16((t.Year()-1980)<<9|int(t.Month())<<5|t.Day()))
+}
+
+func makeEntry(short [11]byte, attr byte, cluster uint32, size uint32, modTime time.Time) []byte {
+	entry := make([]byte, DirEntrySize)
+
+	copy(entry[0:11], short[:])
+	entry[11] = attr
+
+	putTimestamp(entry[14:18], modTime)
+	copy(entry[18:20], entry[16:18])
+	binary.LittleEndian.PutUint16(entry[20:22], uint16(cluster>>16))
+	putTimestamp(entry[22:26], modTime)
+	binary.LittleEndian.PutUint16(entry[26:28], uint16(cluster))
+	binary.LittleEndian.PutUint32(entry[28:32], size)
+
+	return entry
+}
@@ -0,0 +1,215 @@
+package fat
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+	"unicode/utf16"
+
+	"github.com/csnewman/go-appliance/pkg/disk"
+	"github.com/csnewman/go-appliance/pkg/internal/membuf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShortNames(t *testing.T) {
+	none := func([11]byte) bool { return false }
+
+	for name, expected := range map[string]struct {
+		short string
+		long  bool
+	}{
+		"README.TXT":        {"README  TXT", false},
+		"BOOTX64.EFI":       {"BOOTX64 EFI", false},
+		"readme.txt":        {"README~1TXT", true},
+		"My Long Name.conf": {"MYLONG~1CON", true},
+		".hidden":           {"HIDDEN~1   ", true},
+		"a+b.tar.gz":        {"A_BTAR~1GZ ", true},
+	} {
+		short, long, err := generateShortName(name, none)
+		require.NoError(t, err, "short name for %q should generate", name)
+		assert.Equal(t, expected.short, string(short[:]), "short name for %q should match", name)
+		assert.Equal(t, expected.long, long, "long flag for %q should match", name)
+	}
+
+	taken := map[string]bool{"LONGFI~1TXT": true, "LONGFI~2TXT": true}
+
+	short, _, err := generateShortName("longfilename.txt", func(s [11]byte) bool { return taken[string(s[:])] })
+	require.NoError(t, err, "short name should generate")
+	assert.Equal(t, "LONGFI~3TXT", string(short[:]), "numeric tail should increment")
+}
+
+func TestShortNameChecksum(t *testing.T) {
+	short := formatShortName("MYLONG~1", "CON")
+
+	entries := encodeLongName("My Long Name.conf", short)
+	require.Len(t, entries, 2*DirEntrySize, "two long entries expected")
+
+	assert.Equal(t, byte(0x42), entries[0], "first entry should be last in sequence")
+	assert.Equal(t, byte(0x01), entries[DirEntrySize], "second entry should be first in sequence")
+	assert.Equal(t, shortNameChecksum(short), entries[13], "checksum should be stored")
+
+	var chars []uint16
+
+	for _, entry := range [][]byte{entries[DirEntrySize:], entries[:DirEntrySize]} {
+		for _, off := range lfnCharOffsets {
+			chars = append(chars, binary.LittleEndian.Uint16(entry[off:]))
+		}
+	}
+
+	assert.Equal(t, "My Long Name.conf", string(utf16.Decode(chars[:17])), "name should round trip")
+	assert.Equal(t, uint16(0), chars[17], "name should be terminated")
+	assert.Equal(t, uint16(0xFFFF), chars[18], "name should be padded")
+}
+
+func TestFormatFAT32(t *testing.T) {
+	const size = 64 * 1024 * 1024
+
+	dev := membuf.New(size)
+
+	w, err := NewWriter(dev, size, Options{
+		Type:          TypeFAT32,
+		Label:         "esp",
+		Serial:        0x1234ABCD,
+		HiddenSectors: 2048,
+	})
+	require.NoError(t, err, "writer should create")
+
+	modTime := time.Date(2024, 5, 6, 7, 8, 10, 0, time.UTC)
+
+	require.NoError(t, w.AddFS(fstest.MapFS{
+		"EFI/BOOT/BOOTX64.EFI": {Data: []byte(strings.Repeat("x", 5000)), ModTime: modTime},
+		"loader/loader.conf":   {Data: []byte("timeout 3\n"), ModTime: modTime},
+	}), "fs should add")
+	require.NoError(t, w.Close(), "writer should close")
+
+	boot := dev.Data[:SectorSize]
+
+	assert.Equal(t, uint16(SectorSize), binary.LittleEndian.Uint16(boot[11:13]), "sector size should match")
+	assert.Equal(t, byte(1), boot[13], "cluster size should be chosen by size")
+	assert.Equal(t, uint32(2048), binary.LittleEndian.Uint32(boot[28:32]), "hidden sectors should match")
+	assert.Equal(t, uint32(size/SectorSize), binary.LittleEndian.Uint32(boot[32:36]), "total sectors should match")
+	assert.Equal(t, uint32(0x1234ABCD), binary.LittleEndian.Uint32(boot[67:71]), "serial should match")
+	assert.Equal(t, "ESP        ", string(boot[71:82]), "label should match")
+	assert.Equal(t, "FAT32   ", string(boot[82:90]), "type should match")
+	assert.Equal(t, boot, dev.Data[6*SectorSize:7*SectorSize], "backup boot sector should match")
+
+	geo, err := newGeometry(size, TypeFAT32, 0)
+	require.NoError(t, err, "geometry should compute")
+
+	fat := dev.Data[geo.reservedSectors*SectorSize:]
+	root := dev.Data[geo.clusterOffset(fat32RootCluster):]
+
+	assert.Equal(t, TypeFAT32.eoc(), binary.LittleEndian.Uint32(fat[fat32RootCluster*4:]), "root should be one cluster")
+	assert.Equal(t, "ESP        ", string(root[0:11]), "label entry should be first")
+	assert.Equal(t, byte(AttrVolumeID), root[11], "label entry should have volume attribute")
+	assert.Equal(t, "EFI        ", string(root[32:43]), "efi directory should follow")
+	assert.Equal(t, byte(AttrDirectory), root[43], "efi should be a directory")
+
+	// The loader directory has a lowercase name, so needs a long name entry.
+	assert.Equal(t, byte(AttrLongName), root[64+11], "loader should have a long name")
+	assert.Equal(t, "LOADER~1   ", string(root[96:107]), "loader short name should match")
+
+	efi := dev.Data[geo.clusterOffset(uint32(binary.LittleEndian.Uint16(root[32+26:]))):]
+
+	assert.Equal(t, ".          ", string(efi[0:11]), "dot entry should exist")
+	assert.Equal(t, "..         ", string(efi[32:43]), "dot dot entry should exist")
+	assert.Equal(t, uint16(0), binary.LittleEndian.Uint16(efi[32+26:]), "dot dot should reference root as zero")
+
+	_, err = NewWriter(membuf.New(0), 16*1024*1024, Options{Type: TypeFAT32})
+	require.ErrorIs(t, err, ErrTooSmall, "small volumes should be rejected")
+}
+
+func TestAutoType(t *testing.T) {
+	for size, expected := range map[int64]Type{
+		160 * 1024:         TypeFAT12,
+		1024 * 1024:        TypeFAT12,
+		4 * 1024 * 1024:    TypeFAT12,
+		5 * 1024 * 1024:    TypeFAT16,
+		32 * 1024 * 1024:   TypeFAT16,
+		512 * 1024 * 1024:  TypeFAT16,
+		513 * 1024 * 1024:  TypeFAT32,
+		8 << 30:            TypeFAT32,
+		2000 * 1024 * 1024: TypeFAT32,
+	} {
+		geo, err := newGeometry(size, TypeAuto, 0)
+		require.NoError(t, err, "geometry for %v should compute", size)
+		assert.Equal(t, expected, geo.fatType, "type for %v should match", size)
+
+		low, high := clusterLimits(expected)
+		assert.GreaterOrEqual(t, geo.clusters, low, "clusters for %v should be in range", size)
+		assert.LessOrEqual(t, geo.clusters, high, "clusters for %v should be in range", size)
+
+		used := geo.reservedSectors + geo.rootDirSectors() + numFATs*geo.fatSectors +
+			geo.clusters*geo.sectorsPerCluster
+		assert.LessOrEqual(t, used, geo.totalSectors, "layout for %v should fit", size)
+	}
+
+	_, err := newGeometry(64*1024*1024, TypeFAT12, 512)
+	require.ErrorIs(t, err, ErrTooLarge, "large fat12 volumes should be rejected")
+}
+
+func TestFormatFAT12(t *testing.T) {
+	const size = 1024 * 1024
+
+	dev := membuf.New(size)
+
+	w, err := NewWriter(dev, size, Options{Label: "UBOOTENV", Serial: 1})
+	require.NoError(t, err, "writer should create")
+
+	require.NoError(t, w.WriteFile("uboot.env", strings.NewReader(strings.Repeat("e", 1500)), DefaultTime))
+	require.NoError(t, w.WriteFile("config.txt", strings.NewReader("arm_64bit=1\n"), DefaultTime))
+	require.NoError(t, w.Close(), "writer should close")
+
+	boot := dev.Data[:SectorSize]
+
+	assert.Equal(t, []byte{0xEB, 0x3C, 0x90}, boot[0:3], "jump should skip bpb")
+	assert.Equal(t, uint16(fat16RootEntries), binary.LittleEndian.Uint16(boot[17:19]), "root entries should match")
+	assert.Equal(t, uint16(size/SectorSize), binary.LittleEndian.Uint16(boot[19:21]), "total sectors should match")
+	assert.Equal(t, "UBOOTENV   ", string(boot[43:54]), "label should match")
+	assert.Equal(t, "FAT12   ", string(boot[54:62]), "type should match")
+
+	geo, err := newGeometry(size, TypeAuto, 0)
+	require.NoError(t, err, "geometry should compute")
+
+	fat := dev.Data[geo.reservedSectors*SectorSize:]
+
+	// uboot.env occupies clusters 2-4, config.txt cluster 5.
+	assert.Equal(t, []byte{0xF8, 0xFF, 0xFF, 0x03, 0x40, 0x00, 0xFF, 0xFF, 0xFF}, fat[:9], "fat12 should be packed")
+
+	root := dev.Data[geo.rootDirStart():]
+
+	assert.Equal(t, "UBOOTENV   ", string(root[0:11]), "label entry should be first")
+	assert.Equal(t, "UBOOT~1 ENV", string(root[64+0:64+11]), "file short name should match")
+	assert.Equal(t, uint32(1500), binary.LittleEndian.Uint32(root[64+28:]), "file size should match")
+}
+
+func TestMBRPartType(t *testing.T) {
+	assert.Equal(t, disk.MBRPartType(disk.MBRPartTypeFAT12), MBRPartType(TypeAuto, 1024*1024), "fat12 type")
+	assert.Equal(t, disk.MBRPartType(disk.MBRPartTypeFAT16Small), MBRPartType(TypeAuto, 16*1024*1024), "fat16 type")
+	assert.Equal(t, disk.MBRPartType(disk.MBRPartTypeFAT16LBA), MBRPartType(TypeAuto, 64*1024*1024), "fat16 lba type")
+	assert.Equal(t, disk.MBRPartType(disk.MBRPartTypeFAT32LBA), MBRPartType(TypeAuto, 1<<30), "fat32 type")
+}
+
+func TestGeometryClusters(t *testing.T) {
+	for _, ty := range []Type{TypeFAT12, TypeFAT16, TypeFAT32} {
+		// Covers sizes such as 192000 bytes for FAT12, 2129920 for FAT16 and 34094592 for FAT32, where sizing the
+		// FATs for exactly the clusters that fit left a spare sector, which readers counted as a further cluster.
+		for size := int64(128 * 1024); size <= 40*1024*1024; size += SectorSize {
+			geo, err := newGeometry(size, ty, 0)
+			if err != nil {
+				continue
+			}
+
+			// Readers derive the cluster count from the space left after the FATs, which must not leave room for
+			// clusters the FATs do not cover.
+			data := geo.totalSectors - geo.reservedSectors - geo.rootDirSectors() - geo.fats*geo.fatSectors
+			require.Equal(t, geo.clusters, data/geo.sectorsPerCluster, "%v of %v bytes should match readers", ty,
+				size)
+			require.LessOrEqual(t, fatSectorsFor(ty, geo.clusters), geo.fatSectors, "%v of %v bytes should fit FAT",
+				ty, size)
+		}
+	}
+}
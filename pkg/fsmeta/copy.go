@@ -0,0 +1,77 @@
+package fsmeta
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+var ErrNoReadLink = errors.New("source cannot read symlinks")
+
+// Builder is implemented by the filesystem writers in this module.
+type Builder interface {
+	Mkdir(name string, attr Attr) error
+	WriteFile(name string, r io.Reader, attr Attr) error
+	Symlink(name string, target string, attr Attr) error
+	Mknod(name string, attr Attr) error
+	Link(name string, target string) error
+}
+
+// CopyFS adds the contents of fsys to b, starting with its root. Metadata is taken from Attr values returned by
+// FileInfo.Sys, otherwise files are owned by root. Entries sharing a non-zero Attr.Inode are added as hard links to
+// the first of them. Symlinks require fsys to implement ReadLinkFS.
+func CopyFS(b Builder, fsys fs.FS) error {
+	links := make(map[uint64]string)
+
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		attr := FromFileInfo(info)
+
+		if !d.IsDir() && attr.Inode != 0 {
+			if first, ok := links[attr.Inode]; ok {
+				return b.Link(name, first)
+			}
+
+			links[attr.Inode] = name
+		}
+
+		attr.Inode = 0
+
+		switch {
+		case d.IsDir():
+			return b.Mkdir(name, attr)
+		case d.Type().IsRegular():
+			f, err := fsys.Open(name)
+			if err != nil {
+				return err
+			}
+
+			defer f.Close()
+
+			return b.WriteFile(name, f, attr)
+		case d.Type()&fs.ModeSymlink != 0:
+			rfs, ok := fsys.(ReadLinkFS)
+			if !ok {
+				return fmt.Errorf("%w: %v", ErrNoReadLink, name)
+			}
+
+			target, err := rfs.ReadLink(name)
+			if err != nil {
+				return err
+			}
+
+			return b.Symlink(name, target, attr)
+		default:
+			return b.Mknod(name, attr)
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package fsmeta
+
+import (
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder records the calls made by CopyFS.
+type recorder struct {
+	ops []string
+}
+
+func (r *recorder) Mkdir(name string, attr Attr) error {
+	r.ops = append(r.ops, "mkdir "+name)
+
+	return nil
+}
+
+func (r *recorder) WriteFile(name string, data io.Reader, attr Attr) error {
+	content, err := io.ReadAll(data)
+	r.ops = append(r.ops, "file "+name+" "+string(content))
+
+	return err
+}
+
+func (r *recorder) Symlink(name string, target string, attr Attr) error {
+	r.ops = append(r.ops, "symlink "+name+" "+target)
+
+	return nil
+}
+
+func (r *recorder) Mknod(name string, attr Attr) error {
+	r.ops = append(r.ops, "mknod "+name)
+
+	return nil
+}
+
+func (r *recorder) Link(name string, target string) error {
+	r.ops = append(r.ops, "link "+name+" "+target)
+
+	return nil
+}
+
+func TestCopyFS(t *testing.T) {
+	var r recorder
+
+	require.NoError(t, CopyFS(&r, fstest.MapFS{
+		"bin/a":    {Data: []byte("a"), Mode: 0o755, Sys: &Attr{Mode: 0o755, Inode: 7}},
+		"bin/b":    {Data: []byte("a"), Mode: 0o755, Sys: &Attr{Mode: 0o755, Inode: 7}},
+		"bin/c":    {Data: []byte("c"), Mode: 0o755, Sys: &Attr{Mode: 0o755, Inode: 8}},
+		"dev/null": {Mode: fs.ModeDevice | fs.ModeCharDevice | 0o666},
+		"etc/motd": {Data: []byte("hi"), Mode: 0o644},
+	}), "fs should copy")
+
+	assert.Equal(t, []string{
+		"mkdir .", "mkdir bin", "file bin/a a", "link bin/b bin/a", "file bin/c c", "mkdir dev", "mknod dev/null",
+		"mkdir etc", "file etc/motd hi",
+	}, r.ops, "entries sharing an inode should be linked")
+
+	// Hide any ReadLink method of the source.
+	err := CopyFS(&r, struct{ fs.FS }{fstest.MapFS{"link": {Data: []byte("target"), Mode: fs.ModeSymlink | 0o777}}})
+	assert.ErrorIs(t, err, ErrNoReadLink, "symlink without ReadLinkFS should fail")
+}
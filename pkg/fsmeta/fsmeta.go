@@ -0,0 +1,147 @@
+package fsmeta
+
+import (
+	"io/fs"
+	"slices"
+	"time"
+)
+
+// Unix file type and permission bits, as used in st_mode.
+const (
+	ModeTypeMask = 0o170000
+	ModeSocket   = 0o140000
+	ModeSymlink  = 0o120000
+	ModeRegular  = 0o100000
+	ModeBlock    = 0o060000
+	ModeDir      = 0o040000
+	ModeChar     = 0o020000
+	ModeFIFO     = 0o010000
+	ModeSetuid   = 0o4000
+	ModeSetgid   = 0o2000
+	ModeSticky   = 0o1000
+	ModePerm     = 0o777
+)
+
+// Attr holds the Unix metadata of a file. Filesystem readers in this module return an *Attr from
+// fs.FileInfo.Sys, and writers accept it for each entry.
+type Attr struct {
+	Mode       fs.FileMode
+	UID        uint32
+	GID        uint32
+	ModTime    time.Time
+	AccessTime time.Time
+	ChangeTime time.Time
+	Major      uint32
+	Minor      uint32
+	Xattrs     map[string][]byte
+	// Inode identifies the file within its source filesystem so that hard links can be detected, such as by CopyFS.
+	// It is zero when unknown. Writers do not store it.
+	Inode uint64
+}
+
+// FromFileInfo returns the metadata of a file, using the attributes from Sys when available and otherwise defaulting
+// to root ownership.
+func FromFileInfo(info fs.FileInfo) Attr {
+	if attr, ok := info.Sys().(*Attr); ok {
+		return *attr
+	}
+
+	return Attr{
+		Mode:       info.Mode(),
+		ModTime:    info.ModTime(),
+		AccessTime: info.ModTime(),
+		ChangeTime: info.ModTime(),
+	}
+}
+
+// UnixMode converts the mode into st_mode bits.
+func (a *Attr) UnixMode() uint32 {
+	return UnixMode(a.Mode)
+}
+
+// XattrNames returns the extended attribute names in sorted order, so that output is deterministic.
+func (a *Attr) XattrNames() []string {
+	names := make([]string, 0, len(a.Xattrs))
+	for name := range a.Xattrs {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+func UnixMode(mode fs.FileMode) uint32 {
+	out := uint32(mode.Perm())
+
+	switch mode.Type() {
+	case fs.ModeDir:
+		out |= ModeDir
+	case fs.ModeSymlink:
+		out |= ModeSymlink
+	case fs.ModeNamedPipe:
+		out |= ModeFIFO
+	case fs.ModeSocket:
+		out |= ModeSocket
+	case fs.ModeDevice:
+		out |= ModeBlock
+	case fs.ModeDevice | fs.ModeCharDevice:
+		out |= ModeChar
+	default:
+		out |= ModeRegular
+	}
+
+	if mode&fs.ModeSetuid != 0 {
+		out |= ModeSetuid
+	}
+
+	if mode&fs.ModeSetgid != 0 {
+		out |= ModeSetgid
+	}
+
+	if mode&fs.ModeSticky != 0 {
+		out |= ModeSticky
+	}
+
+	return out
+}
+
+// FileMode converts st_mode bits into an fs.FileMode.
+func FileMode(mode uint32) fs.FileMode {
+	out := fs.FileMode(mode & ModePerm)
+
+	switch mode & ModeTypeMask {
+	case ModeDir:
+		out |= fs.ModeDir
+	case ModeSymlink:
+		out |= fs.ModeSymlink
+	case ModeFIFO:
+		out |= fs.ModeNamedPipe
+	case ModeSocket:
+		out |= fs.ModeSocket
+	case ModeBlock:
+		out |= fs.ModeDevice
+	case ModeChar:
+		out |= fs.ModeDevice | fs.ModeCharDevice
+	}
+
+	if mode&ModeSetuid != 0 {
+		out |= fs.ModeSetuid
+	}
+
+	if mode&ModeSetgid != 0 {
+		out |= fs.ModeSetgid
+	}
+
+	if mode&ModeSticky != 0 {
+		out |= fs.ModeSticky
+	}
+
+	return out
+}
+
+// ReadLinkFS is implemented by filesystems which can report symlink targets.
+type ReadLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+}
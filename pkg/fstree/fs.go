@@ -0,0 +1,262 @@
+package fstree
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const maxSymlinks = 40
+
+func pathError(op string, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// resolve walks a path from the root, following symlinks in intermediate components and, when follow is set, the
+// final component. Symlink targets are interpreted relative to the tree root.
+func (t *Tree) resolve(op string, name string, follow bool) (*node, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError(op, name, fs.ErrInvalid)
+	}
+
+	if t.closed {
+		return nil, pathError(op, name, fs.ErrClosed)
+	}
+
+	stack := []*node{t.root}
+	parts := strings.Split(name, "/")
+	links := 0
+
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		cur := stack[len(stack)-1]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+
+			continue
+		}
+
+		if !cur.isDir() {
+			return nil, pathError(op, name, ErrNotDir)
+		}
+
+		next := cur.children[part]
+		if next == nil {
+			return nil, pathError(op, name, fs.ErrNotExist)
+		}
+
+		if next.isSymlink() && (len(parts) > 0 || follow) {
+			links++
+			if links > maxSymlinks {
+				return nil, pathError(op, name, errors.New("too many levels of symbolic links"))
+			}
+
+			if strings.HasPrefix(next.target, "/") {
+				stack = stack[:1]
+			}
+
+			parts = append(strings.Split(next.target, "/"), parts...)
+
+			continue
+		}
+
+		stack = append(stack, next)
+	}
+
+	return stack[len(stack)-1], nil
+}
+
+// Open opens a file for reading. File data is read from the spool, or from the source of files added by reference.
+func (t *Tree) Open(name string) (fs.File, error) {
+	n, err := t.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &fileInfo{name: path.Base(name), node: n}
+
+	if n.isDir() {
+		return &dir{info: info, entries: t.dirEntries(n)}, nil
+	}
+
+	if !n.attr.Mode.IsRegular() {
+		return &file{info: info, r: io.NopCloser(strings.NewReader(""))}, nil
+	}
+
+	r, err := t.openData(n)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+
+	return &file{info: info, r: r}, nil
+}
+
+func (t *Tree) dirEntries(n *node) []fs.DirEntry {
+	out := make([]fs.DirEntry, 0, len(n.children))
+
+	for _, name := range n.sortedNames() {
+		out = append(out, fs.FileInfoToDirEntry(&fileInfo{name: name, node: n.children[name]}))
+	}
+
+	return out
+}
+
+func (t *Tree) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := t.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if !n.isDir() {
+		return nil, pathError("readdir", name, ErrNotDir)
+	}
+
+	return t.dirEntries(n), nil
+}
+
+func (t *Tree) Stat(name string) (fs.FileInfo, error) {
+	n, err := t.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{name: path.Base(name), node: n}, nil
+}
+
+// Lstat describes a file without following a final symlink.
+func (t *Tree) Lstat(name string) (fs.FileInfo, error) {
+	n, err := t.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{name: path.Base(name), node: n}, nil
+}
+
+// ReadLink returns the target of a symlink.
+func (t *Tree) ReadLink(name string) (string, error) {
+	n, err := t.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+
+	if !n.isSymlink() {
+		return "", pathError("readlink", name, fs.ErrInvalid)
+	}
+
+	return n.target, nil
+}
+
+type fileInfo struct {
+	name string
+	node *node
+}
+
+func (i *fileInfo) Name() string {
+	return i.name
+}
+
+func (i *fileInfo) Size() int64 {
+	switch {
+	case i.node.isSymlink():
+		return int64(len(i.node.target))
+	case i.node.attr.Mode.IsRegular():
+		return i.node.size
+	default:
+		return 0
+	}
+}
+
+func (i *fileInfo) Mode() fs.FileMode {
+	return i.node.attr.Mode
+}
+
+func (i *fileInfo) ModTime() time.Time {
+	return i.node.attr.ModTime
+}
+
+func (i *fileInfo) IsDir() bool {
+	return i.node.isDir()
+}
+
+func (i *fileInfo) Sys() any {
+	attr := i.node.attr
+	attr.Xattrs = cloneXattrs(attr.Xattrs)
+
+	return &attr
+}
+
+func cloneXattrs(xattrs map[string][]byte) map[string][]byte {
+	if xattrs == nil {
+		return nil
+	}
+
+	out := make(map[string][]byte, len(xattrs))
+	for name, value := range xattrs {
+		out[name] = slices.Clone(value)
+	}
+
+	return out
+}
+
+type file struct {
+	info *fileInfo
+	r    io.ReadCloser
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Read(data []byte) (int, error) {
+	return f.r.Read(data)
+}
+
+func (f *file) Close() error {
+	return f.r.Close()
+}
+
+type dir struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *dir) ReadDir(count int) ([]fs.DirEntry, error) {
+	entries := d.entries[d.offset:]
+
+	if count > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+
+		entries = entries[:min(count, len(entries))]
+	}
+
+	d.offset += len(entries)
+
+	return entries, nil
+}
+
+func (d *dir) Close() error {
+	return nil
+}
@@ -0,0 +1,106 @@
+package fstree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+)
+
+// hostKey identifies a host file with multiple links.
+type hostKey struct {
+	dev uint64
+	ino uint64
+}
+
+// hostAttr reads the metadata of a host file, along with a key identifying it when it has hard links.
+func hostAttr(name string, info fs.FileInfo) (fsmeta.Attr, hostKey, error) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fsmeta.FromFileInfo(info), hostKey{}, nil
+	}
+
+	attr := fsmeta.Attr{
+		Mode:       info.Mode(),
+		UID:        st.Uid,
+		GID:        st.Gid,
+		ModTime:    info.ModTime(),
+		AccessTime: time.Unix(st.Atim.Unix()),
+		ChangeTime: time.Unix(st.Ctim.Unix()),
+	}
+
+	if info.Mode()&fs.ModeDevice != 0 {
+		// Decode the glibc dev_t encoding.
+		rdev := uint64(st.Rdev)
+		attr.Major = uint32(rdev>>8&0xFFF | rdev>>32&^0xFFF)
+		attr.Minor = uint32(rdev&0xFF | rdev>>12&^0xFF)
+	}
+
+	// Extended attribute syscalls follow symlinks, so links are skipped.
+	if info.Mode()&fs.ModeSymlink == 0 {
+		xattrs, err := hostXattrs(name)
+		if err != nil {
+			return attr, hostKey{}, err
+		}
+
+		attr.Xattrs = xattrs
+	}
+
+	var key hostKey
+
+	if !info.IsDir() && st.Nlink > 1 {
+		key = hostKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+	}
+
+	return attr, key, nil
+}
+
+func hostXattrs(name string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(name, nil)
+	if errors.Is(err, syscall.ENOTSUP) || size == 0 {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list xattrs: %w", err)
+	}
+
+	list := make([]byte, size)
+
+	size, err = syscall.Listxattr(name, list)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list xattrs: %w", err)
+	}
+
+	xattrs := make(map[string][]byte)
+
+	for _, key := range bytes.Split(list[:size], []byte{0}) {
+		if len(key) == 0 {
+			continue
+		}
+
+		size, err := syscall.Getxattr(name, string(key), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read xattr %s: %w", key, err)
+		}
+
+		value := make([]byte, size)
+
+		size, err = syscall.Getxattr(name, string(key), value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read xattr %s: %w", key, err)
+		}
+
+		xattrs[string(key)] = value[:size]
+	}
+
+	if len(xattrs) == 0 {
+		return nil, nil
+	}
+
+	return xattrs, nil
+}
@@ -0,0 +1,63 @@
+package fstree
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTreeAddDir(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "opt/app"), 0o750), "directory should create")
+	require.NoError(t, os.WriteFile(filepath.Join(src, "opt/app/run"), []byte("#!/bin/sh\n"), 0o755),
+		"file should write")
+	require.NoError(t, os.Link(filepath.Join(src, "opt/app/run"), filepath.Join(src, "opt/app/start")),
+		"hard link should create")
+	require.NoError(t, os.Symlink("app/run", filepath.Join(src, "opt/run")), "symlink should create")
+
+	xattrs := true
+
+	err := syscall.Setxattr(filepath.Join(src, "opt/app/run"), "user.origin", []byte("host"), 0)
+	if errors.Is(err, syscall.ENOTSUP) {
+		t.Log("user xattrs not supported by the host, skipping xattr check")
+
+		xattrs = false
+	} else {
+		require.NoError(t, err, "xattr should set")
+	}
+
+	tree := New(Options{TempDir: t.TempDir()})
+	defer tree.Close()
+
+	require.NoError(t, tree.AddDir(src, MergeOptions{Owner: &Owner{}}), "directory should merge")
+
+	info, err := tree.Stat("opt/app")
+	require.NoError(t, err, "directory should stat")
+	assert.Equal(t, fs.ModeDir|0o750, info.Mode(), "directory mode should be kept")
+
+	run, err := tree.Stat("opt/app/run")
+	require.NoError(t, err, "file should stat")
+
+	attr := run.Sys().(*fsmeta.Attr)
+	assert.Equal(t, fs.FileMode(0o755), run.Mode(), "file mode should be kept")
+	assert.Zero(t, attr.UID, "owner should be overridden")
+
+	if xattrs {
+		assert.Equal(t, "host", string(attr.Xattrs["user.origin"]), "xattr should be read")
+	}
+
+	start, err := tree.Stat("opt/app/start")
+	require.NoError(t, err, "hard link should stat")
+	assert.Equal(t, attr.Inode, start.Sys().(*fsmeta.Attr).Inode, "hard link should be detected")
+
+	data, err := fs.ReadFile(tree, "opt/run")
+	require.NoError(t, err, "symlink should resolve")
+	assert.Equal(t, "#!/bin/sh\n", string(data), "file should read from the host")
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package fstree
+
+import (
+	"io/fs"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+)
+
+// hostKey identifies a host file with multiple links.
+type hostKey struct{}
+
+// hostAttr reads the metadata of a host file. Ownership and hard links are not read outside of Linux.
+func hostAttr(_ string, info fs.FileInfo) (fsmeta.Attr, hostKey, error) {
+	return fsmeta.FromFileInfo(info), hostKey{}, nil
+}
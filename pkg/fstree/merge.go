@@ -0,0 +1,389 @@
+package fstree
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/csnewman/go-appliance/pkg/compress"
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+)
+
+// paxXattrPrefix prefixes the PAX records holding extended attributes, as written by GNU tar and libarchive.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// Whiteout file names used by container image layers.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// Owner is a uid and gid pair.
+type Owner struct {
+	UID uint32
+	GID uint32
+}
+
+type MergeOptions struct {
+	// Dir is the directory within the tree that content is merged into, defaulting to the root.
+	Dir string
+	// Owner replaces the ownership of every merged entry when set, such as for host files owned by the build user.
+	Owner *Owner
+	// Whiteouts applies the whiteout files of container image layers instead of adding them. A ".wh.<name>" entry
+	// removes name from the tree, and a ".wh..wh..opq" entry removes the existing contents of its directory. Neither
+	// removes entries from the same source.
+	Whiteouts bool
+}
+
+func (o *MergeOptions) apply(attr *fsmeta.Attr) {
+	if o.Owner != nil {
+		attr.UID = o.Owner.UID
+		attr.GID = o.Owner.GID
+	}
+}
+
+func (o *MergeOptions) join(name string) string {
+	return path.Join(cleanPath(o.Dir), cleanPath(name))
+}
+
+// merger tracks the hard links of a source, identified by a source specific key.
+type merger[K comparable] struct {
+	t     *Tree
+	links map[K]string
+}
+
+func newMerger[K comparable](t *Tree) *merger[K] {
+	return &merger[K]{t: t, links: make(map[K]string)}
+}
+
+// link creates a hard link when key has been seen before, otherwise recording name as its first path.
+func (m *merger[K]) link(name string, key K) (bool, error) {
+	if first, ok := m.links[key]; ok {
+		return true, m.t.Link(name, first)
+	}
+
+	m.links[key] = name
+
+	return false, nil
+}
+
+// AddFS merges the contents of fsys. Metadata is taken from fsmeta.Attr values returned by FileInfo.Sys, otherwise
+// files are owned by root, and hard links are detected from fsmeta.Attr.Inode. File data is read from fsys when
+// needed, so it must remain available for the lifetime of the tree. The metadata of the root of fsys is not used.
+// Symlinks require fsys to implement fsmeta.ReadLinkFS.
+func (t *Tree) AddFS(fsys fs.FS, opts MergeOptions) error {
+	if t.closed {
+		return ErrClosed
+	}
+
+	if err := t.Mkdir(opts.join("."), t.dirAttr(opts.join("."))); err != nil {
+		return err
+	}
+
+	m := newMerger[uint64](t)
+
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		attr := fsmeta.FromFileInfo(info)
+		opts.apply(&attr)
+
+		dst := opts.join(name)
+
+		if !d.IsDir() && attr.Inode != 0 {
+			if linked, err := m.link(dst, attr.Inode); linked || err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case d.IsDir():
+			return t.Mkdir(dst, attr)
+		case d.Type().IsRegular():
+			return t.AddFile(dst, info.Size(), func() (fs.File, error) {
+				return fsys.Open(name)
+			}, attr)
+		case d.Type()&fs.ModeSymlink != 0:
+			rfs, ok := fsys.(fsmeta.ReadLinkFS)
+			if !ok {
+				return fmt.Errorf("%w: %v is a symlink but the source cannot read links", ErrUnsupportedType, name)
+			}
+
+			target, err := rfs.ReadLink(name)
+			if err != nil {
+				return err
+			}
+
+			return t.Symlink(dst, target, attr)
+		default:
+			return t.Mknod(dst, attr)
+		}
+	})
+}
+
+// dirAttr returns the metadata of an existing directory, or the default for a new one.
+func (t *Tree) dirAttr(name string) fsmeta.Attr {
+	if n, err := t.entry(name); err == nil && n.isDir() {
+		return n.attr
+	}
+
+	return fsmeta.Attr{Mode: fs.ModeDir | 0o755}
+}
+
+// AddDir merges the contents of a host directory, without following symlinks. On Linux, ownership, device numbers,
+// extended attributes and hard links are read from the host, otherwise files are owned by root. File data is read
+// from the host when needed, so it must remain unchanged for the lifetime of the tree. The metadata of the directory
+// itself is not used.
+func (t *Tree) AddDir(dir string, opts MergeOptions) error {
+	if t.closed {
+		return ErrClosed
+	}
+
+	if err := t.Mkdir(opts.join("."), t.dirAttr(opts.join("."))); err != nil {
+		return err
+	}
+
+	m := newMerger[hostKey](t)
+
+	return filepath.WalkDir(dir, func(src string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, src)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		attr, key, err := hostAttr(src, info)
+		if err != nil {
+			return fmt.Errorf("reading %v: %w", src, err)
+		}
+
+		opts.apply(&attr)
+
+		dst := opts.join(filepath.ToSlash(rel))
+
+		if key != (hostKey{}) {
+			if linked, err := m.link(dst, key); linked || err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case d.IsDir():
+			return t.Mkdir(dst, attr)
+		case d.Type().IsRegular():
+			return t.AddFile(dst, info.Size(), func() (fs.File, error) {
+				return os.Open(src)
+			}, attr)
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(src)
+			if err != nil {
+				return err
+			}
+
+			return t.Symlink(dst, target, attr)
+		default:
+			return t.Mknod(dst, attr)
+		}
+	})
+}
+
+// OpenTar creates a tree from a tar stream, which may be gzip compressed. The caller must close the tree.
+func OpenTar(r io.Reader, opts Options) (*Tree, error) {
+	t := New(opts)
+
+	if err := t.AddTar(r, MergeOptions{}); err != nil {
+		_ = t.Close()
+
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// AddTar merges the entries of a tar stream, including PAX extended attributes and device nodes, which do not need
+// to be created on the host. Gzip compressed streams are detected and decompressed. File data is spooled. Hard link
+// targets must precede their links.
+func (t *Tree) AddTar(r io.Reader, opts MergeOptions) error {
+	if t.closed {
+		return ErrClosed
+	}
+
+	br := bufio.NewReader(r)
+	r = br
+
+	if compress.IsGzip(br) {
+		gr, err := compress.Gzip{}.NewReader(br)
+		if err != nil {
+			return err
+		}
+
+		defer gr.Close()
+
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	added := make(map[string]bool)
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read tar: %w", err)
+		}
+
+		// Global headers, such as the one git archive writes, hold PAX records rather than a file.
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		dst := opts.join(hdr.Name)
+
+		if opts.Whiteouts {
+			if ok, err := t.whiteout(dst, added); ok || err != nil {
+				if err != nil {
+					return fmt.Errorf("tar entry %v: %w", hdr.Name, err)
+				}
+
+				continue
+			}
+
+			for p := dst; p != "."; p = path.Dir(p) {
+				added[p] = true
+			}
+		}
+
+		if err := t.addTarEntry(tr, hdr, dst, opts); err != nil {
+			return fmt.Errorf("tar entry %v: %w", hdr.Name, err)
+		}
+	}
+}
+
+// whiteout applies name when it is a whiteout file, reporting whether it was. Entries in added come from the same
+// source and are not removed.
+func (t *Tree) whiteout(name string, added map[string]bool) (bool, error) {
+	dir, base := path.Split(name)
+
+	if base == whiteoutOpaque {
+		n, err := t.lookup(dir, true)
+		if err != nil {
+			return true, err
+		}
+
+		t.prune(cleanPath(dir), n, added)
+
+		return true, nil
+	}
+
+	target, ok := strings.CutPrefix(base, whiteoutPrefix)
+	if !ok {
+		return false, nil
+	}
+
+	if err := validName(target); err != nil {
+		return true, err
+	}
+
+	name = path.Join(dir, target)
+	if added[name] {
+		return true, nil
+	}
+
+	if err := t.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return true, err
+	}
+
+	return true, nil
+}
+
+// prune removes the contents of a directory which are not in added.
+func (t *Tree) prune(name string, n *node, added map[string]bool) {
+	for base, child := range n.children {
+		p := path.Join(name, base)
+
+		switch {
+		case !added[p]:
+			delete(n.children, base)
+		case child.isDir():
+			t.prune(p, child, added)
+		}
+	}
+}
+
+// tarAttr returns the metadata of a tar entry.
+func tarAttr(hdr *tar.Header) fsmeta.Attr {
+	attr := fsmeta.Attr{
+		Mode:       hdr.FileInfo().Mode(),
+		UID:        uint32(hdr.Uid),
+		GID:        uint32(hdr.Gid),
+		ModTime:    hdr.ModTime.UTC(),
+		AccessTime: hdr.AccessTime.UTC(),
+		ChangeTime: hdr.ChangeTime.UTC(),
+	}
+
+	if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+		attr.Major = uint32(hdr.Devmajor)
+		attr.Minor = uint32(hdr.Devminor)
+	}
+
+	for key, value := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(key, paxXattrPrefix); ok {
+			if attr.Xattrs == nil {
+				attr.Xattrs = make(map[string][]byte)
+			}
+
+			attr.Xattrs[name] = []byte(value)
+		}
+	}
+
+	return attr
+}
+
+func (t *Tree) addTarEntry(tr *tar.Reader, hdr *tar.Header, dst string, opts MergeOptions) error {
+	attr := tarAttr(hdr)
+	opts.apply(&attr)
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return t.Mkdir(dst, attr)
+	case tar.TypeReg, tar.TypeGNUSparse:
+		return t.WriteFile(dst, tr, attr)
+	case tar.TypeSymlink:
+		return t.Symlink(dst, hdr.Linkname, attr)
+	case tar.TypeLink:
+		return t.Link(dst, opts.join(hdr.Linkname))
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return t.Mknod(dst, attr)
+	default:
+		return fmt.Errorf("%w: tar type %q", ErrUnsupportedType, hdr.Typeflag)
+	}
+}
@@ -0,0 +1,150 @@
+package fstree
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/diskbuilder"
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+)
+
+// WriteTar serialises the tree as a PAX tar stream, sorted by path with each directory preceding its contents.
+// Ownership is numeric, extended attributes are stored as SCHILY.xattr records and hard links refer to the first
+// path of their file. Times which are not set are written as the Unix epoch rather than the current time.
+func (t *Tree) WriteTar(w io.Writer) error {
+	if t.closed {
+		return ErrClosed
+	}
+
+	tw := tar.NewWriter(w)
+	first := make(map[*node]string)
+
+	for _, e := range t.entries() {
+		n := e.node
+
+		hdr := tarHeader(n.attr)
+		hdr.Name = e.name
+
+		switch {
+		case n.isDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case first[n] != "":
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first[n]
+		case n.isSymlink():
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = n.target
+		case n.attr.Mode.IsRegular():
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = n.size
+		case n.attr.Mode.Type() == fs.ModeNamedPipe:
+			hdr.Typeflag = tar.TypeFifo
+		case n.attr.Mode.Type() == fs.ModeDevice|fs.ModeCharDevice:
+			hdr.Typeflag = tar.TypeChar
+		case n.attr.Mode.Type() == fs.ModeDevice:
+			hdr.Typeflag = tar.TypeBlock
+		default:
+			return fmt.Errorf("%w: %v is %v", ErrUnsupportedType, e.name, n.attr.Mode.Type())
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write %v: %w", e.name, err)
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			if err := t.writeTarData(tw, n); err != nil {
+				return fmt.Errorf("failed to write %v: %w", e.name, err)
+			}
+		}
+
+		if !n.isDir() && first[n] == "" {
+			first[n] = e.name
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write tar: %w", err)
+	}
+
+	return nil
+}
+
+func tarTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return time.Unix(0, 0).UTC()
+	}
+
+	return t
+}
+
+func tarHeader(attr fsmeta.Attr) *tar.Header {
+	hdr := &tar.Header{
+		Format:  tar.FormatPAX,
+		Mode:    int64(attr.UnixMode() &^ fsmeta.ModeTypeMask),
+		Uid:     int(attr.UID),
+		Gid:     int(attr.GID),
+		ModTime: tarTime(attr.ModTime),
+	}
+
+	if !attr.AccessTime.IsZero() {
+		hdr.AccessTime = attr.AccessTime
+	}
+
+	if !attr.ChangeTime.IsZero() {
+		hdr.ChangeTime = attr.ChangeTime
+	}
+
+	if attr.Mode&fs.ModeDevice != 0 {
+		hdr.Devmajor = int64(attr.Major)
+		hdr.Devminor = int64(attr.Minor)
+	}
+
+	if len(attr.Xattrs) > 0 {
+		hdr.PAXRecords = make(map[string]string, len(attr.Xattrs))
+
+		for _, name := range attr.XattrNames() {
+			hdr.PAXRecords[paxXattrPrefix+name] = string(attr.Xattrs[name])
+		}
+	}
+
+	return hdr
+}
+
+func (t *Tree) writeTarData(tw *tar.Writer, n *node) error {
+	r, err := t.openData(n)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	if _, err := io.Copy(tw, r); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+type tarContent struct {
+	tree *Tree
+}
+
+// TarContent returns the tree serialised by WriteTar as partition content. The tar stream is produced as it is read,
+// so the tree must not be modified until the content has been written.
+func (t *Tree) TarContent() diskbuilder.Content {
+	return &tarContent{tree: t}
+}
+
+func (c *tarContent) Open() (io.ReadCloser, int64, error) {
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(c.tree.WriteTar(pw))
+	}()
+
+	return pr, -1, nil
+}
@@ -0,0 +1,311 @@
+package fstree
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/csnewman/go-appliance/pkg/compress"
+	"github.com/csnewman/go-appliance/pkg/disk"
+	"github.com/csnewman/go-appliance/pkg/diskbuilder"
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listTar checks the stream with libarchive when available, returning its verbose listing.
+func listTar(t *testing.T, data []byte) string {
+	t.Helper()
+
+	bin, err := exec.LookPath("bsdtar")
+	if err != nil {
+		t.Log("bsdtar not available, skipping consistency check")
+
+		return ""
+	}
+
+	path := filepath.Join(t.TempDir(), "tree.tar")
+	require.NoError(t, os.WriteFile(path, data, 0o644), "tar should save")
+
+	out, err := exec.Command(bin, "-tvnf", path).CombinedOutput()
+	require.NoError(t, err, "bsdtar should list the tar:\n%s", out)
+
+	return string(out)
+}
+
+func TestWriteTar(t *testing.T) {
+	var buf bytes.Buffer
+
+	require.NoError(t, buildTree(t).WriteTar(&buf), "tar should write")
+
+	var again bytes.Buffer
+
+	require.NoError(t, buildTree(t).WriteTar(&again), "tar should write again")
+	assert.Equal(t, buf.Bytes(), again.Bytes(), "output should be deterministic")
+
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	headers := make(map[string]*tar.Header)
+
+	var names []string
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		require.NoError(t, err, "tar should read")
+
+		names = append(names, hdr.Name)
+		headers[hdr.Name] = hdr
+	}
+
+	assert.Equal(t, []string{
+		"./", "bin", "dev/", "dev/null", "etc/", "etc/gshadow", "etc/shadow", "home/", "home/user/", "run/",
+		"run/initctl", "usr/", "usr/bin/", "usr/bin/ping",
+	}, names, "entries should be sorted with parents first")
+
+	assert.Equal(t, byte(tar.TypeReg), headers["etc/gshadow"].Typeflag, "first link should hold the data")
+	assert.Equal(t, byte(tar.TypeLink), headers["etc/shadow"].Typeflag, "later link should refer to the first")
+	assert.Equal(t, "etc/gshadow", headers["etc/shadow"].Linkname, "link should name the first path")
+	assert.Equal(t, "system_u:object_r:shadow_t:s0\x00",
+		headers["etc/gshadow"].PAXRecords["SCHILY.xattr.security.selinux"], "xattr should be a pax record")
+	assert.Equal(t, int64(0o4755), headers["usr/bin/ping"].Mode, "setuid should be kept")
+	assert.Equal(t, byte(tar.TypeChar), headers["dev/null"].Typeflag, "device type should be kept")
+	assert.Equal(t, int64(3), headers["dev/null"].Devminor, "device numbers should be kept")
+	assert.Equal(t, byte(tar.TypeFifo), headers["run/initctl"].Typeflag, "fifo type should be kept")
+	assert.Equal(t, 1000, headers["home/user/"].Uid, "ownership should be kept")
+	assert.Equal(t, testTime, headers["./"].ModTime.UTC(), "root metadata should be kept")
+
+	if out := listTar(t, buf.Bytes()); out != "" {
+		assert.Contains(t, out, "bin -> usr/bin", "listing should include the symlink")
+		assert.Contains(t, out, "etc/shadow link to etc/gshadow", "listing should include the hard link")
+		assert.Contains(t, out, "1,3", "listing should include the device numbers")
+	}
+}
+
+func TestAddTar(t *testing.T) {
+	var buf bytes.Buffer
+
+	require.NoError(t, buildTree(t).WriteTar(&buf), "tar should write")
+
+	tree := New(Options{TempDir: t.TempDir()})
+	defer tree.Close()
+
+	require.NoError(t, tree.AddTar(bytes.NewReader(buf.Bytes()), MergeOptions{}), "tar should merge")
+
+	info, err := tree.Stat(".")
+	require.NoError(t, err, "root should stat")
+	assert.Equal(t, testTime, info.ModTime(), "root metadata should be read")
+
+	shadow, err := tree.Stat("etc/shadow")
+	require.NoError(t, err, "file should stat")
+
+	attr := shadow.Sys().(*fsmeta.Attr)
+	assert.Equal(t, uint32(42), attr.GID, "gid should be read")
+	assert.Equal(t, []byte("system_u:object_r:shadow_t:s0\x00"), attr.Xattrs["security.selinux"],
+		"xattr should be read")
+
+	gshadow, err := tree.Stat("etc/gshadow")
+	require.NoError(t, err, "hard link should stat")
+	assert.Equal(t, attr.Inode, gshadow.Sys().(*fsmeta.Attr).Inode, "hard link should be kept")
+
+	data, err := fs.ReadFile(tree, "etc/shadow")
+	require.NoError(t, err, "file should read")
+	assert.Equal(t, "root:*::0:::::\n", string(data), "data should be spooled")
+
+	info, err = tree.Lstat("dev/null")
+	require.NoError(t, err, "device should stat")
+	assert.Equal(t, fs.ModeDevice|fs.ModeCharDevice|0o666, info.Mode(), "device mode should be read")
+	assert.Equal(t, uint32(1), info.Sys().(*fsmeta.Attr).Major, "major should be read")
+
+	info, err = tree.Stat("usr/bin/ping")
+	require.NoError(t, err, "setuid file should stat")
+	assert.Equal(t, fs.ModeSetuid|0o755, info.Mode(), "setuid should be read")
+
+	var out bytes.Buffer
+
+	require.NoError(t, tree.WriteTar(&out), "tar should write")
+	assert.Equal(t, buf.Bytes(), out.Bytes(), "tar should round trip")
+
+	// Merging beneath a directory applies to hard link targets, and ownership can be replaced.
+	require.NoError(t, tree.AddTar(bytes.NewReader(buf.Bytes()), MergeOptions{
+		Dir:   "copy",
+		Owner: &Owner{UID: 5, GID: 6},
+	}), "tar should merge beneath a directory")
+
+	info, err = tree.Stat("copy/etc/shadow")
+	require.NoError(t, err, "link should be merged")
+	assert.Equal(t, uint32(5), info.Sys().(*fsmeta.Attr).UID, "uid should be replaced")
+	assert.Equal(t, uint32(6), info.Sys().(*fsmeta.Attr).GID, "gid should be replaced")
+}
+
+func TestTarContent(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "disk.img")
+
+	b, err := diskbuilder.New(path, 8*1024*1024)
+	require.NoError(t, err, "builder should create")
+
+	start, end, err := b.Allocate(4*1024*1024, diskbuilder.DefaultAlignment)
+	require.NoError(t, err, "partition should allocate")
+
+	part, err := disk.NewGPTPartition(disk.GPTTypeLinuxFileSystem, start, end, "rootfs")
+	require.NoError(t, err, "partition should create")
+
+	b.Add(part)
+
+	tree := buildTree(t)
+
+	written, err := b.WriteContent(ctx, 0, tree.TarContent(), diskbuilder.ContentOptions{})
+	require.NoError(t, err, "content should write")
+	require.NoError(t, b.CloseContext(ctx), "builder should close")
+	require.NoError(t, b.Disk.Close(), "disk should close")
+
+	var expected bytes.Buffer
+
+	require.NoError(t, tree.WriteTar(&expected), "tar should write")
+	assert.Equal(t, int64(expected.Len()), written, "whole stream should be written")
+
+	d, err := disk.Open(path)
+	require.NoError(t, err, "disk should open")
+
+	defer d.Close()
+
+	actual := make([]byte, expected.Len())
+	_, err = d.PartitionSection(part).ReadAt(actual, 0)
+	require.NoError(t, err, "partition should read")
+	assert.Equal(t, expected.Bytes(), actual, "partition should hold the tar stream")
+}
+
+func TestOpenTar(t *testing.T) {
+	var buf bytes.Buffer
+
+	require.NoError(t, buildTree(t).WriteTar(&buf), "tar should write")
+
+	var gz bytes.Buffer
+
+	gw, err := compress.Gzip{}.NewWriter(&gz)
+	require.NoError(t, err, "gzip writer should create")
+
+	_, err = gw.Write(buf.Bytes())
+	require.NoError(t, err, "tar should compress")
+	require.NoError(t, gw.Close(), "gzip writer should close")
+
+	for name, data := range map[string][]byte{"plain": buf.Bytes(), "gzip": gz.Bytes()} {
+		tree, err := OpenTar(bytes.NewReader(data), Options{TempDir: t.TempDir()})
+		require.NoError(t, err, "%v tar should open", name)
+
+		require.NoError(t, fstest.TestFS(tree, "etc/shadow", "etc/gshadow", "usr/bin/ping", "dev/null"),
+			"%v tree should behave", name)
+
+		var out bytes.Buffer
+
+		require.NoError(t, tree.WriteTar(&out), "tar should write")
+		assert.Equal(t, buf.Bytes(), out.Bytes(), "%v tar should round trip", name)
+		require.NoError(t, tree.Close(), "tree should close")
+	}
+
+	_, err = OpenTar(bytes.NewReader(gz.Bytes()[:len(gz.Bytes())/2]), Options{TempDir: t.TempDir()})
+	assert.Error(t, err, "truncated stream should fail")
+}
+
+func TestOpenTarGlobalHeader(t *testing.T) {
+	tree, err := OpenTar(layerTar(t,
+		&tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{
+			"comment": "0123456789abcdef",
+		}},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "README", Mode: 0o644},
+	), Options{TempDir: t.TempDir()})
+	require.NoError(t, err, "tar should open")
+
+	defer tree.Close()
+
+	entries, err := fs.ReadDir(tree, ".")
+	require.NoError(t, err, "root should read")
+	require.Len(t, entries, 1, "global header should be skipped")
+	assert.Equal(t, "README", entries[0].Name(), "file should be added")
+}
+
+// layerTar builds a tar stream with the given entries, where regular files contain their own name.
+func layerTar(t *testing.T, hdrs ...*tar.Header) *bytes.Reader {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	tw := tar.NewWriter(&buf)
+
+	for _, hdr := range hdrs {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+
+		require.NoError(t, tw.WriteHeader(hdr), "header should write")
+
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(hdr.Name))
+			require.NoError(t, err, "data should write")
+		}
+	}
+
+	require.NoError(t, tw.Close(), "tar should close")
+
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestAddTarWhiteouts(t *testing.T) {
+	tree := New(Options{TempDir: t.TempDir()})
+	defer tree.Close()
+
+	opts := MergeOptions{Whiteouts: true}
+
+	require.NoError(t, tree.AddTar(layerTar(t,
+		&tar.Header{Typeflag: tar.TypeReg, Name: "etc/hosts", Mode: 0o644},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0o644},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "var/cache/a", Mode: 0o644},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "var/cache/sub/b", Mode: 0o644},
+		&tar.Header{Typeflag: tar.TypeDir, Name: "var/log/", Mode: 0o750},
+	), opts), "lower layer should merge")
+
+	require.NoError(t, tree.AddTar(layerTar(t,
+		&tar.Header{Typeflag: tar.TypeReg, Name: "etc/.wh.hosts", Mode: 0o644},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "var/.wh.missing", Mode: 0o644},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "var/cache/sub/c", Mode: 0o644},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "var/cache/.wh..wh..opq", Mode: 0o644},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "var/cache/d", Mode: 0o644},
+		&tar.Header{Typeflag: tar.TypeLink, Name: "etc/passwd-", Linkname: "etc/passwd"},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "etc/group", Mode: 0o644},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "etc/.wh.group", Mode: 0o644},
+	), opts), "upper layer should merge")
+
+	var names []string
+
+	require.NoError(t, fs.WalkDir(tree, ".", func(name string, d fs.DirEntry, err error) error {
+		names = append(names, name)
+
+		return err
+	}), "tree should walk")
+
+	assert.Equal(t, []string{
+		".", "etc", "etc/group", "etc/passwd", "etc/passwd-", "var", "var/cache", "var/cache/d", "var/cache/sub",
+		"var/cache/sub/c", "var/log",
+	}, names, "whiteouts should be applied to lower layers only")
+
+	require.NoError(t, tree.AddTar(layerTar(t,
+		&tar.Header{Typeflag: tar.TypeReg, Name: "etc/.wh.hosts", Mode: 0o644},
+	), MergeOptions{}), "whiteout should merge as a file")
+
+	_, err := tree.Stat("etc/.wh.hosts")
+	require.NoError(t, err, "whiteout should only be applied when requested")
+
+	assert.ErrorIs(t, tree.AddTar(layerTar(t,
+		&tar.Header{Typeflag: tar.TypeReg, Name: "etc/.wh..", Mode: 0o644},
+	), opts), ErrInvalidName, "whiteout of the parent should be rejected")
+}
@@ -0,0 +1,471 @@
+package fstree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+)
+
+var (
+	ErrInvalidName     = errors.New("invalid file name")
+	ErrNotDir          = errors.New("not a directory")
+	ErrUnsupportedType = errors.New("unsupported file type")
+	ErrClosed          = errors.New("tree closed")
+)
+
+type node struct {
+	attr     fsmeta.Attr
+	target   string
+	children map[string]*node
+
+	// Regular file data is either spooled, or opened from its source when read.
+	offset int64
+	size   int64
+	open   func() (fs.File, error)
+}
+
+func (n *node) isDir() bool {
+	return n.attr.Mode.IsDir()
+}
+
+func (n *node) isSymlink() bool {
+	return n.attr.Mode.Type() == fs.ModeSymlink
+}
+
+func (n *node) sortedNames() []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+func withType(mode fs.FileMode, ty fs.FileMode) fs.FileMode {
+	return mode&^fs.ModeType | ty
+}
+
+type Options struct {
+	// TempDir is where file data read from streams is spooled, defaulting to the system temporary directory.
+	TempDir string
+}
+
+// Tree holds the files of a filesystem along with their Unix metadata, independent of any filesystem format. It can
+// be built programmatically or merged from other sources, read as an fs.FS, copied into a filesystem writer or
+// serialised as a tar stream.
+//
+// Adding an entry replaces any existing entry of the same name, except that a directory added over a directory only
+// replaces its metadata. Missing parent directories are created, owned by root. Entries are given unique inode
+// numbers, shared by hard links, which are reported by fsmeta.Attr.Inode.
+type Tree struct {
+	opts    Options
+	root    *node
+	inodes  uint64
+	spool   *os.File
+	spooled int64
+	closed  bool
+}
+
+// New creates an empty tree. Close must be called to remove any spooled data.
+func New(opts Options) *Tree {
+	t := &Tree{opts: opts}
+	t.root = t.newNode(fsmeta.Attr{Mode: fs.ModeDir | 0o755})
+
+	return t
+}
+
+// Close removes spooled data. The tree can no longer be read or modified.
+func (t *Tree) Close() error {
+	if t.closed {
+		return ErrClosed
+	}
+
+	t.closed = true
+
+	if t.spool == nil {
+		return nil
+	}
+
+	_ = t.spool.Close()
+
+	if err := os.Remove(t.spool.Name()); err != nil {
+		return fmt.Errorf("failed to remove spool: %w", err)
+	}
+
+	return nil
+}
+
+func (t *Tree) newNode(attr fsmeta.Attr) *node {
+	t.inodes++
+	attr.Inode = t.inodes
+
+	n := &node{attr: attr}
+
+	if attr.Mode.IsDir() {
+		n.children = make(map[string]*node)
+	}
+
+	return n
+}
+
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	return nil
+}
+
+func cleanPath(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// lookup finds a directory without following symlinks, optionally creating missing directories.
+func (t *Tree) lookup(name string, create bool) (*node, error) {
+	name = cleanPath(name)
+
+	cur := t.root
+
+	if name == "" {
+		return cur, nil
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		next := cur.children[part]
+
+		if next == nil {
+			if !create {
+				return nil, fmt.Errorf("%w: %v", fs.ErrNotExist, name)
+			}
+
+			next = t.newNode(fsmeta.Attr{Mode: fs.ModeDir | 0o755})
+			cur.children[part] = next
+		}
+
+		if !next.isDir() {
+			return nil, fmt.Errorf("%w: %v", ErrNotDir, part)
+		}
+
+		cur = next
+	}
+
+	return cur, nil
+}
+
+// entry finds the entry at name without following symlinks.
+func (t *Tree) entry(name string) (*node, error) {
+	name = cleanPath(name)
+	if name == "" {
+		return t.root, nil
+	}
+
+	dir, base := path.Split(name)
+
+	parent, err := t.lookup(dir, false)
+	if err != nil {
+		return nil, err
+	}
+
+	n := parent.children[base]
+	if n == nil {
+		return nil, fmt.Errorf("%w: %v", fs.ErrNotExist, name)
+	}
+
+	return n, nil
+}
+
+// place links n at name, replacing any existing entry.
+func (t *Tree) place(name string, n *node) error {
+	if t.closed {
+		return ErrClosed
+	}
+
+	dir, base := path.Split(cleanPath(name))
+
+	if err := validName(base); err != nil {
+		return err
+	}
+
+	parent, err := t.lookup(dir, true)
+	if err != nil {
+		return err
+	}
+
+	parent.children[base] = n
+
+	return nil
+}
+
+func (t *Tree) create(name string, attr fsmeta.Attr) (*node, error) {
+	n := t.newNode(attr)
+
+	if err := t.place(name, n); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// Mkdir creates a directory, along with any missing parents. The metadata of an existing directory, including the
+// root when name is ".", is replaced.
+func (t *Tree) Mkdir(name string, attr fsmeta.Attr) error {
+	if t.closed {
+		return ErrClosed
+	}
+
+	attr.Mode = withType(attr.Mode, fs.ModeDir)
+
+	if existing, err := t.entry(name); err == nil && existing.isDir() {
+		attr.Inode = existing.attr.Inode
+		existing.attr = attr
+
+		return nil
+	}
+
+	_, err := t.create(name, attr)
+
+	return err
+}
+
+// spoolData copies r into the spool, returning its offset and size.
+func (t *Tree) spoolData(r io.Reader) (int64, int64, error) {
+	if t.spool == nil {
+		spool, err := os.CreateTemp(t.opts.TempDir, "fstree-*")
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to create spool: %w", err)
+		}
+
+		t.spool = spool
+	}
+
+	start := t.spooled
+
+	size, err := io.Copy(io.NewOffsetWriter(t.spool, start), r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to spool data: %w", err)
+	}
+
+	t.spooled += size
+
+	return start, size, nil
+}
+
+// WriteFile creates a regular file containing the data read from r, which is spooled to a temporary file.
+func (t *Tree) WriteFile(name string, r io.Reader, attr fsmeta.Attr) error {
+	if t.closed {
+		return ErrClosed
+	}
+
+	offset, size, err := t.spoolData(r)
+	if err != nil {
+		return fmt.Errorf("writing %v: %w", name, err)
+	}
+
+	attr.Mode = withType(attr.Mode, 0)
+
+	n, err := t.create(name, attr)
+	if err != nil {
+		return err
+	}
+
+	n.offset = offset
+	n.size = size
+
+	return nil
+}
+
+// AddFile creates a regular file of the given size whose data is read from open each time the file is read, avoiding
+// a copy of data which is already stored elsewhere.
+func (t *Tree) AddFile(name string, size int64, open func() (fs.File, error), attr fsmeta.Attr) error {
+	attr.Mode = withType(attr.Mode, 0)
+
+	n, err := t.create(name, attr)
+	if err != nil {
+		return err
+	}
+
+	n.size = size
+	n.open = open
+
+	return nil
+}
+
+// Symlink creates a symbolic link, along with any missing parent directories.
+func (t *Tree) Symlink(name string, target string, attr fsmeta.Attr) error {
+	if target == "" {
+		return fmt.Errorf("%w: empty symlink target", ErrInvalidName)
+	}
+
+	attr.Mode = withType(attr.Mode, fs.ModeSymlink)
+
+	n, err := t.create(name, attr)
+	if err != nil {
+		return err
+	}
+
+	n.target = target
+
+	return nil
+}
+
+// Mknod creates a device node, FIFO or socket, selected by the type bits of attr.Mode.
+func (t *Tree) Mknod(name string, attr fsmeta.Attr) error {
+	switch attr.Mode.Type() {
+	case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice, fs.ModeNamedPipe, fs.ModeSocket:
+	default:
+		return fmt.Errorf("%w: %v is %v", ErrUnsupportedType, name, attr.Mode.Type())
+	}
+
+	_, err := t.create(name, attr)
+
+	return err
+}
+
+// Link creates a hard link to an existing non-directory entry, without following symlinks.
+func (t *Tree) Link(name string, target string) error {
+	if t.closed {
+		return ErrClosed
+	}
+
+	n, err := t.entry(target)
+	if err != nil {
+		return err
+	}
+
+	if n.isDir() {
+		return fmt.Errorf("%w: cannot hard link directory %v", ErrUnsupportedType, target)
+	}
+
+	return t.place(name, n)
+}
+
+// Remove deletes an entry, along with the contents of a directory.
+func (t *Tree) Remove(name string) error {
+	if t.closed {
+		return ErrClosed
+	}
+
+	name = cleanPath(name)
+	if name == "" {
+		return fmt.Errorf("%w: cannot remove the root", ErrInvalidName)
+	}
+
+	dir, base := path.Split(name)
+
+	parent, err := t.lookup(dir, false)
+	if err != nil {
+		return err
+	}
+
+	if parent.children[base] == nil {
+		return fmt.Errorf("%w: %v", fs.ErrNotExist, name)
+	}
+
+	delete(parent.children, base)
+
+	return nil
+}
+
+type walkEntry struct {
+	name string
+	node *node
+}
+
+// entries lists the tree sorted by path with each directory preceding its contents, starting with the root as ".".
+func (t *Tree) entries() []walkEntry {
+	out := []walkEntry{{name: ".", node: t.root}}
+
+	var walk func(prefix string, n *node)
+
+	walk = func(prefix string, n *node) {
+		for _, name := range n.sortedNames() {
+			child := n.children[name]
+			out = append(out, walkEntry{name: prefix + name, node: child})
+
+			if child.isDir() {
+				walk(prefix+name+"/", child)
+			}
+		}
+	}
+
+	walk("", t.root)
+
+	return out
+}
+
+// Builder is implemented by the filesystem writers in this module.
+type Builder = fsmeta.Builder
+
+// CopyTo adds the tree to a filesystem writer, in sorted order. Unlike copying through fs.FS, hard links are kept.
+func (t *Tree) CopyTo(b Builder) error {
+	if t.closed {
+		return ErrClosed
+	}
+
+	first := make(map[*node]string)
+
+	for _, e := range t.entries() {
+		n := e.node
+		attr := n.attr
+		attr.Inode = 0
+
+		var err error
+
+		switch {
+		case n.isDir():
+			err = b.Mkdir(e.name, attr)
+		case first[n] != "":
+			err = b.Link(e.name, first[n])
+		case n.isSymlink():
+			err = b.Symlink(e.name, n.target, attr)
+		case n.attr.Mode.IsRegular():
+			err = t.copyFile(b, e.name, n, attr)
+		default:
+			err = b.Mknod(e.name, attr)
+		}
+
+		if err != nil {
+			return fmt.Errorf("copying %v: %w", e.name, err)
+		}
+
+		if !n.isDir() && first[n] == "" {
+			first[n] = e.name
+		}
+	}
+
+	return nil
+}
+
+func (t *Tree) copyFile(b Builder, name string, n *node, attr fsmeta.Attr) error {
+	r, err := t.openData(n)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	return b.WriteFile(name, r, attr)
+}
+
+// openData opens the data of a regular file.
+func (t *Tree) openData(n *node) (io.ReadCloser, error) {
+	if n.open == nil {
+		return io.NopCloser(io.NewSectionReader(t.spool, n.offset, n.size)), nil
+	}
+
+	f, err := n.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
@@ -0,0 +1,187 @@
+package fstree
+
+import (
+	"bytes"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/cpio"
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testTime = time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+
+func buildTree(t *testing.T) *Tree {
+	t.Helper()
+
+	tree := New(Options{TempDir: t.TempDir()})
+	t.Cleanup(func() {
+		_ = tree.Close()
+	})
+
+	require.NoError(t, tree.Mkdir(".", fsmeta.Attr{Mode: 0o755, ModTime: testTime}), "root should update")
+	require.NoError(t, tree.WriteFile("etc/shadow", strings.NewReader("root:*::0:::::\n"), fsmeta.Attr{
+		Mode:    0o640,
+		UID:     0,
+		GID:     42,
+		ModTime: testTime,
+		Xattrs:  map[string][]byte{"security.selinux": []byte("system_u:object_r:shadow_t:s0\x00")},
+	}), "file should write")
+	require.NoError(t, tree.Link("etc/gshadow", "etc/shadow"), "hard link should create")
+	require.NoError(t, tree.WriteFile("usr/bin/ping", strings.NewReader("ping"), fsmeta.Attr{
+		Mode:   0o755 | fs.ModeSetuid,
+		Xattrs: map[string][]byte{"security.capability": {1, 0, 0, 2, 0, 0x20}},
+	}), "setuid file should write")
+	require.NoError(t, tree.Symlink("bin", "usr/bin", fsmeta.Attr{Mode: 0o777}), "symlink should create")
+	require.NoError(t, tree.Mknod("dev/null", fsmeta.Attr{
+		Mode:  fs.ModeDevice | fs.ModeCharDevice | 0o666,
+		Major: 1,
+		Minor: 3,
+	}), "device should create")
+	require.NoError(t, tree.Mknod("run/initctl", fsmeta.Attr{Mode: fs.ModeNamedPipe | 0o600}), "fifo should create")
+	require.NoError(t, tree.Mkdir("home/user", fsmeta.Attr{Mode: 0o700, UID: 1000, GID: 1000}),
+		"directory should create")
+
+	return tree
+}
+
+func TestTree(t *testing.T) {
+	tree := buildTree(t)
+
+	require.NoError(t, fstest.TestFS(tree, "etc/shadow", "etc/gshadow", "usr/bin/ping", "dev/null",
+		"home/user"), "tree should behave")
+
+	data, err := fs.ReadFile(tree, "bin/ping")
+	require.NoError(t, err, "file should read through the symlink")
+	assert.Equal(t, "ping", string(data), "file should have its data")
+
+	info, err := tree.Stat("etc/shadow")
+	require.NoError(t, err, "file should stat")
+
+	attr := info.Sys().(*fsmeta.Attr)
+	assert.Equal(t, fs.FileMode(0o640), info.Mode(), "mode should be kept")
+	assert.Equal(t, uint32(42), attr.GID, "gid should be kept")
+	assert.Equal(t, testTime, info.ModTime(), "mtime should be kept")
+	assert.Equal(t, "system_u:object_r:shadow_t:s0\x00", string(attr.Xattrs["security.selinux"]),
+		"xattr should be kept")
+
+	link, err := tree.Stat("etc/gshadow")
+	require.NoError(t, err, "hard link should stat")
+	assert.Equal(t, attr.Inode, link.Sys().(*fsmeta.Attr).Inode, "hard link should share an inode")
+
+	info, err = tree.Stat("usr/bin/ping")
+	require.NoError(t, err, "setuid file should stat")
+	assert.Equal(t, fs.ModeSetuid, info.Mode()&fs.ModeSetuid, "setuid should be kept")
+	assert.NotEqual(t, attr.Inode, info.Sys().(*fsmeta.Attr).Inode, "files should have unique inodes")
+
+	info, err = tree.Stat("usr")
+	require.NoError(t, err, "implicit parent should stat")
+	assert.Equal(t, fs.ModeDir|0o755, info.Mode(), "implicit parent should use default permissions")
+
+	// A directory added over a directory keeps its contents, other entries are replaced.
+	require.NoError(t, tree.Mkdir("etc", fsmeta.Attr{Mode: 0o750}), "directory should update")
+	require.NoError(t, tree.WriteFile("etc/shadow", strings.NewReader("new"), fsmeta.Attr{Mode: 0o600}),
+		"file should replace")
+
+	info, err = tree.Stat("etc")
+	require.NoError(t, err, "directory should stat")
+	assert.Equal(t, fs.ModeDir|0o750, info.Mode(), "directory metadata should be replaced")
+
+	data, err = fs.ReadFile(tree, "etc/shadow")
+	require.NoError(t, err, "replaced file should read")
+	assert.Equal(t, "new", string(data), "replaced file should have the new data")
+
+	data, err = fs.ReadFile(tree, "etc/gshadow")
+	require.NoError(t, err, "hard link should read")
+	assert.Equal(t, "root:*::0:::::\n", string(data), "other links should keep the old file")
+
+	require.NoError(t, tree.Remove("usr"), "directory should remove")
+
+	_, err = tree.Stat("bin/ping")
+	assert.ErrorIs(t, err, fs.ErrNotExist, "removed contents should not exist")
+
+	assert.ErrorIs(t, tree.Remove("usr"), fs.ErrNotExist, "missing entry should not remove")
+	assert.ErrorIs(t, tree.Link("etc2", "etc"), ErrUnsupportedType, "directory hard link should be rejected")
+	assert.ErrorIs(t, tree.Mknod("file", fsmeta.Attr{Mode: 0o644}), ErrUnsupportedType,
+		"regular mknod should be rejected")
+	assert.ErrorIs(t, tree.WriteFile("etc/shadow/x", strings.NewReader(""), fsmeta.Attr{}), ErrNotDir,
+		"file parent should be rejected")
+
+	require.NoError(t, tree.Close(), "tree should close")
+	assert.ErrorIs(t, tree.Close(), ErrClosed, "second close should fail")
+
+	_, err = tree.Open("etc")
+	assert.ErrorIs(t, err, fs.ErrClosed, "closed tree should not open")
+}
+
+func TestTreeCopyTo(t *testing.T) {
+	tree := buildTree(t)
+
+	var buf bytes.Buffer
+
+	w, err := cpio.NewWriter(&buf, cpio.Options{TempDir: t.TempDir()})
+	require.NoError(t, err, "writer should create")
+	require.NoError(t, tree.CopyTo(w), "tree should copy")
+	require.NoError(t, w.Close(), "writer should close")
+
+	fsys, err := cpio.Open(&buf)
+	require.NoError(t, err, "archive should open")
+
+	shadow, err := fsys.Stat("etc/shadow")
+	require.NoError(t, err, "file should be copied")
+
+	gshadow, err := fsys.Stat("etc/gshadow")
+	require.NoError(t, err, "hard link should be copied")
+	assert.Equal(t, shadow.Sys().(*fsmeta.Attr).Inode, gshadow.Sys().(*fsmeta.Attr).Inode,
+		"hard link should be kept")
+
+	info, err := fsys.Lstat("dev/null")
+	require.NoError(t, err, "device should be copied")
+	assert.Equal(t, uint32(3), info.Sys().(*fsmeta.Attr).Minor, "device numbers should be copied")
+
+	info, err = fsys.Stat("home/user")
+	require.NoError(t, err, "directory should be copied")
+	assert.Equal(t, uint32(1000), info.Sys().(*fsmeta.Attr).UID, "ownership should be copied")
+}
+
+func TestTreeAddFS(t *testing.T) {
+	tree := New(Options{TempDir: t.TempDir()})
+	defer tree.Close()
+
+	require.NoError(t, tree.AddFS(fstest.MapFS{
+		"index.html":  {Data: []byte("<html>"), Mode: 0o644, ModTime: testTime},
+		"css/app.css": {Data: []byte("body{}"), Mode: 0o644},
+	}, MergeOptions{Dir: "srv/www", Owner: &Owner{UID: 33, GID: 33}}), "fs should merge")
+
+	data, err := fs.ReadFile(tree, "srv/www/css/app.css")
+	require.NoError(t, err, "file should be merged beneath the directory")
+	assert.Equal(t, "body{}", string(data), "file should read from its source")
+
+	info, err := tree.Stat("srv/www/index.html")
+	require.NoError(t, err, "file should stat")
+	assert.Equal(t, uint32(33), info.Sys().(*fsmeta.Attr).UID, "owner should be overridden")
+	assert.Equal(t, testTime, info.ModTime(), "mtime should be kept")
+
+	// Merging a tree keeps its hard links, which are identified by inode.
+	other := New(Options{TempDir: t.TempDir()})
+	defer other.Close()
+
+	require.NoError(t, other.AddFS(buildTree(t), MergeOptions{}), "tree should merge")
+
+	shadow, err := other.Stat("etc/shadow")
+	require.NoError(t, err, "file should stat")
+
+	gshadow, err := other.Stat("etc/gshadow")
+	require.NoError(t, err, "hard link should stat")
+	assert.Equal(t, shadow.Sys().(*fsmeta.Attr).Inode, gshadow.Sys().(*fsmeta.Attr).Inode,
+		"hard link should be kept")
+
+	target, err := other.ReadLink("bin")
+	require.NoError(t, err, "symlink should be merged")
+	assert.Equal(t, "usr/bin", target, "symlink target should be kept")
+}
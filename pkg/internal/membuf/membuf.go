@@ -0,0 +1,46 @@
+package membuf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrFull = errors.New("write beyond end of buffer")
+
+// Buffer holds the contents of a disk or image in memory. Writes past the end grow the buffer, unless Fixed is set,
+// in which case they fail with ErrFull.
+type Buffer struct {
+	Data  []byte
+	Fixed bool
+}
+
+// New returns a fixed buffer of size zero bytes.
+func New(size int) *Buffer {
+	return &Buffer{Data: make([]byte, size), Fixed: true}
+}
+
+func (b *Buffer) ReadAt(data []byte, off int64) (int, error) {
+	if off >= int64(len(b.Data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(data, b.Data[off:])
+	if n < len(data) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (b *Buffer) WriteAt(data []byte, off int64) (int, error) {
+	if end := off + int64(len(data)); end > int64(len(b.Data)) {
+		if b.Fixed {
+			return 0, fmt.Errorf("%w: %v bytes at %v, buffer holds %v", ErrFull, len(data), off, len(b.Data))
+		}
+
+		b.Data = append(b.Data, make([]byte, end-int64(len(b.Data)))...)
+	}
+
+	return copy(b.Data[off:], data), nil
+}
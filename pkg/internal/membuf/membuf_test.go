@@ -0,0 +1,28 @@
+package membuf
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuffer(t *testing.T) {
+	var grow Buffer
+
+	n, err := grow.WriteAt([]byte("abc"), 4)
+	require.NoError(t, err, "write should grow the buffer")
+	assert.Equal(t, 3, n, "write should be complete")
+	assert.Equal(t, []byte("\x00\x00\x00\x00abc"), grow.Data, "gap should be zeroed")
+
+	data := make([]byte, 4)
+	n, err = grow.ReadAt(data, 5)
+	assert.ErrorIs(t, err, io.EOF, "short read should report EOF")
+	assert.Equal(t, []byte("bc"), data[:n], "read should return the tail")
+
+	fixed := New(4)
+	_, err = fixed.WriteAt([]byte("abc"), 2)
+	assert.ErrorIs(t, err, ErrFull, "fixed buffer should not grow")
+	assert.Len(t, fixed.Data, 4, "fixed buffer should keep its size")
+}
@@ -0,0 +1,377 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/csnewman/go-appliance/pkg/fat"
+	"github.com/csnewman/go-appliance/pkg/internal/membuf"
+)
+
+const (
+	catalogEntrySize = 32
+	bootSystemID     = "EL TORITO SPECIFICATION"
+
+	catalogValidation    = 0x01
+	catalogBootable      = 0x88
+	catalogSectionHeader = 0x90
+	catalogFinalHeader   = 0x91
+
+	maxESPSize = 4 * 1024 * 1024 * 1024
+)
+
+type bootImage struct {
+	BootEntry
+	node *node
+	lba  uint32
+}
+
+// patchBootInfo fills in the boot information table of an image which will be stored at lba.
+func patchBootInfo(data []byte, lba uint32) error {
+	if len(data) < bootInfoEnd {
+		return fmt.Errorf("%w: image too small for boot information table", ErrInvalidBoot)
+	}
+
+	clear(data[bootInfoOffset:bootInfoEnd])
+
+	var sum uint32
+
+	for i := bootInfoEnd; i < len(data); i += 4 {
+		var word [4]byte
+		copy(word[:], data[i:])
+		sum += binary.LittleEndian.Uint32(word[:])
+	}
+
+	binary.LittleEndian.PutUint32(data[8:], SystemAreaSectors)
+	binary.LittleEndian.PutUint32(data[12:], lba)
+	binary.LittleEndian.PutUint32(data[16:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(data[20:], sum)
+
+	return nil
+}
+
+func (w *Writer) resolveBoot() ([]bootImage, error) {
+	images := make([]bootImage, 0, len(w.opts.Boot))
+
+	for _, entry := range w.opts.Boot {
+		dir, base := splitPath(entry.Path)
+
+		parent, err := w.lookup(dir, false)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v: %w", ErrInvalidBoot, entry.Path, err)
+		}
+
+		n := parent.children[base]
+		if n == nil || !n.attr.Mode.IsRegular() || n.size == 0 || n.size > MaxExtentSize {
+			return nil, fmt.Errorf("%w: %v is not a non-empty file within a single extent", ErrInvalidBoot, entry.Path)
+		}
+
+		if entry.LoadSectors == 0 {
+			entry.LoadSectors = defaultBIOSLoad
+
+			if entry.Platform == PlatformEFI {
+				entry.LoadSectors = uint16(min((n.size+virtualSectorSize-1)/virtualSectorSize, 0xFFFF))
+			}
+		}
+
+		images = append(images, bootImage{BootEntry: entry, node: n})
+	}
+
+	return images, nil
+}
+
+func (w *Writer) bootRecord() []byte {
+	d := make([]byte, SectorSize)
+	d[0] = DescriptorBoot
+	copy(d[1:], StandardID)
+	d[6] = descriptorVersion
+	copy(d[7:], bootSystemID)
+	binary.LittleEndian.PutUint32(d[71:], w.catalog)
+
+	return d
+}
+
+func putCatalogEntry(buf []byte, image bootImage) {
+	buf[0] = catalogBootable
+	binary.LittleEndian.PutUint16(buf[6:], image.LoadSectors)
+	binary.LittleEndian.PutUint32(buf[8:], image.lba)
+}
+
+// bootCatalog lists the boot images. The first image is the default entry, whilst the remainder are grouped into a
+// section per platform.
+func bootCatalog(images []bootImage) ([]byte, error) {
+	var platforms []Platform
+
+	sections := make(map[Platform][]bootImage)
+
+	for _, image := range images[1:] {
+		if sections[image.Platform] == nil {
+			platforms = append(platforms, image.Platform)
+		}
+
+		sections[image.Platform] = append(sections[image.Platform], image)
+	}
+
+	if 2+len(platforms)+len(images)-1 > SectorSize/catalogEntrySize {
+		return nil, fmt.Errorf("%w: too many entries for the boot catalog", ErrInvalidBoot)
+	}
+
+	buf := make([]byte, SectorSize)
+
+	buf[0] = catalogValidation
+	buf[1] = byte(images[0].Platform)
+	buf[30], buf[31] = 0x55, 0xAA
+
+	var sum uint16
+	for i := 0; i < catalogEntrySize; i += 2 {
+		sum += binary.LittleEndian.Uint16(buf[i:])
+	}
+
+	binary.LittleEndian.PutUint16(buf[28:], -sum)
+
+	putCatalogEntry(buf[catalogEntrySize:], images[0])
+
+	off := 2 * catalogEntrySize
+
+	for i, platform := range platforms {
+		buf[off] = catalogSectionHeader
+		if i == len(platforms)-1 {
+			buf[off] = catalogFinalHeader
+		}
+
+		buf[off+1] = byte(platform)
+		binary.LittleEndian.PutUint16(buf[off+2:], uint16(len(sections[platform])))
+		off += catalogEntrySize
+
+		for _, image := range sections[platform] {
+			putCatalogEntry(buf[off:], image)
+			off += catalogEntrySize
+		}
+	}
+
+	return buf, nil
+}
+
+// ESPImage builds a FAT formatted EFI system partition containing fsys, for use as an EFI boot entry. When size is
+// zero, the image is sized to fit the content.
+func ESPImage(fsys fs.FS, size int64) ([]byte, error) {
+	if size > 0 {
+		return buildESP(fsys, size)
+	}
+
+	size = 512 * 1024
+
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		size += (info.Size()+4095)/4096*4096 + 4096
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Cluster sizes grow with the volume, so retry with more space until the content fits.
+	for {
+		size = (size + 64*1024 - 1) / (64 * 1024) * (64 * 1024)
+
+		img, err := buildESP(fsys, size)
+		if !errors.Is(err, fat.ErrNoSpace) || size > maxESPSize {
+			return img, err
+		}
+
+		size += size / 4
+	}
+}
+
+func buildESP(fsys fs.FS, size int64) ([]byte, error) {
+	img := membuf.New(int(size))
+
+	w, err := fat.NewWriter(img, size, fat.Options{Label: "EFI", Serial: 1})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := w.AddFS(fsys); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return img.Data, nil
+}
+
+// BootImage describes an entry of the El Torito boot catalog of an image being read.
+type BootImage struct {
+	Platform  Platform
+	Bootable  bool
+	Emulation byte
+	// LoadSegment and LoadSectors describe how BIOS firmware loads the image, in 512-byte sectors.
+	LoadSegment uint16
+	LoadSectors uint16
+	LBA         uint32
+	// Path is the file holding the image, when it is stored as a file. Size is the size of that file, or of the
+	// sectors loaded by the firmware otherwise.
+	Path string
+	Size int64
+}
+
+func parseCatalogEntry(buf []byte, platform Platform) BootImage {
+	le := binary.LittleEndian
+
+	return BootImage{
+		Platform:    platform,
+		Bootable:    buf[0] == catalogBootable,
+		Emulation:   buf[1] & 0x0F,
+		LoadSegment: le.Uint16(buf[2:]),
+		LoadSectors: le.Uint16(buf[6:]),
+		LBA:         le.Uint32(buf[8:]),
+		Size:        int64(le.Uint16(buf[6:])) * virtualSectorSize,
+	}
+}
+
+// BootImages lists the entries of the boot catalog, starting with the default entry. Images stored as files are
+// located within the tree.
+func (f *FS) BootImages() ([]BootImage, error) {
+	if f.catalog == 0 {
+		return nil, nil
+	}
+
+	next := int64(f.catalog) * SectorSize
+	read := func() ([]byte, error) {
+		buf := make([]byte, catalogEntrySize)
+
+		if _, err := f.r.ReadAt(buf, next); err != nil {
+			return nil, fmt.Errorf("failed to read boot catalog: %w", err)
+		}
+
+		next += catalogEntrySize
+
+		return buf, nil
+	}
+
+	validation, err := read()
+	if err != nil {
+		return nil, err
+	}
+
+	var sum uint16
+	for i := 0; i < catalogEntrySize; i += 2 {
+		sum += binary.LittleEndian.Uint16(validation[i:])
+	}
+
+	if validation[0] != catalogValidation || validation[30] != 0x55 || validation[31] != 0xAA || sum != 0 {
+		return nil, fmt.Errorf("%w: bad boot catalog validation entry", ErrInvalidImage)
+	}
+
+	entry, err := read()
+	if err != nil {
+		return nil, err
+	}
+
+	images := []BootImage{parseCatalogEntry(entry, Platform(validation[1]))}
+
+	for final := false; !final && len(images) < maxCatalogEntries; {
+		header, err := read()
+		if err != nil {
+			return nil, err
+		}
+
+		if header[0] != catalogSectionHeader && header[0] != catalogFinalHeader {
+			break
+		}
+
+		final = header[0] == catalogFinalHeader
+
+		for count := binary.LittleEndian.Uint16(header[2:]); count > 0 && len(images) < maxCatalogEntries; {
+			if entry, err = read(); err != nil {
+				return nil, err
+			}
+
+			if entry[0] == catalogExtension {
+				continue
+			}
+
+			images = append(images, parseCatalogEntry(entry, Platform(header[1])))
+			count--
+		}
+	}
+
+	if err := f.locateBootImages(images); err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// locateBootImages searches the tree for files whose data starts at each boot image.
+func (f *FS) locateBootImages(images []BootImage) error {
+	remaining := len(images)
+	visited := make(map[uint32]bool)
+
+	var walk func(dir string, n *inodeData) error
+
+	walk = func(dir string, n *inodeData) error {
+		if visited[n.extents[0].lba] {
+			return nil
+		}
+
+		visited[n.extents[0].lba] = true
+
+		children, err := f.readDir(n)
+		if err != nil {
+			return err
+		}
+
+		for _, child := range children {
+			if remaining == 0 {
+				return nil
+			}
+
+			name := path.Join(dir, child.name)
+
+			if child.isDir() {
+				if err := walk(name, child); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if !child.attr.Mode.IsRegular() || child.size == 0 {
+				continue
+			}
+
+			for i := range images {
+				if images[i].Path == "" && images[i].LBA == child.extents[0].lba {
+					images[i].Path = name
+					images[i].Size = child.size
+					remaining--
+				}
+			}
+		}
+
+		return nil
+	}
+
+	return walk(".", f.root)
+}
+
+// OpenBootImage returns a reader for the data of a boot image.
+func (f *FS) OpenBootImage(image BootImage) *io.SectionReader {
+	return io.NewSectionReader(f.r, int64(image.LBA)*SectorSize, image.Size)
+}
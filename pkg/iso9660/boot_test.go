@@ -0,0 +1,132 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/csnewman/go-appliance/pkg/fat"
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/csnewman/go-appliance/pkg/internal/membuf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootCatalog(t *testing.T) {
+	esp, err := ESPImage(fstest.MapFS{
+		"EFI/BOOT/BOOTX64.EFI": {Data: []byte("efi loader")},
+	}, 0)
+	require.NoError(t, err, "esp should build")
+
+	loader := make([]byte, 6000)
+	for i := range loader {
+		loader[i] = byte(i * 7)
+	}
+
+	img := &membuf.Buffer{}
+
+	w, err := NewWriter(img, 0, Options{
+		TempDir: t.TempDir(),
+		Boot: []BootEntry{
+			{Platform: PlatformBIOS, Path: "isolinux/isolinux.bin", BootInfoTable: true},
+			{Platform: PlatformEFI, Path: "/boot/efi.img"},
+		},
+	})
+	require.NoError(t, err, "writer should create")
+
+	require.NoError(t, w.WriteFile("isolinux/isolinux.bin", bytes.NewReader(loader), fsmeta.Attr{Mode: 0o444}),
+		"loader should write")
+	require.NoError(t, w.WriteFile("boot/efi.img", bytes.NewReader(esp), fsmeta.Attr{Mode: 0o444}),
+		"esp should write")
+	require.NoError(t, w.Close(), "writer should close")
+
+	data := img.Data
+
+	record := data[(SystemAreaSectors+1)*SectorSize:][:SectorSize]
+	assert.Equal(t, byte(DescriptorBoot), record[0], "boot record should follow the primary descriptor")
+	assert.Equal(t, bootSystemID, strings.TrimRight(string(record[7:39]), "\x00"), "boot system should be el torito")
+	assert.Equal(t, byte(DescriptorSupplementary), data[(SystemAreaSectors+2)*SectorSize], "joliet should follow")
+
+	catalog := data[int(binary.LittleEndian.Uint32(record[71:]))*SectorSize:][:SectorSize]
+
+	var sum uint16
+	for i := 0; i < catalogEntrySize; i += 2 {
+		sum += binary.LittleEndian.Uint16(catalog[i:])
+	}
+
+	assert.Zero(t, sum, "validation entry should checksum to zero")
+	assert.Equal(t, []byte{0x55, 0xAA}, catalog[30:32], "validation entry should be signed")
+	assert.Equal(t, byte(PlatformBIOS), catalog[1], "default platform should be bios")
+
+	bios := catalog[catalogEntrySize:]
+	assert.Equal(t, byte(catalogBootable), bios[0], "default entry should be bootable")
+	assert.Equal(t, uint16(4), binary.LittleEndian.Uint16(bios[6:]), "bios should load four sectors")
+
+	header := catalog[2*catalogEntrySize:]
+	assert.Equal(t, byte(catalogFinalHeader), header[0], "efi section should be final")
+	assert.Equal(t, byte(PlatformEFI), header[1], "section should be efi")
+	assert.Equal(t, uint16(1), binary.LittleEndian.Uint16(header[2:]), "section should hold one entry")
+
+	efi := catalog[3*catalogEntrySize:]
+	assert.Equal(t, uint16(len(esp)/virtualSectorSize), binary.LittleEndian.Uint16(efi[6:]),
+		"efi should load the whole image")
+
+	efiLBA := binary.LittleEndian.Uint32(efi[8:])
+	assert.Equal(t, esp, data[int(efiLBA)*SectorSize:][:len(esp)], "esp should be stored at the entry")
+
+	biosLBA := binary.LittleEndian.Uint32(bios[8:])
+	patched := data[int(biosLBA)*SectorSize:][:len(loader)]
+
+	assert.Equal(t, uint32(SystemAreaSectors), binary.LittleEndian.Uint32(patched[8:]), "table should locate the pvd")
+	assert.Equal(t, biosLBA, binary.LittleEndian.Uint32(patched[12:]), "table should locate the loader")
+	assert.Equal(t, uint32(len(loader)), binary.LittleEndian.Uint32(patched[16:]), "table should hold the length")
+	assert.Equal(t, loader[bootInfoEnd:], patched[bootInfoEnd:], "loader after the table should be unchanged")
+
+	var checksum uint32
+	for i := bootInfoEnd; i < len(loader); i += 4 {
+		checksum += binary.LittleEndian.Uint32(loader[i:])
+	}
+
+	assert.Equal(t, checksum, binary.LittleEndian.Uint32(patched[20:]), "table should hold the checksum")
+}
+
+func TestESPImage(t *testing.T) {
+	src := fstest.MapFS{
+		"EFI/BOOT/BOOTX64.EFI": {Data: bytes.Repeat([]byte{0xCC}, 300000)},
+		"EFI/BOOT/grub.cfg":    {Data: []byte("set timeout=5\n")},
+	}
+
+	esp, err := ESPImage(src, 0)
+	require.NoError(t, err, "esp should build")
+
+	fsys, err := fat.Open(bytes.NewReader(esp))
+	require.NoError(t, err, "esp should open")
+	assert.Equal(t, "EFI", fsys.Label(), "esp should be labelled")
+
+	data, err := fs.ReadFile(fsys, "EFI/BOOT/BOOTX64.EFI")
+	require.NoError(t, err, "loader should read")
+	assert.Equal(t, src["EFI/BOOT/BOOTX64.EFI"].Data, data, "loader should round trip")
+
+	sized, err := ESPImage(src, 4*1024*1024)
+	require.NoError(t, err, "sized esp should build")
+	assert.Len(t, sized, 4*1024*1024, "esp should use the requested size")
+}
+
+func TestBootErrors(t *testing.T) {
+	for _, entry := range []BootEntry{
+		{Platform: PlatformBIOS, Path: "missing/loader.bin"},
+		{Platform: PlatformBIOS, Path: "boot"},
+		{Platform: PlatformEFI, Path: "boot/empty.img"},
+	} {
+		w, err := NewWriter(&membuf.Buffer{}, 0, Options{TempDir: t.TempDir(), Boot: []BootEntry{entry}})
+		require.NoError(t, err, "writer should create")
+
+		require.NoError(t, w.WriteFile("boot/empty.img", strings.NewReader(""), fsmeta.Attr{}), "file should write")
+		assert.ErrorIs(t, w.Close(), ErrInvalidBoot, "%v should be rejected", entry.Path)
+	}
+
+	assert.ErrorIs(t, patchBootInfo(make([]byte, 32), 20), ErrInvalidBoot, "short loader should be rejected")
+}
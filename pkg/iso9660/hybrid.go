@@ -0,0 +1,167 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/disk"
+	"github.com/csnewman/go-appliance/pkg/internal/membuf"
+	"github.com/google/uuid"
+)
+
+const (
+	sectorBlocks = SectorSize / disk.BlockSize
+	// hybridTailSectors holds the secondary GPT header and partition entries created by disk.NewGPT, appended to the
+	// end of the image.
+	hybridTailSectors = (33*disk.BlockSize + SectorSize - 1) / SectorSize
+
+	hybridISOName = "ISOHybrid ISO"
+	hybridESPName = "ISOHybrid"
+)
+
+// hybridGUID returns the disk GUID, derived from the volume identity when not specified.
+func (w *Writer) hybridGUID() uuid.UUID {
+	if w.opts.Hybrid.GUID != uuid.Nil {
+		return w.opts.Hybrid.GUID
+	}
+
+	return uuid.NewSHA1(uuid.Nil, []byte(w.opts.VolumeID+"\x00"+w.opts.Time.UTC().Format(time.RFC3339Nano)))
+}
+
+// hybridPartitions lists the partitions of the image. The first covers the ISO 9660 data, following the system
+// area, whilst the remainder cover each EFI boot image, overlapping the first.
+func hybridPartitions(guid uuid.UUID, dataBlocks uint64, boot []bootImage) []disk.GPTPartition {
+	parts := []disk.GPTPartition{{
+		Type:     disk.GPTTypeMicrosoftBasicData,
+		ID:       uuid.NewSHA1(guid, []byte(hybridISOName)),
+		StartLBA: SystemAreaSectors * sectorBlocks,
+		EndLBA:   dataBlocks - 1,
+		Name:     hybridISOName,
+	}}
+
+	for _, image := range boot {
+		if image.Platform != PlatformEFI {
+			continue
+		}
+
+		start := uint64(image.lba) * sectorBlocks
+		blocks := uint64((image.node.size + disk.BlockSize - 1) / disk.BlockSize)
+
+		parts = append(parts, disk.GPTPartition{
+			Type:     disk.GPTTypeEFISystem,
+			ID:       uuid.NewSHA1(guid, []byte(fmt.Sprintf("%v%v", hybridESPName, len(parts)))),
+			StartLBA: start,
+			EndLBA:   start + blocks - 1,
+			Name:     hybridESPName,
+		})
+	}
+
+	return parts
+}
+
+// hybridMBR builds the MBR, with a bootable entry of type zero covering the whole image and an entry for the first
+// EFI boot image. The bootstrap code is told the location of the first BIOS boot image, as isohybrid does.
+func (w *Writer) hybridMBR(totalBlocks uint64, parts []disk.GPTPartition, boot []bootImage) (*disk.MBR, error) {
+	mbr := disk.NewMBR()
+	mbr.DiskID = w.opts.Hybrid.DiskID
+
+	if mbr.DiskID == 0 {
+		guid := w.hybridGUID()
+		mbr.DiskID = binary.LittleEndian.Uint32(guid[:])
+	}
+
+	copy(mbr.Bootstrap[:bootstrapSize], w.opts.Hybrid.Bootstrap)
+
+	for _, image := range boot {
+		if image.Platform == PlatformBIOS {
+			binary.LittleEndian.PutUint64(mbr.Bootstrap[bootstrapSize:], uint64(image.lba)*sectorBlocks)
+
+			break
+		}
+	}
+
+	iso, err := disk.NewMBRPartitionLBA(disk.MBRPartTypeEmpty, 0, totalBlocks)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNoSpace, err)
+	}
+
+	iso.Attrs = disk.MBRAttrBootable
+	mbr.Part1 = iso
+
+	if len(parts) > 1 {
+		esp, err := disk.NewMBRPartitionLBA(
+			disk.MBRPartTypeEFISystem,
+			parts[1].StartLBA,
+			parts[1].EndLBA-parts[1].StartLBA+1,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrNoSpace, err)
+		}
+
+		mbr.Part2 = esp
+	}
+
+	return mbr, nil
+}
+
+// writeHybrid overlays the MBR and primary GPT onto the system area, and writes the secondary GPT into the sectors
+// reserved at the end of the image.
+func (w *Writer) writeHybrid(total uint32, boot []bootImage) error {
+	totalBlocks := uint64(total) * sectorBlocks
+	tailStart := uint64(total-hybridTailSectors) * sectorBlocks
+
+	primary, secondary, err := disk.NewGPT(totalBlocks)
+	if err != nil {
+		return fmt.Errorf("failed to create gpt: %w", err)
+	}
+
+	guid := w.hybridGUID()
+	parts := hybridPartitions(guid, tailStart, boot)
+
+	for _, gpt := range []*disk.GPT{primary, secondary} {
+		gpt.GUID = guid
+		gpt.DataFirst = SystemAreaSectors * sectorBlocks
+	}
+
+	mbr, err := w.hybridMBR(totalBlocks, parts, boot)
+	if err != nil {
+		return err
+	}
+
+	// The checksum covers every entry, including those left empty.
+	entries := make([]disk.GPTPartition, primary.PartitionCount)
+	copy(entries, parts)
+
+	head := membuf.New(SystemAreaSectors * SectorSize)
+	mbr.FillBytes(head.Data)
+
+	tail := membuf.New(hybridTailSectors * SectorSize)
+
+	for _, table := range []struct {
+		gpt  *disk.GPT
+		buf  *membuf.Buffer
+		base uint64
+	}{
+		{primary, head, 0},
+		{secondary, tail, tailStart},
+	} {
+		start := (table.gpt.PartitionsLBA - table.base) * disk.BlockSize
+
+		crc, err := disk.WriteGPTPartitions(table.buf, start, table.gpt.EntrySize, entries)
+		if err != nil {
+			return fmt.Errorf("failed to encode gpt partitions: %w", err)
+		}
+
+		table.gpt.PartitionsCRC = crc
+		table.gpt.Checksum = table.gpt.CalculateChecksum()
+
+		table.gpt.FillBytes(table.buf.Data[(table.gpt.ThisLBA-table.base)*disk.BlockSize:])
+	}
+
+	if err := w.writeAt(head.Data, 0); err != nil {
+		return err
+	}
+
+	return w.writeAt(tail.Data, int64(tailStart)*disk.BlockSize)
+}
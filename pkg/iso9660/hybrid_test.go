@@ -0,0 +1,117 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/csnewman/go-appliance/pkg/disk"
+	"github.com/csnewman/go-appliance/pkg/fat"
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/csnewman/go-appliance/pkg/internal/membuf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func buildHybrid(t *testing.T, esp []byte) []byte {
+	t.Helper()
+
+	img := &membuf.Buffer{}
+
+	w, err := NewWriter(img, 0, Options{
+		TempDir: t.TempDir(),
+		Boot: []BootEntry{
+			{Platform: PlatformBIOS, Path: "isolinux/isolinux.bin", BootInfoTable: true},
+			{Platform: PlatformEFI, Path: "boot/efi.img"},
+		},
+		Hybrid: &Hybrid{Bootstrap: bytes.Repeat([]byte{0xFA}, 512)},
+	})
+	require.NoError(t, err, "writer should create")
+
+	require.NoError(t, w.WriteFile("isolinux/isolinux.bin", bytes.NewReader(make([]byte, 4096)),
+		fsmeta.Attr{Mode: 0o444}), "loader should write")
+	require.NoError(t, w.WriteFile("boot/efi.img", bytes.NewReader(esp), fsmeta.Attr{Mode: 0o444}),
+		"esp should write")
+	require.NoError(t, w.Close(), "writer should close")
+	require.Equal(t, w.Size(), int64(len(img.Data)), "size should match the written image")
+
+	return img.Data
+}
+
+func TestHybrid(t *testing.T) {
+	esp, err := ESPImage(fstest.MapFS{
+		"EFI/BOOT/BOOTX64.EFI": {Data: []byte("efi loader")},
+	}, 0)
+	require.NoError(t, err, "esp should build")
+
+	data := buildHybrid(t, esp)
+	blocks := uint64(len(data) / disk.BlockSize)
+
+	pvd := data[SystemAreaSectors*SectorSize:]
+	assert.Equal(t, StandardID, string(pvd[1:6]), "primary descriptor should be intact")
+	assert.Equal(t, uint32(len(data)/SectorSize), binary.LittleEndian.Uint32(pvd[80:]),
+		"volume should cover the secondary gpt")
+
+	mbr := disk.ParseMBR(data)
+	assert.Equal(t, uint16(disk.MBRSignature), mbr.Signature, "mbr should be signed")
+	assert.Equal(t, bytes.Repeat([]byte{0xFA}, bootstrapSize), mbr.Bootstrap[:bootstrapSize],
+		"bootstrap should be copied")
+
+	assert.Equal(t, byte(disk.MBRAttrBootable), mbr.Part1.Attrs, "iso partition should be bootable")
+	assert.Equal(t, disk.MBRPartType(disk.MBRPartTypeEmpty), mbr.Part1.Type, "iso partition should be type zero")
+	assert.Equal(t, uint32(0), mbr.Part1.LBAStart, "iso partition should start at zero")
+	assert.Equal(t, uint32(blocks), mbr.Part1.LBASize, "iso partition should cover the image")
+	assert.Equal(t, disk.MBRPartType(disk.MBRPartTypeEFISystem), mbr.Part2.Type, "second partition should be efi")
+	assert.Equal(t, uint32(len(esp)/disk.BlockSize), mbr.Part2.LBASize, "efi partition should cover the esp")
+
+	loader := binary.LittleEndian.Uint64(mbr.Bootstrap[bootstrapSize:])
+	patched := data[loader*disk.BlockSize:]
+	assert.Equal(t, uint32(loader/sectorBlocks), binary.LittleEndian.Uint32(patched[12:]),
+		"bootstrap should locate the bios loader")
+
+	r := bytes.NewReader(data)
+
+	primary, err := disk.ParseGPT(data[disk.BlockSize:])
+	require.NoError(t, err, "primary gpt should parse")
+	assert.Equal(t, primary.Checksum, primary.CalculateChecksum(), "primary checksum should match")
+	assert.Equal(t, blocks-1, primary.AlternativeLBA, "secondary gpt should be at the end")
+	assert.LessOrEqual(t, primary.PartitionsLBA*disk.BlockSize+uint64(primary.PartitionCount*primary.EntrySize),
+		uint64(SystemAreaSectors*SectorSize), "primary gpt should fit within the system area")
+
+	parts, crc, err := disk.ParseGPTPartitions(r, primary.PartitionsLBA*disk.BlockSize, primary.EntrySize,
+		primary.PartitionCount)
+	require.NoError(t, err, "primary partitions should parse")
+	assert.Equal(t, primary.PartitionsCRC, crc, "primary partition crc should match")
+
+	assert.Equal(t, disk.GPTTypeMicrosoftBasicData, parts[0].Type, "first partition should hold the iso")
+	assert.Equal(t, "ISOHybrid ISO", parts[0].Name, "iso partition should be named")
+	assert.Equal(t, uint64(SystemAreaSectors*sectorBlocks), parts[0].StartLBA, "iso partition should follow the gpt")
+	assert.LessOrEqual(t, parts[0].EndLBA, primary.DataLast, "iso partition should end before the secondary gpt")
+
+	assert.Equal(t, disk.GPTTypeEFISystem, parts[1].Type, "second partition should hold the esp")
+	assert.Equal(t, uint64(mbr.Part2.LBAStart), parts[1].StartLBA, "tables should agree on the esp")
+	assert.Equal(t, disk.GPTPartition{}, parts[2], "remaining entries should be empty")
+
+	secondary, err := disk.ParseGPT(data[primary.AlternativeLBA*disk.BlockSize:])
+	require.NoError(t, err, "secondary gpt should parse")
+	assert.Equal(t, secondary.Checksum, secondary.CalculateChecksum(), "secondary checksum should match")
+	assert.Equal(t, primary.GUID, secondary.GUID, "tables should share the disk guid")
+
+	_, crc, err = disk.ParseGPTPartitions(r, secondary.PartitionsLBA*disk.BlockSize, secondary.EntrySize,
+		secondary.PartitionCount)
+	require.NoError(t, err, "secondary partitions should parse")
+	assert.Equal(t, secondary.PartitionsCRC, crc, "secondary partition crc should match")
+
+	section := data[parts[1].StartLBA*disk.BlockSize : (parts[1].EndLBA+1)*disk.BlockSize]
+
+	fsys, err := fat.Open(bytes.NewReader(section))
+	require.NoError(t, err, "esp partition should open")
+
+	loaderData, err := fs.ReadFile(fsys, "EFI/BOOT/BOOTX64.EFI")
+	require.NoError(t, err, "efi loader should read")
+	assert.Equal(t, []byte("efi loader"), loaderData, "efi loader should round trip")
+
+	assert.Equal(t, data, buildHybrid(t, esp), "hybrid images should be deterministic")
+}
@@ -0,0 +1,115 @@
+package iso9660
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	SectorSize = 2048
+	// SystemAreaSectors is the number of sectors reserved before the first volume descriptor, available for a hybrid
+	// MBR or GPT.
+	SystemAreaSectors = 16
+	// MaxExtentSize is the largest extent a single directory record can describe. Larger files are split into
+	// multiple extents.
+	MaxExtentSize = 0xFFFFF800
+	MaxNameLen    = 255
+
+	StandardID = "CD001"
+
+	descriptorVersion = 1
+	recordHeaderSize  = 33
+	maxRecordSize     = 255
+	pathRecordSize    = 8
+	maxPrimaryName    = 30
+	maxPrimaryDirName = 31
+	maxJolietName     = 64
+	maxDirectories    = 0xFFFF
+	maxDepth          = 8
+	relocatedDir      = "rr_moved"
+	maxSymlinkTarget  = 4095
+	virtualSectorSize = 512
+	defaultBIOSLoad   = 4
+	bootInfoOffset    = 8
+	bootInfoEnd       = 64
+	bootstrapSize     = 432
+)
+
+// Volume descriptor types.
+const (
+	DescriptorBoot          = 0
+	DescriptorPrimary       = 1
+	DescriptorSupplementary = 2
+	DescriptorTerminator    = 255
+)
+
+// Directory record flags.
+const (
+	FlagHidden      = 0x01
+	FlagDirectory   = 0x02
+	FlagMultiExtent = 0x80
+)
+
+// Platform identifies the firmware an El Torito boot entry targets.
+type Platform uint8
+
+const (
+	PlatformBIOS Platform = 0x00
+	PlatformEFI  Platform = 0xEF
+)
+
+var (
+	ErrNoSpace         = errors.New("no space left for image")
+	ErrInvalidName     = errors.New("invalid file name")
+	ErrExist           = errors.New("file already exists")
+	ErrNotDir          = errors.New("not a directory")
+	ErrUnsupportedType = errors.New("unsupported file type")
+	ErrInvalidBoot     = errors.New("invalid boot entry")
+	ErrTooManyDirs     = errors.New("too many directories")
+	ErrClosed          = errors.New("writer closed")
+)
+
+// BootEntry describes an El Torito boot image, which must be a regular file within the image.
+type BootEntry struct {
+	Platform Platform
+	// Path is the location of the boot image within the image, such as isolinux/isolinux.bin or an EFI system
+	// partition image created with ESPImage.
+	Path string
+	// LoadSectors is the number of 512-byte sectors the firmware loads. BIOS entries default to 4, as expected by
+	// ISOLINUX and GRUB, whilst EFI entries default to the whole image.
+	LoadSectors uint16
+	// BootInfoTable patches the image with its location, as required by ISOLINUX. The file itself is modified.
+	BootInfoTable bool
+}
+
+type Options struct {
+	// VolumeID is the volume label, up to 32 characters. It is upper-cased for the primary descriptor and truncated
+	// to 16 characters for Joliet. Defaults to CDROM.
+	VolumeID    string
+	Publisher   string
+	Application string
+	// Time is recorded as the creation time in the volume descriptors and used for files without a modification
+	// time. The Unix epoch is used when zero.
+	Time time.Time
+	// Boot lists the El Torito boot entries. The first is the default entry, whilst the rest are grouped into
+	// sections by platform.
+	Boot []BootEntry
+	// TempDir is where file data is spooled until Close, defaulting to the system temporary directory.
+	TempDir string
+	// Hybrid places an MBR and GPT in the system area, allowing the image to boot when written directly to a disk.
+	Hybrid *Hybrid
+}
+
+// Hybrid describes the partition tables of an isohybrid image, laid out as xorriso does with -isohybrid-mbr and
+// -isohybrid-gpt-basdat.
+type Hybrid struct {
+	// Bootstrap is the MBR boot code, such as isohdpfx.bin from ISOLINUX. Only the first 432 bytes are used, as the
+	// location of the first BIOS boot image is recorded after them.
+	Bootstrap []byte
+	// DiskID and GUID identify the disk. When zero, they are derived from the volume ID and time, so a rebuilt image
+	// keeps them.
+	DiskID uint32
+	GUID   uuid.UUID
+}
@@ -0,0 +1,167 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || len(name) > MaxNameLen || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	return nil
+}
+
+// dCharacters converts a string to the d-characters permitted in primary identifiers, upper-casing letters and
+// replacing anything else with an underscore.
+func dCharacters(s string) string {
+	var out strings.Builder
+
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z':
+			r -= 'a' - 'A'
+		case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_':
+		default:
+			r = '_'
+		}
+
+		out.WriteRune(r)
+	}
+
+	return out.String()
+}
+
+// uniqueName returns the first candidate, built from a numeric tail, which is not already in use.
+func uniqueName(candidate func(tail string) string, used map[string]bool) (string, error) {
+	if name := candidate(""); !used[name] {
+		return name, nil
+	}
+
+	for n := 1; n < 1000000; n++ {
+		if name := candidate("_" + strconv.Itoa(n)); !used[name] {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: no free identifier", ErrExist)
+}
+
+// primaryName returns the identifier of an entry in the primary directory hierarchy, following the ISO 9660 level 2
+// limits of 31 characters for directories and 30 for the name and extension of files, which gain a ;1 version.
+func primaryName(name string, dir bool, used map[string]bool) (string, error) {
+	if dir {
+		base := dCharacters(name)
+
+		return uniqueName(func(tail string) string {
+			return base[:min(len(base), maxPrimaryDirName-len(tail))] + tail
+		}, used)
+	}
+
+	base, ext := name, ""
+
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		base = name[:i]
+		ext = dCharacters(name[i+1:])
+		ext = ext[:min(len(ext), 10)]
+	}
+
+	base = dCharacters(base)
+
+	return uniqueName(func(tail string) string {
+		return base[:min(len(base), maxPrimaryName-len(ext)-len(tail))] + tail + "." + ext + ";1"
+	}, used)
+}
+
+// jolietName returns the identifier of an entry in the Joliet hierarchy, which keeps the case and characters of the
+// original name but is limited to 64 UCS-2 characters.
+func jolietName(name string, used map[string]bool) (string, error) {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`*/:;?\`, r) {
+			return '_'
+		}
+
+		return r
+	}, name)
+
+	base, ext := name, ""
+
+	if i := strings.LastIndexByte(name, '.'); i > 0 && len(name)-i <= 16 {
+		base = name[:i]
+		ext = name[i:]
+	}
+
+	units := utf16.Encode([]rune(base))
+	extLen := len(utf16.Encode([]rune(ext)))
+
+	return uniqueName(func(tail string) string {
+		keep := units[:min(len(units), maxJolietName-extLen-len(tail))]
+
+		// Avoid splitting a surrogate pair.
+		if n := len(keep); n > 0 && utf16.IsSurrogate(rune(keep[n-1])) && n < len(units) {
+			keep = keep[:n-1]
+		}
+
+		return string(utf16.Decode(keep)) + tail + ext
+	}, used)
+}
+
+func encodeUCS2(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	out := make([]byte, 0, 2*len(units))
+
+	for _, u := range units {
+		out = binary.BigEndian.AppendUint16(out, u)
+	}
+
+	return out
+}
+
+// decodeUCS2 reads a big-endian Joliet identifier, ignoring any trailing odd byte.
+func decodeUCS2(b []byte) string {
+	units := make([]uint16, len(b)/2)
+
+	for i := range units {
+		units[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+
+	return string(utf16.Decode(units))
+}
+
+// comparePrimary orders primary identifiers by name and then extension, each padded with spaces, as required for
+// directory records and the path table.
+func comparePrimary(a string, b string) int {
+	split := func(s string) (string, string) {
+		s, _, _ = strings.Cut(s, ";")
+		base, ext, _ := strings.Cut(s, ".")
+
+		return base, ext
+	}
+
+	abase, aext := split(a)
+	bbase, bext := split(b)
+
+	if c := strings.Compare(abase, bbase); c != 0 {
+		return c
+	}
+
+	if c := strings.Compare(aext, bext); c != 0 {
+		return c
+	}
+
+	return strings.Compare(a, b)
+}
+
+// truncateUCS2 shortens s to at most n UTF-16 code units.
+func truncateUCS2(s string, n int) string {
+	units := utf16.Encode([]rune(s))
+	if len(units) <= n {
+		return s
+	}
+
+	return string(utf16.Decode(units[:n]))
+}
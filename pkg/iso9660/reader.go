@@ -0,0 +1,908 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+)
+
+var ErrInvalidImage = errors.New("invalid iso 9660 image")
+
+const (
+	maxSymlinks       = 40
+	maxDescriptors    = 64
+	maxContinuations  = 32
+	maxCatalogEntries = 1024
+	maxDirectorySize  = 64 * 1024 * 1024
+
+	flagAssociated   = 0x04
+	catalogExtension = 0x44
+	tfLongForm       = 0x80
+)
+
+// FS provides read-only access to an ISO 9660 image. Rock Ridge names and metadata are used when present, otherwise
+// Joliet names are preferred over the primary hierarchy, whose names are lower-cased as Linux does.
+type FS struct {
+	r         io.ReaderAt
+	volumeID  string
+	root      *inodeData
+	joliet    bool
+	rockRidge bool
+	suspSkip  int
+	catalog   uint32
+}
+
+var (
+	_ fs.FS             = (*FS)(nil)
+	_ fs.ReadDirFS      = (*FS)(nil)
+	_ fs.StatFS         = (*FS)(nil)
+	_ fsmeta.ReadLinkFS = (*FS)(nil)
+)
+
+// Open reads the image at the start of r, which may be a plain file or a section of a disk.Disk.
+func Open(r io.ReaderAt) (*FS, error) {
+	f := &FS{r: r}
+
+	var primary, joliet []byte
+
+scan:
+	for i := range maxDescriptors {
+		d := make([]byte, SectorSize)
+
+		if _, err := r.ReadAt(d, int64(SystemAreaSectors+i)*SectorSize); err != nil {
+			return nil, fmt.Errorf("failed to read volume descriptor: %w", err)
+		}
+
+		if string(d[1:6]) != StandardID {
+			return nil, fmt.Errorf("%w: bad standard identifier", ErrInvalidImage)
+		}
+
+		switch d[0] {
+		case DescriptorPrimary:
+			if primary == nil {
+				primary = d
+			}
+		case DescriptorSupplementary:
+			if esc := string(d[88:91]); joliet == nil && (esc == "%/@" || esc == "%/C" || esc == "%/E") {
+				joliet = d
+			}
+		case DescriptorBoot:
+			if strings.TrimRight(string(d[7:39]), "\x00") == bootSystemID {
+				f.catalog = binary.LittleEndian.Uint32(d[71:])
+			}
+		case DescriptorTerminator:
+			break scan
+		}
+	}
+
+	if primary == nil {
+		return nil, fmt.Errorf("%w: missing primary volume descriptor", ErrInvalidImage)
+	}
+
+	f.volumeID = strings.TrimRight(string(primary[40:72]), " ")
+
+	root, err := parseRecord(primary[156:190])
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := f.records(root.ext)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%w: empty root directory", ErrInvalidImage)
+	}
+
+	// Rock Ridge is signalled by an SP entry at the start of the system use area of the root's own record.
+	dot := records[0]
+	if su := dot.su; len(su) >= 7 && string(su[:2]) == "SP" && su[4] == 0xBE && su[5] == 0xEF {
+		f.rockRidge = true
+		f.suspSkip = int(su[6])
+	}
+
+	if !f.rockRidge && joliet != nil {
+		f.joliet = true
+
+		if root, err = parseRecord(joliet[156:190]); err != nil {
+			return nil, err
+		}
+
+		if records, err = f.records(root.ext); err != nil {
+			return nil, err
+		}
+
+		if len(records) == 0 {
+			return nil, fmt.Errorf("%w: empty root directory", ErrInvalidImage)
+		}
+
+		dot = records[0]
+	}
+
+	dot.ext = root.ext
+
+	if f.root, err = f.newInode(dot, dot.su); err != nil {
+		return nil, err
+	}
+
+	f.root.name = "."
+
+	return f, nil
+}
+
+// VolumeID returns the volume label of the primary descriptor.
+func (f *FS) VolumeID() string {
+	return f.volumeID
+}
+
+// RockRidge reports whether names and metadata are read from Rock Ridge extensions.
+func (f *FS) RockRidge() bool {
+	return f.rockRidge
+}
+
+// Joliet reports whether names are read from the Joliet hierarchy.
+func (f *FS) Joliet() bool {
+	return f.joliet
+}
+
+type rawRecord struct {
+	pos   int64
+	ident []byte
+	ext   extent
+	flags byte
+	time  time.Time
+	su    []byte
+}
+
+func parseRecord(rec []byte) (rawRecord, error) {
+	if len(rec) < recordHeaderSize || int(rec[32]) > len(rec)-recordHeaderSize {
+		return rawRecord{}, fmt.Errorf("%w: truncated directory record", ErrInvalidImage)
+	}
+
+	if rec[26] != 0 || rec[27] != 0 {
+		return rawRecord{}, fmt.Errorf("%w: interleaved files are not supported", ErrInvalidImage)
+	}
+
+	le := binary.LittleEndian
+	identLen := int(rec[32])
+	suStart := min(recordHeaderSize+identLen+(identLen+1)%2, len(rec))
+
+	return rawRecord{
+		ident: rec[recordHeaderSize : recordHeaderSize+identLen],
+		ext:   extent{lba: le.Uint32(rec[2:]), size: le.Uint32(rec[10:])},
+		flags: rec[25],
+		time:  parseRecordTime(rec[18:25]),
+		su:    rec[suStart:],
+	}, nil
+}
+
+func parseRecordTime(buf []byte) time.Time {
+	if buf[0] == 0 && buf[1] == 0 && buf[2] == 0 {
+		return time.Time{}
+	}
+
+	zone := time.FixedZone("", int(int8(buf[6]))*15*60)
+
+	return time.Date(1900+int(buf[0]), time.Month(buf[1]), int(buf[2]), int(buf[3]), int(buf[4]), int(buf[5]), 0,
+		zone).UTC()
+}
+
+// parseVolumeTime reads the seventeen byte timestamp used by volume descriptors and the long form of TF entries.
+func parseVolumeTime(buf []byte) time.Time {
+	var year, month, day, hour, minute, sec, centi int
+
+	if _, err := fmt.Sscanf(string(buf[:16]), "%4d%2d%2d%2d%2d%2d%2d", &year, &month, &day, &hour, &minute, &sec,
+		&centi); err != nil || year == 0 {
+		return time.Time{}
+	}
+
+	zone := time.FixedZone("", int(int8(buf[16]))*15*60)
+
+	return time.Date(year, time.Month(month), day, hour, minute, sec, centi*10000000, zone).UTC()
+}
+
+// records reads the directory records within a directory extent. Records do not cross sector boundaries, with any
+// remaining space in a sector left zeroed.
+func (f *FS) records(ext extent) ([]rawRecord, error) {
+	if ext.size > maxDirectorySize {
+		return nil, fmt.Errorf("%w: directory at %v has %v bytes", ErrInvalidImage, ext.lba, ext.size)
+	}
+
+	buf := make([]byte, ext.size)
+	start := int64(ext.lba) * SectorSize
+
+	if _, err := f.r.ReadAt(buf, start); err != nil {
+		return nil, fmt.Errorf("failed to read directory at %v: %w", ext.lba, err)
+	}
+
+	var out []rawRecord
+
+	for off := 0; off < len(buf); {
+		size := int(buf[off])
+
+		if size == 0 {
+			off = (off/SectorSize + 1) * SectorSize
+
+			continue
+		}
+
+		if off+size > len(buf) {
+			return nil, fmt.Errorf("%w: directory record at %v overruns its directory", ErrInvalidImage,
+				start+int64(off))
+		}
+
+		rec, err := parseRecord(buf[off : off+size])
+		if err != nil {
+			return nil, err
+		}
+
+		rec.pos = start + int64(off)
+		out = append(out, rec)
+		off += size
+	}
+
+	return out, nil
+}
+
+type inodeData struct {
+	name      string
+	extents   []extent
+	size      int64
+	attr      fsmeta.Attr
+	target    string
+	relocated bool
+}
+
+func (n *inodeData) isDir() bool {
+	return n.attr.Mode.IsDir()
+}
+
+func (n *inodeData) isSymlink() bool {
+	return n.attr.Mode.Type() == fs.ModeSymlink
+}
+
+// decodeName converts an identifier to a file name, removing the version and any trailing dot.
+func (f *FS) decodeName(ident []byte) string {
+	var name string
+
+	if f.joliet {
+		name = decodeUCS2(ident)
+	} else {
+		name = strings.ToLower(string(ident))
+	}
+
+	if i := strings.LastIndexByte(name, ';'); i >= 0 {
+		name = name[:i]
+	}
+
+	if trimmed := strings.TrimSuffix(name, "."); trimmed != "" {
+		name = trimmed
+	}
+
+	return name
+}
+
+// newInode describes the file referenced by a directory record. Files without Rock Ridge metadata are read-only and
+// identified by the location of their data, or of their record when they have none.
+func (f *FS) newInode(rec rawRecord, su []byte) (*inodeData, error) {
+	n := &inodeData{
+		name:    f.decodeName(rec.ident),
+		extents: []extent{rec.ext},
+		size:    int64(rec.ext.size),
+		attr: fsmeta.Attr{
+			Mode:       0o444,
+			ModTime:    rec.time,
+			AccessTime: rec.time,
+			ChangeTime: rec.time,
+			Inode:      uint64(rec.pos),
+		},
+	}
+
+	if rec.flags&FlagDirectory != 0 {
+		n.attr.Mode = fs.ModeDir | 0o555
+	}
+
+	if rec.ext.size > 0 {
+		n.attr.Inode = uint64(rec.ext.lba) * SectorSize
+	}
+
+	if f.rockRidge {
+		if err := f.applyRockRidge(n, su); err != nil {
+			return nil, err
+		}
+	}
+
+	return n, nil
+}
+
+// systemUse calls fn for each SUSP entry of a record, following continuation areas.
+func (f *FS) systemUse(su []byte, fn func(sig string, entry []byte) error) error {
+	for hops := 0; ; hops++ {
+		var next []byte
+
+		for len(su) >= suspHeaderSize {
+			size := int(su[2])
+			if size < suspHeaderSize || size > len(su) {
+				break
+			}
+
+			entry := su[:size]
+			su = su[size:]
+
+			switch sig := string(entry[:2]); sig {
+			case "ST":
+				su = nil
+			case "CE":
+				if size < ceEntrySize {
+					return fmt.Errorf("%w: truncated CE entry", ErrInvalidImage)
+				}
+
+				le := binary.LittleEndian
+				block, offset, length := le.Uint32(entry[4:]), le.Uint32(entry[12:]), le.Uint32(entry[20:])
+
+				if length > SectorSize || offset > SectorSize {
+					return fmt.Errorf("%w: CE area of %v bytes at offset %v", ErrInvalidImage, length, offset)
+				}
+
+				next = make([]byte, length)
+
+				if _, err := f.r.ReadAt(next, int64(block)*SectorSize+int64(offset)); err != nil {
+					return fmt.Errorf("failed to read continuation area: %w", err)
+				}
+			default:
+				if err := fn(sig, entry); err != nil {
+					return err
+				}
+			}
+		}
+
+		if next == nil {
+			return nil
+		}
+
+		if hops >= maxContinuations {
+			return fmt.Errorf("%w: too many continuation areas", ErrInvalidImage)
+		}
+
+		su = next
+	}
+}
+
+// applyRockRidge updates an inode with the name, attributes and symlink target recorded in Rock Ridge entries.
+func (f *FS) applyRockRidge(n *inodeData, su []byte) error {
+	le := binary.LittleEndian
+
+	var (
+		name      []byte
+		hasName   bool
+		parts     []string
+		continued bool
+		child     uint32
+		hasChild  bool
+	)
+
+	err := f.systemUse(su, func(sig string, entry []byte) error {
+		switch sig {
+		case "NM":
+			if len(entry) < 5 || entry[4]&(rrCurrent|rrParent) != 0 {
+				return nil
+			}
+
+			name = append(name, entry[5:]...)
+			hasName = true
+		case "PX":
+			if len(entry) < 36 {
+				return fmt.Errorf("%w: truncated PX entry", ErrInvalidImage)
+			}
+
+			n.attr.Mode = fsmeta.FileMode(le.Uint32(entry[4:]))
+			n.attr.UID = le.Uint32(entry[20:])
+			n.attr.GID = le.Uint32(entry[28:])
+
+			if len(entry) >= 44 {
+				n.attr.Inode = uint64(le.Uint32(entry[36:]))
+			}
+		case "TF":
+			if len(entry) < 5 {
+				return fmt.Errorf("%w: truncated TF entry", ErrInvalidImage)
+			}
+
+			flags := entry[4]
+			size := 7
+
+			if flags&tfLongForm != 0 {
+				size = 17
+			}
+
+			off := 5
+
+			for bit := byte(1); bit < tfLongForm; bit <<= 1 {
+				if flags&bit == 0 {
+					continue
+				}
+
+				if off+size > len(entry) {
+					return fmt.Errorf("%w: truncated TF entry", ErrInvalidImage)
+				}
+
+				t := parseRecordTime(entry[off:])
+				if size == 17 {
+					t = parseVolumeTime(entry[off:])
+				}
+
+				switch bit {
+				case tfModify:
+					n.attr.ModTime = t
+				case tfAccess:
+					n.attr.AccessTime = t
+				case tfChange:
+					n.attr.ChangeTime = t
+				}
+
+				off += size
+			}
+		case "PN":
+			if len(entry) < 20 {
+				return fmt.Errorf("%w: truncated PN entry", ErrInvalidImage)
+			}
+
+			// Decode the 64-bit glibc dev_t encoding, matching rrPN.
+			dev := uint64(le.Uint32(entry[4:]))<<32 | uint64(le.Uint32(entry[12:]))
+			n.attr.Major = uint32(dev&0xFFF00>>8 | dev>>32&^0xFFF)
+			n.attr.Minor = uint32(dev&0xFF | dev>>12&0xFFFFFF00)
+		case "SL":
+			if len(entry) < 5 {
+				return fmt.Errorf("%w: truncated SL entry", ErrInvalidImage)
+			}
+
+			for body := entry[5:]; len(body) >= 2; {
+				flags, size := body[0], int(body[1])
+				if 2+size > len(body) {
+					return fmt.Errorf("%w: truncated SL component", ErrInvalidImage)
+				}
+
+				var part string
+
+				switch {
+				case flags&rrCurrent != 0:
+					part = "."
+				case flags&rrParent != 0:
+					part = ".."
+				case flags&rrRoot != 0:
+					part = "/"
+				default:
+					part = string(body[2 : 2+size])
+				}
+
+				if continued && len(parts) > 0 {
+					parts[len(parts)-1] += part
+				} else {
+					parts = append(parts, part)
+				}
+
+				continued = flags&rrContinue != 0
+				body = body[2+size:]
+			}
+		case "RE":
+			n.relocated = true
+		case "CL":
+			if len(entry) < 12 {
+				return fmt.Errorf("%w: truncated CL entry", ErrInvalidImage)
+			}
+
+			child = le.Uint32(entry[4:])
+			hasChild = true
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if hasName {
+		n.name = string(name)
+	}
+
+	if parts != nil {
+		if parts[0] == "/" {
+			n.target = "/" + strings.Join(parts[1:], "/")
+		} else {
+			n.target = strings.Join(parts, "/")
+		}
+	}
+
+	// Deep directories may be relocated, leaving a placeholder which links to the directory's new location.
+	if hasChild {
+		records, err := f.records(extent{lba: child, size: SectorSize})
+		if err != nil {
+			return err
+		}
+
+		if len(records) == 0 {
+			return fmt.Errorf("%w: relocated directory at %v is empty", ErrInvalidImage, child)
+		}
+
+		n.extents = []extent{{lba: child, size: records[0].ext.size}}
+		n.size = int64(records[0].ext.size)
+		n.attr.Mode = fs.ModeDir | n.attr.Mode.Perm()
+		n.attr.Inode = uint64(child) * SectorSize
+	}
+
+	return nil
+}
+
+// readDir lists a directory, merging the records of files stored in multiple extents and omitting relocated
+// directories, which are reached through their placeholders.
+func (f *FS) readDir(n *inodeData) ([]*inodeData, error) {
+	records, err := f.records(n.extents[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		out     []*inodeData
+		pending *inodeData
+	)
+
+	for i, rec := range records {
+		if i < 2 || rec.flags&flagAssociated != 0 {
+			continue
+		}
+
+		if pending != nil {
+			pending.extents = append(pending.extents, rec.ext)
+			pending.size += int64(rec.ext.size)
+		} else {
+			child, err := f.newInode(rec, rec.su[min(f.suspSkip, len(rec.su)):])
+			if err != nil {
+				return nil, err
+			}
+
+			if !child.relocated {
+				out = append(out, child)
+			}
+
+			pending = child
+		}
+
+		if rec.flags&FlagMultiExtent == 0 {
+			pending = nil
+		}
+	}
+
+	return out, nil
+}
+
+func pathError(op string, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// resolve walks a path from the root, following symlinks in intermediate components and, when follow is set, the
+// final component. Symlink targets are interpreted relative to the image root.
+func (f *FS) resolve(op string, name string, follow bool) (*inodeData, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError(op, name, fs.ErrInvalid)
+	}
+
+	stack := []*inodeData{f.root}
+	parts := strings.Split(name, "/")
+	links := 0
+
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		cur := stack[len(stack)-1]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+
+			continue
+		}
+
+		if !cur.isDir() {
+			return nil, pathError(op, name, ErrNotDir)
+		}
+
+		entries, err := f.readDir(cur)
+		if err != nil {
+			return nil, pathError(op, name, err)
+		}
+
+		idx := slices.IndexFunc(entries, func(e *inodeData) bool {
+			return e.name == part
+		})
+
+		if idx < 0 {
+			return nil, pathError(op, name, fs.ErrNotExist)
+		}
+
+		next := entries[idx]
+
+		if next.isSymlink() && (len(parts) > 0 || follow) {
+			links++
+			if links > maxSymlinks {
+				return nil, pathError(op, name, errors.New("too many levels of symbolic links"))
+			}
+
+			if strings.HasPrefix(next.target, "/") {
+				stack = stack[:1]
+			}
+
+			parts = append(strings.Split(next.target, "/"), parts...)
+
+			continue
+		}
+
+		stack = append(stack, next)
+	}
+
+	return stack[len(stack)-1], nil
+}
+
+func (f *FS) info(name string, n *inodeData) *fileInfo {
+	size := n.size
+	if n.isSymlink() {
+		size = int64(len(n.target))
+	}
+
+	attr := n.attr
+
+	return &fileInfo{name: name, size: size, attr: &attr}
+}
+
+func (f *FS) Open(name string) (fs.File, error) {
+	n, err := f.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	info := f.info(path.Base(name), n)
+
+	if n.isDir() {
+		entries, err := f.dirEntries(n)
+		if err != nil {
+			return nil, pathError("open", name, err)
+		}
+
+		return &dir{info: info, entries: entries}, nil
+	}
+
+	return &file{fs: f, info: info, inode: n}, nil
+}
+
+func (f *FS) dirEntries(n *inodeData) ([]fs.DirEntry, error) {
+	children, err := f.readDir(n)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]fs.DirEntry, len(children))
+
+	for i, child := range children {
+		out[i] = fs.FileInfoToDirEntry(f.info(child.name, child))
+	}
+
+	slices.SortFunc(out, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return out, nil
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := f.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if !n.isDir() {
+		return nil, pathError("readdir", name, ErrNotDir)
+	}
+
+	entries, err := f.dirEntries(n)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+
+	return entries, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	n, err := f.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.info(path.Base(name), n), nil
+}
+
+// Lstat describes a file without following a final symlink.
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	n, err := f.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.info(path.Base(name), n), nil
+}
+
+// ReadLink returns the target of a symlink.
+func (f *FS) ReadLink(name string) (string, error) {
+	n, err := f.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+
+	if !n.isSymlink() {
+		return "", pathError("readlink", name, fs.ErrInvalid)
+	}
+
+	return n.target, nil
+}
+
+type fileInfo struct {
+	name string
+	size int64
+	attr *fsmeta.Attr
+}
+
+func (i *fileInfo) Name() string {
+	return i.name
+}
+
+func (i *fileInfo) Size() int64 {
+	return i.size
+}
+
+func (i *fileInfo) Mode() fs.FileMode {
+	return i.attr.Mode
+}
+
+func (i *fileInfo) ModTime() time.Time {
+	return i.attr.ModTime
+}
+
+func (i *fileInfo) IsDir() bool {
+	return i.attr.Mode.IsDir()
+}
+
+func (i *fileInfo) Sys() any {
+	return i.attr
+}
+
+type file struct {
+	fs     *FS
+	info   *fileInfo
+	inode  *inodeData
+	offset int64
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Read(data []byte) (int, error) {
+	n, err := f.ReadAt(data, f.offset)
+	f.offset += int64(n)
+
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+// ReadAt reads across the extents of the file, which are stored in order.
+func (f *file) ReadAt(data []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fs.ErrInvalid
+	}
+
+	if off >= f.inode.size || f.inode.isSymlink() {
+		return 0, io.EOF
+	}
+
+	total := 0
+
+	for _, ext := range f.inode.extents {
+		if total == len(data) {
+			break
+		}
+
+		if size := int64(ext.size); off >= size {
+			off -= size
+
+			continue
+		}
+
+		chunk := data[total:min(len(data), total+int(int64(ext.size)-off))]
+
+		n, err := f.fs.r.ReadAt(chunk, int64(ext.lba)*SectorSize+off)
+		total += n
+
+		if err != nil && (err != io.EOF || n < len(chunk)) {
+			return total, fmt.Errorf("failed to read extent at %v: %w", ext.lba, err)
+		}
+
+		off = 0
+	}
+
+	if total < len(data) {
+		return total, io.EOF
+	}
+
+	return total, nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	default:
+		return 0, fs.ErrInvalid
+	}
+
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+type dir struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *dir) ReadDir(count int) ([]fs.DirEntry, error) {
+	entries := d.entries[d.offset:]
+
+	if count > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+
+		entries = entries[:min(count, len(entries))]
+	}
+
+	d.offset += len(entries)
+
+	return entries, nil
+}
+
+func (d *dir) Close() error {
+	return nil
+}
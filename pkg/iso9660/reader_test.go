@@ -0,0 +1,180 @@
+package iso9660
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReaderRockRidge(t *testing.T) {
+	_, img := buildImage(t, Options{VolumeID: "install"})
+
+	fsys, err := Open(bytes.NewReader(img))
+	require.NoError(t, err, "image should open")
+	assert.True(t, fsys.RockRidge(), "rock ridge should be detected")
+	assert.Equal(t, "INSTALL", fsys.VolumeID(), "volume id should be read")
+
+	// The long symlink dangles, so check the directories without it.
+	for dir, expected := range map[string]string{
+		"isolinux":  "isolinux.cfg",
+		"dev":       "console",
+		"docs":      longestName,
+		"pool/main": "package-000_1.0_amd64.deb",
+		"a":         deepPath[2:] + "/file",
+	} {
+		sub, err := fs.Sub(fsys, dir)
+		require.NoError(t, err, "sub should create")
+		require.NoError(t, fstest.TestFS(sub, expected), "%v should behave", dir)
+	}
+
+	data, err := fs.ReadFile(fsys, "isolinux/default")
+	require.NoError(t, err, "symlink should be followed")
+	assert.Equal(t, "default linux\n", string(data), "symlink should resolve to its target")
+
+	target, err := fsys.ReadLink("live/filesystem")
+	require.NoError(t, err, "link should read")
+	assert.Equal(t, linkTarget, target, "long link target should round trip")
+
+	info, err := fsys.Stat("isolinux/isolinux.cfg")
+	require.NoError(t, err, "stat should succeed")
+
+	attr := info.Sys().(*fsmeta.Attr)
+	assert.Equal(t, fs.FileMode(0o640), info.Mode(), "mode should round trip")
+	assert.Equal(t, uint32(1000), attr.UID, "uid should round trip")
+	assert.Equal(t, uint32(100), attr.GID, "gid should round trip")
+	assert.Equal(t, time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC), info.ModTime(), "mtime should round trip")
+
+	link, err := fsys.Stat("isolinux/syslinux.cfg")
+	require.NoError(t, err, "hard link should stat")
+	assert.Equal(t, attr.Inode, link.Sys().(*fsmeta.Attr).Inode, "hard link should share an inode")
+
+	info, err = fsys.Lstat("dev/console")
+	require.NoError(t, err, "device should stat")
+	assert.Equal(t, fs.ModeDevice|fs.ModeCharDevice, info.Mode().Type(), "device type should round trip")
+	assert.Equal(t, uint32(5), info.Sys().(*fsmeta.Attr).Major, "major should round trip")
+	assert.Equal(t, uint32(1), info.Sys().(*fsmeta.Attr).Minor, "minor should round trip")
+
+	entries, err := fsys.ReadDir("pool/main")
+	require.NoError(t, err, "large directory should list")
+	assert.Len(t, entries, 200, "all entries should be listed")
+
+	images, err := fsys.BootImages()
+	require.NoError(t, err, "boot catalog should be optional")
+	assert.Empty(t, images, "image without a catalog should have no boot images")
+}
+
+func TestReaderFallback(t *testing.T) {
+	_, img := buildImage(t, Options{})
+
+	// Hide the SP entry of the root record, leaving only the Joliet names.
+	root := SystemAreaSectors*SectorSize + 156
+	dot := int(img[root+2]) * SectorSize
+	require.Equal(t, "SP", string(img[dot+34:dot+36]), "root should start with an SP entry")
+	copy(img[dot+34:], "XX")
+
+	fsys, err := Open(bytes.NewReader(img))
+	require.NoError(t, err, "image should open")
+	assert.False(t, fsys.RockRidge(), "rock ridge should be ignored")
+	assert.True(t, fsys.Joliet(), "joliet should be used")
+
+	data, err := fs.ReadFile(fsys, notesEnglish[:60]+".txt")
+	require.NoError(t, err, "joliet name should open")
+	assert.Equal(t, notesEnglish, string(data), "file should read")
+
+	info, err := fsys.Stat("isolinux/isolinux.cfg")
+	require.NoError(t, err, "stat should succeed")
+	assert.Equal(t, fs.FileMode(0o444), info.Mode(), "files should be read-only")
+
+	// Hide the Joliet descriptor, leaving the primary names.
+	img[(SystemAreaSectors+1)*SectorSize+88] = 0
+
+	fsys, err = Open(bytes.NewReader(img))
+	require.NoError(t, err, "image should open")
+	assert.False(t, fsys.Joliet(), "joliet should be ignored")
+
+	data, err = fs.ReadFile(fsys, "release_notes_for_the_appli.txt")
+	require.NoError(t, err, "primary name should open")
+	assert.Equal(t, notesEnglish, string(data), "file should read")
+
+	_, err = fsys.Stat("_disk/base_installable")
+	require.NoError(t, err, "name without extension should lose its trailing dot")
+}
+
+func TestReaderBoot(t *testing.T) {
+	esp, err := ESPImage(fstest.MapFS{
+		"EFI/BOOT/BOOTX64.EFI": {Data: []byte("efi loader")},
+	}, 0)
+	require.NoError(t, err, "esp should build")
+
+	data := buildHybrid(t, esp)
+
+	fsys, err := Open(bytes.NewReader(data))
+	require.NoError(t, err, "hybrid image should open")
+
+	images, err := fsys.BootImages()
+	require.NoError(t, err, "boot catalog should read")
+	require.Len(t, images, 2, "both entries should be listed")
+
+	assert.Equal(t, PlatformBIOS, images[0].Platform, "default entry should be bios")
+	assert.True(t, images[0].Bootable, "default entry should be bootable")
+	assert.Equal(t, uint16(4), images[0].LoadSectors, "bios should load four sectors")
+	assert.Equal(t, "isolinux/isolinux.bin", images[0].Path, "bios image should be located")
+
+	assert.Equal(t, PlatformEFI, images[1].Platform, "second entry should be efi")
+	assert.Equal(t, "boot/efi.img", images[1].Path, "efi image should be located")
+	assert.Equal(t, int64(len(esp)), images[1].Size, "efi image size should be that of its file")
+
+	read, err := io.ReadAll(fsys.OpenBootImage(images[1]))
+	require.NoError(t, err, "efi image should read")
+	assert.Equal(t, esp, read, "efi image should round trip")
+}
+
+func TestReaderExtents(t *testing.T) {
+	img := make([]byte, 8*SectorSize)
+	for i := range img {
+		img[i] = byte(i / SectorSize)
+	}
+
+	fsys := &FS{r: bytes.NewReader(img)}
+	n := &inodeData{
+		extents: []extent{{lba: 5, size: SectorSize}, {lba: 2, size: 10}},
+		size:    SectorSize + 10,
+		attr:    fsmeta.Attr{Mode: 0o444},
+	}
+
+	f := &file{fs: fsys, info: fsys.info("split", n), inode: n}
+
+	data, err := io.ReadAll(f)
+	require.NoError(t, err, "file should read")
+	assert.Equal(t, append(bytes.Repeat([]byte{5}, SectorSize), bytes.Repeat([]byte{2}, 10)...), data,
+		"extents should be read in order")
+
+	buf := make([]byte, 4)
+	count, err := f.ReadAt(buf, SectorSize-2)
+	require.NoError(t, err, "read across extents should succeed")
+	assert.Equal(t, 4, count, "read should fill the buffer")
+	assert.Equal(t, []byte{5, 5, 2, 2}, buf, "read should span both extents")
+}
+
+func TestReaderInvalid(t *testing.T) {
+	_, err := Open(bytes.NewReader(make([]byte, 20*SectorSize)))
+	assert.ErrorIs(t, err, ErrInvalidImage, "zeroed image should be rejected")
+
+	_, img := buildImage(t, Options{})
+
+	fsys, err := Open(bytes.NewReader(img))
+	require.NoError(t, err, "image should open")
+
+	_, err = fsys.Open("missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist, "missing file should not exist")
+
+	_, err = fsys.ReadDir("isolinux/isolinux.cfg")
+	assert.ErrorIs(t, err, ErrNotDir, "file should not list")
+}
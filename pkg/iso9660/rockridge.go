@@ -0,0 +1,270 @@
+package iso9660
+
+import (
+	"strings"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+)
+
+const (
+	suspHeaderSize = 4
+	maxEntrySize   = 255
+	ceEntrySize    = 28
+
+	rrExtensionID   = "RRIP_1991A"
+	rrExtensionDesc = "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+	rrExtensionSrc  = "PLEASE CONTACT DISC PUBLISHER FOR SPECIFICATION SOURCE.  SEE PUBLISHER IDENTIFIER IN PRIMARY " +
+		"VOLUME DESCRIPTOR FOR CONTACT INFORMATION."
+)
+
+// Rock Ridge flags.
+const (
+	rrContinue = 0x01
+	rrCurrent  = 0x02
+	rrParent   = 0x04
+	rrRoot     = 0x08
+
+	tfModify = 0x02
+	tfAccess = 0x04
+	tfChange = 0x08
+)
+
+func putBoth32(buf []byte, v uint32) {
+	buf[0], buf[1], buf[2], buf[3] = byte(v), byte(v>>8), byte(v>>16), byte(v>>24)
+	buf[4], buf[5], buf[6], buf[7] = byte(v>>24), byte(v>>16), byte(v>>8), byte(v)
+}
+
+func putBoth16(buf []byte, v uint16) {
+	buf[0], buf[1] = byte(v), byte(v>>8)
+	buf[2], buf[3] = byte(v>>8), byte(v)
+}
+
+func suspEntry(sig string, payload int) []byte {
+	entry := make([]byte, suspHeaderSize+payload)
+	copy(entry, sig)
+	entry[2] = byte(len(entry))
+	entry[3] = 1
+
+	return entry
+}
+
+// suspSP marks the root directory as using the System Use Sharing Protocol.
+func suspSP() []byte {
+	entry := suspEntry("SP", 3)
+	entry[4], entry[5] = 0xBE, 0xEF
+
+	return entry
+}
+
+// suspER identifies Rock Ridge as the extension in use.
+func suspER() []byte {
+	entry := suspEntry("ER", 4+len(rrExtensionID)+len(rrExtensionDesc)+len(rrExtensionSrc))
+	entry[4] = byte(len(rrExtensionID))
+	entry[5] = byte(len(rrExtensionDesc))
+	entry[6] = byte(len(rrExtensionSrc))
+	entry[7] = 1
+	copy(entry[8:], rrExtensionID+rrExtensionDesc+rrExtensionSrc)
+
+	return entry
+}
+
+func suspCE(block uint32, offset uint32, length uint32) []byte {
+	entry := suspEntry("CE", 24)
+	putBoth32(entry[4:], block)
+	putBoth32(entry[12:], offset)
+	putBoth32(entry[20:], length)
+
+	return entry
+}
+
+func rrPX(attr *fsmeta.Attr, links uint32) []byte {
+	entry := suspEntry("PX", 32)
+	putBoth32(entry[4:], attr.UnixMode())
+	putBoth32(entry[12:], links)
+	putBoth32(entry[20:], attr.UID)
+	putBoth32(entry[28:], attr.GID)
+
+	return entry
+}
+
+// rrPN records a device number, split into the high and low halves of the 64-bit Linux dev_t encoding as done by
+// libisofs and expected by libarchive. The kernel also decodes small device numbers from the low half alone.
+func rrPN(attr *fsmeta.Attr) []byte {
+	major, minor := uint64(attr.Major), uint64(attr.Minor)
+	dev := major&0xFFF<<8 | major&^0xFFF<<32 | minor&0xFF | minor&^0xFF<<12
+
+	entry := suspEntry("PN", 16)
+	putBoth32(entry[4:], uint32(dev>>32))
+	putBoth32(entry[12:], uint32(dev))
+
+	return entry
+}
+
+// rrCL links the placeholder left at the original location of a relocated directory to the directory.
+func rrCL() []byte {
+	return suspEntry("CL", 8)
+}
+
+// rrPL links the parent record of a relocated directory to its original parent.
+func rrPL() []byte {
+	return suspEntry("PL", 8)
+}
+
+// rrRE marks a relocated directory, which readers list only through its placeholder.
+func rrRE() []byte {
+	return suspEntry("RE", 0)
+}
+
+func rrTF(attr *fsmeta.Attr) []byte {
+	entry := suspEntry("TF", 1+3*7)
+	entry[4] = tfModify | tfAccess | tfChange
+
+	for i, t := range []time.Time{attr.ModTime, attr.AccessTime, attr.ChangeTime} {
+		if t.IsZero() {
+			t = attr.ModTime
+		}
+
+		putRecordTime(entry[5+i*7:], t)
+	}
+
+	return entry
+}
+
+// rrNM records the original name, split across entries when it does not fit in one.
+func rrNM(name string) [][]byte {
+	var out [][]byte
+
+	for {
+		chunk := name[:min(len(name), maxEntrySize-5)]
+		name = name[len(chunk):]
+
+		entry := suspEntry("NM", 1+len(chunk))
+		copy(entry[5:], chunk)
+
+		if name != "" {
+			entry[4] = rrContinue
+		}
+
+		out = append(out, entry)
+
+		if name == "" {
+			return out
+		}
+	}
+}
+
+type slComponent struct {
+	flags   byte
+	content string
+}
+
+// rrSL records a symlink target as a series of components. Entries are split within a component, or after an empty
+// continued component, as libarchive does not separate components at entry boundaries.
+func rrSL(target string) [][]byte {
+	var components []slComponent
+
+	if strings.HasPrefix(target, "/") {
+		components = append(components, slComponent{flags: rrRoot})
+	}
+
+	for _, part := range strings.Split(target, "/") {
+		switch part {
+		case "":
+		case ".":
+			components = append(components, slComponent{flags: rrCurrent})
+		case "..":
+			components = append(components, slComponent{flags: rrParent})
+		default:
+			components = append(components, slComponent{content: part})
+		}
+	}
+
+	var out [][]byte
+
+	for len(components) > 0 {
+		var body []byte
+
+		for len(components) > 0 {
+			c := components[0]
+			free := maxEntrySize - 5 - len(body)
+
+			// Whole components leave space for an empty continued component, unless nothing follows.
+			if 2+len(c.content) <= free-2 || (len(components) == 1 && 2+len(c.content) <= free) {
+				body = append(body, c.flags, byte(len(c.content)))
+				body = append(body, c.content...)
+				components = components[1:]
+
+				continue
+			}
+
+			if len(c.content) > free-2 && free > 2 {
+				body = append(body, c.flags|rrContinue, byte(free-2))
+				body = append(body, c.content[:free-2]...)
+				components[0].content = c.content[free-2:]
+			} else {
+				body = append(body, rrContinue, 0)
+			}
+
+			break
+		}
+
+		entry := suspEntry("SL", 1+len(body))
+		copy(entry[5:], body)
+
+		if len(components) > 0 {
+			entry[4] = rrContinue
+		}
+
+		out = append(out, entry)
+	}
+
+	return out
+}
+
+func entriesSize(entries [][]byte) int {
+	size := 0
+	for _, e := range entries {
+		size += len(e)
+	}
+
+	return size
+}
+
+// splitSystemUse divides entries between the directory record, which has space for inline bytes, and a chain of
+// continuation areas, each fitting within a sector. Space is left for the CE entry linking each part to the next.
+func splitSystemUse(entries [][]byte, inline int) ([][]byte, [][][]byte) {
+	if entriesSize(entries) <= inline {
+		return entries, nil
+	}
+
+	n, size := 0, 0
+	for n < len(entries) && size+len(entries[n]) <= inline-ceEntrySize {
+		size += len(entries[n])
+		n++
+	}
+
+	head := entries[:n]
+	rest := entries[n:]
+
+	var areas [][][]byte
+
+	for len(rest) > 0 {
+		if entriesSize(rest) <= SectorSize {
+			areas = append(areas, rest)
+
+			break
+		}
+
+		n, size = 0, 0
+		for n < len(rest) && size+len(rest[n]) <= SectorSize-ceEntrySize {
+			size += len(rest[n])
+			n++
+		}
+
+		areas = append(areas, rest[:n])
+		rest = rest[n:]
+	}
+
+	return head, areas
+}
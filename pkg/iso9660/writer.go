@@ -0,0 +1,1153 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+)
+
+type extent struct {
+	lba  uint32
+	size uint32
+}
+
+type node struct {
+	attr     fsmeta.Attr
+	links    uint32
+	children map[string]*node
+	data     int64
+	size     int64
+	target   string
+}
+
+func (n *node) isDir() bool {
+	return n.attr.Mode.IsDir()
+}
+
+func (n *node) sortedNames() []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+// extents splits the file data, stored from the data area at base, into extents no larger than MaxExtentSize. Empty
+// files and other entries without data have a single empty extent.
+func (n *node) extents(base uint32) []extent {
+	if n.size == 0 {
+		return []extent{{}}
+	}
+
+	var out []extent
+
+	for off := int64(0); off < n.size; off += MaxExtentSize {
+		out = append(out, extent{
+			lba:  base + uint32((n.data+off)/SectorSize),
+			size: uint32(min(n.size-off, MaxExtentSize)),
+		})
+	}
+
+	return out
+}
+
+// nlink returns the link count reported through Rock Ridge, counting the entries of subdirectories for directories.
+func (n *node) nlink() uint32 {
+	if !n.isDir() {
+		return n.links
+	}
+
+	links := uint32(2)
+
+	for _, c := range n.children {
+		if c.isDir() {
+			links++
+		}
+	}
+
+	return links
+}
+
+func withType(mode fs.FileMode, ty fs.FileMode) fs.FileMode {
+	return mode&^fs.ModeType | ty
+}
+
+// Writer builds an ISO 9660 image with Joliet and Rock Ridge extensions. Readers such as libarchive process images
+// sequentially, requiring the directories to precede file data, so file data is spooled to a temporary file as it is
+// added and copied into place after the path tables and directories on Close. Directories nested beyond eight levels
+// are relocated to rr_moved in the primary hierarchy, whilst Joliet keeps them in place.
+type Writer struct {
+	dst       io.WriterAt
+	limit     int64
+	opts      Options
+	spool     *os.File
+	spooled   int64
+	catalog   uint32
+	metaStart uint32
+	root      *node
+	closed    bool
+	size      int64
+}
+
+// NewWriter prepares an image within dst. A positive size limits the space the image may use. Close must be called to
+// remove the spool file, even if the image is abandoned.
+func NewWriter(dst io.WriterAt, size int64, opts Options) (*Writer, error) {
+	if opts.VolumeID == "" {
+		opts.VolumeID = "CDROM"
+	}
+
+	if len(opts.VolumeID) > 32 {
+		return nil, fmt.Errorf("%w: volume id %q exceeds 32 characters", ErrInvalidName, opts.VolumeID)
+	}
+
+	if opts.Time.IsZero() {
+		opts.Time = time.Unix(0, 0).UTC()
+	}
+
+	for _, entry := range opts.Boot {
+		if entry.Platform != PlatformBIOS && entry.Platform != PlatformEFI {
+			return nil, fmt.Errorf("%w: unsupported platform 0x%02x", ErrInvalidBoot, entry.Platform)
+		}
+
+		if entry.Path == "" {
+			return nil, fmt.Errorf("%w: missing path", ErrInvalidBoot)
+		}
+	}
+
+	w := &Writer{
+		dst:   dst,
+		limit: size,
+		opts:  opts,
+		root: &node{
+			attr:     fsmeta.Attr{Mode: fs.ModeDir | 0o755, ModTime: opts.Time},
+			children: make(map[string]*node),
+		},
+	}
+
+	// The primary, Joliet and terminating descriptors are always present, with the boot record and its catalog
+	// following the primary descriptor when booting is enabled.
+	next := uint32(SystemAreaSectors + 3)
+
+	if len(opts.Boot) > 0 {
+		w.catalog = next + 1
+		next += 2
+	}
+
+	w.metaStart = next
+
+	return w, nil
+}
+
+func (w *Writer) writeAt(data []byte, off int64) error {
+	if w.limit > 0 && off+int64(len(data)) > w.limit {
+		return fmt.Errorf("%w: image exceeds %v bytes", ErrNoSpace, w.limit)
+	}
+
+	if _, err := w.dst.WriteAt(data, off); err != nil {
+		return fmt.Errorf("failed to write image: %w", err)
+	}
+
+	return nil
+}
+
+func sectors(size int64) int64 {
+	return (size + SectorSize - 1) / SectorSize
+}
+
+// writeData spools r, returning its offset within the data area and its size.
+func (w *Writer) writeData(r io.Reader) (int64, int64, error) {
+	if w.spool == nil {
+		spool, err := os.CreateTemp(w.opts.TempDir, "iso9660-*")
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to create spool: %w", err)
+		}
+
+		w.spool = spool
+	}
+
+	start := w.spooled
+
+	size, err := io.Copy(io.NewOffsetWriter(w.spool, start), r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to spool data: %w", err)
+	}
+
+	if w.limit > 0 && int64(w.metaStart)*SectorSize+start+sectors(size)*SectorSize > w.limit {
+		return 0, 0, fmt.Errorf("%w: image exceeds %v bytes", ErrNoSpace, w.limit)
+	}
+
+	// Pad the final sector, as extents are sector aligned.
+	if pad := sectors(size)*SectorSize - size; pad > 0 {
+		if _, err := w.spool.WriteAt(make([]byte, pad), start+size); err != nil {
+			return 0, 0, fmt.Errorf("failed to spool data: %w", err)
+		}
+	}
+
+	w.spooled += sectors(size) * SectorSize
+
+	return start, size, nil
+}
+
+func splitPath(name string) (string, string) {
+	return path.Split(cleanPath(name))
+}
+
+func cleanPath(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+func (w *Writer) lookup(name string, create bool) (*node, error) {
+	name = cleanPath(name)
+
+	cur := w.root
+
+	if name == "" {
+		return cur, nil
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		next := cur.children[part]
+
+		if next == nil {
+			if !create {
+				return nil, fmt.Errorf("%w: %v", fs.ErrNotExist, name)
+			}
+
+			var err error
+
+			next, err = w.addNode(cur, part, fsmeta.Attr{Mode: fs.ModeDir | 0o755, ModTime: w.opts.Time})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !next.isDir() {
+			return nil, fmt.Errorf("%w: %v", ErrNotDir, part)
+		}
+
+		cur = next
+	}
+
+	return cur, nil
+}
+
+func (w *Writer) addNode(parent *node, name string, attr fsmeta.Attr) (*node, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	if parent.children[name] != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExist, name)
+	}
+
+	if attr.ModTime.IsZero() {
+		attr.ModTime = w.opts.Time
+	}
+
+	n := &node{
+		attr:  attr,
+		links: 1,
+	}
+
+	if attr.Mode.IsDir() {
+		n.children = make(map[string]*node)
+	}
+
+	parent.children[name] = n
+
+	return n, nil
+}
+
+func (w *Writer) create(name string, attr fsmeta.Attr) (*node, error) {
+	if w.closed {
+		return nil, ErrClosed
+	}
+
+	dir, base := splitPath(name)
+
+	parent, err := w.lookup(dir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return w.addNode(parent, base, attr)
+}
+
+// Mkdir creates a directory, along with any missing parents. The metadata of an existing directory, including the
+// root when name is ".", is replaced.
+func (w *Writer) Mkdir(name string, attr fsmeta.Attr) error {
+	if w.closed {
+		return ErrClosed
+	}
+
+	attr.Mode = withType(attr.Mode, fs.ModeDir)
+
+	if attr.ModTime.IsZero() {
+		attr.ModTime = w.opts.Time
+	}
+
+	dir, base := splitPath(name)
+
+	existing := w.root
+
+	if base != "" {
+		parent, err := w.lookup(dir, true)
+		if err != nil {
+			return err
+		}
+
+		existing = parent.children[base]
+
+		if existing == nil || !existing.isDir() {
+			_, err = w.addNode(parent, base, attr)
+
+			return err
+		}
+	}
+
+	existing.attr = attr
+
+	return nil
+}
+
+// WriteFile creates a regular file, along with any missing parent directories, containing the data read from r.
+// Extended attributes are not supported by Rock Ridge and are ignored.
+func (w *Writer) WriteFile(name string, r io.Reader, attr fsmeta.Attr) error {
+	attr.Mode = withType(attr.Mode, 0)
+
+	n, err := w.create(name, attr)
+	if err != nil {
+		return err
+	}
+
+	n.data, n.size, err = w.writeData(r)
+	if err != nil {
+		return fmt.Errorf("writing %v: %w", name, err)
+	}
+
+	return nil
+}
+
+func (w *Writer) Symlink(name string, target string, attr fsmeta.Attr) error {
+	if target == "" || len(target) > maxSymlinkTarget {
+		return fmt.Errorf("%w: symlink target of %v bytes", ErrInvalidName, len(target))
+	}
+
+	attr.Mode = withType(attr.Mode, fs.ModeSymlink)
+
+	n, err := w.create(name, attr)
+	if err != nil {
+		return err
+	}
+
+	n.target = target
+
+	return nil
+}
+
+// Mknod creates a device node, FIFO or socket, selected by the type bits of attr.Mode.
+func (w *Writer) Mknod(name string, attr fsmeta.Attr) error {
+	switch attr.Mode.Type() {
+	case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice, fs.ModeNamedPipe, fs.ModeSocket:
+	default:
+		return fmt.Errorf("%w: %v is %v", ErrUnsupportedType, name, attr.Mode.Type())
+	}
+
+	_, err := w.create(name, attr)
+
+	return err
+}
+
+// Link creates a hard link to an existing non-directory entry. Both directory records share the same extent.
+func (w *Writer) Link(name string, target string) error {
+	if w.closed {
+		return ErrClosed
+	}
+
+	tdir, tbase := splitPath(target)
+
+	tparent, err := w.lookup(tdir, false)
+	if err != nil {
+		return err
+	}
+
+	n := tparent.children[tbase]
+	if n == nil {
+		return fmt.Errorf("%w: %v", fs.ErrNotExist, target)
+	}
+
+	if n.isDir() {
+		return fmt.Errorf("%w: cannot hard link directory %v", ErrUnsupportedType, target)
+	}
+
+	dir, base := splitPath(name)
+
+	parent, err := w.lookup(dir, true)
+	if err != nil {
+		return err
+	}
+
+	if err := validName(base); err != nil {
+		return err
+	}
+
+	if parent.children[base] != nil {
+		return fmt.Errorf("%w: %v", ErrExist, name)
+	}
+
+	parent.children[base] = n
+	n.links++
+
+	return nil
+}
+
+// AddFS copies the contents of fsys into the image root, as described by fsmeta.CopyFS.
+func (w *Writer) AddFS(fsys fs.FS) error {
+	return fsmeta.CopyFS(w, fsys)
+}
+
+// hierarchy is the directory tree as described by either the primary or the Joliet volume descriptor.
+type hierarchy struct {
+	joliet bool
+	dirs   []*directory
+	pathL  uint32
+	pathM  uint32
+	// byNode locates the directory built for each directory node.
+	byNode map[*node]*directory
+	// moved holds the directories relocated to movedDir, with parents recording their original parents.
+	moved    []namedNode
+	movedDir namedNode
+	parents  map[*node]*node
+}
+
+type namedNode struct {
+	name string
+	node *node
+}
+
+// relocate finds the directories below dir which would exceed the eight levels permitted in the primary hierarchy,
+// given the level of dir. As with mkisofs, each of them is moved to rr_moved in the root, leaving a placeholder in
+// its original parent which Rock Ridge readers follow.
+func (h *hierarchy) relocate(dir *node, level int) {
+	for _, name := range dir.sortedNames() {
+		child := dir.children[name]
+		if !child.isDir() {
+			continue
+		}
+
+		if level >= maxDepth {
+			h.moved = append(h.moved, namedNode{name: name, node: child})
+			h.parents[child] = dir
+		}
+
+		h.relocate(child, level+1)
+	}
+}
+
+// placement lists the directories in the order their extents are placed, depth first as mkisofs does rather than in
+// path table order. This is the layout libarchive expects when reporting relocated directories at their original
+// paths.
+func (h *hierarchy) placement(d *directory, out []*directory) []*directory {
+	out = append(out, d)
+
+	for _, r := range d.records[2:] {
+		if r.dir != nil {
+			out = h.placement(r.dir, out)
+		}
+	}
+
+	return out
+}
+
+// nlink returns the link count of n as reported through Rock Ridge, counting rr_moved as a subdirectory of the root.
+func (h *hierarchy) nlink(n *node) uint32 {
+	if h.movedDir.node != nil && n == h.dirs[0].node {
+		return n.nlink() + 1
+	}
+
+	return n.nlink()
+}
+
+// linkRelocated fills in the CL and PL entries, which locate relocated directories and their original parents, once
+// the directories have been placed.
+func (h *hierarchy) linkRelocated() {
+	for _, d := range h.dirs {
+		for _, r := range d.records {
+			if r.link != nil {
+				putBoth32(r.link[4:], h.byNode[r.linkTo].lba)
+			}
+		}
+	}
+}
+
+type directory struct {
+	node    *node
+	parent  *directory
+	ident   []byte
+	number  int
+	records []*record
+	lba     uint32
+	size    uint32
+	// continuations is the number of sectors following the directory holding continuation areas.
+	continuations uint32
+}
+
+type record struct {
+	ident []byte
+	node  *node
+	dir   *directory
+	part  int
+	flags byte
+	su    [][]byte
+	areas [][][]byte
+	ce    []area
+	// link is a CL or PL entry pointing at the directory of linkTo.
+	link   []byte
+	linkTo *node
+}
+
+// area locates a continuation area holding system use entries which did not fit in a directory record.
+type area struct {
+	pos  int64
+	size uint32
+}
+
+func (a area) block() uint32 {
+	return uint32(a.pos / SectorSize)
+}
+
+func (a area) offset() uint32 {
+	return uint32(a.pos % SectorSize)
+}
+
+func (r *record) baseSize() int {
+	return recordHeaderSize + len(r.ident) + 1 - len(r.ident)%2
+}
+
+func (r *record) length() int {
+	size := r.baseSize() + entriesSize(r.su)
+
+	if len(r.areas) > 0 {
+		size += ceEntrySize
+	}
+
+	return size + size%2
+}
+
+func (h *hierarchy) pathTableSize() int64 {
+	var size int64
+
+	for _, d := range h.dirs {
+		size += int64(pathRecordSize + len(d.ident) + len(d.ident)%2)
+	}
+
+	return size
+}
+
+func (h *hierarchy) pathTable(order binary.ByteOrder) []byte {
+	var buf []byte
+
+	for _, d := range h.dirs {
+		entry := make([]byte, pathRecordSize+len(d.ident)+len(d.ident)%2)
+		entry[0] = byte(len(d.ident))
+		order.PutUint32(entry[2:], d.lba)
+		order.PutUint16(entry[6:], uint16(d.parent.number))
+		copy(entry[8:], d.ident)
+
+		buf = append(buf, entry...)
+	}
+
+	return buf
+}
+
+// buildHierarchy assigns identifiers to every entry and orders the directories as required by the path table: by
+// depth, then by parent, then by identifier.
+func (w *Writer) buildHierarchy(joliet bool) (*hierarchy, error) {
+	h := &hierarchy{joliet: joliet, byNode: make(map[*node]*directory), parents: make(map[*node]*node)}
+
+	root := &directory{node: w.root, ident: []byte{0}}
+	root.parent = root
+	h.dirs = append(h.dirs, root)
+	h.byNode[w.root] = root
+
+	if !joliet {
+		h.relocate(w.root, 1)
+	}
+
+	if len(h.moved) > 0 {
+		used := make(map[string]bool)
+		for name := range w.root.children {
+			used[name] = true
+		}
+
+		name, err := uniqueName(func(tail string) string { return relocatedDir + tail }, used)
+		if err != nil {
+			return nil, err
+		}
+
+		h.movedDir = namedNode{name: name, node: &node{
+			attr:  fsmeta.Attr{Mode: fs.ModeDir | 0o755, ModTime: w.opts.Time},
+			links: 1,
+		}}
+	}
+
+	for i := 0; i < len(h.dirs); i++ {
+		d := h.dirs[i]
+		d.number = i + 1
+
+		if d.number > maxDirectories {
+			return nil, fmt.Errorf("%w: more than %v", ErrTooManyDirs, maxDirectories)
+		}
+
+		if err := w.buildRecords(h, d); err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+func (w *Writer) buildRecords(h *hierarchy, d *directory) error {
+	type entry struct {
+		name  string
+		ident string
+		node  *node
+	}
+
+	var children []namedNode
+
+	if d.node == h.movedDir.node {
+		children = h.moved
+	} else {
+		for _, name := range d.node.sortedNames() {
+			children = append(children, namedNode{name: name, node: d.node.children[name]})
+		}
+
+		if d.parent == d && h.movedDir.node != nil {
+			children = append(children, h.movedDir)
+		}
+	}
+
+	used := make(map[string]bool)
+	entries := make([]entry, 0, len(children))
+
+	for _, c := range children {
+		name, n := c.name, c.node
+
+		var (
+			ident string
+			err   error
+		)
+
+		if h.joliet {
+			ident, err = jolietName(name, used)
+		} else {
+			ident, err = primaryName(name, n.isDir(), used)
+		}
+
+		if err != nil {
+			return fmt.Errorf("%w: %v", err, name)
+		}
+
+		used[ident] = true
+		entries = append(entries, entry{name: name, ident: ident, node: n})
+	}
+
+	if h.joliet {
+		slices.SortFunc(entries, func(a, b entry) int {
+			return bytes.Compare(encodeUCS2(a.ident), encodeUCS2(b.ident))
+		})
+	} else {
+		slices.SortFunc(entries, func(a, b entry) int {
+			return comparePrimary(a.ident, b.ident)
+		})
+	}
+
+	self := &record{ident: []byte{0}, node: d.node, dir: d, flags: FlagDirectory}
+	parent := &record{ident: []byte{1}, node: d.parent.node, dir: d.parent, flags: FlagDirectory}
+
+	if !h.joliet {
+		self.su = [][]byte{rrPX(&d.node.attr, h.nlink(d.node)), rrTF(&d.node.attr)}
+		parent.su = [][]byte{rrPX(&d.parent.node.attr, h.nlink(d.parent.node)), rrTF(&d.parent.node.attr)}
+
+		// A relocated directory records its original parent, which readers report in place of rr_moved.
+		if orig := h.parents[d.node]; orig != nil {
+			parent.link, parent.linkTo = rrPL(), orig
+			parent.su = append(parent.su, parent.link)
+		}
+
+		// The root identifies the extensions in use, with SP required to come first.
+		if d.parent == d {
+			self.su = append([][]byte{suspSP()}, append(self.su, suspER())...)
+		}
+	}
+
+	d.records = append(d.records, self, parent)
+
+	for _, e := range entries {
+		ident := []byte(e.ident)
+		if h.joliet {
+			ident = encodeUCS2(e.ident)
+		}
+
+		var su [][]byte
+
+		if !h.joliet {
+			su = append(rrNM(e.name), rrPX(&e.node.attr, h.nlink(e.node)), rrTF(&e.node.attr))
+
+			switch e.node.attr.Mode.Type() {
+			case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice:
+				su = append(su, rrPN(&e.node.attr))
+			case fs.ModeSymlink:
+				su = append(su, rrSL(e.node.target)...)
+			}
+		}
+
+		relocated := h.parents[e.node] != nil
+
+		// The original location of a relocated directory holds an empty file record linking to it.
+		if relocated && d.node != h.movedDir.node {
+			r := &record{ident: ident, node: e.node, su: su, link: rrCL(), linkTo: e.node}
+			r.su = append(r.su, r.link)
+			d.records = append(d.records, r)
+
+			continue
+		}
+
+		if relocated {
+			su = append(su, rrRE())
+		}
+
+		if e.node.isDir() {
+			child := &directory{node: e.node, parent: d, ident: ident}
+			h.dirs = append(h.dirs, child)
+			h.byNode[e.node] = child
+
+			d.records = append(d.records, &record{ident: ident, node: e.node, dir: child, flags: FlagDirectory, su: su})
+
+			continue
+		}
+
+		parts := len(e.node.extents(0))
+
+		for i := range parts {
+			var flags byte
+			if i < parts-1 {
+				flags = FlagMultiExtent
+			}
+
+			d.records = append(d.records, &record{ident: ident, node: e.node, part: i, flags: flags, su: su})
+		}
+	}
+
+	for _, r := range d.records {
+		r.su, r.areas = splitSystemUse(r.su, maxRecordSize-1-r.baseSize())
+	}
+
+	return nil
+}
+
+// layoutSize returns the size of the directory extent, given that records may not cross sector boundaries.
+func (d *directory) layoutSize() uint32 {
+	var off int64
+
+	for _, r := range d.records {
+		size := int64(r.length())
+
+		if off%SectorSize+size > SectorSize {
+			off = sectors(off) * SectorSize
+		}
+
+		off += size
+	}
+
+	return uint32(sectors(off) * SectorSize)
+}
+
+// encode builds the directory extent, given the location of the data area.
+func (d *directory) encode(base uint32) []byte {
+	buf := make([]byte, d.size)
+
+	var off int
+
+	for _, r := range d.records {
+		size := r.length()
+
+		if off%SectorSize+size > SectorSize {
+			off = int(sectors(int64(off)) * SectorSize)
+		}
+
+		var ext extent
+
+		if r.dir != nil {
+			ext = extent{lba: r.dir.lba, size: r.dir.size}
+		} else {
+			ext = r.node.extents(base)[r.part]
+		}
+
+		su := slices.Concat(r.su...)
+		if len(r.areas) > 0 {
+			su = append(su, suspCE(r.ce[0].block(), r.ce[0].offset(), r.ce[0].size)...)
+		}
+
+		encodeRecord(buf[off:off+size], r.ident, ext, r.flags, r.node.attr.ModTime, su)
+		off += size
+	}
+
+	return buf
+}
+
+func encodeRecord(buf []byte, ident []byte, ext extent, flags byte, t time.Time, su []byte) {
+	buf[0] = byte(len(buf))
+	putBoth32(buf[2:], ext.lba)
+	putBoth32(buf[10:], ext.size)
+	putRecordTime(buf[18:], t)
+	buf[25] = flags
+	putBoth16(buf[28:], 1)
+	buf[32] = byte(len(ident))
+	copy(buf[33:], ident)
+	copy(buf[33+len(ident)+1-len(ident)%2:], su)
+}
+
+// putRecordTime stores the seven byte timestamp used by directory records, clamped to the years it can represent.
+func putRecordTime(buf []byte, t time.Time) {
+	t = t.UTC()
+
+	year := min(max(t.Year(), 1900), 2155)
+
+	buf[0] = byte(year - 1900)
+	buf[1] = byte(t.Month())
+	buf[2] = byte(t.Day())
+	buf[3] = byte(t.Hour())
+	buf[4] = byte(t.Minute())
+	buf[5] = byte(t.Second())
+	buf[6] = 0
+}
+
+// putVolumeTime stores the seventeen byte timestamp used by volume descriptors. A zero time is left unspecified.
+func putVolumeTime(buf []byte, t time.Time) {
+	if t.IsZero() {
+		copy(buf, "0000000000000000")
+		buf[16] = 0
+
+		return
+	}
+
+	t = t.UTC()
+
+	copy(buf, fmt.Sprintf("%04d%02d%02d%02d%02d%02d%02d", min(t.Year(), 9999), t.Month(), t.Day(), t.Hour(),
+		t.Minute(), t.Second(), t.Nanosecond()/10000000))
+	buf[16] = 0
+}
+
+// Close writes the path tables, directories, file data, volume descriptors and boot catalog, completing the image.
+func (w *Writer) Close() error {
+	if w.closed {
+		return ErrClosed
+	}
+
+	w.closed = true
+
+	defer w.removeSpool()
+
+	boot, err := w.resolveBoot()
+	if err != nil {
+		return err
+	}
+
+	primary, err := w.buildHierarchy(false)
+	if err != nil {
+		return err
+	}
+
+	joliet, err := w.buildHierarchy(true)
+	if err != nil {
+		return err
+	}
+
+	hierarchies := []*hierarchy{primary, joliet}
+	lba := w.metaStart
+
+	for _, h := range hierarchies {
+		size := uint32(sectors(h.pathTableSize()))
+
+		h.pathL = lba
+		h.pathM = lba + size
+		lba += 2 * size
+	}
+
+	for _, h := range hierarchies {
+		for _, d := range h.placement(h.dirs[0], nil) {
+			d.lba = lba
+			d.size = d.layoutSize()
+			lba += d.size/SectorSize + d.placeContinuations(lba+d.size/SectorSize)
+		}
+
+		h.linkRelocated()
+	}
+
+	base := lba
+	total := base + uint32(w.spooled/SectorSize)
+
+	if w.opts.Hybrid != nil {
+		total += hybridTailSectors
+	}
+
+	if w.limit > 0 && int64(total)*SectorSize > w.limit {
+		return fmt.Errorf("%w: image of %v sectors exceeds %v bytes", ErrNoSpace, total, w.limit)
+	}
+
+	for _, h := range hierarchies {
+		size := sectors(h.pathTableSize()) * SectorSize
+
+		for i, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			table := h.pathTable(order)
+			table = append(table, make([]byte, size-int64(len(table)))...)
+
+			if err := w.writeAt(table, int64(h.pathL)*SectorSize+int64(i)*size); err != nil {
+				return err
+			}
+		}
+
+		for _, d := range h.dirs {
+			if err := w.writeAt(d.encode(base), int64(d.lba)*SectorSize); err != nil {
+				return err
+			}
+
+			if d.continuations > 0 {
+				if err := w.writeAt(d.encodeContinuations(), int64(d.lba)*SectorSize+int64(d.size)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if err := w.writeFileData(base, boot); err != nil {
+		return err
+	}
+
+	if err := w.writeDescriptors(primary, joliet, total, boot); err != nil {
+		return err
+	}
+
+	if w.opts.Hybrid != nil {
+		if err := w.writeHybrid(total, boot); err != nil {
+			return err
+		}
+	}
+
+	w.size = int64(total) * SectorSize
+
+	return nil
+}
+
+// writeFileData patches any boot information tables and copies the spooled file data into the data area at base.
+func (w *Writer) writeFileData(base uint32, boot []bootImage) error {
+	if w.spool == nil {
+		return nil
+	}
+
+	for i := range boot {
+		boot[i].lba = boot[i].node.extents(base)[0].lba
+
+		if !boot[i].BootInfoTable {
+			continue
+		}
+
+		data := make([]byte, boot[i].node.size)
+
+		if _, err := w.spool.ReadAt(data, boot[i].node.data); err != nil {
+			return fmt.Errorf("failed to read boot image: %w", err)
+		}
+
+		if err := patchBootInfo(data, boot[i].lba); err != nil {
+			return fmt.Errorf("%w: %v", err, boot[i].Path)
+		}
+
+		if _, err := w.spool.WriteAt(data, boot[i].node.data); err != nil {
+			return fmt.Errorf("failed to patch boot image: %w", err)
+		}
+	}
+
+	dst := io.NewOffsetWriter(w.dst, int64(base)*SectorSize)
+
+	if _, err := io.Copy(dst, io.NewSectionReader(w.spool, 0, w.spooled)); err != nil {
+		return fmt.Errorf("failed to write file data: %w", err)
+	}
+
+	return nil
+}
+
+func (w *Writer) removeSpool() {
+	if w.spool == nil {
+		return
+	}
+
+	_ = w.spool.Close()
+	_ = os.Remove(w.spool.Name())
+	w.spool = nil
+}
+
+// placeContinuations packs the continuation areas of the directory's records, each within a single sector, into the
+// sectors starting at lba, returning the number of sectors used. They directly follow the directory so that
+// sequential readers encounter them whilst processing it.
+func (d *directory) placeContinuations(lba uint32) uint32 {
+	var off int64
+
+	for _, r := range d.records {
+		for i, entries := range r.areas {
+			size := uint32(entriesSize(entries))
+			if i < len(r.areas)-1 {
+				size += ceEntrySize
+			}
+
+			if off%SectorSize+int64(size) > SectorSize {
+				off = sectors(off) * SectorSize
+			}
+
+			r.ce = append(r.ce, area{pos: int64(lba)*SectorSize + off, size: size})
+			off += int64(size)
+		}
+	}
+
+	d.continuations = uint32(sectors(off))
+
+	return d.continuations
+}
+
+func (d *directory) encodeContinuations() []byte {
+	buf := make([]byte, int64(d.continuations)*SectorSize)
+	start := int64(d.lba)*SectorSize + int64(d.size)
+
+	for _, r := range d.records {
+		for i, entries := range r.areas {
+			data := slices.Concat(entries...)
+
+			if i < len(r.areas)-1 {
+				next := r.ce[i+1]
+				data = append(data, suspCE(next.block(), next.offset(), next.size)...)
+			}
+
+			copy(buf[r.ce[i].pos-start:], data)
+		}
+	}
+
+	return buf
+}
+
+func (w *Writer) writeDescriptors(primary *hierarchy, joliet *hierarchy, total uint32, boot []bootImage) error {
+	// Clear the system area, which is left for hybrid boot records.
+	if err := w.writeAt(make([]byte, SystemAreaSectors*SectorSize), 0); err != nil {
+		return err
+	}
+
+	descriptors := [][]byte{w.volumeDescriptor(primary, total)}
+
+	if len(boot) > 0 {
+		descriptors = append(descriptors, w.bootRecord())
+	}
+
+	terminator := make([]byte, SectorSize)
+	terminator[0] = DescriptorTerminator
+	copy(terminator[1:], StandardID)
+	terminator[6] = descriptorVersion
+
+	descriptors = append(descriptors, w.volumeDescriptor(joliet, total), terminator)
+
+	if len(boot) > 0 {
+		catalog, err := bootCatalog(boot)
+		if err != nil {
+			return err
+		}
+
+		descriptors = append(descriptors, catalog)
+	}
+
+	return w.writeAt(slices.Concat(descriptors...), SystemAreaSectors*SectorSize)
+}
+
+// putString fills a descriptor field with text padded by spaces, encoded as UCS-2 for Joliet.
+func putString(buf []byte, s string, joliet bool) {
+	if !joliet {
+		copy(buf, bytes.Repeat([]byte{' '}, len(buf)))
+		copy(buf, strings.ToUpper(s))
+
+		return
+	}
+
+	for i := 0; i+1 < len(buf); i += 2 {
+		buf[i], buf[i+1] = 0, ' '
+	}
+
+	encoded := encodeUCS2(s)
+	copy(buf, encoded[:min(len(encoded), len(buf)&^1)])
+}
+
+func (w *Writer) volumeDescriptor(h *hierarchy, total uint32) []byte {
+	d := make([]byte, SectorSize)
+
+	d[0] = DescriptorPrimary
+	if h.joliet {
+		d[0] = DescriptorSupplementary
+	}
+
+	copy(d[1:], StandardID)
+	d[6] = descriptorVersion
+
+	volumeID := w.opts.VolumeID
+	if h.joliet {
+		volumeID = truncateUCS2(volumeID, 16)
+	}
+
+	putString(d[8:40], "", h.joliet)
+	putString(d[40:72], volumeID, h.joliet)
+	putBoth32(d[80:], total)
+
+	// Escape sequence selecting UCS-2 level 3.
+	if h.joliet {
+		copy(d[88:], "%/E")
+	}
+
+	putBoth16(d[120:], 1)
+	putBoth16(d[124:], 1)
+	putBoth16(d[128:], SectorSize)
+	putBoth32(d[132:], uint32(h.pathTableSize()))
+	binary.LittleEndian.PutUint32(d[140:], h.pathL)
+	binary.BigEndian.PutUint32(d[148:], h.pathM)
+
+	root := h.dirs[0]
+	encodeRecord(d[156:190], []byte{0}, extent{lba: root.lba, size: root.size}, FlagDirectory,
+		w.root.attr.ModTime, nil)
+
+	putString(d[190:318], "", h.joliet)
+	putString(d[318:446], w.opts.Publisher, h.joliet)
+	putString(d[446:574], "", h.joliet)
+	putString(d[574:702], w.opts.Application, h.joliet)
+	putString(d[702:739], "", h.joliet)
+	putString(d[739:776], "", h.joliet)
+	putString(d[776:813], "", h.joliet)
+	putVolumeTime(d[813:], w.opts.Time)
+	putVolumeTime(d[830:], w.opts.Time)
+	putVolumeTime(d[847:], time.Time{})
+	putVolumeTime(d[864:], w.opts.Time)
+	d[881] = 1
+
+	return d
+}
+
+// Size returns the size of the image in bytes, once closed.
+func (w *Writer) Size() int64 {
+	return w.size
+}
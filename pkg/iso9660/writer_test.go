@@ -0,0 +1,531 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/csnewman/go-appliance/pkg/internal/membuf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testRecord struct {
+	ident   string
+	lba     uint32
+	size    uint32
+	flags   byte
+	entries map[string][][]byte
+}
+
+// systemUse collects the SUSP entries of a directory record, following continuation areas.
+func systemUse(img []byte, su []byte, out map[string][][]byte) {
+	for len(su) >= 4 && su[2] >= 4 && int(su[2]) <= len(su) {
+		entry := su[:su[2]]
+		su = su[su[2]:]
+
+		if string(entry[:2]) == "CE" {
+			block := binary.LittleEndian.Uint32(entry[4:])
+			offset := binary.LittleEndian.Uint32(entry[12:])
+			length := binary.LittleEndian.Uint32(entry[20:])
+			start := int(block)*SectorSize + int(offset)
+
+			systemUse(img, img[start:start+int(length)], out)
+
+			continue
+		}
+
+		out[string(entry[:2])] = append(out[string(entry[:2])], entry)
+	}
+}
+
+func readDir(t *testing.T, img []byte, lba uint32, size uint32) []testRecord {
+	t.Helper()
+
+	var records []testRecord
+
+	data := img[int(lba)*SectorSize:][:size]
+
+	for off := 0; off < len(data); {
+		length := int(data[off])
+		if length == 0 {
+			off = (off/SectorSize + 1) * SectorSize
+
+			continue
+		}
+
+		rec := data[off : off+length]
+		identLen := int(rec[32])
+
+		r := testRecord{
+			ident:   string(rec[33 : 33+identLen]),
+			lba:     binary.LittleEndian.Uint32(rec[2:]),
+			size:    binary.LittleEndian.Uint32(rec[10:]),
+			flags:   rec[25],
+			entries: make(map[string][][]byte),
+		}
+
+		require.Equal(t, binary.BigEndian.Uint32(rec[6:]), r.lba, "lba should be both endian")
+		require.LessOrEqual(t, off%SectorSize+length, SectorSize, "records should not cross sectors")
+
+		systemUse(img, rec[33+identLen+1-identLen%2:], r.entries)
+		records = append(records, r)
+		off += length
+	}
+
+	return records
+}
+
+func (r *testRecord) name() string {
+	var name string
+
+	for _, nm := range r.entries["NM"] {
+		name += string(nm[5:])
+	}
+
+	return name
+}
+
+// symlinkTarget decodes SL entries in the same way as the Linux kernel.
+func symlinkTarget(entries [][]byte) string {
+	var out strings.Builder
+
+	for _, entry := range entries {
+		body := entry[5:]
+
+		for len(body) >= 2 {
+			flags, size := body[0], int(body[1])
+
+			switch {
+			case flags&rrRoot != 0:
+				out.WriteString("/")
+			case flags&rrCurrent != 0:
+				out.WriteString(".")
+			case flags&rrParent != 0:
+				out.WriteString("..")
+			default:
+				out.Write(body[2 : 2+size])
+			}
+
+			body = body[2+size:]
+
+			if flags&(rrContinue|rrRoot) == 0 && (len(body) >= 2 || entry[4]&rrContinue != 0) {
+				out.WriteString("/")
+			}
+		}
+	}
+
+	return out.String()
+}
+
+func findRecord(t *testing.T, records []testRecord, name string) testRecord {
+	t.Helper()
+
+	for _, r := range records {
+		if r.name() == name {
+			return r
+		}
+	}
+
+	require.Failf(t, "record not found", "%v should be present", name)
+
+	return testRecord{}
+}
+
+// Names exercising the identifier limits: the release notes share a prefix beyond the 64 characters kept by Joliet,
+// and the longest name allowed by Rock Ridge needs NM entries beyond a single directory record.
+var (
+	notesEnglish = "Release Notes for the Appliance Installer Media, Version 1.0 (English).txt"
+	notesFrench  = "Release Notes for the Appliance Installer Media, Version 1.0 (French).txt"
+	longestName  = strings.Repeat("n", MaxNameLen-3) + ".md"
+	linkTarget   = "/" + strings.Repeat("a/", 300) + "end"
+	// deepPath is nested beyond the eight levels of the primary hierarchy, so h and each directory below it are
+	// relocated.
+	deepPath = "a/b/c/d/e/f/g/h/i/j/k/l/m/n"
+)
+
+func buildImage(t *testing.T, opts Options) (*Writer, []byte) {
+	t.Helper()
+
+	img := &membuf.Buffer{}
+
+	opts.TempDir = t.TempDir()
+
+	w, err := NewWriter(img, 0, opts)
+	require.NoError(t, err, "writer should create")
+
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	require.NoError(t, w.WriteFile("isolinux/isolinux.cfg", strings.NewReader("default linux\n"), fsmeta.Attr{
+		Mode:    0o640,
+		UID:     1000,
+		GID:     100,
+		ModTime: mtime,
+	}), "file should write")
+	require.NoError(t, w.Link("isolinux/syslinux.cfg", "isolinux/isolinux.cfg"), "hard link should create")
+	require.NoError(t, w.Symlink("isolinux/default", "isolinux.cfg", fsmeta.Attr{Mode: 0o777}), "symlink should create")
+	require.NoError(t, w.Symlink("live/filesystem", linkTarget, fsmeta.Attr{Mode: 0o777}), "long symlink should create")
+	require.NoError(t, w.Mknod("dev/console", fsmeta.Attr{Mode: fs.ModeDevice | fs.ModeCharDevice | 0o600, Major: 5,
+		Minor: 1}), "char device should create")
+	require.NoError(t, w.WriteFile(".disk/base_installable", strings.NewReader(""), fsmeta.Attr{Mode: 0o444}),
+		"empty file should write")
+
+	for _, name := range []string{notesEnglish, notesFrench} {
+		require.NoError(t, w.WriteFile(name, strings.NewReader(name), fsmeta.Attr{Mode: 0o644}),
+			"long name should write")
+	}
+
+	require.NoError(t, w.WriteFile("docs/"+longestName, strings.NewReader("x"), fsmeta.Attr{Mode: 0o644}),
+		"longest name should write")
+	require.NoError(t, w.WriteFile(deepPath+"/file", strings.NewReader("deep\n"), fsmeta.Attr{Mode: 0o644}),
+		"deep file should write")
+
+	for i := range 200 {
+		require.NoError(t, w.WriteFile(fmt.Sprintf("pool/main/package-%03d_1.0_amd64.deb", i),
+			strings.NewReader(strings.Repeat("q", i)), fsmeta.Attr{Mode: 0o644}), "package should write")
+	}
+
+	require.NoError(t, w.Close(), "writer should close")
+
+	return w, img.Data
+}
+
+func TestWriter(t *testing.T) {
+	w, img := buildImage(t, Options{VolumeID: "Install Media", Time: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)})
+
+	assert.Equal(t, int64(len(img)), w.Size(), "size should match the image")
+
+	pvd := img[SystemAreaSectors*SectorSize:][:SectorSize]
+	svd := img[(SystemAreaSectors+1)*SectorSize:][:SectorSize]
+	term := img[(SystemAreaSectors+2)*SectorSize:][:SectorSize]
+
+	assert.Equal(t, byte(DescriptorPrimary), pvd[0], "primary descriptor should come first")
+	assert.Equal(t, StandardID, string(pvd[1:6]), "standard id should be set")
+	assert.Equal(t, "INSTALL MEDIA", strings.TrimRight(string(pvd[40:72]), " "), "volume id should be upper case")
+	assert.Equal(t, uint32(len(img)/SectorSize), binary.LittleEndian.Uint32(pvd[80:]), "volume size should match")
+	assert.Equal(t, "2024010203040500", string(pvd[813:829]), "creation time should be set")
+	assert.Equal(t, byte(DescriptorSupplementary), svd[0], "joliet descriptor should follow")
+	assert.Equal(t, "%/E", string(svd[88:91]), "joliet escape sequence should be set")
+	assert.Equal(t, encodeUCS2("Install Media"), svd[40:66], "joliet volume id should keep case")
+	assert.Equal(t, byte(DescriptorTerminator), term[0], "terminator should follow")
+
+	rootLBA := binary.LittleEndian.Uint32(pvd[158:])
+	rootSize := binary.LittleEndian.Uint32(pvd[166:])
+	root := readDir(t, img, rootLBA, rootSize)
+
+	require.GreaterOrEqual(t, len(root), 2, "root should have dot entries")
+	assert.Equal(t, "\x00", root[0].ident, "first entry should be dot")
+	assert.Equal(t, "\x01", root[1].ident, "second entry should be dotdot")
+	assert.Len(t, root[0].entries["SP"], 1, "root should mark SUSP")
+	require.Len(t, root[0].entries["ER"], 1, "root should identify rock ridge")
+	assert.Contains(t, string(root[0].entries["ER"][0]), rrExtensionID, "extension should be rock ridge")
+	assert.Equal(t, rootLBA, root[1].lba, "root parent should be itself")
+
+	for i := 3; i < len(root); i++ {
+		assert.Negative(t, comparePrimary(root[i-1].ident, root[i].ident), "records should be sorted")
+	}
+
+	// Primary identifiers are limited to 30 characters including the extension, so the release notes collide and gain
+	// a numeric tail.
+	english := findRecord(t, root, notesEnglish)
+	french := findRecord(t, root, notesFrench)
+	assert.Equal(t, "RELEASE_NOTES_FOR_THE_APPLI.TXT;1", english.ident, "primary name should be mangled")
+	assert.Equal(t, "RELEASE_NOTES_FOR_THE_APP_1.TXT;1", french.ident, "primary collision should gain a tail")
+	assert.Equal(t, notesEnglish, string(img[int(english.lba)*SectorSize:][:english.size]), "data should be stored")
+
+	empty := findRecord(t, readDir(t, img, findRecord(t, root, ".disk").lba, findRecord(t, root, ".disk").size),
+		"base_installable")
+	assert.Zero(t, empty.size, "empty file should have no data")
+
+	live := findRecord(t, root, "live")
+	filesystem := findRecord(t, readDir(t, img, live.lba, live.size), "filesystem")
+	assert.Greater(t, len(filesystem.entries["SL"]), 1, "long symlink should span entries")
+	assert.Equal(t, linkTarget, symlinkTarget(filesystem.entries["SL"]), "target should decode")
+
+	isolinuxRec := findRecord(t, root, "isolinux")
+	assert.Equal(t, byte(FlagDirectory), isolinuxRec.flags, "directory flag should be set")
+
+	isolinux := readDir(t, img, isolinuxRec.lba, isolinuxRec.size)
+	cfg := findRecord(t, isolinux, "isolinux.cfg")
+	syslinux := findRecord(t, isolinux, "syslinux.cfg")
+
+	px := cfg.entries["PX"][0]
+	assert.Equal(t, uint32(fsmeta.ModeRegular|0o640), binary.LittleEndian.Uint32(px[4:]), "mode should be set")
+	assert.Equal(t, uint32(2), binary.LittleEndian.Uint32(px[12:]), "links should be counted")
+	assert.Equal(t, uint32(1000), binary.LittleEndian.Uint32(px[20:]), "uid should be set")
+	assert.Equal(t, uint32(100), binary.LittleEndian.Uint32(px[28:]), "gid should be set")
+	assert.Equal(t, byte(121), cfg.entries["TF"][0][5], "mtime should be set")
+	assert.Equal(t, cfg.lba, syslinux.lba, "hard links should share data")
+	assert.Equal(t, "isolinux.cfg", symlinkTarget(findRecord(t, isolinux, "default").entries["SL"]),
+		"symlink should be set")
+
+	dev := readDir(t, img, findRecord(t, root, "dev").lba, findRecord(t, root, "dev").size)
+	pn := findRecord(t, dev, "console").entries["PN"][0]
+	assert.Equal(t, uint32(0x501), binary.LittleEndian.Uint32(pn[12:]), "device number should be encoded")
+
+	// The longest name is recorded in full through NM entries continued beyond the directory record.
+	docs := readDir(t, img, findRecord(t, root, "docs").lba, findRecord(t, root, "docs").size)
+	assert.Equal(t, longestName, docs[2].name(), "longest name should be continued")
+	assert.Greater(t, len(docs[2].entries["NM"]), 1, "longest name should span entries")
+
+	pool := findRecord(t, root, "pool")
+	main := findRecord(t, readDir(t, img, pool.lba, pool.size), "main")
+	assert.Greater(t, main.size, uint32(SectorSize), "large directory should span sectors")
+	assert.Len(t, readDir(t, img, main.lba, main.size), 202, "all entries should be listed")
+
+	pathL := binary.LittleEndian.Uint32(pvd[140:])
+	table := img[int(pathL)*SectorSize:]
+	assert.Equal(t, byte(1), table[0], "root path entry should have a single byte identifier")
+	assert.Equal(t, rootLBA, binary.LittleEndian.Uint32(table[2:]), "root path entry should locate the root")
+
+	// Joliet keeps the case of names, limited to 64 characters with the extension kept, so the release notes again
+	// collide.
+	jroot := readDir(t, img, binary.LittleEndian.Uint32(svd[158:]), binary.LittleEndian.Uint32(svd[166:]))
+
+	var jnames []string
+	for _, r := range jroot[2:] {
+		jnames = append(jnames, decodeUCS2([]byte(r.ident)))
+		assert.LessOrEqual(t, len(r.ident), 2*maxJolietName, "joliet names should be limited")
+		assert.Empty(t, r.entries, "joliet records should not carry rock ridge")
+	}
+
+	assert.Contains(t, jnames, notesEnglish[:60]+".txt", "joliet should truncate long names")
+	assert.Contains(t, jnames, notesFrench[:58]+"_1.txt", "joliet collision should gain a tail")
+}
+
+func TestWriterRelocation(t *testing.T) {
+	_, img := buildImage(t, Options{})
+
+	pvd := img[SystemAreaSectors*SectorSize:][:SectorSize]
+	root := readDir(t, img, binary.LittleEndian.Uint32(pvd[158:]), binary.LittleEndian.Uint32(pvd[166:]))
+
+	// Follow the deep path through the primary hierarchy, stepping into rr_moved at each placeholder.
+	moved := findRecord(t, root, relocatedDir)
+	movedDir := readDir(t, img, moved.lba, moved.size)
+	dir := root
+	depth := 1
+
+	var parentLBA uint32
+
+	for _, name := range strings.Split(deepPath, "/") {
+		rec := findRecord(t, dir, name)
+		parentLBA = dir[0].lba
+
+		if cl := rec.entries["CL"]; cl != nil {
+			assert.Zero(t, rec.flags&FlagDirectory, "placeholder %v should be a file", name)
+
+			target := findRecord(t, movedDir, name)
+			assert.Len(t, target.entries["RE"], 1, "relocated %v should be marked", name)
+			assert.Equal(t, target.lba, binary.LittleEndian.Uint32(cl[0][4:]), "placeholder %v should link", name)
+
+			rec = target
+			depth = 2
+		}
+
+		require.Equal(t, byte(FlagDirectory), rec.flags, "%v should be a directory", name)
+
+		dir = readDir(t, img, rec.lba, rec.size)
+		depth++
+
+		assert.LessOrEqual(t, depth, maxDepth, "%v should be within the primary depth limit", name)
+
+		if pl := dir[1].entries["PL"]; pl != nil {
+			assert.Equal(t, moved.lba, dir[1].lba, "relocated %v should be a child of rr_moved", name)
+			assert.Equal(t, parentLBA, binary.LittleEndian.Uint32(pl[0][4:]), "%v should link its parent", name)
+		}
+	}
+
+	assert.Len(t, movedDir, 2+7, "h to n should be relocated")
+	assert.Equal(t, "deep\n", string(img[int(findRecord(t, dir, "file").lba)*SectorSize:][:5]), "file should be kept")
+
+	// Joliet has no Rock Ridge to describe relocations, so the deep path is kept as is.
+	svd := img[(SystemAreaSectors+1)*SectorSize:][:SectorSize]
+	jdir := readDir(t, img, binary.LittleEndian.Uint32(svd[158:]), binary.LittleEndian.Uint32(svd[166:]))
+
+	for _, name := range strings.Split(deepPath, "/") {
+		var found bool
+
+		for _, r := range jdir[2:] {
+			if decodeUCS2([]byte(r.ident)) == name {
+				jdir = readDir(t, img, r.lba, r.size)
+				found = true
+			}
+		}
+
+		require.True(t, found, "joliet should keep %v in place", name)
+	}
+}
+
+// TestWriterMultiExtent checks the records of a file larger than a single extent. Spooling over 4GiB is too slow for
+// a unit test, so a small file is grown in place before the image is closed.
+func TestWriterMultiExtent(t *testing.T) {
+	img := &membuf.Buffer{}
+
+	w, err := NewWriter(img, 0, Options{TempDir: t.TempDir()})
+	require.NoError(t, err, "writer should create")
+
+	require.NoError(t, w.WriteFile("disk.img", strings.NewReader("head"), fsmeta.Attr{Mode: 0o644}),
+		"file should write")
+
+	n := w.root.children["disk.img"]
+	n.size = 2*MaxExtentSize + 5
+	w.spooled = sectors(n.size) * SectorSize
+
+	require.NoError(t, w.Close(), "writer should close")
+
+	pvd := img.Data[SystemAreaSectors*SectorSize:][:SectorSize]
+	root := readDir(t, img.Data, binary.LittleEndian.Uint32(pvd[158:]), binary.LittleEndian.Uint32(pvd[166:]))
+	require.Len(t, root, 2+3, "file should have a record per extent")
+
+	for i, rec := range root[2:] {
+		assert.Equal(t, "DISK.IMG;1", rec.ident, "extents should share the identifier")
+
+		if i < 2 {
+			assert.Equal(t, byte(FlagMultiExtent), rec.flags, "extent %v should be continued", i)
+			assert.Equal(t, uint32(MaxExtentSize), rec.size, "extent %v should be full", i)
+			assert.Equal(t, rec.lba+MaxExtentSize/SectorSize, root[2+i+1].lba, "extent %v should be contiguous", i)
+		} else {
+			assert.Zero(t, rec.flags, "last extent should end the file")
+			assert.Equal(t, uint32(5), rec.size, "last extent should hold the remainder")
+		}
+	}
+
+	fsys, err := Open(bytes.NewReader(img.Data))
+	require.NoError(t, err, "image should open")
+
+	info, err := fsys.Stat("disk.img")
+	require.NoError(t, err, "file should stat")
+	assert.Equal(t, n.size, info.Size(), "extents should be merged")
+}
+
+func TestWriterDeterministic(t *testing.T) {
+	_, first := buildImage(t, Options{})
+	_, second := buildImage(t, Options{})
+
+	assert.Equal(t, first, second, "images should be identical")
+}
+
+func TestNames(t *testing.T) {
+	used := make(map[string]bool)
+
+	for name, expected := range map[string]string{
+		"readme":         "README.;1",
+		"vmlinuz-6.1.0":  "VMLINUZ_6_1.0;1",
+		"initrd.img":     "INITRD.IMG;1",
+		".config":        "_CONFIG.;1",
+		"archive.tar.gz": "ARCHIVE_TAR.GZ;1",
+		"a-very-long-file-name-exceeding-limits.txt": "A_VERY_LONG_FILE_NAME_EXCEE.TXT;1",
+	} {
+		ident, err := primaryName(name, false, used)
+		require.NoError(t, err, "name should convert")
+		assert.Equal(t, expected, ident, "primary name for %q should match", name)
+	}
+
+	ident, err := primaryName("EFI", true, used)
+	require.NoError(t, err, "directory name should convert")
+	assert.Equal(t, "EFI", ident, "directory should have no version")
+
+	used = map[string]bool{"README.TXT;1": true, "README_1.TXT;1": true}
+	ident, err = primaryName("readme.txt", false, used)
+	require.NoError(t, err, "name should convert")
+	assert.Equal(t, "README_2.TXT;1", ident, "collisions should gain a numeric tail")
+
+	long := strings.Repeat("é", 70) + ".txt"
+	ident, err = jolietName(long, map[string]bool{})
+	require.NoError(t, err, "joliet name should convert")
+	assert.Equal(t, strings.Repeat("é", 60)+".txt", ident, "joliet name should keep the extension")
+
+	ident, err = jolietName("a:b", map[string]bool{"a_b": true})
+	require.NoError(t, err, "joliet name should convert")
+	assert.Equal(t, "a_b_1", ident, "joliet collisions should gain a numeric tail")
+
+	assert.Negative(t, comparePrimary("A.B;1", "A.B1;1"), "shorter extension should sort first")
+	assert.Negative(t, comparePrimary("A.Z;1", "AB.A;1"), "name should be compared before extension")
+}
+
+func TestRockRidgeSymlink(t *testing.T) {
+	for _, target := range []string{
+		"../lib/x",
+		"/",
+		"./a//b/",
+		"/" + strings.Repeat("x/", 500) + "y",
+		strings.Repeat("z", 255) + "/" + strings.Repeat("w", 255),
+		strings.Repeat("ab/", 83) + strings.Repeat("c", 200),
+	} {
+		entries := rrSL(target)
+
+		for _, entry := range entries {
+			assert.LessOrEqual(t, len(entry), maxEntrySize, "entries should fit")
+		}
+
+		expected := strings.TrimSuffix(strings.ReplaceAll(target, "//", "/"), "/")
+		if target == "/" {
+			expected = "/"
+		}
+
+		assert.Equal(t, expected, symlinkTarget(entries), "target %.20q should round trip", target)
+	}
+}
+
+func TestExtents(t *testing.T) {
+	n := &node{data: 4 * SectorSize, size: 2*MaxExtentSize + 5}
+
+	extents := n.extents(100)
+	require.Len(t, extents, 3, "large file should be split")
+	assert.Equal(t, extent{lba: 104, size: MaxExtentSize}, extents[0], "first extent should be full")
+	assert.Equal(t, uint32(104+2*MaxExtentSize/SectorSize), extents[2].lba, "extents should be contiguous")
+	assert.Equal(t, uint32(5), extents[2].size, "last extent should hold the remainder")
+	assert.Equal(t, []extent{{}}, (&node{}).extents(100), "empty file should have an empty extent")
+}
+
+func TestWriterAddFS(t *testing.T) {
+	w, err := NewWriter(&membuf.Buffer{}, 0, Options{TempDir: t.TempDir()})
+	require.NoError(t, err, "writer should create")
+
+	require.NoError(t, w.AddFS(fstest.MapFS{
+		"bin/busybox": {Data: []byte("tool"), Mode: 0o755, Sys: &fsmeta.Attr{Mode: 0o755, Inode: 5}},
+		"bin/sh":      {Data: []byte("tool"), Mode: 0o755, Sys: &fsmeta.Attr{Mode: 0o755, Inode: 5}},
+		"etc/motd":    {Data: []byte("hello\n"), Mode: 0o644},
+	}), "fs should add")
+
+	bin := w.root.children["bin"]
+	assert.Same(t, bin.children["busybox"], bin.children["sh"], "files sharing an inode should be linked")
+	require.NoError(t, w.Close(), "writer should close")
+}
+
+func TestWriterErrors(t *testing.T) {
+	_, err := NewWriter(&membuf.Buffer{}, 0, Options{VolumeID: strings.Repeat("x", 33)})
+	assert.ErrorIs(t, err, ErrInvalidName, "long volume id should be rejected")
+
+	_, err = NewWriter(&membuf.Buffer{}, 0, Options{Boot: []BootEntry{{Platform: 0x02, Path: "x"}}})
+	assert.ErrorIs(t, err, ErrInvalidBoot, "unknown platform should be rejected")
+
+	w, err := NewWriter(&membuf.Buffer{}, 0, Options{TempDir: t.TempDir()})
+	require.NoError(t, err, "writer should create")
+
+	require.NoError(t, w.WriteFile("file", strings.NewReader("x"), fsmeta.Attr{Mode: 0o644}), "file should write")
+	assert.ErrorIs(t, w.WriteFile("file", strings.NewReader(""), fsmeta.Attr{}), ErrExist, "duplicate should be rejected")
+	assert.ErrorIs(t, w.WriteFile("file/x", strings.NewReader(""), fsmeta.Attr{}), ErrNotDir,
+		"file parent should be rejected")
+	require.NoError(t, w.Mkdir("dir", fsmeta.Attr{}), "dir should create")
+	assert.ErrorIs(t, w.Link("dir2", "dir"), ErrUnsupportedType, "directory hard link should be rejected")
+	assert.ErrorIs(t, w.Mknod("reg", fsmeta.Attr{Mode: 0o644}), ErrUnsupportedType, "regular mknod should be rejected")
+	assert.ErrorIs(t, w.Symlink("link", strings.Repeat("x", 5000), fsmeta.Attr{}), ErrInvalidName,
+		"long symlink should be rejected")
+	require.NoError(t, w.Close(), "writer should close")
+	assert.ErrorIs(t, w.Close(), ErrClosed, "second close should fail")
+	assert.ErrorIs(t, w.Mkdir("late", fsmeta.Attr{}), ErrClosed, "closed writer should reject changes")
+
+	small, err := NewWriter(&membuf.Buffer{}, 64*SectorSize, Options{TempDir: t.TempDir()})
+	require.NoError(t, err, "writer should create")
+
+	err = small.WriteFile("big", bytes.NewReader(make([]byte, 64*SectorSize)), fsmeta.Attr{Mode: 0o644})
+	assert.ErrorIs(t, err, ErrNoSpace, "oversized image should be rejected")
+	require.NoError(t, small.Close(), "writer should close")
+}
@@ -0,0 +1,235 @@
+package oci
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+
+	"github.com/csnewman/go-appliance/pkg/compress"
+	"github.com/csnewman/go-appliance/pkg/fstree"
+)
+
+// ArchiveImage is an entry of the manifest.json of an archive written by docker save. Paths are relative to the
+// root of the archive.
+type ArchiveImage struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// Archive is an archive written by docker save, holding images as an ordered list of layer tarballs. Archives which
+// also hold an OCI image layout, as written when Docker uses the containerd image store, are read through it.
+type Archive struct {
+	tree     *fstree.Tree
+	layout   *Layout
+	layers   map[string]string
+	Manifest []ArchiveImage
+}
+
+// OpenArchiveFile opens a docker save archive stored on the host.
+func OpenArchiveFile(path string, opts fstree.Options) (*Archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return OpenArchive(f, opts)
+}
+
+// OpenArchive reads a docker save archive or a tarred OCI image layout, which may be gzip compressed. The contents
+// of the archive are spooled until it is closed.
+func OpenArchive(r io.Reader, opts fstree.Options) (*Archive, error) {
+	tree, err := fstree.OpenTar(r, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Archive{tree: tree, layers: make(map[string]string)}
+
+	if _, err := tree.Stat("oci-layout"); err == nil {
+		if a.layout, err = OpenLayout(tree); err != nil {
+			_ = tree.Close()
+
+			return nil, err
+		}
+	}
+
+	data, err := a.readFile("manifest.json")
+	if errors.Is(err, fs.ErrNotExist) && a.layout != nil {
+		return a, nil
+	}
+
+	if err == nil {
+		err = json.Unmarshal(data, &a.Manifest)
+	}
+
+	if err != nil {
+		_ = tree.Close()
+
+		return nil, fmt.Errorf("%w: manifest.json: %w", ErrInvalidArchive, err)
+	}
+
+	return a, nil
+}
+
+// Close removes the spooled contents of the archive.
+func (a *Archive) Close() error {
+	return a.tree.Close()
+}
+
+func (a *Archive) readFile(name string) ([]byte, error) {
+	f, err := a.tree.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return io.ReadAll(io.LimitReader(f, maxJSONSize))
+}
+
+// Image selects an image, checking that its configuration matches the platform.
+func (a *Archive) Image(opts ImageOptions) (*Image, error) {
+	if a.layout != nil {
+		return a.layout.Image(opts)
+	}
+
+	if opts.Platform == (Platform{}) {
+		opts.Platform = DefaultPlatform()
+	}
+
+	for _, entry := range a.Manifest {
+		if opts.Ref != "" && !slices.Contains(entry.RepoTags, opts.Ref) {
+			continue
+		}
+
+		img, err := a.image(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		if img.Config.OS == "" || opts.Platform.Matches(img.Config.Platform) {
+			return img, nil
+		}
+	}
+
+	if opts.Ref != "" {
+		return nil, fmt.Errorf("%w: no image %q for %v", ErrNotFound, opts.Ref, opts.Platform)
+	}
+
+	return nil, fmt.Errorf("%w: no image for %v", ErrNotFound, opts.Platform)
+}
+
+// image describes an archive entry as a manifest. Layers are identified by the uncompressed digests listed in the
+// config.
+func (a *Archive) image(entry ArchiveImage) (*Image, error) {
+	data, err := a.readFile(entry.Config)
+	if err != nil {
+		return nil, fmt.Errorf("%w: config: %w", ErrInvalidArchive, err)
+	}
+
+	sum := sha256.Sum256(data)
+
+	img := &Image{
+		blobs: a,
+		Manifest: Manifest{
+			SchemaVersion: 2,
+			MediaType:     MediaTypeDockerManifest,
+			Config: Descriptor{
+				MediaType: MediaTypeDockerConfig,
+				Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+				Size:      int64(len(data)),
+			},
+		},
+	}
+
+	if err := json.Unmarshal(data, &img.Config); err != nil {
+		return nil, fmt.Errorf("%w: %v: %w", ErrInvalidArchive, entry.Config, err)
+	}
+
+	if len(img.Config.RootFS.DiffIDs) != len(entry.Layers) {
+		return nil, fmt.Errorf("%w: %v lists %v layers, config has %v", ErrInvalidArchive, entry.Config,
+			len(entry.Layers), len(img.Config.RootFS.DiffIDs))
+	}
+
+	for i, name := range entry.Layers {
+		digest := img.Config.RootFS.DiffIDs[i]
+
+		if _, _, err := blobPath(digest); err != nil {
+			return nil, err
+		}
+
+		info, err := a.tree.Stat(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: layer: %w", ErrInvalidArchive, err)
+		}
+
+		a.layers[digest] = name
+
+		img.Manifest.Layers = append(img.Manifest.Layers, Descriptor{
+			MediaType: MediaTypeDockerLayerTar,
+			Digest:    digest,
+			Size:      info.Size(),
+		})
+	}
+
+	return img, nil
+}
+
+// Open opens a layer of an image returned by Image, verifying its digest as it is read. Compressed layers are
+// decompressed, as their digest is that of the uncompressed tar.
+func (a *Archive) Open(desc Descriptor) (io.ReadCloser, error) {
+	name, ok := a.layers[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("%w: no layer %v", ErrInvalidArchive, desc.Digest)
+	}
+
+	_, h, err := blobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := a.tree.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open layer: %w", err)
+	}
+
+	br := bufio.NewReader(f)
+	if !compress.IsGzip(br) {
+		return &blob{Reader: &verifier{r: br, h: h, desc: desc}, Closer: f}, nil
+	}
+
+	gr, err := compress.Gzip{}.NewReader(br)
+	if err != nil {
+		_ = f.Close()
+
+		return nil, fmt.Errorf("%w: layer: %w", ErrInvalidArchive, err)
+	}
+
+	// The size of the uncompressed layer is not known.
+	desc.Size = -1
+
+	return &blob{Reader: &verifier{r: gr, h: h, desc: desc}, Closer: closers{gr, f}}, nil
+}
+
+// closers closes each of its members in order, returning any errors.
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var errs []error
+
+	for _, closer := range c {
+		errs = append(errs, closer.Close())
+	}
+
+	return errors.Join(errs...)
+}
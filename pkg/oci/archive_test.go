@@ -0,0 +1,311 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/csnewman/go-appliance/pkg/fstree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// saveArchive builds an archive in the format written by docker save, with layers stored either in legacy layer
+// directories or as blobs.
+func saveArchive(t *testing.T, blobs bool, layers [][]byte, diffIDs []string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	tw := tar.NewWriter(&buf)
+
+	add := func(name string, data []byte) {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0o644,
+			Size:     int64(len(data)),
+		}), "header should write")
+
+		_, err := tw.Write(data)
+		require.NoError(t, err, "data should write")
+	}
+
+	var config Config
+
+	config.Platform = Platform{OS: "linux", Architecture: "arm64"}
+	config.Config.Cmd = []string{"/bin/sh"}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = diffIDs
+
+	configData, err := json.Marshal(config)
+	require.NoError(t, err, "config should encode")
+
+	configSum := sha256.Sum256(configData)
+	entry := ArchiveImage{
+		Config:   hex.EncodeToString(configSum[:]) + ".json",
+		RepoTags: []string{"app:latest"},
+	}
+
+	if blobs {
+		entry.Config = "blobs/sha256/" + hex.EncodeToString(configSum[:])
+	}
+
+	add(entry.Config, configData)
+
+	for _, data := range layers {
+		sum := sha256.Sum256(data)
+		name := hex.EncodeToString(sum[:]) + "/layer.tar"
+
+		if blobs {
+			name = "blobs/sha256/" + hex.EncodeToString(sum[:])
+		}
+
+		add(name, data)
+
+		entry.Layers = append(entry.Layers, name)
+	}
+
+	manifest, err := json.Marshal([]ArchiveImage{entry})
+	require.NoError(t, err, "manifest should encode")
+
+	add("manifest.json", manifest)
+	add("repositories", []byte(`{"app":{"latest":"`+hex.EncodeToString(configSum[:])+`"}}`))
+
+	require.NoError(t, tw.Close(), "archive should close")
+
+	return buf.Bytes()
+}
+
+func testLayers(t *testing.T) ([][]byte, []string) {
+	var (
+		layers  [][]byte
+		diffIDs []string
+	)
+
+	for _, data := range baseLayers(t) {
+		// Layers are stored uncompressed by docker save.
+		if gr, err := gzip.NewReader(bytes.NewReader(data)); err == nil {
+			var buf bytes.Buffer
+
+			_, err := buf.ReadFrom(gr)
+			require.NoError(t, err, "layer should decompress")
+
+			data = buf.Bytes()
+		}
+
+		sum := sha256.Sum256(data)
+
+		layers = append(layers, data)
+		diffIDs = append(diffIDs, "sha256:"+hex.EncodeToString(sum[:]))
+	}
+
+	return layers, diffIDs
+}
+
+func TestArchive(t *testing.T) {
+	layers, diffIDs := testLayers(t)
+
+	for _, blobs := range []bool{false, true} {
+		checkArchive(t, saveArchive(t, blobs, layers, diffIDs))
+
+		// The containerd image store saves layers as pulled, so the first layer is stored gzip compressed.
+		checkArchive(t, saveArchive(t, blobs, baseLayers(t), diffIDs))
+	}
+}
+
+func checkArchive(t *testing.T, data []byte) {
+	t.Helper()
+
+	var gz bytes.Buffer
+
+	gw := gzip.NewWriter(&gz)
+	_, err := gw.Write(data)
+	require.NoError(t, err, "archive should compress")
+	require.NoError(t, gw.Close(), "gzip should close")
+
+	for _, archive := range [][]byte{data, gz.Bytes()} {
+		a, err := OpenArchive(bytes.NewReader(archive), fstree.Options{TempDir: t.TempDir()})
+		require.NoError(t, err, "archive should open")
+
+		img, err := a.Image(ImageOptions{Ref: "app:latest", Platform: Platform{OS: "linux", Architecture: "arm64"}})
+		require.NoError(t, err, "image should resolve")
+		assert.Equal(t, []string{"/bin/sh"}, img.Config.Config.Cmd, "config should be read")
+		assert.Len(t, img.Manifest.Layers, 2, "layers should be listed")
+
+		tree, err := img.Flatten(fstree.Options{TempDir: t.TempDir()})
+		require.NoError(t, err, "image should flatten")
+
+		var names []string
+
+		require.NoError(t, fs.WalkDir(tree, ".", func(name string, d fs.DirEntry, err error) error {
+			names = append(names, name)
+
+			return err
+		}), "tree should walk")
+
+		assert.Equal(t, []string{
+			".", "dev", "dev/null", "etc", "etc/gshadow", "etc/shadow", "home", "home/user",
+			"home/user/.profile", "var", "var/cache",
+		}, names, "layers should be merged with whiteouts applied")
+
+		shadow, err := tree.Stat("etc/shadow")
+		require.NoError(t, err, "file should stat")
+
+		gshadow, err := tree.Stat("etc/gshadow")
+		require.NoError(t, err, "hard link should stat")
+		assert.Equal(t, shadow.Sys().(*fsmeta.Attr).Inode, gshadow.Sys().(*fsmeta.Attr).Inode,
+			"hard link to a lower layer should be kept")
+
+		profile, err := tree.Stat("home/user/.profile")
+		require.NoError(t, err, "file should stat")
+		assert.Equal(t, uint32(1000), profile.Sys().(*fsmeta.Attr).UID, "ownership should be kept")
+
+		require.NoError(t, tree.Close(), "tree should close")
+
+		_, err = a.Image(ImageOptions{Platform: Platform{OS: "linux", Architecture: "amd64"}})
+		assert.ErrorIs(t, err, ErrNotFound, "other platform should not match")
+
+		_, err = a.Image(ImageOptions{Ref: "app:old", Platform: Platform{OS: "linux", Architecture: "arm64"}})
+		assert.ErrorIs(t, err, ErrNotFound, "missing tag should not match")
+
+		require.NoError(t, a.Close(), "archive should close")
+	}
+}
+
+// containerdArchive builds an archive in the format written by docker save with the containerd image store, where
+// layers are stored as blobs, including compressed ones, alongside an OCI image layout. The layout is removed when
+// not wanted, leaving only manifest.json.
+func containerdArchive(t *testing.T, layout bool) []byte {
+	t.Helper()
+
+	l := newTestLayout(t)
+	_, diffIDs := testLayers(t)
+
+	var (
+		config Config
+		layers []Descriptor
+		paths  []string
+	)
+
+	for i, data := range baseLayers(t) {
+		mediaType := MediaTypeLayer
+		if i == 0 {
+			mediaType = MediaTypeLayerGzip
+		}
+
+		desc := l.blob(mediaType, data)
+
+		layers = append(layers, desc)
+		paths = append(paths, "blobs/sha256/"+strings.TrimPrefix(desc.Digest, "sha256:"))
+	}
+
+	config.Platform = Platform{OS: "linux", Architecture: "arm64"}
+	config.Config.Cmd = []string{"/bin/sh"}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = diffIDs
+
+	configDesc := l.json(MediaTypeConfig, config)
+	manifest := l.json(MediaTypeManifest, Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        configDesc,
+		Layers:        layers,
+	})
+	manifest.Annotations = map[string]string{
+		AnnotationImageName: "docker.io/library/app:latest",
+		AnnotationRefName:   "latest",
+	}
+
+	l.index(Index{SchemaVersion: 2, Manifests: []Descriptor{manifest}})
+
+	if !layout {
+		require.NoError(t, os.Remove(filepath.Join(l.dir, "oci-layout")), "marker should remove")
+		require.NoError(t, os.Remove(filepath.Join(l.dir, "index.json")), "index should remove")
+	}
+
+	data, err := json.Marshal([]ArchiveImage{{
+		Config:   "blobs/sha256/" + strings.TrimPrefix(configDesc.Digest, "sha256:"),
+		RepoTags: []string{"app:latest"},
+		Layers:   paths,
+	}})
+	require.NoError(t, err, "manifest should encode")
+	require.NoError(t, os.WriteFile(filepath.Join(l.dir, "manifest.json"), data, 0o644), "manifest should write")
+
+	tree := fstree.New(fstree.Options{TempDir: t.TempDir()})
+	defer tree.Close()
+
+	require.NoError(t, tree.AddFS(os.DirFS(l.dir), fstree.MergeOptions{}), "layout should add")
+
+	var buf bytes.Buffer
+
+	require.NoError(t, tree.WriteTar(&buf), "archive should write")
+
+	return buf.Bytes()
+}
+
+func TestArchiveCompressedLayers(t *testing.T) {
+	for _, layout := range []bool{true, false} {
+		a, err := OpenArchive(bytes.NewReader(containerdArchive(t, layout)), fstree.Options{TempDir: t.TempDir()})
+		require.NoError(t, err, "archive should open")
+
+		img, err := a.Image(ImageOptions{Ref: "app:latest", Platform: Platform{OS: "linux", Architecture: "arm64"}})
+		require.NoError(t, err, "image should resolve")
+		assert.Equal(t, []string{"/bin/sh"}, img.Config.Config.Cmd, "config should be read")
+
+		if layout {
+			assert.Equal(t, MediaTypeLayerGzip, img.Manifest.Layers[0].MediaType, "layout manifest should be used")
+		}
+
+		tree, err := img.Flatten(fstree.Options{TempDir: t.TempDir()})
+		require.NoError(t, err, "image should flatten")
+
+		data, err := fs.ReadFile(tree, "home/user/.profile")
+		require.NoError(t, err, "file should read")
+		assert.Equal(t, "home/user/.profile", string(data), "file should come from the layers")
+
+		_, err = tree.Stat("etc/hostname")
+		assert.ErrorIs(t, err, fs.ErrNotExist, "whiteout should be applied")
+
+		require.NoError(t, tree.Close(), "tree should close")
+		require.NoError(t, a.Close(), "archive should close")
+	}
+}
+
+func TestArchiveInvalid(t *testing.T) {
+	layers, diffIDs := testLayers(t)
+
+	_, err := OpenArchive(bytes.NewReader(layers[0]), fstree.Options{TempDir: t.TempDir()})
+	assert.ErrorIs(t, err, ErrInvalidArchive, "archive without a manifest should fail")
+
+	// The layers are listed in the wrong order.
+	a, err := OpenArchive(bytes.NewReader(saveArchive(t, false, layers, []string{diffIDs[1], diffIDs[0]})),
+		fstree.Options{TempDir: t.TempDir()})
+	require.NoError(t, err, "archive should open")
+
+	defer a.Close()
+
+	img, err := a.Image(ImageOptions{Platform: Platform{OS: "linux", Architecture: "arm64"}})
+	require.NoError(t, err, "image should resolve")
+
+	_, err = img.Flatten(fstree.Options{TempDir: t.TempDir()})
+	assert.ErrorIs(t, err, ErrDigestMismatch, "layers should be verified")
+
+	b, err := OpenArchive(bytes.NewReader(saveArchive(t, false, layers, diffIDs[:1])),
+		fstree.Options{TempDir: t.TempDir()})
+	require.NoError(t, err, "archive should open")
+
+	defer b.Close()
+
+	_, err = b.Image(ImageOptions{Platform: Platform{OS: "linux", Architecture: "arm64"}})
+	assert.ErrorIs(t, err, ErrInvalidArchive, "layer count should be checked")
+}
@@ -0,0 +1,362 @@
+package oci
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/csnewman/go-appliance/pkg/fstree"
+)
+
+// maxJSONSize bounds the manifests, indexes and configs read into memory.
+const maxJSONSize = 4 << 20
+
+var layerTypes = map[string]bool{
+	MediaTypeLayer:          true,
+	MediaTypeLayerGzip:      true,
+	MediaTypeDockerLayer:    true,
+	MediaTypeDockerLayerTar: true,
+}
+
+// blobStore is implemented by the sources of images.
+type blobStore interface {
+	Open(desc Descriptor) (io.ReadCloser, error)
+}
+
+// Layout is an OCI image layout, holding blobs addressed by digest and an index of the images they form.
+type Layout struct {
+	fsys  fs.FS
+	Index Index
+}
+
+// OpenLayoutDir opens the image layout in a host directory.
+func OpenLayoutDir(dir string) (*Layout, error) {
+	return OpenLayout(os.DirFS(dir))
+}
+
+// OpenLayout opens an image layout, reading its index. Blobs are read from fsys when used.
+func OpenLayout(fsys fs.FS) (*Layout, error) {
+	var marker struct {
+		Version string `json:"imageLayoutVersion"`
+	}
+
+	if err := readJSON(fsys, "oci-layout", &marker); err != nil {
+		return nil, err
+	}
+
+	if marker.Version != LayoutVersion {
+		return nil, fmt.Errorf("%w: unsupported version %q", ErrInvalidLayout, marker.Version)
+	}
+
+	l := &Layout{fsys: fsys}
+
+	if err := readJSON(fsys, "index.json", &l.Index); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func readJSON(fsys fs.FS, name string, v any) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidLayout, err)
+	}
+
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxJSONSize))
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %w", name, err)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %v: %w", ErrInvalidLayout, name, err)
+	}
+
+	return nil
+}
+
+// blobPath returns the path of a blob within the layout, rejecting digests which are not valid sha256 or sha512
+// hashes.
+func blobPath(digest string) (string, hash.Hash, error) {
+	alg, sum, _ := strings.Cut(digest, ":")
+
+	var h hash.Hash
+
+	switch alg {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return "", nil, fmt.Errorf("%w: %q", ErrInvalidDigest, digest)
+	}
+
+	if len(sum) != h.Size()*2 || strings.ToLower(sum) != sum {
+		return "", nil, fmt.Errorf("%w: %q", ErrInvalidDigest, digest)
+	}
+
+	if _, err := hex.DecodeString(sum); err != nil {
+		return "", nil, fmt.Errorf("%w: %q", ErrInvalidDigest, digest)
+	}
+
+	return "blobs/" + alg + "/" + sum, h, nil
+}
+
+// verifier checks the size and digest of a blob once it has been read to the end. The size is not checked when
+// negative.
+type verifier struct {
+	r    io.Reader
+	h    hash.Hash
+	desc Descriptor
+	read int64
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.read += int64(n)
+	v.h.Write(p[:n])
+
+	if v.desc.Size >= 0 && v.read > v.desc.Size {
+		return n, fmt.Errorf("%w: %v is larger than %v bytes", ErrDigestMismatch, v.desc.Digest, v.desc.Size)
+	}
+
+	if errors.Is(err, io.EOF) {
+		if v.desc.Size >= 0 && v.read != v.desc.Size {
+			return n, fmt.Errorf("%w: %v is %v bytes, expected %v", ErrDigestMismatch, v.desc.Digest, v.read,
+				v.desc.Size)
+		}
+
+		_, sum, _ := strings.Cut(v.desc.Digest, ":")
+		if hex.EncodeToString(v.h.Sum(nil)) != sum {
+			return n, fmt.Errorf("%w: %v", ErrDigestMismatch, v.desc.Digest)
+		}
+	}
+
+	return n, err
+}
+
+type blob struct {
+	io.Reader
+	io.Closer
+}
+
+// Open opens a blob, verifying its size and digest as it is read. Reads fail with ErrDigestMismatch at the end of
+// the blob when it does not match.
+func (l *Layout) Open(desc Descriptor) (io.ReadCloser, error) {
+	name, h, err := blobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := l.fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob: %w", err)
+	}
+
+	return &blob{Reader: &verifier{r: f, h: h, desc: desc}, Closer: f}, nil
+}
+
+// ReadBlob reads a blob into memory, along with verifying it. Only blobs of up to 4 MiB, such as manifests, can be
+// read.
+func (l *Layout) ReadBlob(desc Descriptor) ([]byte, error) {
+	if desc.Size > maxJSONSize {
+		return nil, fmt.Errorf("%w: %v is too large", ErrInvalidLayout, desc.Digest)
+	}
+
+	r, err := l.Open(desc)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	var buf bytes.Buffer
+
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, fmt.Errorf("failed to read blob: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (l *Layout) readBlobJSON(desc Descriptor, v any) error {
+	data, err := l.ReadBlob(desc)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %v: %w", ErrInvalidLayout, desc.Digest, err)
+	}
+
+	return nil
+}
+
+type ImageOptions struct {
+	// Ref selects an image by its org.opencontainers.image.ref.name annotation in a layout, such as "latest", or by
+	// a repository tag, such as "app:latest". The first image for the platform is used when empty.
+	Ref string
+	// Platform defaults to DefaultPlatform.
+	Platform Platform
+}
+
+// Image is a single platform image within a layout or archive, which must remain open while the image is used.
+type Image struct {
+	blobs      blobStore
+	Descriptor Descriptor
+	Manifest   Manifest
+	Config     Config
+}
+
+// Image selects an image for a platform, descending into multi-platform indexes.
+func (l *Layout) Image(opts ImageOptions) (*Image, error) {
+	if opts.Platform == (Platform{}) {
+		opts.Platform = DefaultPlatform()
+	}
+
+	for _, desc := range l.Index.Manifests {
+		if opts.Ref != "" && !matchesRef(desc, opts.Ref) {
+			continue
+		}
+
+		img, err := l.resolve(desc, opts.Platform, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		if img != nil {
+			return img, nil
+		}
+	}
+
+	if opts.Ref != "" {
+		return nil, fmt.Errorf("%w: no image %q for %v", ErrNotFound, opts.Ref, opts.Platform)
+	}
+
+	return nil, fmt.Errorf("%w: no image for %v", ErrNotFound, opts.Platform)
+}
+
+// matchesRef reports whether an image of the index is named ref, by its ref name or by its full image name, where
+// Docker Hub images may be named as in "app:latest".
+func matchesRef(desc Descriptor, ref string) bool {
+	if desc.Annotations[AnnotationRefName] == ref {
+		return true
+	}
+
+	name := desc.Annotations[AnnotationImageName]
+
+	return name != "" && (name == ref || name == "docker.io/"+ref || name == "docker.io/library/"+ref)
+}
+
+// resolve returns the image for platform referenced by desc, or nil when there is none.
+func (l *Layout) resolve(desc Descriptor, platform Platform, depth int) (*Image, error) {
+	if desc.Platform != nil && !platform.Matches(*desc.Platform) {
+		return nil, nil
+	}
+
+	switch desc.MediaType {
+	case MediaTypeIndex, MediaTypeDockerList:
+		if depth > 8 {
+			return nil, fmt.Errorf("%w: indexes nested too deeply", ErrInvalidLayout)
+		}
+
+		var index Index
+
+		if err := l.readBlobJSON(desc, &index); err != nil {
+			return nil, err
+		}
+
+		for _, child := range index.Manifests {
+			img, err := l.resolve(child, platform, depth+1)
+			if img != nil || err != nil {
+				return img, err
+			}
+		}
+
+		return nil, nil
+	case MediaTypeManifest, MediaTypeDockerManifest:
+		img := &Image{blobs: l, Descriptor: desc}
+
+		if err := l.readBlobJSON(desc, &img.Manifest); err != nil {
+			return nil, err
+		}
+
+		if err := l.readBlobJSON(img.Manifest.Config, &img.Config); err != nil {
+			return nil, err
+		}
+
+		if img.Config.OS != "" && !platform.Matches(img.Config.Platform) {
+			return nil, nil
+		}
+
+		return img, nil
+	default:
+		return nil, nil
+	}
+}
+
+// Flatten applies the layers of the image in order, producing its root filesystem. Whiteout files remove entries
+// of earlier layers, and ownership, permissions, extended attributes, hard links and device nodes are taken from
+// the layers. Layers must be uncompressed or gzip compressed, and zstd layers fail with ErrUnsupportedMediaType.
+// The tree can be written to a partition with its TarContent, or copied into a filesystem writer. The caller must
+// close the tree.
+func (img *Image) Flatten(opts fstree.Options) (*fstree.Tree, error) {
+	t := fstree.New(opts)
+
+	for i, layer := range img.Manifest.Layers {
+		if err := img.applyLayer(t, layer); err != nil {
+			_ = t.Close()
+
+			return nil, fmt.Errorf("layer %v: %w", i, err)
+		}
+	}
+
+	return t, nil
+}
+
+func (img *Image) applyLayer(t *fstree.Tree, layer Descriptor) error {
+	if !layerTypes[layer.MediaType] {
+		return fmt.Errorf("%w: %q", ErrUnsupportedMediaType, layer.MediaType)
+	}
+
+	r, err := img.blobs.Open(layer)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	if err := t.AddTar(r, fstree.MergeOptions{Whiteouts: true}); err != nil {
+		return err
+	}
+
+	// Read any padding after the end of the archive, so that the digest is checked.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// WriteTar writes the flattened root filesystem as a single tar stream, as described by fstree.Tree.WriteTar.
+func (img *Image) WriteTar(w io.Writer, opts fstree.Options) error {
+	t, err := img.Flatten(opts)
+	if err != nil {
+		return err
+	}
+
+	defer t.Close()
+
+	return t.WriteTar(w)
+}
@@ -0,0 +1,298 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/csnewman/go-appliance/pkg/fstree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testLayout writes an image layout to a temporary directory.
+type testLayout struct {
+	t   *testing.T
+	dir string
+}
+
+func newTestLayout(t *testing.T) *testLayout {
+	t.Helper()
+
+	l := &testLayout{t: t, dir: t.TempDir()}
+
+	require.NoError(t, os.MkdirAll(filepath.Join(l.dir, "blobs", "sha256"), 0o755), "blobs should create")
+	require.NoError(t, os.WriteFile(filepath.Join(l.dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`),
+		0o644), "marker should write")
+
+	return l
+}
+
+func (l *testLayout) blob(mediaType string, data []byte) Descriptor {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	require.NoError(l.t, os.WriteFile(filepath.Join(l.dir, "blobs", "sha256", digest), data, 0o644),
+		"blob should write")
+
+	return Descriptor{MediaType: mediaType, Digest: "sha256:" + digest, Size: int64(len(data))}
+}
+
+func (l *testLayout) json(mediaType string, v any) Descriptor {
+	data, err := json.Marshal(v)
+	require.NoError(l.t, err, "json should encode")
+
+	return l.blob(mediaType, data)
+}
+
+func (l *testLayout) index(index Index) {
+	data, err := json.Marshal(index)
+	require.NoError(l.t, err, "index should encode")
+	require.NoError(l.t, os.WriteFile(filepath.Join(l.dir, "index.json"), data, 0o644), "index should write")
+}
+
+// image writes a manifest with a config for platform and the given layers.
+func (l *testLayout) image(platform Platform, layers ...Descriptor) Descriptor {
+	var config Config
+
+	config.Platform = platform
+	config.Config.Entrypoint = []string{"/sbin/init"}
+	config.RootFS.Type = "layers"
+
+	desc := l.json(MediaTypeManifest, Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        l.json(MediaTypeConfig, config),
+		Layers:        layers,
+	})
+	desc.Platform = &platform
+
+	return desc
+}
+
+// layerTar builds a layer, where regular files contain their own name.
+func layerTar(t *testing.T, compress bool, hdrs ...*tar.Header) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	var w io.Writer = &buf
+
+	gw := gzip.NewWriter(&buf)
+	if compress {
+		w = gw
+	}
+
+	tw := tar.NewWriter(w)
+
+	for _, hdr := range hdrs {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+
+		require.NoError(t, tw.WriteHeader(hdr), "header should write")
+
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(hdr.Name))
+			require.NoError(t, err, "data should write")
+		}
+	}
+
+	require.NoError(t, tw.Close(), "tar should close")
+
+	if compress {
+		require.NoError(t, gw.Close(), "gzip should close")
+	}
+
+	return buf.Bytes()
+}
+
+func baseLayers(t *testing.T) [][]byte {
+	return [][]byte{
+		layerTar(t, true,
+			&tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0o755},
+			&tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755},
+			&tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644},
+			&tar.Header{Typeflag: tar.TypeReg, Name: "etc/shadow", Mode: 0o640, Gid: 42, PAXRecords: map[string]string{
+				"SCHILY.xattr.security.selinux": "system_u:object_r:shadow_t:s0",
+			}},
+			&tar.Header{Typeflag: tar.TypeReg, Name: "var/cache/apt/pkgcache.bin", Mode: 0o644},
+			&tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3},
+		),
+		layerTar(t, false,
+			&tar.Header{Typeflag: tar.TypeReg, Name: "etc/.wh.hostname", Mode: 0o644},
+			&tar.Header{Typeflag: tar.TypeDir, Name: "var/cache/", Mode: 0o755},
+			&tar.Header{Typeflag: tar.TypeReg, Name: "var/cache/.wh..wh..opq", Mode: 0o644},
+			&tar.Header{Typeflag: tar.TypeLink, Name: "etc/gshadow", Linkname: "etc/shadow"},
+			&tar.Header{Typeflag: tar.TypeReg, Name: "home/user/.profile", Mode: 0o600, Uid: 1000, Gid: 1000},
+		),
+	}
+}
+
+func buildLayout(t *testing.T) *testLayout {
+	t.Helper()
+
+	l := newTestLayout(t)
+
+	var layers []Descriptor
+
+	for i, data := range baseLayers(t) {
+		mediaType := MediaTypeLayer
+		if i == 0 {
+			mediaType = MediaTypeLayerGzip
+		}
+
+		layers = append(layers, l.blob(mediaType, data))
+	}
+
+	arm := l.image(Platform{OS: "linux", Architecture: "arm64"}, layers...)
+	amd := l.image(Platform{OS: "linux", Architecture: "amd64"}, layers[0])
+
+	list := l.json(MediaTypeIndex, Index{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeIndex,
+		Manifests:     []Descriptor{amd, arm},
+	})
+	list.Annotations = map[string]string{AnnotationRefName: "latest"}
+
+	l.index(Index{SchemaVersion: 2, Manifests: []Descriptor{list}})
+
+	return l
+}
+
+func TestLayout(t *testing.T) {
+	l := buildLayout(t)
+
+	layout, err := OpenLayoutDir(l.dir)
+	require.NoError(t, err, "layout should open")
+
+	img, err := layout.Image(ImageOptions{Ref: "latest", Platform: Platform{OS: "linux", Architecture: "arm64"}})
+	require.NoError(t, err, "image should resolve")
+	assert.Len(t, img.Manifest.Layers, 2, "arm64 manifest should be selected")
+	assert.Equal(t, []string{"/sbin/init"}, img.Config.Config.Entrypoint, "config should be read")
+
+	tree, err := img.Flatten(fstree.Options{TempDir: t.TempDir()})
+	require.NoError(t, err, "image should flatten")
+
+	defer tree.Close()
+
+	var names []string
+
+	require.NoError(t, fs.WalkDir(tree, ".", func(name string, d fs.DirEntry, err error) error {
+		names = append(names, name)
+
+		return err
+	}), "tree should walk")
+
+	assert.Equal(t, []string{
+		".", "dev", "dev/null", "etc", "etc/gshadow", "etc/shadow", "home", "home/user", "home/user/.profile", "var",
+		"var/cache",
+	}, names, "layers should be merged with whiteouts applied")
+
+	shadow, err := tree.Stat("etc/shadow")
+	require.NoError(t, err, "file should stat")
+
+	attr := shadow.Sys().(*fsmeta.Attr)
+	assert.Equal(t, uint32(42), attr.GID, "ownership should be kept")
+	assert.Equal(t, "system_u:object_r:shadow_t:s0", string(attr.Xattrs["security.selinux"]), "xattr should be kept")
+
+	gshadow, err := tree.Stat("etc/gshadow")
+	require.NoError(t, err, "hard link should stat")
+	assert.Equal(t, attr.Inode, gshadow.Sys().(*fsmeta.Attr).Inode, "hard link to a lower layer should be kept")
+
+	null, err := tree.Lstat("dev/null")
+	require.NoError(t, err, "device should stat")
+	assert.Equal(t, uint32(1), null.Sys().(*fsmeta.Attr).Major, "device should be kept")
+
+	var buf bytes.Buffer
+
+	require.NoError(t, img.WriteTar(&buf, fstree.Options{TempDir: t.TempDir()}), "image should write as tar")
+
+	var expected bytes.Buffer
+
+	require.NoError(t, tree.WriteTar(&expected), "tree should write as tar")
+	assert.Equal(t, expected.Bytes(), buf.Bytes(), "tar should match the flattened tree")
+
+	img, err = layout.Image(ImageOptions{Platform: Platform{OS: "linux", Architecture: "amd64"}})
+	require.NoError(t, err, "image should resolve")
+	assert.Len(t, img.Manifest.Layers, 1, "amd64 manifest should be selected")
+
+	_, err = layout.Image(ImageOptions{Platform: Platform{OS: "linux", Architecture: "s390x"}})
+	assert.ErrorIs(t, err, ErrNotFound, "missing platform should fail")
+
+	_, err = layout.Image(ImageOptions{Ref: "stable", Platform: Platform{OS: "linux", Architecture: "arm64"}})
+	assert.ErrorIs(t, err, ErrNotFound, "missing ref should fail")
+}
+
+func TestLayoutInvalid(t *testing.T) {
+	_, err := OpenLayoutDir(t.TempDir())
+	assert.ErrorIs(t, err, ErrInvalidLayout, "missing marker should fail")
+
+	l := newTestLayout(t)
+	layer := l.blob(MediaTypeLayer, layerTar(t, false, &tar.Header{Typeflag: tar.TypeReg, Name: "a", Mode: 0o644}))
+	platform := Platform{OS: "linux", Architecture: "arm64"}
+
+	l.index(Index{SchemaVersion: 2, Manifests: []Descriptor{
+		l.image(platform, layer),
+		l.image(Platform{OS: "linux", Architecture: "amd64"}, Descriptor{
+			MediaType: "application/vnd.oci.image.layer.v1.tar+zstd",
+			Digest:    layer.Digest,
+			Size:      layer.Size,
+		}),
+		l.image(Platform{OS: "linux", Architecture: "riscv64"}, Descriptor{
+			MediaType: MediaTypeLayer,
+			Digest:    "sha256:../../oci-layout",
+		}),
+	}})
+
+	layout, err := OpenLayoutDir(l.dir)
+	require.NoError(t, err, "layout should open")
+
+	img, err := layout.Image(ImageOptions{Platform: Platform{OS: "linux", Architecture: "amd64"}})
+	require.NoError(t, err, "image should resolve")
+
+	_, err = img.Flatten(fstree.Options{TempDir: t.TempDir()})
+	assert.ErrorIs(t, err, ErrUnsupportedMediaType, "zstd layer should be rejected")
+
+	img, err = layout.Image(ImageOptions{Platform: Platform{OS: "linux", Architecture: "riscv64"}})
+	require.NoError(t, err, "image should resolve")
+
+	_, err = img.Flatten(fstree.Options{TempDir: t.TempDir()})
+	assert.ErrorIs(t, err, ErrInvalidDigest, "digest should be validated")
+
+	img, err = layout.Image(ImageOptions{Platform: platform})
+	require.NoError(t, err, "image should resolve")
+
+	// Corrupt the file data, keeping the size.
+	path := filepath.Join(l.dir, "blobs", "sha256", layer.Digest[len("sha256:"):])
+	data, err := os.ReadFile(path)
+	require.NoError(t, err, "layer should read")
+
+	data[512] = 'b'
+	require.NoError(t, os.WriteFile(path, data, 0o644), "layer should write")
+
+	_, err = img.Flatten(fstree.Options{TempDir: t.TempDir()})
+	assert.ErrorIs(t, err, ErrDigestMismatch, "corrupt layer should be rejected")
+}
+
+func TestParsePlatform(t *testing.T) {
+	p, err := ParsePlatform("linux/arm/v7")
+	require.NoError(t, err, "platform should parse")
+	assert.Equal(t, Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, p, "platform should match")
+	assert.Equal(t, "linux/arm/v7", p.String(), "platform should format")
+	assert.True(t, p.Matches(Platform{OS: "linux", Architecture: "arm"}), "missing variant should match")
+	assert.False(t, p.Matches(Platform{OS: "linux", Architecture: "arm", Variant: "v6"}),
+		"other variant should not match")
+
+	_, err = ParsePlatform("linux")
+	assert.ErrorIs(t, err, ErrInvalidPlatform, "missing architecture should fail")
+}
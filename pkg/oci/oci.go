@@ -0,0 +1,128 @@
+package oci
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Media types of image manifests, indexes and layers, including the Docker equivalents which are found in layouts
+// written by Docker.
+const (
+	MediaTypeIndex          = "application/vnd.oci.image.index.v1+json"
+	MediaTypeManifest       = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeConfig         = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayer          = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeLayerGzip      = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerConfig   = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerLayer    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	MediaTypeDockerLayerTar = "application/vnd.docker.image.rootfs.diff.tar"
+)
+
+// AnnotationRefName names an image within a layout.
+const AnnotationRefName = "org.opencontainers.image.ref.name"
+
+// AnnotationImageName holds the full name of an image, such as "docker.io/library/app:latest", in layouts written by
+// containerd and by Docker using the containerd image store.
+const AnnotationImageName = "io.containerd.image.name"
+
+// LayoutVersion is the supported version of the oci-layout file.
+const LayoutVersion = "1.0.0"
+
+var (
+	ErrInvalidLayout        = errors.New("invalid image layout")
+	ErrInvalidArchive       = errors.New("invalid image archive")
+	ErrInvalidDigest        = errors.New("invalid digest")
+	ErrDigestMismatch       = errors.New("digest mismatch")
+	ErrUnsupportedMediaType = errors.New("unsupported media type")
+	ErrNotFound             = errors.New("image not found")
+	ErrInvalidPlatform      = errors.New("invalid platform")
+)
+
+// Platform identifies the operating system and CPU an image is built for, using Go's GOOS and GOARCH values.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// DefaultPlatform returns linux on the current architecture.
+func DefaultPlatform() Platform {
+	return Platform{OS: "linux", Architecture: runtime.GOARCH}
+}
+
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+
+	return s
+}
+
+// ParsePlatform parses a platform such as "linux/arm64" or "linux/arm/v7".
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("%w: %q", ErrInvalidPlatform, s)
+	}
+
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+
+	return p, nil
+}
+
+// Matches reports whether an image built for other runs on p. A variant is only compared when both are set.
+func (p Platform) Matches(other Platform) bool {
+	if p.OS != other.OS || p.Architecture != other.Architecture {
+		return false
+	}
+
+	return p.Variant == "" || other.Variant == "" || p.Variant == other.Variant
+}
+
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// Config is the image configuration, describing the platform and how the image is run.
+type Config struct {
+	Platform
+
+	Config struct {
+		User       string            `json:"User,omitempty"`
+		Env        []string          `json:"Env,omitempty"`
+		Entrypoint []string          `json:"Entrypoint,omitempty"`
+		Cmd        []string          `json:"Cmd,omitempty"`
+		WorkingDir string            `json:"WorkingDir,omitempty"`
+		Labels     map[string]string `json:"Labels,omitempty"`
+	} `json:"config"`
+
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
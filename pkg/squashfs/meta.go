@@ -0,0 +1,80 @@
+package squashfs
+
+import (
+	"encoding/binary"
+)
+
+// metaWriter packs a table into metadata blocks of up to 8KiB, each prefixed by a length header.
+type metaWriter struct {
+	comp   Compressor
+	buf    []byte
+	out    []byte
+	starts []uint64
+}
+
+// ref returns the reference to the next byte written: the offset of its block within the table and the offset within
+// the uncompressed block.
+func (m *metaWriter) ref() uint64 {
+	return uint64(len(m.out))<<16 | uint64(len(m.buf))
+}
+
+func (m *metaWriter) write(data []byte) error {
+	for len(data) > 0 {
+		n := copy(m.buf[len(m.buf):cap(m.buf)], data)
+		m.buf = m.buf[:len(m.buf)+n]
+		data = data[n:]
+
+		if len(m.buf) == MetadataSize {
+			if err := m.flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *metaWriter) flush() error {
+	if len(m.buf) == 0 {
+		return nil
+	}
+
+	m.starts = append(m.starts, uint64(len(m.out)))
+
+	block, compressed, err := compressBlock(m.comp, m.buf)
+	if err != nil {
+		return err
+	}
+
+	header := uint16(len(block))
+	if !compressed {
+		header |= metaUncompressed
+	}
+
+	m.out = binary.LittleEndian.AppendUint16(m.out, header)
+	m.out = append(m.out, block...)
+	m.buf = m.buf[:0]
+
+	return nil
+}
+
+func newMetaWriter(comp Compressor) *metaWriter {
+	return &metaWriter{
+		comp: comp,
+		buf:  make([]byte, 0, MetadataSize),
+	}
+}
+
+// compressBlock compresses data, returning it unchanged when compression does not save space.
+func compressBlock(comp Compressor, data []byte) ([]byte, bool, error) {
+	out, err := comp.Compress(data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(out) >= len(data) {
+		return data, false, nil
+	}
+
+	return out, true, nil
+}
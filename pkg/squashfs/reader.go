@@ -0,0 +1,1071 @@
+package squashfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+)
+
+const maxSymlinks = 40
+
+// FS provides read-only access to a squashfs 4.0 image.
+type FS struct {
+	r          io.ReaderAt
+	comp       Decompressor
+	blockSize  uint64
+	modTime    time.Time
+	rootRef    uint64
+	bytesUsed  uint64
+	idTable    uint64
+	xattrTable uint64
+	inodeTable uint64
+	dirTable   uint64
+	fragTable  uint64
+	fragments  uint32
+	ids        []uint32
+
+	xattrKV  uint64
+	xattrIDs uint32
+
+	mu    sync.Mutex
+	cache map[uint64]metaBlock
+}
+
+type metaBlock struct {
+	data []byte
+	next uint64
+}
+
+var (
+	_ fs.FS             = (*FS)(nil)
+	_ fs.ReadDirFS      = (*FS)(nil)
+	_ fs.StatFS         = (*FS)(nil)
+	_ fsmeta.ReadLinkFS = (*FS)(nil)
+)
+
+// Open reads the image at the start of r, such as the section returned by disk.Disk.PartitionSection. Gzip is always
+// supported, other compression formats require a matching decompressor.
+func Open(r io.ReaderAt, decompressors ...Decompressor) (*FS, error) {
+	sb := make([]byte, SuperblockSize)
+
+	if _, err := r.ReadAt(sb, 0); err != nil {
+		return nil, fmt.Errorf("failed to read superblock: %w", err)
+	}
+
+	le := binary.LittleEndian
+
+	if le.Uint32(sb) != Magic {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidFilesystem)
+	}
+
+	if major, minor := le.Uint16(sb[28:]), le.Uint16(sb[30:]); major != VersionMajor || minor != VersionMinor {
+		return nil, fmt.Errorf("%w: version %v.%v", ErrInvalidFilesystem, major, minor)
+	}
+
+	f := &FS{
+		r:          r,
+		blockSize:  uint64(le.Uint32(sb[12:])),
+		modTime:    time.Unix(int64(le.Uint32(sb[8:])), 0).UTC(),
+		fragments:  le.Uint32(sb[16:]),
+		rootRef:    le.Uint64(sb[32:]),
+		bytesUsed:  le.Uint64(sb[40:]),
+		idTable:    le.Uint64(sb[48:]),
+		xattrTable: le.Uint64(sb[56:]),
+		inodeTable: le.Uint64(sb[64:]),
+		dirTable:   le.Uint64(sb[72:]),
+		fragTable:  le.Uint64(sb[80:]),
+		cache:      make(map[uint64]metaBlock),
+	}
+
+	if bs := f.blockSize; bs < MinBlockSize || bs > MaxBlockSize || bs&(bs-1) != 0 || 1<<le.Uint16(sb[22:]) != bs {
+		return nil, fmt.Errorf("%w: block size %v", ErrInvalidFilesystem, bs)
+	}
+
+	comp := Compression(le.Uint16(sb[20:]))
+
+	for _, d := range append([]Decompressor{Gzip{}}, decompressors...) {
+		if d.ID() == comp {
+			f.comp = d
+		}
+	}
+
+	if f.comp == nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedCompression, comp)
+	}
+
+	if err := f.readIDs(int(le.Uint16(sb[26:]))); err != nil {
+		return nil, err
+	}
+
+	if f.xattrTable != NotPresent {
+		header := make([]byte, 16)
+
+		if _, err := r.ReadAt(header, int64(f.xattrTable)); err != nil {
+			return nil, fmt.Errorf("failed to read xattr table: %w", err)
+		}
+
+		f.xattrKV = le.Uint64(header)
+		f.xattrIDs = le.Uint32(header[8:])
+	}
+
+	return f, nil
+}
+
+// ModTime returns the time recorded in the superblock.
+func (f *FS) ModTime() time.Time {
+	return f.modTime
+}
+
+func (f *FS) Compression() Compression {
+	return f.comp.ID()
+}
+
+func (f *FS) BlockSize() int {
+	return int(f.blockSize)
+}
+
+func (f *FS) readIDs(count int) error {
+	if count == 0 {
+		return fmt.Errorf("%w: empty id table", ErrInvalidFilesystem)
+	}
+
+	data, err := f.readTable(f.idTable, count*4)
+	if err != nil {
+		return fmt.Errorf("failed to read id table: %w", err)
+	}
+
+	f.ids = make([]uint32, count)
+
+	for i := range f.ids {
+		f.ids[i] = binary.LittleEndian.Uint32(data[i*4:])
+	}
+
+	return nil
+}
+
+// readMetaBlock returns the decompressed metadata block at off along with the location of the following block.
+func (f *FS) readMetaBlock(off uint64) ([]byte, uint64, error) {
+	f.mu.Lock()
+	cached, ok := f.cache[off]
+	f.mu.Unlock()
+
+	if ok {
+		return cached.data, cached.next, nil
+	}
+
+	header := make([]byte, 2)
+
+	if _, err := f.r.ReadAt(header, int64(off)); err != nil {
+		return nil, 0, fmt.Errorf("failed to read metadata block at %v: %w", off, err)
+	}
+
+	size := binary.LittleEndian.Uint16(header)
+	compressed := size&metaUncompressed == 0
+	size &^= metaUncompressed
+
+	if size == 0 || size > MetadataSize || off+2+uint64(size) > f.bytesUsed {
+		return nil, 0, fmt.Errorf("%w: metadata block at %v has size %v", ErrInvalidFilesystem, off, size)
+	}
+
+	data := make([]byte, size)
+
+	if _, err := f.r.ReadAt(data, int64(off)+2); err != nil {
+		return nil, 0, fmt.Errorf("failed to read metadata block at %v: %w", off, err)
+	}
+
+	if compressed {
+		var err error
+
+		if data, err = f.comp.Decompress(data, MetadataSize); err != nil {
+			return nil, 0, fmt.Errorf("metadata block at %v: %w", off, err)
+		}
+
+		if len(data) == 0 {
+			return nil, 0, fmt.Errorf("%w: empty metadata block at %v", ErrInvalidFilesystem, off)
+		}
+	}
+
+	next := off + 2 + uint64(size)
+
+	f.mu.Lock()
+	f.cache[off] = metaBlock{data: data, next: next}
+	f.mu.Unlock()
+
+	return data, next, nil
+}
+
+// metaReader reads a stream of metadata spanning consecutive metadata blocks.
+type metaReader struct {
+	f      *FS
+	block  uint64
+	offset int
+	data   []byte
+	next   uint64
+}
+
+func (f *FS) newMetaReader(block uint64, offset uint64) *metaReader {
+	return &metaReader{f: f, block: block, offset: int(offset)}
+}
+
+func (m *metaReader) read(n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+
+	for len(out) < n {
+		if m.data == nil {
+			data, next, err := m.f.readMetaBlock(m.block)
+			if err != nil {
+				return nil, err
+			}
+
+			if m.offset > len(data) {
+				return nil, fmt.Errorf("%w: offset %v beyond metadata block at %v", ErrInvalidFilesystem, m.offset,
+					m.block)
+			}
+
+			m.data = data
+			m.next = next
+		}
+
+		if m.offset == len(m.data) {
+			m.block = m.next
+			m.offset = 0
+			m.data = nil
+
+			continue
+		}
+
+		chunk := min(n-len(out), len(m.data)-m.offset)
+		out = append(out, m.data[m.offset:m.offset+chunk]...)
+		m.offset += chunk
+	}
+
+	return out, nil
+}
+
+// readRef reads from a table using a reference to a metadata block and the offset within it.
+func (f *FS) readRef(table uint64, ref uint64, n int) ([]byte, error) {
+	return f.newMetaReader(table+ref>>16, ref&0xFFFF).read(n)
+}
+
+// readTable reads the start of a lookup table, which is stored in consecutive metadata blocks located by an index.
+func (f *FS) readTable(index uint64, n int) ([]byte, error) {
+	return f.readTableAt(index, 0, n)
+}
+
+func (f *FS) readTableAt(index uint64, off uint64, n int) ([]byte, error) {
+	if index == NotPresent {
+		return nil, fmt.Errorf("%w: missing table", ErrInvalidFilesystem)
+	}
+
+	ptr := make([]byte, 8)
+
+	if _, err := f.r.ReadAt(ptr, int64(index+off/MetadataSize*8)); err != nil {
+		return nil, fmt.Errorf("failed to read table index: %w", err)
+	}
+
+	return f.newMetaReader(binary.LittleEndian.Uint64(ptr), off%MetadataSize).read(n)
+}
+
+type inodeData struct {
+	num   uint32
+	ty    uint16
+	mode  fs.FileMode
+	uid   uint32
+	gid   uint32
+	mtime uint32
+	links uint32
+	size  uint64
+	xattr uint32
+
+	listing    uint64
+	start      uint64
+	blocks     []uint32
+	fragment   uint32
+	fragOffset uint32
+	target     string
+	dev        uint32
+}
+
+func (n *inodeData) isDir() bool {
+	return n.mode.IsDir()
+}
+
+func (n *inodeData) isSymlink() bool {
+	return n.mode.Type() == fs.ModeSymlink
+}
+
+var inodeModes = map[uint16]uint32{
+	TypeDir:     fsmeta.ModeDir,
+	TypeFile:    fsmeta.ModeRegular,
+	TypeSymlink: fsmeta.ModeSymlink,
+	TypeBlock:   fsmeta.ModeBlock,
+	TypeChar:    fsmeta.ModeChar,
+	TypeFIFO:    fsmeta.ModeFIFO,
+	TypeSocket:  fsmeta.ModeSocket,
+}
+
+func (f *FS) readInode(ref uint64) (*inodeData, error) {
+	m := f.newMetaReader(f.inodeTable+ref>>16, ref&0xFFFF)
+
+	header, err := m.read(16)
+	if err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+
+	n := &inodeData{
+		ty:       le.Uint16(header),
+		mtime:    le.Uint32(header[8:]),
+		num:      le.Uint32(header[12:]),
+		xattr:    InvalidXattr,
+		fragment: InvalidFragment,
+	}
+
+	uid, gid := le.Uint16(header[4:]), le.Uint16(header[6:])
+	if int(uid) >= len(f.ids) || int(gid) >= len(f.ids) {
+		return nil, fmt.Errorf("%w: inode %v id index out of range", ErrInvalidFilesystem, n.num)
+	}
+
+	n.uid, n.gid = f.ids[uid], f.ids[gid]
+
+	basic := n.ty
+	if basic >= TypeExtDir {
+		basic -= TypeExtDir - TypeDir
+	}
+
+	mode, ok := inodeModes[basic]
+	if !ok || n.ty > TypeExtSocket {
+		return nil, fmt.Errorf("%w: inode %v has type %v", ErrInvalidFilesystem, n.num, n.ty)
+	}
+
+	n.mode = fsmeta.FileMode(mode | uint32(le.Uint16(header[2:]))&0o7777)
+
+	var body []byte
+
+	switch n.ty {
+	case TypeDir:
+		if body, err = m.read(16); err != nil {
+			return nil, err
+		}
+
+		n.listing = uint64(le.Uint32(body))<<16 | uint64(le.Uint16(body[10:]))
+		n.links = le.Uint32(body[4:])
+		n.size = uint64(le.Uint16(body[8:]))
+	case TypeExtDir:
+		if body, err = m.read(24); err != nil {
+			return nil, err
+		}
+
+		n.links = le.Uint32(body)
+		n.size = uint64(le.Uint32(body[4:]))
+		n.listing = uint64(le.Uint32(body[8:]))<<16 | uint64(le.Uint16(body[18:]))
+		n.xattr = le.Uint32(body[20:])
+	case TypeFile:
+		if body, err = m.read(16); err != nil {
+			return nil, err
+		}
+
+		n.links = 1
+		n.start = uint64(le.Uint32(body))
+		n.fragment = le.Uint32(body[4:])
+		n.fragOffset = le.Uint32(body[8:])
+		n.size = uint64(le.Uint32(body[12:]))
+	case TypeExtFile:
+		if body, err = m.read(40); err != nil {
+			return nil, err
+		}
+
+		n.start = le.Uint64(body)
+		n.size = le.Uint64(body[8:])
+		n.links = le.Uint32(body[24:])
+		n.fragment = le.Uint32(body[28:])
+		n.fragOffset = le.Uint32(body[32:])
+		n.xattr = le.Uint32(body[36:])
+	case TypeSymlink, TypeExtSymlink:
+		if body, err = m.read(8); err != nil {
+			return nil, err
+		}
+
+		n.links = le.Uint32(body)
+		n.size = uint64(le.Uint32(body[4:]))
+
+		if n.size > 4096 {
+			return nil, fmt.Errorf("%w: inode %v symlink of %v bytes", ErrInvalidFilesystem, n.num, n.size)
+		}
+
+		target, err := m.read(int(n.size))
+		if err != nil {
+			return nil, err
+		}
+
+		n.target = string(target)
+
+		if n.ty == TypeExtSymlink {
+			if body, err = m.read(4); err != nil {
+				return nil, err
+			}
+
+			n.xattr = le.Uint32(body)
+		}
+	case TypeBlock, TypeChar, TypeExtBlock, TypeExtChar:
+		if body, err = m.read(8); err != nil {
+			return nil, err
+		}
+
+		n.links = le.Uint32(body)
+		n.dev = le.Uint32(body[4:])
+
+		if n.ty >= TypeExtDir {
+			if body, err = m.read(4); err != nil {
+				return nil, err
+			}
+
+			n.xattr = le.Uint32(body)
+		}
+	default:
+		if body, err = m.read(4); err != nil {
+			return nil, err
+		}
+
+		n.links = le.Uint32(body)
+
+		if n.ty >= TypeExtDir {
+			if body, err = m.read(4); err != nil {
+				return nil, err
+			}
+
+			n.xattr = le.Uint32(body)
+		}
+	}
+
+	if n.mode.IsRegular() {
+		count := n.size / f.blockSize
+
+		if n.fragment == InvalidFragment && n.size%f.blockSize != 0 {
+			count++
+		}
+
+		if count > n.size/MinBlockSize+1 || count*4 > 1<<30 {
+			return nil, fmt.Errorf("%w: inode %v has %v blocks", ErrInvalidFilesystem, n.num, count)
+		}
+
+		raw, err := m.read(int(count) * 4)
+		if err != nil {
+			return nil, err
+		}
+
+		n.blocks = make([]uint32, count)
+
+		for i := range n.blocks {
+			n.blocks[i] = le.Uint32(raw[i*4:])
+		}
+	}
+
+	return n, nil
+}
+
+// readBlock reads a data block, which is stored uncompressed when bit 24 of its size is set.
+func (f *FS) readBlock(start uint64, size uint32) ([]byte, error) {
+	length := size &^ dataUncompressed
+
+	if uint64(length) > f.blockSize || start+uint64(length) > f.bytesUsed {
+		return nil, fmt.Errorf("%w: data block at %v has size %v", ErrInvalidFilesystem, start, length)
+	}
+
+	data := make([]byte, length)
+
+	if _, err := f.r.ReadAt(data, int64(start)); err != nil {
+		return nil, fmt.Errorf("failed to read data block at %v: %w", start, err)
+	}
+
+	if size&dataUncompressed != 0 {
+		return data, nil
+	}
+
+	data, err := f.comp.Decompress(data, int(f.blockSize))
+	if err != nil {
+		return nil, fmt.Errorf("data block at %v: %w", start, err)
+	}
+
+	return data, nil
+}
+
+func (f *FS) readFragment(n *inodeData) ([]byte, error) {
+	if n.fragment >= f.fragments {
+		return nil, fmt.Errorf("%w: inode %v fragment %v out of range", ErrInvalidFilesystem, n.num, n.fragment)
+	}
+
+	entry, err := f.readTableAt(f.fragTable, uint64(n.fragment)*16, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+
+	data, err := f.readBlock(le.Uint64(entry), le.Uint32(entry[8:]))
+	if err != nil {
+		return nil, err
+	}
+
+	end := uint64(n.fragOffset) + n.size%f.blockSize
+	if end > uint64(len(data)) {
+		return nil, fmt.Errorf("%w: inode %v tail beyond fragment", ErrInvalidFilesystem, n.num)
+	}
+
+	return data[n.fragOffset:end], nil
+}
+
+// fileBlock returns the decompressed contents of a block within a file, including the tail stored in a fragment.
+func (f *FS) fileBlock(n *inodeData, idx uint64) ([]byte, error) {
+	length := min(f.blockSize, n.size-idx*f.blockSize)
+
+	if idx >= uint64(len(n.blocks)) {
+		return f.readFragment(n)
+	}
+
+	if n.blocks[idx] == 0 {
+		return make([]byte, length), nil
+	}
+
+	start := n.start
+	for _, size := range n.blocks[:idx] {
+		start += uint64(size &^ dataUncompressed)
+	}
+
+	data, err := f.readBlock(start, n.blocks[idx])
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(data)) != length {
+		return nil, fmt.Errorf("%w: inode %v block %v has %v bytes", ErrInvalidFilesystem, n.num, idx, len(data))
+	}
+
+	return data, nil
+}
+
+type rawXattr struct {
+	name  string
+	value []byte
+}
+
+func (f *FS) xattrs(n *inodeData) ([]rawXattr, error) {
+	if n.xattr == InvalidXattr {
+		return nil, nil
+	}
+
+	if n.xattr >= f.xattrIDs {
+		return nil, fmt.Errorf("%w: inode %v xattr %v out of range", ErrInvalidFilesystem, n.num, n.xattr)
+	}
+
+	le := binary.LittleEndian
+
+	entry, err := f.readTableAt(f.xattrTable+16, uint64(n.xattr)*16, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	ref, count := le.Uint64(entry), le.Uint32(entry[8:])
+	m := f.newMetaReader(f.xattrKV+ref>>16, ref&0xFFFF)
+
+	var out []rawXattr
+
+	for range count {
+		header, err := m.read(4)
+		if err != nil {
+			return nil, err
+		}
+
+		ty, size := le.Uint16(header), le.Uint16(header[2:])
+
+		name, err := m.read(int(size))
+		if err != nil {
+			return nil, err
+		}
+
+		raw, err := m.read(4)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := m.read(int(le.Uint32(raw)))
+		if err != nil {
+			return nil, err
+		}
+
+		if ty&xattrOOL != 0 {
+			if len(value) != 8 {
+				return nil, fmt.Errorf("%w: inode %v has a bad xattr reference", ErrInvalidFilesystem, n.num)
+			}
+
+			ref := le.Uint64(value)
+
+			if raw, err = f.readRef(f.xattrKV, ref, 4); err != nil {
+				return nil, err
+			}
+
+			if value, err = f.newMetaReader(f.xattrKV+ref>>16, ref&0xFFFF+4).read(int(le.Uint32(raw))); err != nil {
+				return nil, err
+			}
+		}
+
+		prefix := int(ty &^ xattrOOL)
+		if prefix >= len(xattrPrefixes) {
+			return nil, fmt.Errorf("%w: inode %v xattr prefix %v", ErrInvalidFilesystem, n.num, prefix)
+		}
+
+		out = append(out, rawXattr{name: xattrPrefixes[prefix] + string(name), value: value})
+	}
+
+	return out, nil
+}
+
+func (f *FS) attr(n *inodeData) (*fsmeta.Attr, error) {
+	mtime := time.Unix(int64(n.mtime), 0).UTC()
+
+	attr := &fsmeta.Attr{
+		Mode:       n.mode,
+		UID:        n.uid,
+		GID:        n.gid,
+		ModTime:    mtime,
+		AccessTime: mtime,
+		ChangeTime: mtime,
+		Inode:      uint64(n.num),
+	}
+
+	if n.mode&fs.ModeDevice != 0 {
+		attr.Major = n.dev & 0xFFF00 >> 8
+		attr.Minor = n.dev&0xFF | n.dev>>12&0xFFF00
+	}
+
+	attrs, err := f.xattrs(n)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range attrs {
+		if attr.Xattrs == nil {
+			attr.Xattrs = make(map[string][]byte)
+		}
+
+		attr.Xattrs[a.name] = a.value
+	}
+
+	return attr, nil
+}
+
+type rawDirEntry struct {
+	name string
+	ref  uint64
+}
+
+func (f *FS) readDir(n *inodeData) ([]rawDirEntry, error) {
+	// The recorded size includes three bytes for the implicit "." and ".." entries.
+	if n.size <= 3 {
+		return nil, nil
+	}
+
+	m := f.newMetaReader(f.dirTable+n.listing>>16, n.listing&0xFFFF)
+	remaining := int(n.size - 3)
+	le := binary.LittleEndian
+
+	var entries []rawDirEntry
+
+	for remaining > 0 {
+		header, err := m.read(12)
+		if err != nil {
+			return nil, err
+		}
+
+		count := le.Uint32(header) + 1
+		block := uint64(le.Uint32(header[4:]))
+		remaining -= 12
+
+		if count > maxDirEntries {
+			return nil, fmt.Errorf("%w: directory inode %v header has %v entries", ErrInvalidFilesystem, n.num, count)
+		}
+
+		for range count {
+			raw, err := m.read(8)
+			if err != nil {
+				return nil, err
+			}
+
+			name, err := m.read(int(le.Uint16(raw[6:])) + 1)
+			if err != nil {
+				return nil, err
+			}
+
+			entries = append(entries, rawDirEntry{name: string(name), ref: block<<16 | uint64(le.Uint16(raw))})
+			remaining -= 8 + len(name)
+		}
+	}
+
+	return entries, nil
+}
+
+func pathError(op string, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// resolve walks a path from the root, following symlinks in intermediate components and, when follow is set, the
+// final component. Symlink targets are interpreted relative to the image root.
+func (f *FS) resolve(op string, name string, follow bool) (*inodeData, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathError(op, name, fs.ErrInvalid)
+	}
+
+	root, err := f.readInode(f.rootRef)
+	if err != nil {
+		return nil, pathError(op, name, err)
+	}
+
+	stack := []*inodeData{root}
+	parts := strings.Split(name, "/")
+	links := 0
+
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		cur := stack[len(stack)-1]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+
+			continue
+		}
+
+		if !cur.isDir() {
+			return nil, pathError(op, name, ErrNotDir)
+		}
+
+		entries, err := f.readDir(cur)
+		if err != nil {
+			return nil, pathError(op, name, err)
+		}
+
+		idx := slices.IndexFunc(entries, func(e rawDirEntry) bool {
+			return e.name == part
+		})
+
+		if idx < 0 {
+			return nil, pathError(op, name, fs.ErrNotExist)
+		}
+
+		next, err := f.readInode(entries[idx].ref)
+		if err != nil {
+			return nil, pathError(op, name, err)
+		}
+
+		if next.isSymlink() && (len(parts) > 0 || follow) {
+			links++
+			if links > maxSymlinks {
+				return nil, pathError(op, name, errors.New("too many levels of symbolic links"))
+			}
+
+			if strings.HasPrefix(next.target, "/") {
+				stack = stack[:1]
+			}
+
+			parts = append(strings.Split(next.target, "/"), parts...)
+
+			continue
+		}
+
+		stack = append(stack, next)
+	}
+
+	return stack[len(stack)-1], nil
+}
+
+func (f *FS) info(name string, n *inodeData) (*fileInfo, error) {
+	attr, err := f.attr(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{name: name, size: int64(n.size), attr: attr}, nil
+}
+
+func (f *FS) Open(name string) (fs.File, error) {
+	n, err := f.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.info(path.Base(name), n)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+
+	if n.isDir() {
+		entries, err := f.dirEntries(n)
+		if err != nil {
+			return nil, pathError("open", name, err)
+		}
+
+		return &dir{info: info, entries: entries}, nil
+	}
+
+	return &file{fs: f, info: info, inode: n, block: -1}, nil
+}
+
+func (f *FS) dirEntries(n *inodeData) ([]fs.DirEntry, error) {
+	raw, err := f.readDir(n)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]fs.DirEntry, len(raw))
+
+	for i, e := range raw {
+		child, err := f.readInode(e.ref)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := f.info(e.name, child)
+		if err != nil {
+			return nil, err
+		}
+
+		out[i] = fs.FileInfoToDirEntry(info)
+	}
+
+	slices.SortFunc(out, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return out, nil
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := f.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if !n.isDir() {
+		return nil, pathError("readdir", name, ErrNotDir)
+	}
+
+	entries, err := f.dirEntries(n)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+
+	return entries, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	n, err := f.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.info(path.Base(name), n)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+
+	return info, nil
+}
+
+// Lstat describes a file without following a final symlink.
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	n, err := f.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.info(path.Base(name), n)
+	if err != nil {
+		return nil, pathError("lstat", name, err)
+	}
+
+	return info, nil
+}
+
+// ReadLink returns the target of a symlink.
+func (f *FS) ReadLink(name string) (string, error) {
+	n, err := f.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+
+	if !n.isSymlink() {
+		return "", pathError("readlink", name, fs.ErrInvalid)
+	}
+
+	return n.target, nil
+}
+
+type fileInfo struct {
+	name string
+	size int64
+	attr *fsmeta.Attr
+}
+
+func (i *fileInfo) Name() string {
+	return i.name
+}
+
+func (i *fileInfo) Size() int64 {
+	return i.size
+}
+
+func (i *fileInfo) Mode() fs.FileMode {
+	return i.attr.Mode
+}
+
+func (i *fileInfo) ModTime() time.Time {
+	return i.attr.ModTime
+}
+
+func (i *fileInfo) IsDir() bool {
+	return i.attr.Mode.IsDir()
+}
+
+func (i *fileInfo) Sys() any {
+	return i.attr
+}
+
+type file struct {
+	fs     *FS
+	info   *fileInfo
+	inode  *inodeData
+	offset int64
+
+	// The most recently decompressed block, avoiding repeated work for small sequential reads.
+	mu    sync.Mutex
+	block int64
+	data  []byte
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Read(data []byte) (int, error) {
+	n, err := f.ReadAt(data, f.offset)
+	f.offset += int64(n)
+
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (f *file) ReadAt(data []byte, off int64) (int, error) {
+	size := int64(f.inode.size)
+	bs := int64(f.fs.blockSize)
+
+	if off < 0 {
+		return 0, fs.ErrInvalid
+	}
+
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	total := 0
+
+	for total < len(data) && off < size {
+		if idx := off / bs; idx != f.block {
+			block, err := f.fs.fileBlock(f.inode, uint64(idx))
+			if err != nil {
+				return total, err
+			}
+
+			f.block = idx
+			f.data = block
+		}
+
+		copied := copy(data[total:], f.data[off%bs:])
+		total += copied
+		off += int64(copied)
+	}
+
+	if total < len(data) {
+		return total, io.EOF
+	}
+
+	return total, nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	default:
+		return 0, fs.ErrInvalid
+	}
+
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+type dir struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *dir) ReadDir(count int) ([]fs.DirEntry, error) {
+	entries := d.entries[d.offset:]
+
+	if count > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+
+		entries = entries[:min(count, len(entries))]
+	}
+
+	d.offset += len(entries)
+
+	return entries, nil
+}
+
+func (d *dir) Close() error {
+	return nil
+}
@@ -0,0 +1,179 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/csnewman/go-appliance/pkg/internal/membuf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rawDeflate stands in for a compressor outside the standard library.
+type rawDeflate struct{}
+
+func (rawDeflate) ID() Compression {
+	return CompressionZstd
+}
+
+func (rawDeflate) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	fw, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fw.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (rawDeflate) Decompress(data []byte, limit int) ([]byte, error) {
+	return io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), int64(limit)))
+}
+
+func (rawDeflate) Options() []byte {
+	return []byte{1, 0, 0, 0}
+}
+
+func TestReaderRoundTrip(t *testing.T) {
+	for _, opts := range []Options{{}, {BlockSize: 4096, NoFragments: true}, {Compressor: rawDeflate{}}} {
+		img := &membuf.Buffer{}
+		mtime := time.Date(2023, 7, 1, 8, 30, 0, 0, time.UTC)
+
+		w, err := NewWriter(img, 0, opts)
+		require.NoError(t, err, "writer should create")
+
+		large := bytes.Repeat([]byte("squashfs reader "), 100000)
+		clear(large[300000:700000])
+
+		require.NoError(t, w.WriteFile("etc/motd", strings.NewReader("welcome\n"), fsmeta.Attr{
+			Mode:    0o640 | fs.ModeSetgid,
+			UID:     1000,
+			GID:     100000,
+			ModTime: mtime,
+			Xattrs:  map[string][]byte{"user.note": []byte("hi"), "trusted.big": bytes.Repeat([]byte{1}, 9000)},
+		}), "file should write")
+		require.NoError(t, w.WriteFile("var/large.bin", bytes.NewReader(large), fsmeta.Attr{Mode: 0o600}),
+			"large file should write")
+		require.NoError(t, w.WriteFile("var/copy.bin", bytes.NewReader(large), fsmeta.Attr{Mode: 0o600}),
+			"duplicate file should write")
+		require.NoError(t, w.Symlink("etc/issue", "motd", fsmeta.Attr{Mode: 0o777}), "symlink should create")
+		require.NoError(t, w.Symlink("abs", "/etc/motd", fsmeta.Attr{Mode: 0o777}), "symlink should create")
+		require.NoError(t, w.Link("motd.link", "etc/motd"), "hard link should create")
+		require.NoError(t, w.Mknod("dev/sda", fsmeta.Attr{Mode: fs.ModeDevice | 0o660, Major: 8, Minor: 300}),
+			"device should create")
+		require.NoError(t, w.Mknod("dev/tty", fsmeta.Attr{
+			Mode:   fs.ModeDevice | fs.ModeCharDevice | 0o620,
+			Xattrs: map[string][]byte{"security.label": []byte("tty")},
+		}), "char device should create")
+		require.NoError(t, w.Mknod("run/fifo", fsmeta.Attr{Mode: fs.ModeNamedPipe | 0o600}), "fifo should create")
+		require.NoError(t, w.Mknod("run/sock", fsmeta.Attr{Mode: fs.ModeSocket | 0o600}), "socket should create")
+
+		for i := range 600 {
+			require.NoError(t, w.WriteFile("many/"+strings.Repeat("f", i%60)+string(rune('a'+i%26))+
+				strings.Repeat("0", i/26), strings.NewReader(strings.Repeat("z", i)), fsmeta.Attr{Mode: 0o644}),
+				"file should write")
+		}
+
+		require.NoError(t, w.Close(), "writer should close")
+
+		_, err = Open(bytes.NewReader(img.Data))
+		if opts.Compressor != nil {
+			assert.ErrorIs(t, err, ErrUnsupportedCompression, "missing decompressor should be reported")
+		}
+
+		fsys, err := Open(bytes.NewReader(img.Data), rawDeflate{})
+		require.NoError(t, err, "image should open")
+
+		require.NoError(t, fstest.TestFS(fsys, "etc/motd", "var/large.bin", "motd.link", "dev/sda", "run/sock",
+			"many/a"), "image should behave")
+
+		for _, name := range []string{"var/large.bin", "var/copy.bin"} {
+			data, err := fs.ReadFile(fsys, name)
+			require.NoError(t, err, "large file should read")
+			assert.True(t, bytes.Equal(large, data), "large file should round trip")
+		}
+
+		data, err := fs.ReadFile(fsys, "abs")
+		require.NoError(t, err, "absolute symlink should be followed")
+		assert.Equal(t, "welcome\n", string(data), "absolute symlink should resolve from the root")
+
+		target, err := fsys.ReadLink("etc/issue")
+		require.NoError(t, err, "link should read")
+		assert.Equal(t, "motd", target, "link target should match")
+
+		info, err := fsys.Lstat("etc/issue")
+		require.NoError(t, err, "lstat should succeed")
+		assert.Equal(t, fs.ModeSymlink, info.Mode().Type(), "lstat should not follow links")
+
+		info, err = fsys.Stat("etc/motd")
+		require.NoError(t, err, "stat should succeed")
+
+		attr := info.Sys().(*fsmeta.Attr)
+		assert.Equal(t, 0o640|fs.ModeSetgid, info.Mode(), "mode should round trip")
+		assert.Equal(t, uint32(1000), attr.UID, "uid should round trip")
+		assert.Equal(t, uint32(100000), attr.GID, "gid should round trip")
+		assert.Equal(t, mtime, info.ModTime(), "mtime should round trip")
+		assert.Equal(t, []byte("hi"), attr.Xattrs["user.note"], "xattr should round trip")
+		assert.Len(t, attr.Xattrs["trusted.big"], 9000, "large xattr should round trip")
+
+		link, err := fsys.Stat("motd.link")
+		require.NoError(t, err, "hard link should stat")
+		assert.Equal(t, attr.Inode, link.Sys().(*fsmeta.Attr).Inode, "hard link should share an inode")
+
+		info, err = fsys.Stat("dev/sda")
+		require.NoError(t, err, "device should stat")
+		assert.Equal(t, fs.ModeDevice, info.Mode().Type(), "device type should round trip")
+		assert.Equal(t, uint32(8), info.Sys().(*fsmeta.Attr).Major, "major should round trip")
+		assert.Equal(t, uint32(300), info.Sys().(*fsmeta.Attr).Minor, "minor should round trip")
+
+		info, err = fsys.Stat("dev/tty")
+		require.NoError(t, err, "char device should stat")
+		assert.Equal(t, []byte("tty"), info.Sys().(*fsmeta.Attr).Xattrs["security.label"],
+			"extended device should keep xattrs")
+
+		entries, err := fsys.ReadDir("many")
+		require.NoError(t, err, "large directory should list")
+		assert.Len(t, entries, 600, "all entries should be listed")
+	}
+}
+
+func TestReaderInvalid(t *testing.T) {
+	_, err := Open(bytes.NewReader(make([]byte, 4096)))
+	assert.ErrorIs(t, err, ErrInvalidFilesystem, "zeroed image should be rejected")
+
+	w, img := buildImage(t, Options{})
+	require.NotNil(t, w, "image should build")
+
+	corrupt := bytes.Clone(img)
+	corrupt[12] = 0x10
+
+	_, err = Open(bytes.NewReader(corrupt))
+	assert.ErrorIs(t, err, ErrInvalidFilesystem, "bad block size should be rejected")
+
+	fsys, err := Open(bytes.NewReader(img))
+	require.NoError(t, err, "image should open")
+	assert.Equal(t, CompressionGzip, fsys.Compression(), "compression should be reported")
+	assert.Equal(t, DefaultBlock, fsys.BlockSize(), "block size should be reported")
+
+	_, err = fsys.Open("missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist, "missing file should not exist")
+
+	_, err = fsys.ReadDir("etc/hostname")
+	assert.ErrorIs(t, err, ErrNotDir, "file should not list")
+}
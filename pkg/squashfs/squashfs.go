@@ -0,0 +1,204 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	Magic           = 0x73717368
+	SuperblockSize  = 96
+	VersionMajor    = 4
+	VersionMinor    = 0
+	MetadataSize    = 8192
+	DefaultBlock    = 128 * 1024
+	MinBlockSize    = 4096
+	MaxBlockSize    = 1024 * 1024
+	PadSize         = 4096
+	InvalidFragment = 0xFFFFFFFF
+	InvalidXattr    = 0xFFFFFFFF
+	NotPresent      = 0xFFFFFFFFFFFFFFFF
+
+	metaUncompressed = 0x8000
+	dataUncompressed = 1 << 24
+	maxDirEntries    = 256
+	maxIDs           = 65536
+)
+
+// Superblock flags.
+const (
+	FlagUncompressedInodes    = 0x0001
+	FlagUncompressedData      = 0x0002
+	FlagCheck                 = 0x0004
+	FlagUncompressedFragments = 0x0008
+	FlagNoFragments           = 0x0010
+	FlagAlwaysFragments       = 0x0020
+	FlagDuplicates            = 0x0040
+	FlagExportable            = 0x0080
+	FlagUncompressedXattrs    = 0x0100
+	FlagNoXattrs              = 0x0200
+	FlagCompressorOptions     = 0x0400
+	FlagUncompressedIDs       = 0x0800
+)
+
+// Inode types. Extended variants add fields such as xattrs and link counts and equal the basic type plus 7.
+const (
+	TypeDir = iota + 1
+	TypeFile
+	TypeSymlink
+	TypeBlock
+	TypeChar
+	TypeFIFO
+	TypeSocket
+	TypeExtDir
+	TypeExtFile
+	TypeExtSymlink
+	TypeExtBlock
+	TypeExtChar
+	TypeExtFIFO
+	TypeExtSocket
+)
+
+// Xattr prefix identifiers, with the flag marking values stored out of line.
+const (
+	XattrUser     = 0
+	XattrTrusted  = 1
+	XattrSecurity = 2
+	xattrOOL      = 0x100
+)
+
+var xattrPrefixes = []string{"user.", "trusted.", "security."}
+
+var (
+	ErrInvalidBlock    = errors.New("invalid block size")
+	ErrNoSpace         = errors.New("no space left for image")
+	ErrInvalidName     = errors.New("invalid file name")
+	ErrExist           = errors.New("file already exists")
+	ErrNotDir          = errors.New("not a directory")
+	ErrUnsupportedType = errors.New("unsupported file type")
+	ErrInvalidXattr    = errors.New("invalid extended attribute")
+	ErrTooManyIDs      = errors.New("too many uids and gids")
+	ErrClosed          = errors.New("writer closed")
+
+	ErrInvalidFilesystem      = errors.New("invalid squashfs image")
+	ErrUnsupportedCompression = errors.New("unsupported compression")
+)
+
+type Compression uint16
+
+const (
+	CompressionGzip Compression = iota + 1
+	CompressionLZMA
+	CompressionLZO
+	CompressionXZ
+	CompressionLZ4
+	CompressionZstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionGzip:
+		return "gzip"
+	case CompressionLZMA:
+		return "lzma"
+	case CompressionLZO:
+		return "lzo"
+	case CompressionXZ:
+		return "xz"
+	case CompressionLZ4:
+		return "lz4"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("Compression(%d)", uint16(c))
+	}
+}
+
+// Compressor compresses individual data and metadata blocks. Implementations for xz, zstd or lz4 can be provided by
+// callers, producing raw blocks in the format the kernel expects for the reported ID.
+type Compressor interface {
+	ID() Compression
+	Compress(data []byte) ([]byte, error)
+	// Options returns the compressor options block, or nil when the defaults are used.
+	Options() []byte
+}
+
+// Decompressor expands blocks produced by the compressor with the reported ID. The output must not exceed limit bytes.
+type Decompressor interface {
+	ID() Compression
+	Decompress(data []byte, limit int) ([]byte, error)
+}
+
+// Gzip compresses blocks as zlib streams, which is the format squashfs uses for its gzip compressor.
+type Gzip struct {
+	Level int
+}
+
+func (g Gzip) ID() Compression {
+	return CompressionGzip
+}
+
+func (g Gzip) Compress(data []byte) ([]byte, error) {
+	level := g.Level
+	if level == 0 {
+		level = zlib.BestCompression
+	}
+
+	var buf bytes.Buffer
+
+	zw, err := zlib.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zlib writer: %w", err)
+	}
+
+	if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (g Gzip) Decompress(data []byte, limit int) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zlib reader: %w", err)
+	}
+
+	defer zr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+
+	if len(out) > limit {
+		return nil, fmt.Errorf("%w: block exceeds %v bytes", ErrInvalidFilesystem, limit)
+	}
+
+	return out, nil
+}
+
+func (g Gzip) Options() []byte {
+	return nil
+}
+
+type Options struct {
+	// BlockSize is the data block size, a power of two between 4KiB and 1MiB, defaulting to 128KiB.
+	BlockSize int
+	// Compressor defaults to Gzip.
+	Compressor Compressor
+	// NoFragments stores file tails in their own blocks rather than packing them together.
+	NoFragments bool
+	// NoDeduplication disables sharing the data of identical files.
+	NoDeduplication bool
+	// Time is stored in the superblock as the image modification time, and defaults to the Unix epoch.
+	Time time.Time
+}
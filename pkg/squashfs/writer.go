@@ -0,0 +1,1014 @@
+package squashfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+)
+
+type node struct {
+	attr     fsmeta.Attr
+	links    uint32
+	children map[string]*node
+
+	size       uint64
+	start      uint64
+	blocks     []uint32
+	fragment   uint32
+	fragOffset uint32
+	sparse     uint64
+	target     string
+
+	num     uint32
+	ref     uint64
+	written bool
+}
+
+func (n *node) isDir() bool {
+	return n.attr.Mode.IsDir()
+}
+
+func (n *node) sortedNames() []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+func withType(mode fs.FileMode, ty fs.FileMode) fs.FileMode {
+	return mode&^fs.ModeType | ty
+}
+
+// basicType returns the basic inode type, which is also used for directory entries.
+func basicType(mode fs.FileMode) uint16 {
+	switch mode.Type() {
+	case fs.ModeDir:
+		return TypeDir
+	case fs.ModeSymlink:
+		return TypeSymlink
+	case fs.ModeDevice:
+		return TypeBlock
+	case fs.ModeDevice | fs.ModeCharDevice:
+		return TypeChar
+	case fs.ModeNamedPipe:
+		return TypeFIFO
+	case fs.ModeSocket:
+		return TypeSocket
+	default:
+		return TypeFile
+	}
+}
+
+type fragmentEntry struct {
+	start uint64
+	size  uint32
+}
+
+type xattrEntry struct {
+	ref   uint64
+	count uint32
+	size  uint32
+}
+
+// Writer builds a squashfs image. File data is written as it is added, whilst inodes, directories and lookup tables
+// are written on Close.
+type Writer struct {
+	dst       io.WriterAt
+	limit     int64
+	opts      Options
+	comp      Compressor
+	blockSize uint64
+	pos       uint64
+	high      uint64
+	root      *node
+	nodes     int
+
+	fragBuf   []byte
+	fragments []fragmentEntry
+	dedup     map[[sha256.Size]byte]*node
+
+	ids      []uint32
+	idIndex  map[uint32]uint16
+	xattrKV  *metaWriter
+	xattrs   []xattrEntry
+	xattrIDs map[string]uint32
+
+	closed bool
+	size   int64
+}
+
+// NewWriter prepares an image within dst. A positive size limits the space the image may use, such as the size of the
+// target partition.
+func NewWriter(dst io.WriterAt, size int64, opts Options) (*Writer, error) {
+	if opts.BlockSize == 0 {
+		opts.BlockSize = DefaultBlock
+	}
+
+	bs := opts.BlockSize
+	if bs < MinBlockSize || bs > MaxBlockSize || bs&(bs-1) != 0 {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBlock, bs)
+	}
+
+	if opts.Compressor == nil {
+		opts.Compressor = Gzip{}
+	}
+
+	w := &Writer{
+		dst:       dst,
+		limit:     size,
+		opts:      opts,
+		comp:      opts.Compressor,
+		blockSize: uint64(bs),
+		pos:       SuperblockSize,
+		root: &node{
+			attr:     fsmeta.Attr{Mode: fs.ModeDir | 0o755, ModTime: opts.Time},
+			children: make(map[string]*node),
+		},
+		dedup:    make(map[[sha256.Size]byte]*node),
+		idIndex:  make(map[uint32]uint16),
+		xattrKV:  newMetaWriter(opts.Compressor),
+		xattrIDs: make(map[string]uint32),
+	}
+
+	if options := w.comp.Options(); options != nil {
+		header := binary.LittleEndian.AppendUint16(nil, uint16(len(options))|metaUncompressed)
+
+		if err := w.writeData(append(header, options...)); err != nil {
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+func (w *Writer) writeAt(data []byte, off uint64) error {
+	if w.limit > 0 && off+uint64(len(data)) > uint64(w.limit) {
+		return fmt.Errorf("%w: image exceeds %v bytes", ErrNoSpace, w.limit)
+	}
+
+	if _, err := w.dst.WriteAt(data, int64(off)); err != nil {
+		return fmt.Errorf("failed to write image: %w", err)
+	}
+
+	w.high = max(w.high, off+uint64(len(data)))
+
+	return nil
+}
+
+func (w *Writer) writeData(data []byte) error {
+	if err := w.writeAt(data, w.pos); err != nil {
+		return err
+	}
+
+	w.pos += uint64(len(data))
+
+	return nil
+}
+
+// writeBlock compresses and writes a data block, returning its size entry.
+func (w *Writer) writeBlock(data []byte) (uint32, error) {
+	block, compressed, err := compressBlock(w.comp, data)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := w.writeData(block); err != nil {
+		return 0, err
+	}
+
+	size := uint32(len(block))
+	if !compressed {
+		size |= dataUncompressed
+	}
+
+	return size, nil
+}
+
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || len(name) > 256 || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	return nil
+}
+
+func splitPath(name string) (string, string) {
+	return path.Split(strings.Trim(path.Clean("/"+name), "/"))
+}
+
+func (w *Writer) lookup(name string, create bool) (*node, error) {
+	name = strings.Trim(path.Clean("/"+name), "/")
+
+	cur := w.root
+
+	if name == "" {
+		return cur, nil
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		next := cur.children[part]
+
+		if next == nil {
+			if !create {
+				return nil, fmt.Errorf("%w: %v", fs.ErrNotExist, name)
+			}
+
+			var err error
+
+			next, err = w.addNode(cur, part, fsmeta.Attr{Mode: fs.ModeDir | 0o755, ModTime: w.opts.Time})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !next.isDir() {
+			return nil, fmt.Errorf("%w: %v", ErrNotDir, part)
+		}
+
+		cur = next
+	}
+
+	return cur, nil
+}
+
+func (w *Writer) addNode(parent *node, name string, attr fsmeta.Attr) (*node, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	if parent.children[name] != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExist, name)
+	}
+
+	if err := validXattrs(&attr); err != nil {
+		return nil, err
+	}
+
+	n := &node{
+		attr:     attr,
+		links:    1,
+		fragment: InvalidFragment,
+	}
+
+	if attr.Mode.IsDir() {
+		n.children = make(map[string]*node)
+	}
+
+	parent.children[name] = n
+	w.nodes++
+
+	return n, nil
+}
+
+func (w *Writer) create(name string, attr fsmeta.Attr) (*node, error) {
+	if w.closed {
+		return nil, ErrClosed
+	}
+
+	dir, base := splitPath(name)
+
+	parent, err := w.lookup(dir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return w.addNode(parent, base, attr)
+}
+
+// Mkdir creates a directory, along with any missing parents. The metadata of an existing directory, including the
+// root when name is ".", is replaced.
+func (w *Writer) Mkdir(name string, attr fsmeta.Attr) error {
+	if w.closed {
+		return ErrClosed
+	}
+
+	attr.Mode = withType(attr.Mode, fs.ModeDir)
+
+	dir, base := splitPath(name)
+
+	existing := w.root
+
+	if base != "" {
+		parent, err := w.lookup(dir, true)
+		if err != nil {
+			return err
+		}
+
+		existing = parent.children[base]
+
+		if existing == nil || !existing.isDir() {
+			_, err = w.addNode(parent, base, attr)
+
+			return err
+		}
+	}
+
+	if err := validXattrs(&attr); err != nil {
+		return err
+	}
+
+	existing.attr = attr
+
+	return nil
+}
+
+// WriteFile creates a regular file, along with any missing parent directories, containing the data read from r.
+// Blocks consisting entirely of zeros are stored sparsely, and files identical to one already written share its data.
+func (w *Writer) WriteFile(name string, r io.Reader, attr fsmeta.Attr) error {
+	attr.Mode = withType(attr.Mode, 0)
+
+	n, err := w.create(name, attr)
+	if err != nil {
+		return err
+	}
+
+	n.start = w.pos
+
+	hash := sha256.New()
+	buf := make([]byte, w.blockSize)
+
+	var tail []byte
+
+	for {
+		read, err := io.ReadFull(r, buf)
+		if read > 0 {
+			hash.Write(buf[:read])
+			n.size += uint64(read)
+
+			switch {
+			case uint64(read) < w.blockSize && !w.opts.NoFragments:
+				tail = bytes.Clone(buf[:read])
+			case isZero(buf[:read]):
+				n.blocks = append(n.blocks, 0)
+				n.sparse += uint64(read)
+			default:
+				size, err := w.writeBlock(buf[:read])
+				if err != nil {
+					return fmt.Errorf("writing %v: %w", name, err)
+				}
+
+				n.blocks = append(n.blocks, size)
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read %v: %w", name, err)
+		}
+	}
+
+	var sum [sha256.Size]byte
+	hash.Sum(sum[:0])
+
+	if prev := w.dedup[sum]; prev != nil && prev.size == n.size && !w.opts.NoDeduplication {
+		// Discard the data just written, it is overwritten by whatever follows.
+		w.pos = n.start
+		n.start = prev.start
+		n.blocks = prev.blocks
+		n.fragment = prev.fragment
+		n.fragOffset = prev.fragOffset
+		n.sparse = prev.sparse
+
+		return nil
+	}
+
+	if len(tail) > 0 {
+		if err := w.addFragment(n, tail); err != nil {
+			return fmt.Errorf("writing %v: %w", name, err)
+		}
+	}
+
+	w.dedup[sum] = n
+
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (w *Writer) addFragment(n *node, tail []byte) error {
+	if uint64(len(w.fragBuf)+len(tail)) > w.blockSize {
+		if err := w.flushFragment(); err != nil {
+			return err
+		}
+	}
+
+	n.fragment = uint32(len(w.fragments))
+	n.fragOffset = uint32(len(w.fragBuf))
+	w.fragBuf = append(w.fragBuf, tail...)
+
+	return nil
+}
+
+func (w *Writer) flushFragment() error {
+	if len(w.fragBuf) == 0 {
+		return nil
+	}
+
+	start := w.pos
+
+	size, err := w.writeBlock(w.fragBuf)
+	if err != nil {
+		return err
+	}
+
+	w.fragments = append(w.fragments, fragmentEntry{start: start, size: size})
+	w.fragBuf = w.fragBuf[:0]
+
+	return nil
+}
+
+// Symlink creates a symbolic link pointing at target.
+func (w *Writer) Symlink(name string, target string, attr fsmeta.Attr) error {
+	if target == "" {
+		return fmt.Errorf("%w: empty symlink target", ErrInvalidName)
+	}
+
+	attr.Mode = withType(attr.Mode, fs.ModeSymlink)
+
+	n, err := w.create(name, attr)
+	if err != nil {
+		return err
+	}
+
+	n.target = target
+
+	return nil
+}
+
+// Mknod creates a device node, FIFO or socket, selected by the type bits of attr.Mode.
+func (w *Writer) Mknod(name string, attr fsmeta.Attr) error {
+	switch attr.Mode.Type() {
+	case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice, fs.ModeNamedPipe, fs.ModeSocket:
+	default:
+		return fmt.Errorf("%w: %v is %v", ErrUnsupportedType, name, attr.Mode.Type())
+	}
+
+	_, err := w.create(name, attr)
+
+	return err
+}
+
+// Link creates a hard link to an existing non-directory entry.
+func (w *Writer) Link(name string, target string) error {
+	if w.closed {
+		return ErrClosed
+	}
+
+	tdir, tbase := splitPath(target)
+
+	tparent, err := w.lookup(tdir, false)
+	if err != nil {
+		return err
+	}
+
+	n := tparent.children[tbase]
+	if n == nil {
+		return fmt.Errorf("%w: %v", fs.ErrNotExist, target)
+	}
+
+	if n.isDir() {
+		return fmt.Errorf("%w: cannot hard link directory %v", ErrUnsupportedType, target)
+	}
+
+	dir, base := splitPath(name)
+
+	parent, err := w.lookup(dir, true)
+	if err != nil {
+		return err
+	}
+
+	if err := validName(base); err != nil {
+		return err
+	}
+
+	if parent.children[base] != nil {
+		return fmt.Errorf("%w: %v", ErrExist, name)
+	}
+
+	parent.children[base] = n
+	n.links++
+
+	return nil
+}
+
+// AddFS copies the contents of fsys into the image root, as described by fsmeta.CopyFS.
+func (w *Writer) AddFS(fsys fs.FS) error {
+	return fsmeta.CopyFS(w, fsys)
+}
+
+func validXattrs(attr *fsmeta.Attr) error {
+	for name := range attr.Xattrs {
+		if _, _, err := splitXattr(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func splitXattr(name string) (uint16, string, error) {
+	for i, prefix := range xattrPrefixes {
+		if suffix, ok := strings.CutPrefix(name, prefix); ok && suffix != "" {
+			return uint16(i), suffix, nil
+		}
+	}
+
+	return 0, "", fmt.Errorf("%w: %v has an unsupported namespace", ErrInvalidXattr, name)
+}
+
+func (w *Writer) id(value uint32) (uint16, error) {
+	if idx, ok := w.idIndex[value]; ok {
+		return idx, nil
+	}
+
+	if len(w.ids) >= maxIDs {
+		return 0, ErrTooManyIDs
+	}
+
+	idx := uint16(len(w.ids))
+	w.ids = append(w.ids, value)
+	w.idIndex[value] = idx
+
+	return idx, nil
+}
+
+// xattrID stores the attributes of an inode, sharing identical sets between inodes.
+func (w *Writer) xattrID(attr *fsmeta.Attr) (uint32, error) {
+	if len(attr.Xattrs) == 0 {
+		return InvalidXattr, nil
+	}
+
+	var data []byte
+
+	for _, name := range attr.XattrNames() {
+		prefix, suffix, err := splitXattr(name)
+		if err != nil {
+			return 0, err
+		}
+
+		value := attr.Xattrs[name]
+
+		data = binary.LittleEndian.AppendUint16(data, prefix)
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(suffix)))
+		data = append(data, suffix...)
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(value)))
+		data = append(data, value...)
+	}
+
+	if id, ok := w.xattrIDs[string(data)]; ok {
+		return id, nil
+	}
+
+	entry := xattrEntry{
+		ref:   w.xattrKV.ref(),
+		count: uint32(len(attr.Xattrs)),
+		size:  uint32(len(data)),
+	}
+
+	if err := w.xattrKV.write(data); err != nil {
+		return 0, err
+	}
+
+	id := uint32(len(w.xattrs))
+	w.xattrs = append(w.xattrs, entry)
+	w.xattrIDs[string(data)] = id
+
+	return id, nil
+}
+
+// number assigns inode numbers in the order inodes are written: children before their parent directory.
+func (w *Writer) number(dir *node, next *uint32) {
+	for _, name := range dir.sortedNames() {
+		child := dir.children[name]
+
+		if child.isDir() {
+			w.number(child, next)
+		} else if child.num == 0 {
+			*next++
+			child.num = *next
+		}
+	}
+
+	*next++
+	dir.num = *next
+}
+
+type tables struct {
+	inodes *metaWriter
+	dirs   *metaWriter
+}
+
+func (w *Writer) Close() error {
+	if w.closed {
+		return ErrClosed
+	}
+
+	w.closed = true
+
+	if err := w.flushFragment(); err != nil {
+		return err
+	}
+
+	var count uint32
+
+	w.number(w.root, &count)
+
+	t := &tables{
+		inodes: newMetaWriter(w.comp),
+		dirs:   newMetaWriter(w.comp),
+	}
+
+	if err := w.writeDir(t, w.root, count+1); err != nil {
+		return err
+	}
+
+	if err := t.inodes.flush(); err != nil {
+		return err
+	}
+
+	if err := t.dirs.flush(); err != nil {
+		return err
+	}
+
+	return w.writeTables(t, count)
+}
+
+func (w *Writer) writeDir(t *tables, dir *node, parent uint32) error {
+	names := dir.sortedNames()
+	subdirs := uint32(0)
+
+	for _, name := range names {
+		child := dir.children[name]
+
+		if child.isDir() {
+			subdirs++
+
+			if err := w.writeDir(t, child, dir.num); err != nil {
+				return err
+			}
+		} else if !child.written {
+			if err := w.writeInode(t, child, 0, 0, 0); err != nil {
+				return err
+			}
+		}
+	}
+
+	listing := t.dirs.ref()
+	size := uint32(0)
+
+	for i := 0; i < len(names); {
+		base := dir.children[names[i]]
+		block := base.ref >> 16
+
+		j := i + 1
+		for j < len(names) && j-i < maxDirEntries {
+			c := dir.children[names[j]]
+			diff := int64(c.num) - int64(base.num)
+
+			if c.ref>>16 != block || diff < -32768 || diff > 32767 {
+				break
+			}
+
+			j++
+		}
+
+		header := binary.LittleEndian.AppendUint32(nil, uint32(j-i-1))
+		header = binary.LittleEndian.AppendUint32(header, uint32(block))
+		header = binary.LittleEndian.AppendUint32(header, base.num)
+
+		for _, name := range names[i:j] {
+			c := dir.children[name]
+
+			header = binary.LittleEndian.AppendUint16(header, uint16(c.ref))
+			header = binary.LittleEndian.AppendUint16(header, uint16(int16(int64(c.num)-int64(base.num))))
+			header = binary.LittleEndian.AppendUint16(header, basicType(c.attr.Mode))
+			header = binary.LittleEndian.AppendUint16(header, uint16(len(name)-1))
+			header = append(header, name...)
+		}
+
+		if err := t.dirs.write(header); err != nil {
+			return err
+		}
+
+		size += uint32(len(header))
+		i = j
+	}
+
+	dir.links = 2 + subdirs
+
+	return w.writeInode(t, dir, listing, size+3, parent)
+}
+
+// writeInode appends an inode to the inode table. Directories pass the location and size of their listing.
+func (w *Writer) writeInode(t *tables, n *node, listing uint64, dirSize uint32, parent uint32) error {
+	le := binary.LittleEndian
+
+	uid, err := w.id(n.attr.UID)
+	if err != nil {
+		return err
+	}
+
+	gid, err := w.id(n.attr.GID)
+	if err != nil {
+		return err
+	}
+
+	xattr, err := w.xattrID(&n.attr)
+	if err != nil {
+		return err
+	}
+
+	mtime := n.attr.ModTime.Unix()
+	if mtime < 0 || n.attr.ModTime.IsZero() {
+		mtime = 0
+	}
+
+	ty := basicType(n.attr.Mode)
+	ext := xattr != InvalidXattr
+
+	var body []byte
+
+	switch ty {
+	case TypeDir:
+		ext = ext || dirSize > 0xFFFF
+
+		if ext {
+			body = le.AppendUint32(body, n.links)
+			body = le.AppendUint32(body, dirSize)
+			body = le.AppendUint32(body, uint32(listing>>16))
+			body = le.AppendUint32(body, parent)
+			body = le.AppendUint16(body, 0)
+			body = le.AppendUint16(body, uint16(listing))
+			body = le.AppendUint32(body, xattr)
+		} else {
+			body = le.AppendUint32(body, uint32(listing>>16))
+			body = le.AppendUint32(body, n.links)
+			body = le.AppendUint16(body, uint16(dirSize))
+			body = le.AppendUint16(body, uint16(listing))
+			body = le.AppendUint32(body, parent)
+		}
+	case TypeFile:
+		ext = ext || n.links > 1 || n.sparse > 0 || n.size > 0xFFFFFFFF || n.start > 0xFFFFFFFF
+
+		if ext {
+			body = le.AppendUint64(body, n.start)
+			body = le.AppendUint64(body, n.size)
+			body = le.AppendUint64(body, n.sparse)
+			body = le.AppendUint32(body, n.links)
+			body = le.AppendUint32(body, n.fragment)
+			body = le.AppendUint32(body, n.fragOffset)
+			body = le.AppendUint32(body, xattr)
+		} else {
+			body = le.AppendUint32(body, uint32(n.start))
+			body = le.AppendUint32(body, n.fragment)
+			body = le.AppendUint32(body, n.fragOffset)
+			body = le.AppendUint32(body, uint32(n.size))
+		}
+
+		for _, size := range n.blocks {
+			body = le.AppendUint32(body, size)
+		}
+	case TypeSymlink:
+		body = le.AppendUint32(body, n.links)
+		body = le.AppendUint32(body, uint32(len(n.target)))
+		body = append(body, n.target...)
+
+		if ext {
+			body = le.AppendUint32(body, xattr)
+		}
+	case TypeBlock, TypeChar:
+		major, minor := n.attr.Major, n.attr.Minor
+
+		body = le.AppendUint32(body, n.links)
+		body = le.AppendUint32(body, minor&0xFF|major<<8|(minor&^0xFF)<<12)
+
+		if ext {
+			body = le.AppendUint32(body, xattr)
+		}
+	default:
+		body = le.AppendUint32(body, n.links)
+
+		if ext {
+			body = le.AppendUint32(body, xattr)
+		}
+	}
+
+	if ext {
+		ty += TypeExtDir - TypeDir
+	}
+
+	header := le.AppendUint16(nil, ty)
+	header = le.AppendUint16(header, uint16(fsmeta.UnixMode(n.attr.Mode)&0o7777))
+	header = le.AppendUint16(header, uid)
+	header = le.AppendUint16(header, gid)
+	header = le.AppendUint32(header, uint32(mtime))
+	header = le.AppendUint32(header, n.num)
+
+	n.ref = t.inodes.ref()
+	n.written = true
+
+	return t.inodes.write(append(header, body...))
+}
+
+// writeLookup writes a table split into metadata blocks followed by the index of block locations, returning the
+// location of the index.
+func (w *Writer) writeLookup(data []byte) (uint64, error) {
+	m := newMetaWriter(w.comp)
+
+	if err := m.write(data); err != nil {
+		return 0, err
+	}
+
+	if err := m.flush(); err != nil {
+		return 0, err
+	}
+
+	start := w.pos
+
+	if err := w.writeData(m.out); err != nil {
+		return 0, err
+	}
+
+	index := w.pos
+
+	var ptrs []byte
+	for _, s := range m.starts {
+		ptrs = binary.LittleEndian.AppendUint64(ptrs, start+s)
+	}
+
+	if err := w.writeData(ptrs); err != nil {
+		return 0, err
+	}
+
+	return index, nil
+}
+
+func (w *Writer) writeTables(t *tables, count uint32) error {
+	le := binary.LittleEndian
+
+	inodeStart := w.pos
+	if err := w.writeData(t.inodes.out); err != nil {
+		return err
+	}
+
+	dirStart := w.pos
+	if err := w.writeData(t.dirs.out); err != nil {
+		return err
+	}
+
+	var frags []byte
+	for _, f := range w.fragments {
+		frags = le.AppendUint64(frags, f.start)
+		frags = le.AppendUint32(frags, f.size)
+		frags = le.AppendUint32(frags, 0)
+	}
+
+	fragStart, err := w.writeLookup(frags)
+	if err != nil {
+		return err
+	}
+
+	var ids []byte
+	for _, id := range w.ids {
+		ids = le.AppendUint32(ids, id)
+	}
+
+	idStart, err := w.writeLookup(ids)
+	if err != nil {
+		return err
+	}
+
+	xattrStart := uint64(NotPresent)
+	flags := uint16(0)
+
+	if len(w.xattrs) > 0 {
+		if err := w.xattrKV.flush(); err != nil {
+			return err
+		}
+
+		kvStart := w.pos
+		if err := w.writeData(w.xattrKV.out); err != nil {
+			return err
+		}
+
+		var entries []byte
+		for _, x := range w.xattrs {
+			entries = le.AppendUint64(entries, x.ref)
+			entries = le.AppendUint32(entries, x.count)
+			entries = le.AppendUint32(entries, x.size)
+		}
+
+		m := newMetaWriter(w.comp)
+		if err := m.write(entries); err != nil {
+			return err
+		}
+
+		if err := m.flush(); err != nil {
+			return err
+		}
+
+		idsStart := w.pos
+		if err := w.writeData(m.out); err != nil {
+			return err
+		}
+
+		xattrStart = w.pos
+
+		header := le.AppendUint64(nil, kvStart)
+		header = le.AppendUint32(header, uint32(len(w.xattrs)))
+		header = le.AppendUint32(header, 0)
+
+		for _, s := range m.starts {
+			header = le.AppendUint64(header, idsStart+s)
+		}
+
+		if err := w.writeData(header); err != nil {
+			return err
+		}
+	} else {
+		flags |= FlagNoXattrs
+	}
+
+	if w.opts.NoFragments {
+		flags |= FlagNoFragments
+	}
+
+	if !w.opts.NoDeduplication {
+		flags |= FlagDuplicates
+	}
+
+	if w.comp.Options() != nil {
+		flags |= FlagCompressorOptions
+	}
+
+	mtime := w.opts.Time.Unix()
+	if w.opts.Time.IsZero() || mtime < 0 {
+		mtime = 0
+	}
+
+	blockLog := uint16(0)
+	for 1<<blockLog < w.blockSize {
+		blockLog++
+	}
+
+	sb := le.AppendUint32(nil, Magic)
+	sb = le.AppendUint32(sb, count)
+	sb = le.AppendUint32(sb, uint32(mtime))
+	sb = le.AppendUint32(sb, uint32(w.blockSize))
+	sb = le.AppendUint32(sb, uint32(len(w.fragments)))
+	sb = le.AppendUint16(sb, uint16(w.comp.ID()))
+	sb = le.AppendUint16(sb, blockLog)
+	sb = le.AppendUint16(sb, flags)
+	sb = le.AppendUint16(sb, uint16(len(w.ids)))
+	sb = le.AppendUint16(sb, VersionMajor)
+	sb = le.AppendUint16(sb, VersionMinor)
+	sb = le.AppendUint64(sb, w.root.ref)
+	sb = le.AppendUint64(sb, w.pos)
+	sb = le.AppendUint64(sb, idStart)
+	sb = le.AppendUint64(sb, xattrStart)
+	sb = le.AppendUint64(sb, inodeStart)
+	sb = le.AppendUint64(sb, dirStart)
+	sb = le.AppendUint64(sb, fragStart)
+	sb = le.AppendUint64(sb, NotPresent)
+
+	if err := w.writeAt(sb, 0); err != nil {
+		return err
+	}
+
+	// Pad to a 4KiB boundary for loop devices, also clearing any data discarded by deduplication.
+	end := (w.pos + PadSize - 1) / PadSize * PadSize
+
+	if err := w.writeAt(make([]byte, max(end, w.high)-w.pos), w.pos); err != nil {
+		return err
+	}
+
+	w.size = int64(end)
+
+	return nil
+}
+
+// Size returns the size of the image, including padding, once the writer is closed.
+func (w *Writer) Size() int64 {
+	return w.size
+}
@@ -0,0 +1,149 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/csnewman/go-appliance/pkg/fsmeta"
+	"github.com/csnewman/go-appliance/pkg/internal/membuf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func buildImage(t *testing.T, opts Options) (*Writer, []byte) {
+	t.Helper()
+
+	img := &membuf.Buffer{}
+
+	w, err := NewWriter(img, 0, opts)
+	require.NoError(t, err, "writer should create")
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), 40000)
+	clear(large[128<<10 : 256<<10])
+
+	require.NoError(t, w.Mkdir("home/user", fsmeta.Attr{Mode: 0o700, UID: 1000, GID: 70000}), "dir should create")
+	require.NoError(t, w.WriteFile("etc/hostname", strings.NewReader("appliance\n"), fsmeta.Attr{
+		Mode:   0o644,
+		Xattrs: map[string][]byte{"user.origin": []byte("build"), "security.selinux": []byte("system_u")},
+	}), "file should write")
+	require.NoError(t, w.WriteFile("usr/bin/tool", bytes.NewReader(large), fsmeta.Attr{Mode: 0o755 | fs.ModeSetuid}),
+		"large file should write")
+	require.NoError(t, w.WriteFile("usr/bin/tool2", bytes.NewReader(large), fsmeta.Attr{Mode: 0o755}),
+		"duplicate file should write")
+	require.NoError(t, w.WriteFile("empty", strings.NewReader(""), fsmeta.Attr{Mode: 0o600}), "empty file should write")
+	require.NoError(t, w.Symlink("etc/short", "hostname", fsmeta.Attr{Mode: 0o777}), "symlink should create")
+	require.NoError(t, w.Link("etc/hostname.bak", "etc/hostname"), "hard link should create")
+	require.NoError(t, w.Mknod("dev/null", fsmeta.Attr{Mode: fs.ModeDevice | fs.ModeCharDevice | 0o666, Major: 1, Minor: 3}),
+		"char device should create")
+	require.NoError(t, w.Mknod("run/fifo", fsmeta.Attr{Mode: fs.ModeNamedPipe | 0o600}), "fifo should create")
+
+	for i := range 300 {
+		require.NoError(t, w.WriteFile("many/entry-"+strings.Repeat("n", i%30)+string(rune('a'+i%26))+
+			strings.Repeat("0", i/26), strings.NewReader(strings.Repeat("y", i)), fsmeta.Attr{Mode: 0o644}),
+			"file should write")
+	}
+
+	require.NoError(t, w.Close(), "writer should close")
+
+	return w, img.Data
+}
+
+func TestWriter(t *testing.T) {
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	w, img := buildImage(t, Options{BlockSize: 64 << 10, Time: mtime})
+
+	le := binary.LittleEndian
+
+	assert.Equal(t, uint32(Magic), le.Uint32(img), "magic should be set")
+	assert.Equal(t, uint32(mtime.Unix()), le.Uint32(img[8:]), "time should be set")
+	assert.Equal(t, uint32(64<<10), le.Uint32(img[12:]), "block size should be set")
+	assert.Equal(t, uint16(16), le.Uint16(img[22:]), "block log should match")
+	assert.Equal(t, uint16(CompressionGzip), le.Uint16(img[20:]), "gzip should be the default")
+	assert.Equal(t, uint16(3), le.Uint16(img[26:]), "uids and gids should be shared")
+	assert.Equal(t, uint16(VersionMajor), le.Uint16(img[28:]), "version should be set")
+	assert.Zero(t, le.Uint16(img[24:])&FlagNoXattrs, "xattrs should be present")
+	assert.NotZero(t, le.Uint16(img[24:])&FlagDuplicates, "duplicates flag should be set")
+	assert.Equal(t, w.root.num, le.Uint32(img[4:]), "root should be the last inode")
+	assert.Equal(t, uint64(len(img)), uint64(w.Size()), "size should cover the image")
+	assert.Zero(t, w.Size()%PadSize, "image should be padded")
+	assert.Less(t, le.Uint64(img[40:]), uint64(w.Size()), "bytes used should exclude padding")
+
+	usr := w.root.children["usr"].children["bin"]
+	tool, tool2 := usr.children["tool"], usr.children["tool2"]
+
+	assert.Equal(t, tool.start, tool2.start, "identical files should share data")
+	assert.Equal(t, uint64(128<<10), tool.sparse, "zero blocks should be sparse")
+	assert.Equal(t, []uint32{0, 0}, tool.blocks[2:4], "sparse blocks should have no size")
+	assert.NotEqual(t, uint32(InvalidFragment), tool.fragment, "tail should be packed into a fragment")
+	assert.Equal(t, uint32(2), w.root.children["etc"].children["hostname"].links, "hard link should be counted")
+}
+
+func TestWriterDeterministic(t *testing.T) {
+	_, first := buildImage(t, Options{})
+	_, second := buildImage(t, Options{})
+
+	assert.Equal(t, first, second, "images should be identical")
+}
+
+func TestWriterNoFragments(t *testing.T) {
+	w, img := buildImage(t, Options{NoFragments: true, NoDeduplication: true})
+
+	usr := w.root.children["usr"].children["bin"]
+
+	assert.Zero(t, binary.LittleEndian.Uint32(img[16:]), "no fragments should be written")
+	assert.Equal(t, uint32(InvalidFragment), usr.children["tool"].fragment, "tail should be stored as a block")
+	assert.NotEqual(t, usr.children["tool"].start, usr.children["tool2"].start, "duplicates should be kept")
+}
+
+func TestWriterAddFS(t *testing.T) {
+	w, err := NewWriter(&membuf.Buffer{}, 0, Options{})
+	require.NoError(t, err, "writer should create")
+
+	require.NoError(t, w.AddFS(fstest.MapFS{
+		"bin/busybox": {Data: []byte("tool"), Mode: 0o755, Sys: &fsmeta.Attr{Mode: 0o755, Inode: 5}},
+		"bin/sh":      {Data: []byte("tool"), Mode: 0o755, Sys: &fsmeta.Attr{Mode: 0o755, Inode: 5}},
+		"etc/motd":    {Data: []byte("hello\n"), Mode: 0o644},
+	}), "fs should add")
+
+	bin := w.root.children["bin"]
+	assert.Same(t, bin.children["busybox"], bin.children["sh"], "files sharing an inode should be linked")
+	require.NoError(t, w.Close(), "writer should close")
+}
+
+func TestWriterErrors(t *testing.T) {
+	_, err := NewWriter(&membuf.Buffer{}, 0, Options{BlockSize: 3000})
+	assert.ErrorIs(t, err, ErrInvalidBlock, "invalid block size should be rejected")
+
+	w, err := NewWriter(&membuf.Buffer{}, 0, Options{})
+	require.NoError(t, err, "writer should create")
+
+	require.NoError(t, w.WriteFile("file", strings.NewReader("x"), fsmeta.Attr{Mode: 0o644}), "file should write")
+	assert.ErrorIs(t, w.WriteFile("file", strings.NewReader(""), fsmeta.Attr{}), ErrExist, "duplicate should be rejected")
+	assert.ErrorIs(t, w.WriteFile("file/x", strings.NewReader(""), fsmeta.Attr{}), ErrNotDir,
+		"file parent should be rejected")
+	require.NoError(t, w.Mkdir("dir", fsmeta.Attr{}), "dir should create")
+	assert.ErrorIs(t, w.Link("dir2", "dir"), ErrUnsupportedType, "directory hard link should be rejected")
+	assert.ErrorIs(t, w.Mknod("reg", fsmeta.Attr{Mode: 0o644}), ErrUnsupportedType, "regular mknod should be rejected")
+	assert.ErrorIs(t, w.WriteFile("bad", strings.NewReader(""), fsmeta.Attr{Xattrs: map[string][]byte{"system.x": nil}}),
+		ErrInvalidXattr, "unsupported xattr namespace should be rejected")
+
+	require.NoError(t, w.Close(), "writer should close")
+	assert.ErrorIs(t, w.Close(), ErrClosed, "second close should fail")
+
+	small, err := NewWriter(&membuf.Buffer{}, 8192, Options{BlockSize: 4096, NoFragments: true})
+	require.NoError(t, err, "writer should create")
+
+	noise := make([]byte, 64<<10)
+	for i := range noise {
+		noise[i] = byte(i * i >> 3)
+	}
+
+	err = small.WriteFile("big", bytes.NewReader(noise), fsmeta.Attr{Mode: 0o644})
+	assert.ErrorIs(t, err, ErrNoSpace, "oversized image should be rejected")
+}
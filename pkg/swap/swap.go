@@ -0,0 +1,117 @@
+package swap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+)
+
+const (
+	Magic           = "SWAPSPACE2"
+	Version         = 1
+	DefaultPageSize = 4096
+
+	// MinPages is the smallest swap area accepted by mkswap.
+	MinPages = 10
+	// MaxLabelLen is the size of the volume name field.
+	MaxLabelLen = 16
+
+	// The header follows the boot block, with the bad page list after its padding.
+	headerOffset   = 1024
+	badPagesOffset = 1536
+)
+
+var (
+	ErrTooSmall        = errors.New("swap area too small")
+	ErrTooLarge        = errors.New("swap area too large")
+	ErrInvalidPageSize = errors.New("invalid page size")
+	ErrInvalidLabel    = errors.New("invalid label")
+	ErrInvalidBadPage  = errors.New("invalid bad page")
+)
+
+type Options struct {
+	// Label is the volume name, up to 16 bytes.
+	Label string
+	// UUID identifies the swap area. A random value is used when zero.
+	UUID uuid.UUID
+	// PageSize must match the page size of the kernel using the swap area, defaulting to 4096.
+	PageSize int
+	// BadPages lists page indices the kernel should not use. The first page, holding the header, cannot be listed.
+	BadPages []uint32
+	// ByteOrder must match the kernel using the swap area, defaulting to little endian.
+	ByteOrder binary.ByteOrder
+}
+
+// MaxBadPages returns the number of bad pages which fit in the header for a page size.
+func MaxBadPages(pageSize int) int {
+	return (pageSize - len(Magic) - badPagesOffset) / 4
+}
+
+// Format writes a version 1 swap header, as created by mkswap, over the first page of dst. Only whole pages within
+// size are used.
+func Format(dst io.WriterAt, size int64, opts Options) error {
+	if opts.PageSize == 0 {
+		opts.PageSize = DefaultPageSize
+	}
+
+	if opts.PageSize < DefaultPageSize || opts.PageSize&(opts.PageSize-1) != 0 {
+		return fmt.Errorf("%w: %v", ErrInvalidPageSize, opts.PageSize)
+	}
+
+	pages := size / int64(opts.PageSize)
+	if pages < MinPages {
+		return fmt.Errorf("%w: %v pages, need at least %v", ErrTooSmall, pages, MinPages)
+	}
+
+	if pages-1 > 0xFFFFFFFF {
+		return fmt.Errorf("%w: %v pages", ErrTooLarge, pages)
+	}
+
+	if len(opts.Label) > MaxLabelLen {
+		return fmt.Errorf("%w: %q longer than %v bytes", ErrInvalidLabel, opts.Label, MaxLabelLen)
+	}
+
+	if len(opts.BadPages) > MaxBadPages(opts.PageSize) {
+		return fmt.Errorf("%w: %v bad pages, at most %v fit", ErrInvalidBadPage, len(opts.BadPages),
+			MaxBadPages(opts.PageSize))
+	}
+
+	for _, page := range opts.BadPages {
+		if page == 0 || int64(page) >= pages {
+			return fmt.Errorf("%w: page %v outside 1-%v", ErrInvalidBadPage, page, pages-1)
+		}
+	}
+
+	if opts.UUID == uuid.Nil {
+		opts.UUID = uuid.New()
+	}
+
+	if opts.ByteOrder == nil {
+		opts.ByteOrder = binary.LittleEndian
+	}
+
+	// The whole page is written, clearing any boot block or previous signature.
+	page := make([]byte, opts.PageSize)
+	order := opts.ByteOrder
+
+	order.PutUint32(page[headerOffset:], Version)
+	order.PutUint32(page[headerOffset+4:], uint32(pages-1))
+	order.PutUint32(page[headerOffset+8:], uint32(len(opts.BadPages)))
+	copy(page[headerOffset+12:], opts.UUID[:])
+	copy(page[headerOffset+28:headerOffset+28+MaxLabelLen], opts.Label)
+
+	for i, bad := range opts.BadPages {
+		order.PutUint32(page[badPagesOffset+i*4:], bad)
+	}
+
+	copy(page[opts.PageSize-len(Magic):], Magic)
+
+	if _, err := dst.WriteAt(page, 0); err != nil {
+		return fmt.Errorf("failed to write swap header: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package swap
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/csnewman/go-appliance/pkg/disk"
+	"github.com/csnewman/go-appliance/pkg/diskbuilder"
+	"github.com/csnewman/go-appliance/pkg/internal/membuf"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testUUID = uuid.MustParse("0b7c2f4e-8d7a-4f7e-9a51-3c2d1e0f9a8b")
+
+// mkswap formats an image of the given size with mkswap when it is available on the host.
+func mkswap(t *testing.T, size int, args ...string) []byte {
+	t.Helper()
+
+	bin, err := exec.LookPath("mkswap")
+	if err != nil {
+		t.Log("mkswap not available, skipping consistency check")
+
+		return nil
+	}
+
+	path := filepath.Join(t.TempDir(), "swap.img")
+	require.NoError(t, os.WriteFile(path, make([]byte, size), 0o600), "image should save")
+
+	out, err := exec.Command(bin, append(args, path)...).CombinedOutput()
+	require.NoError(t, err, "mkswap should pass:\n%s", out)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err, "image should read")
+
+	return data
+}
+
+func TestFormat(t *testing.T) {
+	d := membuf.New(1 << 20)
+	d.Data[0] = 0xEB
+
+	err := Format(d, int64(len(d.Data))+100, Options{Label: "swap", UUID: testUUID})
+	require.NoError(t, err, "format should succeed")
+
+	assert.Zero(t, d.Data[0], "boot block should be cleared")
+	assert.Equal(t, Magic, string(d.Data[DefaultPageSize-10:DefaultPageSize]), "magic should end the first page")
+	assert.Equal(t, uint32(Version), binary.LittleEndian.Uint32(d.Data[1024:]), "version should be set")
+	assert.Equal(t, uint32(255), binary.LittleEndian.Uint32(d.Data[1028:]), "last page should exclude partial pages")
+	assert.Zero(t, binary.LittleEndian.Uint32(d.Data[1032:]), "there should be no bad pages")
+	assert.Equal(t, testUUID[:], d.Data[1036:1052], "uuid should be set")
+	assert.Equal(t, "swap\x00", string(d.Data[1052:1057]), "label should be set")
+
+	if expected := mkswap(t, 1<<20, "-L", "swap", "-U", testUUID.String()); expected != nil {
+		assert.Equal(t, expected, d.Data, "header should match mkswap")
+	}
+
+	bin, err := exec.LookPath("blkid")
+	if err != nil {
+		t.Log("blkid not available, skipping probe")
+
+		return
+	}
+
+	path := filepath.Join(t.TempDir(), "swap.img")
+	require.NoError(t, os.WriteFile(path, d.Data, 0o600), "image should save")
+
+	out, err := exec.Command(bin, "-p", "-o", "export", path).CombinedOutput()
+	require.NoError(t, err, "blkid should probe:\n%s", out)
+	assert.Contains(t, string(out), "TYPE=swap", "swap should be detected")
+	assert.Contains(t, string(out), "UUID="+testUUID.String(), "uuid should be detected")
+	assert.Contains(t, string(out), "LABEL=swap", "label should be detected")
+}
+
+func TestFormatOptions(t *testing.T) {
+	d := membuf.New(1 << 20)
+
+	err := Format(d, int64(len(d.Data)), Options{
+		PageSize:  16384,
+		BadPages:  []uint32{3, 7},
+		ByteOrder: binary.BigEndian,
+	})
+	require.NoError(t, err, "format should succeed")
+
+	assert.Equal(t, Magic, string(d.Data[16384-10:16384]), "magic should end the larger page")
+	assert.Equal(t, uint32(Version), binary.BigEndian.Uint32(d.Data[1024:]), "version should be big endian")
+	assert.Equal(t, uint32(63), binary.BigEndian.Uint32(d.Data[1028:]), "last page should use the page size")
+	assert.Equal(t, uint32(2), binary.BigEndian.Uint32(d.Data[1032:]), "bad pages should be counted")
+	assert.Equal(t, uint32(3), binary.BigEndian.Uint32(d.Data[1536:]), "first bad page should be listed")
+	assert.Equal(t, uint32(7), binary.BigEndian.Uint32(d.Data[1540:]), "second bad page should be listed")
+	assert.NotEqual(t, make([]byte, 16), d.Data[1036:1052], "random uuid should be set")
+
+	if expected := mkswap(t, 1<<20, "-p", "16384", "-U", "clear"); expected != nil {
+		assert.Equal(t, expected[16384-10:16384], d.Data[16384-10:16384], "magic should match mkswap")
+	}
+}
+
+func TestFormatInvalid(t *testing.T) {
+	d := membuf.New(1 << 20)
+
+	assert.ErrorIs(t, Format(d, 9*DefaultPageSize, Options{}), ErrTooSmall, "tiny area should be rejected")
+	assert.ErrorIs(t, Format(d, 1<<20, Options{PageSize: 6000}), ErrInvalidPageSize,
+		"odd page size should be rejected")
+	assert.ErrorIs(t, Format(d, 1<<20, Options{Label: "a label which is too long"}), ErrInvalidLabel,
+		"long label should be rejected")
+	assert.ErrorIs(t, Format(d, 1<<20, Options{BadPages: []uint32{0}}), ErrInvalidBadPage,
+		"header page should not be listed")
+	assert.ErrorIs(t, Format(d, 1<<20, Options{BadPages: []uint32{256}}), ErrInvalidBadPage,
+		"page past the end should be rejected")
+	assert.ErrorIs(t, Format(d, 1<<20, Options{BadPages: make([]uint32, MaxBadPages(DefaultPageSize)+1)}),
+		ErrInvalidBadPage, "too many bad pages should be rejected")
+	assert.Equal(t, make([]byte, len(d.Data)), d.Data, "nothing should be written on failure")
+}
+
+func TestFormatPartition(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "disk.img")
+
+	b, err := diskbuilder.New(path, 16*1024*1024)
+	require.NoError(t, err, "builder should create")
+
+	start, end, err := b.Allocate(8*1024*1024, diskbuilder.DefaultAlignment)
+	require.NoError(t, err, "partition should allocate")
+
+	part, err := disk.NewGPTPartition(disk.GPTTypeLinuxSwap, start, end, "swap")
+	require.NoError(t, err, "partition should create")
+
+	b.Add(part)
+
+	dst, size, err := b.PartitionWriter(0)
+	require.NoError(t, err, "partition writer should open")
+	require.NoError(t, Format(dst, size, Options{UUID: testUUID}), "swap should format")
+	require.NoError(t, b.CloseContext(ctx), "builder should close")
+	require.NoError(t, b.Disk.Close(), "disk should close")
+
+	d, err := disk.Open(path)
+	require.NoError(t, err, "disk should open")
+
+	defer d.Close()
+
+	header := make([]byte, DefaultPageSize)
+	_, err = d.PartitionSection(part).ReadAt(header, 0)
+	require.NoError(t, err, "header should read")
+
+	assert.Equal(t, Magic, string(header[DefaultPageSize-10:]), "magic should be within the partition")
+	assert.Equal(t, uint32(8*1024*1024/DefaultPageSize-1), binary.LittleEndian.Uint32(header[1028:]),
+		"last page should match the partition")
+	assert.Equal(t, testUUID[:], header[1036:1052], "uuid should be set")
+}